@@ -3,8 +3,11 @@ module axelsvensson.com/mattermost-plugin-character-profiles
 go 1.16
 
 require (
+	github.com/disintegration/imaging v1.6.2
 	github.com/gorilla/mux v1.8.0
 	github.com/mattermost/mattermost-server/v5 v5.37.10
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/image v0.0.0-20210504121937-7319ad40d33e
+	golang.org/x/text v0.3.6
 )
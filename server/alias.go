@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// An alias is an additional identifier for a character profile, e.g. `h` for
+// `haddock`. For each alias, the KV store maps the alias to the identifier of
+// the profile, which in turn lists its aliases. Aliases share the namespace of
+// profile identifiers, so an alias can never be the same as the identifier of
+// another profile or alias.
+
+func getProfileAliasKey(userId, alias string) string {
+	return fmt.Sprintf("profilealias_%s_%s", userId, encodeIdentifierForKey(alias))
+}
+
+// getAliasTarget returns the identifier of the profile that an alias refers
+// to, or "" if there is no such alias.
+func getAliasTarget(be Backend, userId, alias string) (string, *model.AppError) {
+	b, err := be.KVGet(getProfileAliasKey(userId, alias))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// resolveProfileIdentifier returns the identifier of the profile that an
+// alias refers to, or the given identifier if it is not an alias.
+func resolveProfileIdentifier(be Backend, userId, profileId string) (string, *model.AppError) {
+	if IsMe(profileId) {
+		return profileId, nil
+	}
+	target, err := getAliasTarget(be, userId, profileId)
+	if err != nil {
+		return "", err
+	}
+	if target != "" {
+		return target, nil
+	}
+	return profileId, nil
+}
+
+// claimAlias makes an alias refer to a profile, unless the alias is already
+// in use as an alias, a profile identifier or a name for the real profile. It
+// does not add the alias to the profile's list of aliases.
+func claimAlias(be Backend, userId, profileId, alias string) *model.AppError {
+	if IsMe(alias) {
+		return appError(fmt.Sprintf("`%s` refers to your real profile and cannot be used as an alias.", alias), nil)
+	}
+	err := validateIdentifier(alias)
+	if err != nil {
+		return err
+	}
+	exists, err := profileExists(be, userId, alias)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return appError(fmt.Sprintf("`%s` is already the identifier of a character profile.", alias), nil)
+	}
+	claimed, err := be.KVCompareAndSet(getProfileAliasKey(userId, alias), nil, []byte(profileId))
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		target, err := getAliasTarget(be, userId, alias)
+		if err != nil {
+			return err
+		}
+		return appError(fmt.Sprintf("`%s` is already an alias for character profile `%s`.", alias, target), nil)
+	}
+	return nil
+}
+
+// addProfileAlias adds an alias to a character profile.
+func addProfileAlias(be Backend, userId, profileId, alias string) (*Profile, *model.AppError) {
+	profile, err := GetProfile(be, userId, profileId, PROFILE_CHARACTER)
+	if err != nil {
+		return nil, err
+	}
+	err = claimAlias(be, userId, profile.Identifier, alias)
+	if err != nil {
+		return nil, err
+	}
+	profile.Aliases = insertSorted(profile.Aliases, alias)
+	err = setProfile(be, userId, profile)
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// removeProfileAlias removes an alias from the character profile it refers to.
+func removeProfileAlias(be Backend, userId, alias string) (*Profile, *model.AppError) {
+	target, err := getAliasTarget(be, userId, alias)
+	if err != nil {
+		return nil, err
+	}
+	if target == "" {
+		return nil, appError(fmt.Sprintf("`%s` is not an alias.", alias), nil)
+	}
+	err = be.KVDelete(getProfileAliasKey(userId, alias))
+	if err != nil {
+		return nil, err
+	}
+	profile, err := GetProfile(be, userId, target, PROFILE_CHARACTER|PROFILE_CORRUPT)
+	if err != nil {
+		return nil, err
+	}
+	aliases := []string{}
+	for _, a := range profile.Aliases {
+		if a != alias {
+			aliases = append(aliases, a)
+		}
+	}
+	profile.Aliases = aliases
+	err = setProfile(be, userId, profile)
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// claimProfileAliases claims all aliases listed in a profile, e.g. when it is
+// restored or renamed. Aliases that cannot be claimed are removed from the
+// list and returned.
+func claimProfileAliases(be Backend, userId string, profile *Profile) []string {
+	claimed := []string{}
+	dropped := []string{}
+	for _, alias := range profile.Aliases {
+		target, err := getAliasTarget(be, userId, alias)
+		if err == nil && target == profile.Identifier {
+			claimed = append(claimed, alias)
+			continue
+		}
+		err = claimAlias(be, userId, profile.Identifier, alias)
+		if err != nil {
+			dropped = append(dropped, alias)
+		} else {
+			claimed = append(claimed, alias)
+		}
+	}
+	profile.Aliases = claimed
+	return dropped
+}
+
+// releaseProfileAliases removes the aliases that refer to a profile, e.g. when
+// it is deleted. The profile's list of aliases is left as it is.
+func releaseProfileAliases(be Backend, userId string, profile *Profile) *model.AppError {
+	for _, alias := range profile.Aliases {
+		target, err := getAliasTarget(be, userId, alias)
+		if err != nil {
+			return err
+		}
+		if target != profile.Identifier {
+			continue
+		}
+		err = be.KVDelete(getProfileAliasKey(userId, alias))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transferProfileAliases makes the aliases listed in a profile, that refer to
+// another profile, refer to this profile instead. This is used when a profile
+// is renamed.
+func transferProfileAliases(be Backend, userId, oldProfileId string, profile *Profile) *model.AppError {
+	for _, alias := range profile.Aliases {
+		target, err := getAliasTarget(be, userId, alias)
+		if err != nil {
+			return err
+		}
+		if target != oldProfileId {
+			continue
+		}
+		err = be.KVSet(getProfileAliasKey(userId, alias), []byte(profile.Identifier))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestAlias(t *testing.T) {
+	be := newMockBackend()
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	cmd(t, be, "/character milou=Milou", tUser1, tChannel1, tTeam1, "",
+		"Character profile `milou` created with display name \"Milou\"",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", nil}})
+	cmd(t, be, "/character alias haddock h", tUser1, tChannel1, tTeam1, "",
+		"Added alias `h` for character profile `haddock`.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`, `h`", "#5c66ff", nil}})
+	cmd(t, be, "/character alias h archibald", tUser1, tChannel1, tTeam1, "",
+		"Added alias `archibald` for character profile `haddock`.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`, `archibald`, `h`", "#5c66ff", nil}})
+	// Aliases must not collide with anything
+	cmdFail(t, be, "/character alias milou h", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: `h` is already an alias for character profile `haddock`.")
+	cmdFail(t, be, "/character alias milou haddock", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: `haddock` is already the identifier of a character profile.")
+	cmdFail(t, be, "/character alias milou me", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: `me` refers to your real profile and cannot be used as an alias.")
+	cmdFail(t, be, "/character alias nobody n", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Profile `nobody` does not exist.")
+	// Aliases are per user
+	cmdFail(t, be, "/character I am h", tUser2, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Profile `h` does not exist.")
+	// Aliases are shown in the list
+	cmd(t, be, "/character list", tUser1, tChannel1, tTeam1, "",
+		"## Character profiles",
+		[]tAtt{
+			{"**Captain Haddock**\n`haddock`, `archibald`, `h`", "#5c66ff", nil},
+			{"**Milou**\n`milou`", "#5c66ff", nil},
+			{"**user-number-one** *(your real profile)*\n`me`, `myself`", "#009900", nil},
+		})
+	// Aliases can be used for messages, and the canonical identifier is recorded
+	postId := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "h: Blistering barnacles!"},
+		"haddock", "Captain Haddock", avatarImg(be, "haddock", "Captain Haddock"))
+	assert.Equal(t, "haddock", be.Posts[postId].Props["profile_identifier"])
+	// ...and for modifying the profile
+	cmd(t, be, "/character h=Archibald Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` modified by changing the display name from \"Captain Haddock\" to \"Archibald Haddock\"",
+		[]tAtt{{"**Archibald Haddock**\n`haddock`, `archibald`, `h`", "#5c66ff", nil}})
+	cmd(t, be, "/character I am h", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Archibald Haddock\".",
+		[]tAtt{{"**Archibald Haddock**\n`haddock`, `archibald`, `h`", "#5c66ff", nil}})
+	cmd(t, be, "/character I am haddock", tUser1, tChannel1, tTeam1, "",
+		"You are already \"Archibald Haddock\", and if that's not enough you should've rolled better stats.",
+		[]tAtt{})
+	cmdFail(t, be, "/character delete h", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: `h` is an alias for character profile `haddock`. Use `/character unalias h` to remove the alias, or `/character delete haddock` to delete the profile.")
+	cmdFail(t, be, "/character make h into haddock", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: `h` and `haddock` refer to the same character profile `haddock`.")
+	cmd(t, be, "/character unalias archibald", tUser1, tChannel1, tTeam1, "",
+		"Removed alias `archibald` for character profile `haddock`.",
+		[]tAtt{{"**Archibald Haddock**\n`haddock`, `h`", "#5c66ff", nil}})
+	cmdFail(t, be, "/character unalias archibald", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: `archibald` is not an alias.")
+	// Renaming a profile keeps its aliases
+	cmd(t, be, "/character make h into captain", tUser1, tChannel1, tTeam1, "",
+		"Changed identifier for character profile `haddock` to `captain`.",
+		[]tAtt{{"**Archibald Haddock**\n`captain`, `h`", "#5c66ff", nil}})
+	assert.Equal(t, "captain", be.Posts[postId].Props["profile_identifier"])
+	cmd(t, be, "/character alias h haddock", tUser1, tChannel1, tTeam1, "",
+		"Added alias `haddock` for character profile `captain`.",
+		[]tAtt{{"**Archibald Haddock**\n`captain`, `h`, `haddock`", "#5c66ff", nil}})
+	// Deleting a profile frees its aliases, and restoring it claims them again
+	// unless they have been taken.
+	cmd(t, be, "/character delete captain", tUser1, tChannel1, tTeam1, "",
+		"Deleted character profile `captain`. You can restore it with `/character restore captain` within 30 days.",
+		[]tAtt{})
+	cmd(t, be, "/character alias milou h", tUser1, tChannel1, tTeam1, "",
+		"Added alias `h` for character profile `milou`.",
+		[]tAtt{{"**Milou**\n`milou`, `h`", "#5c66ff", nil}})
+	cmd(t, be, "/character restore captain", tUser1, tChannel1, tTeam1, "",
+		"Restored character profile `captain`. These aliases are now used for something else and were removed: `h`.",
+		[]tAtt{{"**Archibald Haddock**\n`captain`, `haddock`", "#5c66ff", nil}})
+	cmd(t, be, "/character history haddock", tUser1, tChannel1, tTeam1, "",
+		"## History of character profile `captain`\n"+
+			"- Version 1, 2020-09-13 12:26 UTC: display name \"Captain Haddock\" and no profile picture\n"+
+			"- Version 2, 2020-09-13 12:26 UTC: display name changed from \"Captain Haddock\" to \"Archibald Haddock\"",
+		[]tAtt{})
+}
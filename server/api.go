@@ -0,0 +1,420 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// The REST API lets clients manage the character profiles of the requesting
+// user as JSON. It uses the service layer, like the `/character` command, and
+// is described by openapi.yaml. Changes that would need confirmation in the
+// command fail with error code `confirmation_required` unless `?confirm=true`
+// is given.
+
+//go:embed openapi.yaml
+var openAPIDescription []byte
+
+// APIProfile is the representation of a profile in the REST API.
+type APIProfile struct {
+	Identifier    string   `json:"identifier"`
+	DisplayName   string   `json:"display_name"`
+	Aliases       []string `json:"aliases"`
+	RealProfile   bool     `json:"real_profile,omitempty"`
+	PictureFileId string   `json:"picture_file_id,omitempty"`
+	PictureCrop   string   `json:"picture_crop,omitempty"`
+	Color         string   `json:"color,omitempty"`
+	AvatarColor   string   `json:"avatar_color,omitempty"`
+	KeepHistory   bool     `json:"keep_history"`
+	Version       int      `json:"version,omitempty"`
+	IconURL       string   `json:"icon_url,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// APIProfileInput is the body of requests creating or modifying a profile.
+// Omitted fields are left as they are.
+type APIProfileInput struct {
+	Identifier    string  `json:"identifier"`
+	DisplayName   *string `json:"display_name"`
+	PictureFileId *string `json:"picture_file_id"`
+	PictureCrop   *string `json:"picture_crop"`
+	Color         *string `json:"color"`
+	KeepHistory   *bool   `json:"keep_history"`
+}
+
+// APIChannelDefault is the default profile of the user in a channel. An empty
+// identifier means the real profile.
+type APIChannelDefault struct {
+	Identifier string `json:"identifier"`
+	// Level is where the default is set: for the channel, its team or the
+	// whole account. It is empty if no default is set.
+	Level   string      `json:"level,omitempty"`
+	Profile *APIProfile `json:"profile,omitempty"`
+}
+
+// APIProfileStats are the usage statistics of a character profile.
+type APIProfileStats struct {
+	Identifier  string `json:"identifier"`
+	DisplayName string `json:"display_name"`
+	ProfileStats
+}
+
+// APIChannelCharacterStats are the usage statistics of a character profile in
+// a channel. DisplayName is omitted if the profile no longer exists.
+type APIChannelCharacterStats struct {
+	ChannelCharacterStats
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// APIError is the body of error responses.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes of the REST API, by the HTTP status of errors from the service
+// layer.
+var apiErrorCodes = map[int]string{
+	http.StatusBadRequest:           "invalid_request",
+	http.StatusForbidden:            "forbidden",
+	http.StatusNotFound:             "not_found",
+	http.StatusConflict:             "conflict",
+	http.StatusPreconditionRequired: "confirmation_required",
+}
+
+func addAPIRoutes(router *mux.Router, be Backend) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(openAPIDescription)
+	}).Methods(http.MethodGet)
+	api.HandleFunc("/profiles", func(w http.ResponseWriter, r *http.Request) {
+		serveListProfiles(be, w, r)
+	}).Methods(http.MethodGet)
+	api.HandleFunc("/profiles", func(w http.ResponseWriter, r *http.Request) {
+		serveCreateProfile(be, w, r)
+	}).Methods(http.MethodPost)
+	api.HandleFunc("/profiles/{profileId}", func(w http.ResponseWriter, r *http.Request) {
+		serveGetProfile(be, w, r, mux.Vars(r)["profileId"])
+	}).Methods(http.MethodGet)
+	api.HandleFunc("/profiles/{profileId}", func(w http.ResponseWriter, r *http.Request) {
+		serveUpdateProfile(be, w, r, mux.Vars(r)["profileId"])
+	}).Methods(http.MethodPatch)
+	api.HandleFunc("/profiles/{profileId}", func(w http.ResponseWriter, r *http.Request) {
+		serveDeleteProfile(be, w, r, mux.Vars(r)["profileId"])
+	}).Methods(http.MethodDelete)
+	api.HandleFunc("/profiles/{profileId}/rename", func(w http.ResponseWriter, r *http.Request) {
+		serveRenameProfile(be, w, r, mux.Vars(r)["profileId"])
+	}).Methods(http.MethodPost)
+	api.HandleFunc("/channels/{channelId:[a-z0-9]{26}}/default", func(w http.ResponseWriter, r *http.Request) {
+		serveGetChannelDefault(be, w, r, mux.Vars(r)["channelId"])
+	}).Methods(http.MethodGet)
+	api.HandleFunc("/channels/{channelId:[a-z0-9]{26}}/default", func(w http.ResponseWriter, r *http.Request) {
+		serveSetChannelDefault(be, w, r, mux.Vars(r)["channelId"])
+	}).Methods(http.MethodPut)
+	api.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		serveProfileStats(be, w, r)
+	}).Methods(http.MethodGet)
+	api.HandleFunc("/channels/{channelId:[a-z0-9]{26}}/stats", func(w http.ResponseWriter, r *http.Request) {
+		serveChannelStats(be, w, r, mux.Vars(r)["channelId"])
+	}).Methods(http.MethodGet)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, err *model.AppError) {
+	status := err.StatusCode
+	code, ok := apiErrorCodes[status]
+	if !ok {
+		status = http.StatusInternalServerError
+		code = "internal_error"
+	}
+	writeJSON(w, status, APIError{Code: code, Message: err.Message})
+}
+
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dErr := json.NewDecoder(r.Body).Decode(v)
+	if dErr != nil {
+		writeJSON(w, http.StatusBadRequest, APIError{Code: "invalid_request", Message: "Invalid JSON: " + dErr.Error()})
+		return false
+	}
+	return true
+}
+
+func apiProfileFromProfile(be Backend, profile Profile) *APIProfile {
+	iconUrl, err := profileIconUrl(be, profile, false)
+	if err != nil {
+		iconUrl = legacyProfileIconUrl(be, profile, false)
+	}
+	ret := &APIProfile{
+		Identifier:  profile.Identifier,
+		DisplayName: profile.Name,
+		Aliases:     append([]string{}, profile.Aliases...),
+		IconURL:     iconUrl,
+	}
+	switch profile.Status {
+	case PROFILE_ME:
+		ret.Identifier = "me"
+		ret.Aliases = []string{"myself"}
+		ret.RealProfile = true
+	case PROFILE_CHARACTER:
+		ret.PictureFileId = profile.PictureFileId
+		ret.PictureCrop = profile.PictureCrop
+		if ret.PictureFileId != "" && ret.PictureCrop == "" {
+			ret.PictureCrop = "center"
+		}
+		ret.Color = profile.Color
+		ret.AvatarColor = avatarColor(profile)
+		ret.KeepHistory = profile.KeepHistory
+		ret.Version = profile.Version
+	default:
+		ret.Error = ErrStr(profile.Error)
+	}
+	return ret
+}
+
+// profileChangesFromInput parses the changes given to the REST API in the
+// same way as the `/character` command does.
+func profileChangesFromInput(be Backend, userId string, input APIProfileInput) (ProfileChanges, *model.AppError) {
+	changes := ProfileChanges{
+		Name:        input.DisplayName,
+		KeepHistory: input.KeepHistory,
+	}
+	if input.PictureFileId != nil {
+		if *input.PictureFileId != "" {
+			err := checkPictureFile(be, userId, *input.PictureFileId)
+			if err != nil {
+				return changes, err
+			}
+		}
+		changes.PictureFileId = input.PictureFileId
+	}
+	if input.PictureCrop != nil {
+		crop, err := parsePictureCrop(*input.PictureCrop)
+		if err != nil {
+			return changes, err
+		}
+		changes.PictureCrop = &crop
+	}
+	if input.Color != nil {
+		color, err := parseAvatarColor(*input.Color)
+		if err != nil {
+			return changes, err
+		}
+		changes.Color = &color
+	}
+	return changes, nil
+}
+
+func serveListProfiles(be Backend, w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	profiles, err := listProfiles(be, userId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	ret := make([]*APIProfile, len(profiles))
+	for i, profile := range profiles {
+		ret[i] = apiProfileFromProfile(be, profile)
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func serveGetProfile(be Backend, w http.ResponseWriter, r *http.Request, profileId string) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	profile, err := GetProfile(be, userId, NormalizeIdentifier(profileId), PROFILE_CHARACTER|PROFILE_ME|PROFILE_CORRUPT|PROFILE_NONEXISTENT)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if profile.Status == PROFILE_NONEXISTENT {
+		writeAPIError(w, serviceError(http.StatusNotFound, fmt.Sprintf("Character profile `%s` does not exist.", profile.Identifier)))
+		return
+	}
+	writeJSON(w, http.StatusOK, apiProfileFromProfile(be, *profile))
+}
+
+func serveCreateProfile(be Backend, w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	var input APIProfileInput
+	if !decodeAPIRequest(w, r, &input) {
+		return
+	}
+	if input.Identifier == "" {
+		writeAPIError(w, appError("Missing identifier.", nil))
+		return
+	}
+	saveProfile(be, w, r, userId, input.Identifier, input, SAVE_CREATE, http.StatusCreated)
+}
+
+func serveUpdateProfile(be Backend, w http.ResponseWriter, r *http.Request, profileId string) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	var input APIProfileInput
+	if !decodeAPIRequest(w, r, &input) {
+		return
+	}
+	if input.Identifier != "" {
+		writeAPIError(w, appError("The identifier cannot be modified. Rename the profile instead.", nil))
+		return
+	}
+	saveProfile(be, w, r, userId, profileId, input, SAVE_MODIFY, http.StatusOK)
+}
+
+func saveProfile(be Backend, w http.ResponseWriter, r *http.Request, userId, profileId string, input APIProfileInput, allowed, status int) {
+	changes, err := profileChangesFromInput(be, userId, input)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	result, err := SaveProfile(be, userId, profileId, changes, allowed, isConfirmed(r))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, status, apiProfileFromProfile(be, result.Profile))
+}
+
+func isConfirmed(r *http.Request) bool {
+	return r.URL.Query().Get("confirm") == "true"
+}
+
+func serveDeleteProfile(be Backend, w http.ResponseWriter, r *http.Request, profileId string) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	err := DeleteProfile(be, userId, profileId, isConfirmed(r))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func serveRenameProfile(be Backend, w http.ResponseWriter, r *http.Request, profileId string) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	var input APIProfileInput
+	if !decodeAPIRequest(w, r, &input) {
+		return
+	}
+	if input.Identifier == "" {
+		writeAPIError(w, appError("Missing identifier.", nil))
+		return
+	}
+	result, err := RenameProfile(be, userId, profileId, input.Identifier, isConfirmed(r))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiProfileFromProfile(be, result.Profile))
+}
+
+// checkChannelAccess checks that the user can read a channel.
+func checkChannelAccess(be Backend, w http.ResponseWriter, userId, channelId string) bool {
+	if !be.HasPermissionToChannel(userId, channelId, model.PERMISSION_READ_CHANNEL) {
+		writeAPIError(w, serviceError(http.StatusNotFound, fmt.Sprintf("Could not find channel `%s`, or you do not have permission to read it.", channelId)))
+		return false
+	}
+	return true
+}
+
+func serveGetChannelDefault(be Backend, w http.ResponseWriter, r *http.Request, channelId string) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	if !checkChannelAccess(be, w, userId, channelId) {
+		return
+	}
+	profileId, level, err := getEffectiveDefaultProfile(be, userId, channelId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	ret := APIChannelDefault{Identifier: profileId, Level: level}
+	profile, err := GetProfile(be, userId, profileId, PROFILE_CHARACTER|PROFILE_ME|PROFILE_CORRUPT|PROFILE_NONEXISTENT)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if profile.Status != PROFILE_NONEXISTENT {
+		ret.Profile = apiProfileFromProfile(be, *profile)
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func serveSetChannelDefault(be Backend, w http.ResponseWriter, r *http.Request, channelId string) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	if !checkChannelAccess(be, w, userId, channelId) {
+		return
+	}
+	var input APIChannelDefault
+	if !decodeAPIRequest(w, r, &input) {
+		return
+	}
+	_, profile, err := SetDefaultProfile(be, userId, channelId, strings.TrimSpace(input.Identifier))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	identifier := profile.Identifier
+	if profile.Status == PROFILE_ME {
+		identifier = ""
+	}
+	_, level, err := getEffectiveDefaultProfile(be, userId, channelId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, APIChannelDefault{Identifier: identifier, Level: level, Profile: apiProfileFromProfile(be, *profile)})
+}
+
+func serveProfileStats(be Backend, w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	profiles, err := listProfiles(be, userId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	ret := []APIProfileStats{}
+	for _, profile := range profiles {
+		if profile.Status == PROFILE_ME {
+			continue
+		}
+		stats, err := GetProfileStats(be, userId, profile.Identifier)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		ret = append(ret, APIProfileStats{Identifier: profile.Identifier, DisplayName: profile.Name, ProfileStats: *stats})
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func serveChannelStats(be Backend, w http.ResponseWriter, r *http.Request, channelId string) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	if !checkChannelAccess(be, w, userId, channelId) {
+		return
+	}
+	stats, err := GetChannelStats(be, channelId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	ret := make([]APIChannelCharacterStats, len(stats))
+	for i, entry := range stats {
+		ret[i] = APIChannelCharacterStats{ChannelCharacterStats: entry}
+		if user, _ := be.GetUser(entry.UserId); user != nil {
+			ret[i].Username = user.Username
+		}
+		if profile, _ := GetProfile(be, entry.UserId, entry.Identifier, PROFILE_CHARACTER); profile != nil {
+			ret[i].DisplayName = profile.Name
+		}
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
@@ -0,0 +1,199 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+// apiRequest sends a request with a JSON body to the REST API and decodes the
+// JSON response into ret unless it is nil.
+func apiRequest(t *testing.T, be main.Backend, method, userId, path, body string, ret interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(method, "/api/v1"+path, strings.NewReader(body))
+	r.Header.Set("Mattermost-User-ID", userId)
+	w := httptest.NewRecorder()
+	main.RouterFromBackend(be).ServeHTTP(w, r)
+	if ret != nil {
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), ret), w.Body.String())
+	}
+	return w.Code
+}
+
+// apiError sends a request to the REST API that is expected to fail, and
+// returns the error code and message.
+func apiError(t *testing.T, be main.Backend, method, userId, path, body string, expectedStatus int) (string, string) {
+	t.Helper()
+	var apiErr main.APIError
+	assert.Equal(t, expectedStatus, apiRequest(t, be, method, userId, path, body, &apiErr))
+	return apiErr.Code, apiErr.Message
+}
+
+func TestAPIProfiles(t *testing.T) {
+	be := newMockBackend()
+	var profiles []main.APIProfile
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodGet, tUser1, "/profiles", "", &profiles))
+	assert.Equal(t, 1, len(profiles))
+	assert.Equal(t, "me", profiles[0].Identifier)
+	assert.True(t, profiles[0].RealProfile)
+	// Create
+	var profile main.APIProfile
+	assert.Equal(t, http.StatusCreated, apiRequest(t, be, http.MethodPost, tUser1, "/profiles",
+		`{"identifier": "Haddock", "display_name": "Captain Haddock", "color": "#3366CC"}`, &profile))
+	assert.Equal(t, "haddock", profile.Identifier)
+	assert.Equal(t, "Captain Haddock", profile.DisplayName)
+	assert.Equal(t, "#3366cc", profile.Color)
+	assert.Equal(t, "#3366cc", profile.AvatarColor)
+	assert.Equal(t, 1, profile.Version)
+	assert.Equal(t, "http://mocksite.tld/plugins/com.axelsvensson.mattermost-plugin-character-profiles/avatar/3366cc/CH", profile.IconURL)
+	code, message := apiError(t, be, http.MethodPost, tUser1, "/profiles", `{"identifier": "haddock", "display_name": "Haddock"}`, http.StatusConflict)
+	assert.Equal(t, "conflict", code)
+	assert.Equal(t, "Character profile `haddock` already exists.", message)
+	code, message = apiError(t, be, http.MethodPost, tUser1, "/profiles", `{"identifier": "milou"}`, http.StatusBadRequest)
+	assert.Equal(t, "invalid_request", code)
+	assert.Contains(t, message, "you must at least provide a display name")
+	code, _ = apiError(t, be, http.MethodPost, tUser1, "/profiles", `{"identifier": "milou", "display_name": "Milou", "color": "blue"}`, http.StatusBadRequest)
+	assert.Equal(t, "invalid_request", code)
+	code, _ = apiError(t, be, http.MethodPost, tUser1, "/profiles", `{"identifier": "milou",`, http.StatusBadRequest)
+	assert.Equal(t, "invalid_request", code)
+	// The same logic as the command is used
+	cmd(t, be, "/character list", tUser1, tChannel1, tTeam1, "", "## Character profiles",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}, {"**user-number-one** *(your real profile)*\n`me`, `myself`", "#009900", nil}})
+	// Get, also by alias
+	cmd(t, be, "/character alias haddock h", tUser1, tChannel1, tTeam1, "",
+		"Added alias `h` for character profile `haddock`.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`, `h`", "#5c66ff", nil}})
+	profile = main.APIProfile{}
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodGet, tUser1, "/profiles/h", "", &profile))
+	assert.Equal(t, "haddock", profile.Identifier)
+	assert.Equal(t, []string{"h"}, profile.Aliases)
+	profile = main.APIProfile{}
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodGet, tUser1, "/profiles/me", "", &profile))
+	assert.Equal(t, "me", profile.Identifier)
+	assert.True(t, profile.RealProfile)
+	code, _ = apiError(t, be, http.MethodGet, tUser1, "/profiles/milou", "", http.StatusNotFound)
+	assert.Equal(t, "not_found", code)
+	// Profiles are personal
+	code, _ = apiError(t, be, http.MethodGet, tUser2, "/profiles/haddock", "", http.StatusNotFound)
+	assert.Equal(t, "not_found", code)
+	// Update
+	profile = main.APIProfile{}
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodPatch, tUser1, "/profiles/haddock",
+		`{"display_name": "Archibald Haddock", "picture_file_id": "`+tFile1+`", "picture_crop": "top", "color": "auto"}`, &profile))
+	assert.Equal(t, "Archibald Haddock", profile.DisplayName)
+	assert.Equal(t, tFile1, profile.PictureFileId)
+	assert.Equal(t, "top", profile.PictureCrop)
+	assert.Equal(t, "", profile.Color)
+	assert.Equal(t, 2, profile.Version)
+	code, _ = apiError(t, be, http.MethodPatch, tUser1, "/profiles/milou", `{"display_name": "Milou"}`, http.StatusNotFound)
+	assert.Equal(t, "not_found", code)
+	code, _ = apiError(t, be, http.MethodPatch, tUser1, "/profiles/haddock", `{"identifier": "milou"}`, http.StatusBadRequest)
+	assert.Equal(t, "invalid_request", code)
+	// Only pictures the user can read
+	be.FileInfos["file2aaaaaaaaaaaaaaaaaaaaa"] = &model.FileInfo{Id: "file2aaaaaaaaaaaaaaaaaaaaa", PostId: "post2aaaaaaaaaaaaaaaaaaaaa", Path: "some-path-to/file2.png", Extension: "png", CreateAt: 1}
+	be.Posts["post2aaaaaaaaaaaaaaaaaaaaa"] = &model.Post{Id: "post2aaaaaaaaaaaaaaaaaaaaa", ChannelId: "channel2aaaaaaaaaaaaaaaaaa", FileIds: []string{"file2aaaaaaaaaaaaaaaaaaaaa"}}
+	code, _ = apiError(t, be, http.MethodPatch, tUser1, "/profiles/haddock", `{"picture_file_id": "file2aaaaaaaaaaaaaaaaaaaaa"}`, http.StatusForbidden)
+	assert.Equal(t, "forbidden", code)
+	code, _ = apiError(t, be, http.MethodPatch, tUser1, "/profiles/haddock", `{"picture_file_id": "file3aaaaaaaaaaaaaaaaaaaaa"}`, http.StatusNotFound)
+	assert.Equal(t, "not_found", code)
+	// Remove the picture
+	profile = main.APIProfile{}
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodPatch, tUser1, "/profiles/haddock", `{"picture_file_id": ""}`, &profile))
+	assert.Equal(t, "", profile.PictureFileId)
+	assert.Equal(t, "", profile.PictureCrop)
+	// Rename and delete need confirmation when they affect messages
+	post := &model.Post{Id: be.NewId(), UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Hello"}
+	post, _ = main.ProfiledPost(be, post, false)
+	be.Posts[post.Id] = post
+	assert.Nil(t, main.RegisterPost(be, post))
+	profile = main.APIProfile{}
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodPost, tUser1, "/profiles/haddock/rename", `{"identifier": "archibald"}`, &profile))
+	assert.Equal(t, "archibald", profile.Identifier)
+	assert.Equal(t, []string{"h"}, profile.Aliases)
+	assert.Equal(t, "archibald", be.Posts[post.Id].Props["profile_identifier"])
+	assert.Nil(t, main.RegisterPost(be, be.Posts[post.Id]))
+	code, message = apiError(t, be, http.MethodPost, tUser1, "/profiles/archibald/rename", `{"identifier": "me"}`, http.StatusPreconditionRequired)
+	assert.Equal(t, "confirmation_required", code)
+	assert.Contains(t, message, "Modifying 1 messages that currently use character profile `archibald` to instead use your real profile")
+	code, _ = apiError(t, be, http.MethodDelete, tUser1, "/profiles/archibald", "", http.StatusPreconditionRequired)
+	assert.Equal(t, "confirmation_required", code)
+	assert.Equal(t, http.StatusNoContent, apiRequest(t, be, http.MethodDelete, tUser1, "/profiles/archibald?confirm=true", "", nil))
+	code, _ = apiError(t, be, http.MethodDelete, tUser1, "/profiles/archibald?confirm=true", "", http.StatusNotFound)
+	assert.Equal(t, "not_found", code)
+	cmd(t, be, "/character trash", tUser1, tChannel1, tTeam1, "", "## Deleted character profiles",
+		[]tAtt{{"**Archibald Haddock**\n`archibald`, `h`\nDeleted 2020-09-13 12:26 UTC, will be purged 2020-10-13 12:26 UTC.", "#5c66ff", nil}})
+	// Recreating a profile used by messages needs confirmation too
+	code, _ = apiError(t, be, http.MethodPost, tUser1, "/profiles", `{"identifier": "archibald", "display_name": "Archie"}`, http.StatusPreconditionRequired)
+	assert.Equal(t, "confirmation_required", code)
+	assert.Equal(t, http.StatusCreated, apiRequest(t, be, http.MethodPost, tUser1, "/profiles?confirm=true", `{"identifier": "archibald", "display_name": "Archie"}`, nil))
+	assert.Equal(t, "Archie", be.Posts[post.Id].Props["override_username"])
+}
+
+func TestAPIChannelDefaults(t *testing.T) {
+	be := newMockBackend()
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	var def main.APIChannelDefault
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodGet, tUser1, "/channels/"+tChannel1+"/default", "", &def))
+	assert.Equal(t, "", def.Identifier)
+	assert.True(t, def.Profile.RealProfile)
+	def = main.APIChannelDefault{}
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodPut, tUser1, "/channels/"+tChannel1+"/default", `{"identifier": "Haddock"}`, &def))
+	assert.Equal(t, "haddock", def.Identifier)
+	assert.Equal(t, "Captain Haddock", def.Profile.DisplayName)
+	cmd(t, be, "/character I am haddock", tUser1, tChannel1, tTeam1, "",
+		"You are already \"Captain Haddock\", and if that's not enough you should've rolled better stats.", nil)
+	def = main.APIChannelDefault{}
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodGet, tUser1, "/channels/"+tChannel1+"/default", "", &def))
+	assert.Equal(t, "haddock", def.Identifier)
+	assert.Equal(t, "channel", def.Level)
+	code, _ := apiError(t, be, http.MethodPut, tUser1, "/channels/"+tChannel1+"/default", `{"identifier": "milou"}`, http.StatusBadRequest)
+	assert.Equal(t, "invalid_request", code)
+	// Only channels the user can read
+	code, _ = apiError(t, be, http.MethodGet, tUser1, "/channels/channel2aaaaaaaaaaaaaaaaaa/default", "", http.StatusNotFound)
+	assert.Equal(t, "not_found", code)
+	code, _ = apiError(t, be, http.MethodPut, tUser1, "/channels/channel2aaaaaaaaaaaaaaaaaa/default", `{"identifier": "haddock"}`, http.StatusNotFound)
+	assert.Equal(t, "not_found", code)
+	// Back to the real profile
+	def = main.APIChannelDefault{}
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodPut, tUser1, "/channels/"+tChannel1+"/default", `{"identifier": ""}`, &def))
+	assert.Equal(t, "", def.Identifier)
+	assert.Equal(t, "channel", def.Level)
+	assert.True(t, def.Profile.RealProfile)
+	// Team defaults apply to channels without a default of their own
+	tChannel3 := "channel3aaaaaaaaaaaaaaaaaa"
+	be.Channels[tChannel3] = &model.Channel{Id: tChannel3, Name: "channel-three", TeamId: tTeam1, Type: model.CHANNEL_OPEN}
+	be.ChannelMembers = append(be.ChannelMembers, struct {
+		UserId    string
+		ChannelId string
+	}{tUser1, tChannel3})
+	cmd(t, be, "/character I am haddock in this team", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Captain Haddock\" in this team, except in channels with a default of their own.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	def = main.APIChannelDefault{}
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodGet, tUser1, "/channels/"+tChannel3+"/default", "", &def))
+	assert.Equal(t, "haddock", def.Identifier)
+	assert.Equal(t, "team", def.Level)
+	def = main.APIChannelDefault{}
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodGet, tUser1, "/channels/"+tChannel1+"/default", "", &def))
+	assert.Equal(t, "", def.Identifier)
+	assert.Equal(t, "channel", def.Level)
+	assert.True(t, def.Profile.RealProfile)
+	// The API requires a Mattermost session, and is described by OpenAPI
+	assert.Equal(t, http.StatusUnauthorized, apiRequest(t, be, http.MethodGet, "", "/profiles", "", nil))
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/openapi.yaml", nil)
+	r.Header.Set("Mattermost-User-ID", tUser1)
+	w := httptest.NewRecorder()
+	main.RouterFromBackend(be).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Body.String(), "openapi: 3.0.3\n"))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Channel admins, such as the game master of a table, can set the default
+// character profile of another member of the channel to one of that member's
+// own character profiles, or to one of their own, which is then copied to the
+// member. The member is told in a direct message from the bot
+// account, and can decline, which brings back the default they had before. The
+// assignment is kept until it is declined, so that the earlier default is
+// known. The direct message records the channel of the assignment in a prop,
+// and the assignment records the id of the direct message, so that its decline
+// button works only for the latest assignment of that member.
+
+// Direct messages about assigned profiles record the channel id in this prop.
+const ASSIGNMENT_CHANNEL_PROP = "profile_assignment_channel_id"
+
+type profileAssignment struct {
+	AssignedBy string `json:"assigned_by"`
+	Identifier string `json:"identifier"`
+	// Previous is the default profile identifier of the channel before the
+	// assignment, or the empty string if there was none.
+	Previous   string `json:"previous,omitempty"`
+	AssignedAt int64  `json:"assigned_at"`
+	// NoticePostId is the id of the direct message that told the member.
+	NoticePostId string `json:"notice_post_id,omitempty"`
+}
+
+func getAssignmentKey(userId, channelId string) string {
+	return fmt.Sprintf("assignment_%s_%s", userId, channelId)
+}
+
+func getAssignment(be Backend, userId, channelId string) (*profileAssignment, *model.AppError) {
+	b, err := be.KVGet(getAssignmentKey(userId, channelId))
+	if err != nil || b == nil {
+		return nil, err
+	}
+	assignment := profileAssignment{}
+	jErr := json.Unmarshal(b, &assignment)
+	if jErr != nil {
+		return nil, appError("Failed to unmarshal assignment.", jErr)
+	}
+	return &assignment, nil
+}
+
+func setAssignment(be Backend, userId, channelId string, assignment profileAssignment) *model.AppError {
+	b, jErr := json.Marshal(assignment)
+	if jErr != nil {
+		return appError("Failed to marshal assignment.", jErr)
+	}
+	return be.KVSet(getAssignmentKey(userId, channelId), b)
+}
+
+// canManageChannel returns whether a user may manage a channel, which is
+// required to assign profiles to its members. Direct messages and group
+// messages cannot be managed.
+func canManageChannel(be Backend, userId string, channel *model.Channel) bool {
+	switch channel.Type {
+	case model.CHANNEL_OPEN:
+		return be.HasPermissionToChannel(userId, channel.Id, model.PERMISSION_MANAGE_PUBLIC_CHANNEL_PROPERTIES)
+	case model.CHANNEL_PRIVATE:
+		return be.HasPermissionToChannel(userId, channel.Id, model.PERMISSION_MANAGE_PRIVATE_CHANNEL_PROPERTIES)
+	default:
+		return false
+	}
+}
+
+// AssignProfile sets the default character profile of a member of a channel on
+// behalf of a channel admin, and tells the member in a direct message from the
+// bot account. The profile is taken from those of the member, or else copied
+// from those of the channel admin.
+func AssignProfile(be Backend, adminId, channelId, username, profileId string) (*model.User, *Profile, *model.AppError) {
+	channel, err := be.GetChannel(channelId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !canManageChannel(be, adminId, channel) {
+		return nil, nil, appError("Only channel admins can assign character profiles to other members.", nil)
+	}
+	botUserId := be.GetBotUserId()
+	if botUserId == "" {
+		return nil, nil, appError("The bot account of the plugin is not available, so players cannot be told about assigned profiles.", nil)
+	}
+	user, _ := be.GetUserByUsername(username)
+	if user == nil {
+		return nil, nil, appError(fmt.Sprintf("Could not find user @%s.", username), nil)
+	}
+	if user.Id == adminId {
+		return nil, nil, appError("Use `/character I am` to set your own default character profile.", nil)
+	}
+	if !be.HasPermissionToChannel(user.Id, channelId, model.PERMISSION_CREATE_POST) {
+		return nil, nil, appError(fmt.Sprintf("@%s cannot post in this channel.", user.Username), nil)
+	}
+	profileId = NormalizeIdentifier(profileId)
+	if IsMe(profileId) {
+		return nil, nil, appError("Only character profiles can be assigned.", nil)
+	}
+	copied := false
+	profile, _ := GetProfile(be, user.Id, profileId, PROFILE_CHARACTER)
+	if profile == nil {
+		profile, err = copyProfile(be, adminId, user, profileId)
+		if err != nil {
+			return nil, nil, err
+		}
+		copied = true
+	}
+	previous, err := getDefaultProfileIdentifier(be, user.Id, channelId)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, _, err = SetDefaultProfile(be, user.Id, channelId, profile.Identifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	assignment := profileAssignment{
+		AssignedBy: adminId,
+		Identifier: profile.Identifier,
+		Previous:   previous,
+		AssignedAt: be.GetMillis(),
+	}
+	if old, _ := getAssignment(be, user.Id, channelId); old != nil && old.Identifier == previous {
+		// Declining goes back to the default the member chose themselves.
+		assignment.Previous = old.Previous
+	}
+	err = setAssignment(be, user.Id, channelId, assignment)
+	if err != nil {
+		return nil, nil, err
+	}
+	notice, err := notifyAssignment(be, botUserId, adminId, user, channel, *profile, copied)
+	if err != nil {
+		return nil, nil, err
+	}
+	assignment.NoticePostId = notice.Id
+	err = setAssignment(be, user.Id, channelId, assignment)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, profile, nil
+}
+
+// copyProfile copies a character profile of a channel admin to a member, so
+// that it can be assigned to them.
+func copyProfile(be Backend, adminId string, user *model.User, profileId string) (*Profile, *model.AppError) {
+	own, _ := GetProfile(be, adminId, profileId, PROFILE_CHARACTER)
+	if own == nil {
+		return nil, appError(fmt.Sprintf("Neither you nor @%s have a character profile `%s`.", user.Username, profileId), nil)
+	}
+	changes := ProfileChanges{Name: &own.Name}
+	if own.PictureFileId != "" {
+		changes.PictureFileId = &own.PictureFileId
+	}
+	if own.PictureCrop != "" {
+		changes.PictureCrop = &own.PictureCrop
+	}
+	if own.Color != "" {
+		changes.Color = &own.Color
+	}
+	result, err := SaveProfile(be, user.Id, own.Identifier, changes, SAVE_CREATE, true)
+	if err != nil {
+		return nil, appErrorPre(fmt.Sprintf("Could not copy character profile `%s` to @%s: ", own.Identifier, user.Username), err)
+	}
+	return &result.Profile, nil
+}
+
+// notifyAssignment tells a member that a profile has been assigned to them,
+// with a button to decline it.
+func notifyAssignment(be Backend, botUserId, adminId string, user *model.User, channel *model.Channel, profile Profile, copied bool) (*model.Post, *model.AppError) {
+	admin, err := be.GetUser(adminId)
+	if err != nil {
+		return nil, err
+	}
+	dm, err := be.GetDirectChannel(user.Id, botUserId)
+	if err != nil {
+		return nil, err
+	}
+	attachment := attachmentFromProfile(be, profile)
+	attachment.Actions = []*model.PostAction{
+		{
+			Type:  model.POST_ACTION_TYPE_BUTTON,
+			Name:  "Decline",
+			Style: "danger",
+			Integration: &model.PostActionIntegration{
+				URL: fmt.Sprintf("/plugins/%s/api/v1/decline", PLUGIN_ID),
+				Context: map[string]interface{}{
+					"command": declineCommand(channel.Id),
+				},
+			},
+		},
+	}
+	message := fmt.Sprintf("@%s made character profile `%s` your default in ~%s. Decline to go back to your earlier default, or use `/character I am` there to choose another.", admin.Username, profile.Identifier, channel.Name)
+	if copied {
+		message += fmt.Sprintf(" The profile was copied from those of @%s, and stays yours if you decline.", admin.Username)
+	}
+	return be.CreatePost(&model.Post{
+		UserId:    botUserId,
+		ChannelId: dm.Id,
+		Message:   message,
+		Props: model.StringInterface{
+			"attachments":           []*model.SlackAttachment{attachment},
+			ASSIGNMENT_CHANNEL_PROP: channel.Id,
+		},
+	})
+}
+
+// declineCommand returns the command that declines the profile assigned in a
+// channel.
+func declineCommand(channelId string) string {
+	return "/character decline " + channelId
+}
+
+// DeclineAssignment brings back the default character profile that a member of
+// a channel had before a profile was assigned to them. It returns the profile
+// that was declined.
+func DeclineAssignment(be Backend, userId, channelId string) (*profileAssignment, *model.AppError) {
+	assignment, err := getAssignment(be, userId, channelId)
+	if err != nil {
+		return nil, err
+	}
+	if assignment == nil {
+		return nil, appError("No character profile has been assigned to you in this channel.", nil)
+	}
+	err = be.KVDelete(getAssignmentKey(userId, channelId))
+	if err != nil {
+		return nil, err
+	}
+	current, err := getDefaultProfileIdentifier(be, userId, channelId)
+	if err != nil {
+		return nil, err
+	}
+	if current != assignment.Identifier {
+		return nil, appError(fmt.Sprintf("You have already chosen another default character profile than `%s`.", assignment.Identifier), nil)
+	}
+	_, _, err = SetDefaultProfile(be, userId, channelId, assignment.Previous)
+	if err != nil {
+		// The earlier profile no longer exists.
+		_, _, err = SetDefaultProfile(be, userId, channelId, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return assignment, nil
+}
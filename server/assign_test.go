@@ -0,0 +1,172 @@
+package main_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestAssign(t *testing.T) {
+	be := newMockBackend()
+	be.ChannelAdmins = map[string]bool{tChannel1 + "_" + tUser1: true}
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser2, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	milouImg := avatarImg(be, "milou", "Milou")
+	cmd(t, be, "/character milou=Milou", tUser2, tChannel1, tTeam1, "",
+		"Character profile `milou` created with display name \"Milou\"",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+
+	cmdFail(t, be, "/character assign @user-number-two as haddock", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: The bot account of the plugin is not available, so players cannot be told about assigned profiles.")
+	be.BotUserId = tBot
+	be.Users[tBot] = &model.User{Id: tBot, Username: "character-profiles", IsBot: true}
+
+	// Permission checks
+	cmdFail(t, be, "/character assign @user-number-one as haddock", tUser2, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Only channel admins can assign character profiles to other members.")
+	cmdFail(t, be, "/character assign @nobody as haddock", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Could not find user @nobody.")
+	cmdFail(t, be, "/character assign @user-number-two as tintin", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Neither you nor @user-number-two have a character profile `tintin`.")
+	be.Users["user3aaaaaaaaaaaaaaaaaaaaa"] = &model.User{Id: "user3aaaaaaaaaaaaaaaaaaaaa", Username: "user-number-three"}
+	cmdFail(t, be, "/character assign @user-number-three as haddock", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: @user-number-three cannot post in this channel.")
+
+	// Assigning notifies the player
+	cmd(t, be, "/character I am milou", tUser2, tChannel1, tTeam1, "",
+		"You are now known as \"Milou\".",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	cmd(t, be, "/character assign @user-number-two as Haddock", tUser1, tChannel1, tTeam1, "",
+		"@user-number-two is now known as \"Captain Haddock\" in this channel, unless they decline.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	var notice *model.Post
+	for _, p := range be.Posts {
+		if p.UserId == tBot {
+			notice = p
+		}
+	}
+	if assert.NotNil(t, notice) {
+		assert.Equal(t, model.GetDMNameFromIds(tUser2, tBot), be.Channels[notice.ChannelId].Name)
+		assert.Equal(t, "@user-number-one made character profile `haddock` your default in ~channel-one. Decline to go back to your earlier default, or use `/character I am` there to choose another.", notice.Message)
+		attachments := notice.Attachments()
+		if assert.Equal(t, 1, len(attachments)) && assert.Equal(t, 1, len(attachments[0].Actions)) {
+			assert.Equal(t, "/character decline "+tChannel1, attachments[0].Actions[0].Integration.Context["command"])
+		}
+	}
+	post(t, be, &model.Post{UserId: tUser2, ChannelId: tChannel1, Message: "Blistering barnacles!"},
+		"haddock", "Captain Haddock", haddockImg)
+
+	// Declining brings back the earlier default, also from the direct message
+	cmd(t, be, "/character decline "+tChannel1, tUser2, notice.ChannelId, "", "",
+		"Declined character profile `haddock`. You are known as \"Milou\" again.",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	post(t, be, &model.Post{UserId: tUser2, ChannelId: tChannel1, Message: "Woof!"},
+		"milou", "Milou", milouImg)
+	cmdFail(t, be, "/character decline", tUser2, tChannel1, tTeam1, "",
+		"Character Profile Plugin: No character profile has been assigned to you in this channel.")
+
+	// Without an earlier default, declining goes back to the real profile
+	cmd(t, be, "/character I am myself", tUser2, tChannel1, tTeam1, "",
+		"You are now yourself again. Hope that feels ok.",
+		[]tAtt{{"**user-number-two** *(your real profile)*\n`me`, `myself`", "#009900", nil}})
+	cmd(t, be, "/character assign @user-number-two as haddock", tUser1, tChannel1, tTeam1, "",
+		"@user-number-two is now known as \"Captain Haddock\" in this channel, unless they decline.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	// The button in the direct message replaces it with the outcome
+	var notice2 *model.Post
+	for _, p := range be.Posts {
+		if p.UserId == tBot && p.Id != notice.Id {
+			notice2 = p
+		}
+	}
+	if assert.NotNil(t, notice2) {
+		body := `{"user_id": "` + tUser2 + `", "post_id": "` + notice2.Id + `", "channel_id": "` + notice2.ChannelId + `", "context": {"command": "/character decline ` + tChannel1 + `"}}`
+		assert.Equal(t, http.StatusBadRequest, apiRequest(t, be, http.MethodPost, tUser1, "/decline", body, nil))
+		// Only the direct message to the member can be used, whatever the request claims
+		otherBody := `{"user_id": "` + tUser1 + `", "post_id": "` + notice2.Id + `", "channel_id": "` + notice2.ChannelId + `", "context": {"command": "/character decline ` + tChannel1 + `"}}`
+		assert.Equal(t, http.StatusNotFound, apiRequest(t, be, http.MethodPost, tUser1, "/decline", otherBody, nil))
+		assert.Equal(t, notice2.Message, be.Posts[notice2.Id].Message)
+		assert.Equal(t, 1, len(be.Posts[notice2.Id].Attachments()))
+		// The direct message of an earlier assignment cannot be used
+		oldBody := `{"user_id": "` + tUser2 + `", "post_id": "` + notice.Id + `", "channel_id": "` + notice.ChannelId + `", "context": {"command": "/character decline ` + tChannel1 + `"}}`
+		assert.Equal(t, http.StatusNotFound, apiRequest(t, be, http.MethodPost, tUser2, "/decline", oldBody, nil))
+		assert.Equal(t, notice.Message, be.Posts[notice.Id].Message)
+		assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodPost, tUser2, "/decline", body, nil))
+		assert.Equal(t, "Declined character profile `haddock`. You are yourself again.", be.Posts[notice2.Id].Message)
+		assert.Empty(t, be.Posts[notice2.Id].Attachments())
+		assert.Empty(t, be.EphemeralPosts[tUser2])
+		// Declining again leaves the message alone
+		assert.Equal(t, http.StatusNotFound, apiRequest(t, be, http.MethodPost, tUser2, "/decline", body, nil))
+		assert.Equal(t, "Declined character profile `haddock`. You are yourself again.", be.Posts[notice2.Id].Message)
+	}
+	post(t, be, &model.Post{UserId: tUser2, ChannelId: tChannel1, Message: "Hello"},
+		"", "", nil)
+
+	// Choosing another default in between makes declining moot
+	cmd(t, be, "/character assign @user-number-two as haddock", tUser1, tChannel1, tTeam1, "",
+		"@user-number-two is now known as \"Captain Haddock\" in this channel, unless they decline.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	cmd(t, be, "/character I am milou", tUser2, tChannel1, tTeam1, "",
+		"You are now known as \"Milou\".",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	cmdFail(t, be, "/character decline", tUser2, tChannel1, tTeam1, "",
+		"Character Profile Plugin: You have already chosen another default character profile than `haddock`.")
+
+	// When declining fails, the button leaves the direct message alone
+	earlier := map[string]bool{}
+	for _, p := range be.Posts {
+		earlier[p.Id] = true
+	}
+	cmd(t, be, "/character assign @user-number-two as haddock", tUser1, tChannel1, tTeam1, "",
+		"@user-number-two is now known as \"Captain Haddock\" in this channel, unless they decline.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	cmd(t, be, "/character I am milou", tUser2, tChannel1, tTeam1, "",
+		"You are now known as \"Milou\".",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	var notice3 *model.Post
+	for _, p := range be.Posts {
+		if p.UserId == tBot && !earlier[p.Id] {
+			notice3 = p
+		}
+	}
+	if assert.NotNil(t, notice3) {
+		body := `{"user_id": "` + tUser2 + `", "post_id": "` + notice3.Id + `", "channel_id": "` + notice3.ChannelId + `"}`
+		assert.Equal(t, http.StatusConflict, apiRequest(t, be, http.MethodPost, tUser2, "/decline", body, nil))
+		assert.Equal(t, notice3.Message, be.Posts[notice3.Id].Message)
+		assert.Equal(t, 1, len(be.Posts[notice3.Id].Attachments()))
+	}
+
+	// A profile of the channel admin is copied to the member
+	tintinImg := avatarImg(be, "tintin", "Tintin")
+	cmd(t, be, "/character tintin=Tintin", tUser1, tChannel1, tTeam1, "",
+		"Character profile `tintin` created with display name \"Tintin\"",
+		[]tAtt{{"**Tintin**\n`tintin`", "#5c66ff", tintinImg}})
+	for _, p := range be.Posts {
+		earlier[p.Id] = true
+	}
+	cmd(t, be, "/character assign @user-number-two as tintin", tUser1, tChannel1, tTeam1, "",
+		"@user-number-two is now known as \"Tintin\" in this channel, unless they decline.",
+		[]tAtt{{"**Tintin**\n`tintin`", "#5c66ff", tintinImg}})
+	var notice4 *model.Post
+	for _, p := range be.Posts {
+		if p.UserId == tBot && !earlier[p.Id] {
+			notice4 = p
+		}
+	}
+	if assert.NotNil(t, notice4) {
+		assert.Equal(t, "@user-number-one made character profile `tintin` your default in ~channel-one. Decline to go back to your earlier default, or use `/character I am` there to choose another. The profile was copied from those of @user-number-one, and stays yours if you decline.", notice4.Message)
+	}
+	post(t, be, &model.Post{UserId: tUser2, ChannelId: tChannel1, Message: "Great snakes!"},
+		"tintin", "Tintin", tintinImg)
+	cmd(t, be, "/character decline", tUser2, tChannel1, tTeam1, "",
+		"Declined character profile `tintin`. You are known as \"Milou\" again.",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	cmd(t, be, "/character I am tintin", tUser2, tChannel1, tTeam1, "",
+		"You are now known as \"Tintin\".",
+		[]tAtt{{"**Tintin**\n`tintin`", "#5c66ff", tintinImg}})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Character profiles without a picture get a generated avatar showing the
+// initials of the display name on a background color, which is either chosen
+// with `color=` or derived from the identifier. Avatar URLs contain the color
+// and initials, so an avatar changes URL whenever it changes appearance, and
+// rendered avatars are cached in the KV store by a hash of their content. Since
+// anyone can request an avatar with any color and initials, only avatars that
+// a saved profile has had are cached.
+
+// AVATAR_STYLE_VERSION is part of the content hash, and must be increased when
+// the rendering changes.
+const AVATAR_STYLE_VERSION = 1
+
+var avatarFont = mustParseAvatarFont()
+
+func mustParseAvatarFont() *opentype.Font {
+	f, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+var avatarColorRegexp = regexp.MustCompile(`^#?([0-9a-fA-F]{6})$`)
+
+// parseAvatarColor returns the stored form of an avatar color given in a
+// command. `auto` means the color derived from the identifier, which is stored
+// as the empty string.
+func parseAvatarColor(c string) (string, *model.AppError) {
+	if strings.ToLower(c) == "auto" {
+		return "", nil
+	}
+	matches := avatarColorRegexp.FindStringSubmatch(c)
+	if matches == nil {
+		return "", appError(fmt.Sprintf("Invalid color `%s`. Use a hex color such as `#3366cc`, or `auto`.", c), nil)
+	}
+	return "#" + strings.ToLower(matches[1]), nil
+}
+
+// describeAvatarColor returns a Markdown description of a stored avatar color.
+func describeAvatarColor(c string) string {
+	if c == "" {
+		return "automatic"
+	}
+	return "`" + c + "`"
+}
+
+// DefaultAvatarColor returns the avatar color derived from a profile
+// identifier, as `#rrggbb`. The hue is taken from a hash of the identifier,
+// while saturation and lightness are fixed to keep white initials readable.
+func DefaultAvatarColor(profileId string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(profileId))
+	hue := float64(h.Sum32()%360) / 60
+	const saturation, lightness = 0.5, 0.42
+	chroma := (1 - math.Abs(2*lightness-1)) * saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue, 2)-1))
+	var r, g, b float64
+	switch int(hue) {
+	case 0:
+		r, g, b = chroma, x, 0
+	case 1:
+		r, g, b = x, chroma, 0
+	case 2:
+		r, g, b = 0, chroma, x
+	case 3:
+		r, g, b = 0, x, chroma
+	case 4:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+	m := lightness - chroma/2
+	component := func(v float64) int { return int(math.Round((v + m) * 255)) }
+	return fmt.Sprintf("#%02x%02x%02x", component(r), component(g), component(b))
+}
+
+// avatarColor returns the avatar color of a profile as `#rrggbb`.
+func avatarColor(profile Profile) string {
+	if profile.Color != "" {
+		return profile.Color
+	}
+	return DefaultAvatarColor(profile.Identifier)
+}
+
+// AvatarInitials returns the initials shown in the avatar of a profile: the
+// first letter or digit of the first and last words of the display name, or
+// the first letter of the identifier if the display name has none.
+func AvatarInitials(displayName, profileId string) string {
+	words := strings.FieldsFunc(displayName, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	initials := []rune{}
+	if len(words) > 0 {
+		initials = append(initials, []rune(words[0])[0])
+	}
+	if len(words) > 1 {
+		initials = append(initials, []rune(words[len(words)-1])[0])
+	}
+	if len(initials) == 0 {
+		initials = append(initials, []rune(profileId)[0])
+	}
+	for i, r := range initials {
+		initials[i] = unicode.ToUpper(r)
+	}
+	return string(initials)
+}
+
+// validAvatarInitials returns whether initials from a URL could have been
+// returned by AvatarInitials.
+func validAvatarInitials(initials string) bool {
+	runes := []rune(initials)
+	if len(runes) < 1 || len(runes) > 2 {
+		return false
+	}
+	for _, r := range runes {
+		if (!unicode.IsLetter(r) && !unicode.IsDigit(r)) || unicode.ToUpper(r) != r {
+			return false
+		}
+	}
+	return true
+}
+
+// avatarURL returns the URL of the generated avatar of a profile.
+func avatarURL(be Backend, profile Profile, thumbnail bool) string {
+	variantPath := ""
+	if thumbnail {
+		variantPath = "/thumbnail"
+	}
+	c := strings.TrimPrefix(avatarColor(profile), "#")
+	initials := AvatarInitials(profile.Name, profile.Identifier)
+	return fmt.Sprintf("%s/avatar/%s/%s%s", GetPluginURL(be), c, url.PathEscape(initials), variantPath)
+}
+
+// RenderAvatar returns a square PNG image of the given size showing initials
+// centered on a background color given as `rrggbb`. The initials are white, or
+// black on light backgrounds.
+func RenderAvatar(initials, colorHex string, size int) ([]byte, *model.AppError) {
+	rgb, pErr := strconv.ParseUint(colorHex, 16, 32)
+	if pErr != nil || len(colorHex) != 6 {
+		return nil, appError(fmt.Sprintf("Invalid avatar color `%s`.", colorHex), pErr)
+	}
+	background := color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 255}
+	foreground := color.Color(color.White)
+	luminance := 0.299*float64(background.R) + 0.587*float64(background.G) + 0.114*float64(background.B)
+	if luminance > 186 {
+		foreground = color.Black
+	}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	face, fErr := opentype.NewFace(avatarFont, &opentype.FaceOptions{
+		Size:    float64(size) * 0.4,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if fErr != nil {
+		return nil, appError("Failed to render avatar.", fErr)
+	}
+	defer face.Close()
+	// Center the ink bounds of the initials rather than their advance and line
+	// height, since these differ a lot between letters.
+	bounds, _ := font.BoundString(face, initials)
+	inkWidth := bounds.Max.X - bounds.Min.X
+	inkHeight := bounds.Max.Y - bounds.Min.Y
+	center := fixed.I(size / 2)
+	drawer := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(foreground),
+		Face: face,
+		Dot: fixed.Point26_6{
+			X: center - inkWidth/2 - bounds.Min.X,
+			Y: center - inkHeight/2 - bounds.Min.Y,
+		},
+	}
+	drawer.DrawString(initials)
+	var buf bytes.Buffer
+	eErr := png.Encode(&buf, img)
+	if eErr != nil {
+		return nil, appError("Failed to encode avatar.", eErr)
+	}
+	return buf.Bytes(), nil
+}
+
+// avatarHash returns the content hash of an avatar.
+func avatarHash(initials, colorHex string, size int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%d\n%d", initials, colorHex, size, AVATAR_STYLE_VERSION)))
+	return hex.EncodeToString(sum[:16])
+}
+
+func getKnownAvatarKey(initials, colorHex string) string {
+	return "knownavatar_" + avatarHash(initials, colorHex, 0)
+}
+
+// rememberAvatar records that the avatar of a profile may be cached.
+func rememberAvatar(be Backend, profile Profile) *model.AppError {
+	initials, colorHex := profileAvatar(profile)
+	return be.KVSet(getKnownAvatarKey(initials, colorHex), []byte("1"))
+}
+
+// isKnownAvatar returns whether a saved profile has had the given avatar.
+func isKnownAvatar(be Backend, initials, colorHex string) (bool, *model.AppError) {
+	b, err := be.KVGet(getKnownAvatarKey(initials, colorHex))
+	return len(b) > 0, err
+}
+
+// profileAvatar returns the initials and color, as `rrggbb`, of the avatar of
+// a profile.
+func profileAvatar(profile Profile) (string, string) {
+	return AvatarInitials(profile.Name, profile.Identifier), strings.TrimPrefix(avatarColor(profile), "#")
+}
+
+// getProfileAvatar returns the rendered avatar of a profile, rendering and
+// caching it unless cached.
+func getProfileAvatar(be Backend, profile Profile, variant string) ([]byte, *model.AppError) {
+	initials, colorHex := profileAvatar(profile)
+	return getAvatar(be, initials, colorHex, variant)
+}
+
+// getAvatar returns a rendered avatar, rendering and caching it unless cached.
+func getAvatar(be Backend, initials, colorHex, variant string) ([]byte, *model.AppError) {
+	size := pictureSizes[variant]
+	key := "avatar_" + avatarHash(initials, colorHex, size)
+	cached, err := be.KVGet(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(cached) > 0 {
+		return cached, nil
+	}
+	rendered, err := RenderAvatar(initials, colorHex, size)
+	if err != nil {
+		return nil, err
+	}
+	err = be.KVSetWithExpiry(key, rendered, PICTURE_CACHE_SECONDS)
+	if err != nil {
+		return nil, err
+	}
+	return rendered, nil
+}
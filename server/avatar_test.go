@@ -0,0 +1,133 @@
+package main_test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+// avatarImg returns a function giving the expected URL of the generated
+// avatar of a profile with the default color.
+func avatarImg(be main.Backend, profileId, displayName string) func(thumb bool) string {
+	return avatarImgWithColor(be, main.DefaultAvatarColor(profileId)[1:], main.AvatarInitials(displayName, profileId))
+}
+
+func avatarImgWithColor(be main.Backend, color, initials string) func(thumb bool) string {
+	return func(thumb bool) string {
+		ret := main.GetPluginURL(be) + "/avatar/" + color + "/" + url.PathEscape(initials)
+		if thumb {
+			ret += "/thumbnail"
+		}
+		return ret
+	}
+}
+
+func TestAvatarInitials(t *testing.T) {
+	assert.Equal(t, "CH", main.AvatarInitials("Captain Haddock", "haddock"))
+	assert.Equal(t, "CH", main.AvatarInitials("captain archibald haddock", "haddock"))
+	assert.Equal(t, "M", main.AvatarInitials("Milou", "milou"))
+	assert.Equal(t, "ÅL", main.AvatarInitials("Åsa Larsson", "åsa"))
+	assert.Equal(t, "R2", main.AvatarInitials("R2-D2 (2)", "robot"))
+	assert.Equal(t, "Q", main.AvatarInitials("???", "question"))
+}
+
+func TestDefaultAvatarColor(t *testing.T) {
+	assert.Regexp(t, "^#[0-9a-f]{6}$", main.DefaultAvatarColor("haddock"))
+	assert.Equal(t, main.DefaultAvatarColor("haddock"), main.DefaultAvatarColor("haddock"))
+	assert.NotEqual(t, main.DefaultAvatarColor("haddock"), main.DefaultAvatarColor("milou"))
+}
+
+func TestRenderAvatar(t *testing.T) {
+	rendered, err := main.RenderAvatar("CH", "3366cc", 128)
+	assert.Nil(t, err)
+	img, dErr := png.Decode(bytes.NewReader(rendered))
+	assert.Nil(t, dErr)
+	assert.Equal(t, image.Rect(0, 0, 128, 128), img.Bounds())
+	// The corner has the background color, and the center has white initials
+	r, g, b, _ := img.At(0, 0).RGBA()
+	assert.Equal(t, []uint32{0x33, 0x66, 0xcc}, []uint32{r >> 8, g >> 8, b >> 8})
+	white := 0
+	for x := 32; x < 96; x++ {
+		r, g, b, _ := img.At(x, 64).RGBA()
+		if r>>8 > 0xf0 && g>>8 > 0xf0 && b>>8 > 0xf0 {
+			white++
+		}
+	}
+	assert.True(t, white > 8)
+	_, err = main.RenderAvatar("CH", "blue", 128)
+	assert.NotNil(t, err)
+}
+
+func countKeysWithPrefix(be main.BackendMock, prefix string) int {
+	count := 0
+	for key := range be.KVStore {
+		if strings.HasPrefix(key, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestAvatars(t *testing.T) {
+	be := newMockBackend()
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	postId := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Blistering barnacles!"},
+		"haddock", "Captain Haddock", haddockImg)
+	w := request(be, http.MethodGet, tUser2, haddockImg(false), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	rendered, err := main.RenderAvatar("CH", main.DefaultAvatarColor("haddock")[1:], 512)
+	assert.Nil(t, err)
+	assert.Equal(t, rendered, w.Body.Bytes())
+	etag := w.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+	w = request(be, http.MethodGet, tUser2, haddockImg(false), http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	w = request(be, http.MethodGet, tUser2, haddockImg(true), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, http.StatusNotFound, request(be, http.MethodGet, tUser2, main.GetPluginURL(be)+"/avatar/3366cc/ABC", nil).Code)
+	assert.Equal(t, http.StatusNotFound, request(be, http.MethodGet, tUser2, main.GetPluginURL(be)+"/avatar/3366cc/ch", nil).Code)
+	assert.Equal(t, http.StatusNotFound, request(be, http.MethodGet, tUser2, main.GetPluginURL(be)+"/avatar/blue/CH", nil).Code)
+	// Avatars that no profile has had are rendered but not cached
+	cached := countKeysWithPrefix(be, "avatar_")
+	assert.Equal(t, 2, cached)
+	w = request(be, http.MethodGet, tUser2, avatarImgWithColor(be, "123456", "ZZ")(false), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	rendered, err = main.RenderAvatar("ZZ", "123456", 512)
+	assert.Nil(t, err)
+	assert.Equal(t, rendered, w.Body.Bytes())
+	assert.Equal(t, cached, countKeysWithPrefix(be, "avatar_"))
+	// A chosen color is used for the avatar, and existing messages are updated
+	cmd(t, be, "/character haddock color=#3366CC", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` modified by setting the avatar color to `#3366cc`",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", avatarImgWithColor(be, "3366cc", "CH")}})
+	assert.Equal(t, avatarImgWithColor(be, "3366cc", "CH")(false), be.Posts[postId].Props["override_icon_url"])
+	cmd(t, be, "/character haddock=Archibald color=auto", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` modified by changing the display name from \"Captain Haddock\" to \"Archibald\" and setting the avatar color to automatic",
+		[]tAtt{{"**Archibald**\n`haddock`", "#5c66ff", avatarImg(be, "haddock", "Archibald")}})
+	cmd(t, be, "/character milou=Milou color=ffcc00", tUser1, tChannel1, tTeam1, "",
+		"Character profile `milou` created with display name \"Milou\" and avatar color `#ffcc00`",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", avatarImgWithColor(be, "ffcc00", "M")}})
+	cmdFail(t, be, "/character milou color=yellow", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Invalid color `yellow`. Use a hex color such as `#3366cc`, or `auto`.")
+	cmd(t, be, "/character history haddock", tUser1, tChannel1, tTeam1, "",
+		"## History of character profile `haddock`\n"+
+			"- Version 1, 2020-09-13 12:26 UTC: display name \"Captain Haddock\" and no profile picture\n"+
+			"- Version 2, 2020-09-13 12:26 UTC: avatar color changed to `#3366cc`\n"+
+			"- Version 3, 2020-09-13 12:26 UTC: display name changed from \"Captain Haddock\" to \"Archibald\" and avatar color changed to automatic",
+		[]tAtt{})
+}
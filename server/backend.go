@@ -9,45 +9,103 @@ import (
 // Backend interface to be implemented by a mock.
 
 type Backend interface {
+	CreatePost(post *model.Post) (*model.Post, *model.AppError)
+	DeletePost(postId string) *model.AppError
+	// GetBotUserId returns the user id of the plugin's bot account, or the
+	// empty string if it does not exist.
+	GetBotUserId() string
 	GetBundlePath() string
+	GetChannel(id string) (*model.Channel, *model.AppError)
+	GetChannelByName(teamId, name string, includeDeleted bool) (*model.Channel, *model.AppError)
+	GetChannelMember(channelId, userId string) (*model.ChannelMember, *model.AppError)
 	GetChannelMembers(channelId string, page int, perPage int) (*model.ChannelMembers, *model.AppError)
 	GetChannelsForTeamForUser(teamId string, userId string, includeDeleted bool) ([]*model.Channel, *model.AppError)
+	GetConfiguration() *configuration
+	GetDirectChannel(userId1, userId2 string) (*model.Channel, *model.AppError)
 	GetFileInfo(id string) (*model.FileInfo, *model.AppError)
+	GetMillis() int64
 	GetPost(id string) (*model.Post, *model.AppError)
+	GetPostThread(postId string) (*model.PostList, *model.AppError)
+	GetPostsForChannel(channelId string, page, perPage int) (*model.PostList, *model.AppError)
 	GetSiteURL() string
 	GetTeam(id string) (*model.Team, *model.AppError)
 	GetUser(id string) (*model.User, *model.AppError)
+	GetUserByUsername(name string) (*model.User, *model.AppError)
+	HasPermissionTo(userId string, permission *model.Permission) bool
+	HasPermissionToChannel(userId, channelId string, permission *model.Permission) bool
 	KVCompareAndSet(key string, oldValue, newValue []byte) (bool, *model.AppError)
 	KVDelete(key string) *model.AppError
 	KVGet(key string) ([]byte, *model.AppError)
+	KVList(page, perPage int) ([]string, *model.AppError)
 	KVSet(key string, value []byte) *model.AppError
+	KVSetWithExpiry(key string, value []byte, expireInSeconds int64) *model.AppError
 	NewId() string
 	ReadFile(path string) ([]byte, *model.AppError)
+	SendEphemeralPost(userId string, post *model.Post) *model.Post
 	UpdateEphemeralPost(userId string, post *model.Post) *model.Post
 	UpdatePost(post *model.Post) (*model.Post, *model.AppError)
+	UploadFile(data []byte, channelId string, filename string) (*model.FileInfo, *model.AppError)
 }
 
 type BackendImpl struct {
-	API        plugin.API
-	BundlePath string
-	SiteURL    string
+	API plugin.API
+	// BotUserId is the user id of the plugin's bot account, if it exists. It is
+	// also set while UseBotAccount is disabled, to recognize messages posted by
+	// it.
+	BotUserId           string
+	BundlePath          string
+	ConfigurationGetter func() *configuration
+	SiteURL             string
 }
 
+func (b BackendImpl) CreatePost(post *model.Post) (*model.Post, *model.AppError) {
+	return b.API.CreatePost(post)
+}
+func (b BackendImpl) DeletePost(postId string) *model.AppError {
+	return b.API.DeletePost(postId)
+}
+func (b BackendImpl) GetBotUserId() string {
+	return b.BotUserId
+}
 func (b BackendImpl) GetBundlePath() string {
 	return b.BundlePath
 }
+func (b BackendImpl) GetChannel(id string) (*model.Channel, *model.AppError) {
+	return b.API.GetChannel(id)
+}
+func (b BackendImpl) GetChannelByName(teamId, name string, includeDeleted bool) (*model.Channel, *model.AppError) {
+	return b.API.GetChannelByName(teamId, name, includeDeleted)
+}
+func (b BackendImpl) GetChannelMember(channelId, userId string) (*model.ChannelMember, *model.AppError) {
+	return b.API.GetChannelMember(channelId, userId)
+}
 func (b BackendImpl) GetChannelMembers(channelId string, page int, perPage int) (*model.ChannelMembers, *model.AppError) {
 	return b.API.GetChannelMembers(channelId, page, perPage)
 }
 func (b BackendImpl) GetChannelsForTeamForUser(teamId string, userId string, includeDeleted bool) ([]*model.Channel, *model.AppError) {
 	return b.API.GetChannelsForTeamForUser(teamId, userId, includeDeleted)
 }
+func (b BackendImpl) GetConfiguration() *configuration {
+	return b.ConfigurationGetter()
+}
+func (b BackendImpl) GetDirectChannel(userId1, userId2 string) (*model.Channel, *model.AppError) {
+	return b.API.GetDirectChannel(userId1, userId2)
+}
 func (b BackendImpl) GetFileInfo(id string) (*model.FileInfo, *model.AppError) {
 	return b.API.GetFileInfo(id)
 }
+func (b BackendImpl) GetMillis() int64 {
+	return model.GetMillis()
+}
 func (b BackendImpl) GetPost(id string) (*model.Post, *model.AppError) {
 	return b.API.GetPost(id)
 }
+func (b BackendImpl) GetPostThread(postId string) (*model.PostList, *model.AppError) {
+	return b.API.GetPostThread(postId)
+}
+func (b BackendImpl) GetPostsForChannel(channelId string, page, perPage int) (*model.PostList, *model.AppError) {
+	return b.API.GetPostsForChannel(channelId, page, perPage)
+}
 func (b BackendImpl) GetSiteURL() string {
 	return b.SiteURL
 }
@@ -57,6 +115,15 @@ func (b BackendImpl) GetTeam(id string) (*model.Team, *model.AppError) {
 func (b BackendImpl) GetUser(id string) (*model.User, *model.AppError) {
 	return b.API.GetUser(id)
 }
+func (b BackendImpl) GetUserByUsername(name string) (*model.User, *model.AppError) {
+	return b.API.GetUserByUsername(name)
+}
+func (b BackendImpl) HasPermissionTo(userId string, permission *model.Permission) bool {
+	return b.API.HasPermissionTo(userId, permission)
+}
+func (b BackendImpl) HasPermissionToChannel(userId, channelId string, permission *model.Permission) bool {
+	return b.API.HasPermissionToChannel(userId, channelId, permission)
+}
 func (b BackendImpl) KVCompareAndSet(key string, oldValue, newValue []byte) (bool, *model.AppError) {
 	return b.API.KVCompareAndSet(key, oldValue, newValue)
 }
@@ -66,18 +133,30 @@ func (b BackendImpl) KVDelete(key string) *model.AppError {
 func (b BackendImpl) KVGet(key string) ([]byte, *model.AppError) {
 	return b.API.KVGet(key)
 }
+func (b BackendImpl) KVList(page, perPage int) ([]string, *model.AppError) {
+	return b.API.KVList(page, perPage)
+}
 func (b BackendImpl) KVSet(key string, value []byte) *model.AppError {
 	return b.API.KVSet(key, value)
 }
+func (b BackendImpl) KVSetWithExpiry(key string, value []byte, expireInSeconds int64) *model.AppError {
+	return b.API.KVSetWithExpiry(key, value, expireInSeconds)
+}
 func (b BackendImpl) NewId() string {
 	return model.NewId()
 }
 func (b BackendImpl) ReadFile(path string) ([]byte, *model.AppError) {
 	return b.API.ReadFile(path)
 }
+func (b BackendImpl) SendEphemeralPost(userId string, post *model.Post) *model.Post {
+	return b.API.SendEphemeralPost(userId, post)
+}
 func (b BackendImpl) UpdateEphemeralPost(userId string, post *model.Post) *model.Post {
 	return b.API.UpdateEphemeralPost(userId, post)
 }
 func (b BackendImpl) UpdatePost(post *model.Post) (*model.Post, *model.AppError) {
 	return b.API.UpdatePost(post)
 }
+func (b BackendImpl) UploadFile(data []byte, channelId string, filename string) (*model.FileInfo, *model.AppError) {
+	return b.API.UploadFile(data, channelId, filename)
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"image"
+	"image/png"
 	"math/rand"
 	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 )
@@ -11,22 +18,88 @@ import (
 // BackendMock is a mock of the Backend interface for testing purposes.
 
 type BackendMock struct {
+	// BotUserId is the user id of the bot account, or empty if it does not
+	// exist.
+	BotUserId string
+	// BundlePath is the plugin bundle path. If empty, a nonexistent path is used.
+	BundlePath string
+	// ChannelAdmins holds "<channel id>_<user id>" for channel members that are
+	// channel admins.
+	ChannelAdmins  map[string]bool
 	ChannelMembers []struct {
 		UserId    string
 		ChannelId string
 	}
-	Channels  map[string]*model.Channel
-	FileInfos map[string]*model.FileInfo
+	Channels      map[string]*model.Channel
+	Configuration *configuration
+	// EphemeralPosts holds the ephemeral posts sent to each user. If nil, they
+	// are discarded.
+	EphemeralPosts map[string][]*model.Post
+	FileInfos      map[string]*model.FileInfo
+	// Files holds the content of files by path. Other files hold a small PNG
+	// image.
+	Files     map[string][]byte
 	IdCounter *int
-	KVStore   map[string][]byte
-	Posts     map[string]*model.Post
-	SiteURL   string
-	Teams     map[string]*model.Team
-	Users     map[string]*model.User
+	// KVExpiry holds the expiry time in milliseconds of KV store keys. If nil,
+	// expiry is ignored.
+	KVExpiry map[string]int64
+	KVStore  map[string][]byte
+	// Millis is the mocked current time. If nil, the real time is used.
+	Millis  *int64
+	Posts   map[string]*model.Post
+	SiteURL string
+	Teams   map[string]*model.Team
+	Users   map[string]*model.User
 }
 
+func (b BackendMock) CreatePost(post *model.Post) (*model.Post, *model.AppError) {
+	post = post.Clone()
+	post.Id = b.NewId()
+	post.CreateAt = b.GetMillis()
+	post.UpdateAt = post.CreateAt
+	b.Posts[post.Id] = post
+	return post, nil
+}
+func (b BackendMock) DeletePost(postId string) *model.AppError {
+	post, err := b.GetPost(postId)
+	if err != nil {
+		return err
+	}
+	post.DeleteAt = b.GetMillis()
+	return nil
+}
+
+func (b BackendMock) GetBotUserId() string {
+	return b.BotUserId
+}
 func (b BackendMock) GetBundlePath() string {
-	return "/mock-bundle-path"
+	if b.BundlePath == "" {
+		return "/mock-bundle-path"
+	}
+	return b.BundlePath
+}
+func (b BackendMock) GetChannel(id string) (*model.Channel, *model.AppError) {
+	channel, ok := b.Channels[id]
+	if !ok {
+		return nil, model.NewAppError("BackendMock", "channel_not_found", nil, "", http.StatusNotFound)
+	}
+	return channel, nil
+}
+func (b BackendMock) GetChannelByName(teamId, name string, includeDeleted bool) (*model.Channel, *model.AppError) {
+	for _, channel := range b.Channels {
+		if channel.TeamId == teamId && channel.Name == name && (channel.DeleteAt == 0 || includeDeleted) {
+			return channel, nil
+		}
+	}
+	return nil, model.NewAppError("BackendMock", "channel_not_found", nil, "", http.StatusNotFound)
+}
+func (b BackendMock) GetChannelMember(channelId, userId string) (*model.ChannelMember, *model.AppError) {
+	for _, member := range b.ChannelMembers {
+		if member.ChannelId == channelId && member.UserId == userId {
+			return &model.ChannelMember{ChannelId: channelId, UserId: userId}, nil
+		}
+	}
+	return nil, model.NewAppError("BackendMock", "channel_member_not_found", nil, "", http.StatusNotFound)
 }
 func (b BackendMock) GetChannelMembers(channelId string, page int, perPage int) (*model.ChannelMembers, *model.AppError) {
 	ret := make(model.ChannelMembers, 0)
@@ -77,6 +150,23 @@ func (b BackendMock) GetChannelsForTeamForUser(teamId string, userId string, inc
 	}
 	return ret, nil
 }
+func (b BackendMock) GetConfiguration() *configuration {
+	if b.Configuration == nil {
+		return &configuration{}
+	}
+	return b.Configuration
+}
+func (b BackendMock) GetDirectChannel(userId1, userId2 string) (*model.Channel, *model.AppError) {
+	name := model.GetDMNameFromIds(userId1, userId2)
+	for _, channel := range b.Channels {
+		if channel.Type == model.CHANNEL_DIRECT && channel.Name == name {
+			return channel, nil
+		}
+	}
+	channel := &model.Channel{Id: b.NewId(), Name: name, Type: model.CHANNEL_DIRECT}
+	b.Channels[channel.Id] = channel
+	return channel, nil
+}
 func (b BackendMock) GetFileInfo(id string) (*model.FileInfo, *model.AppError) {
 	fileInfo, ok := b.FileInfos[id]
 	if !ok {
@@ -84,6 +174,12 @@ func (b BackendMock) GetFileInfo(id string) (*model.FileInfo, *model.AppError) {
 	}
 	return fileInfo, nil
 }
+func (b BackendMock) GetMillis() int64 {
+	if b.Millis == nil {
+		return model.GetMillis()
+	}
+	return *b.Millis
+}
 func (b BackendMock) GetPost(id string) (*model.Post, *model.AppError) {
 	post, ok := b.Posts[id]
 	if !ok || post.DeleteAt != 0 {
@@ -91,6 +187,63 @@ func (b BackendMock) GetPost(id string) (*model.Post, *model.AppError) {
 	}
 	return post, nil
 }
+
+// GetPostThread returns the root of the thread of the given post, along with
+// all replies.
+func (b BackendMock) GetPostThread(postId string) (*model.PostList, *model.AppError) {
+	post, err := b.GetPost(postId)
+	if err != nil {
+		return nil, err
+	}
+	rootId := post.Id
+	if post.RootId != "" {
+		rootId = post.RootId
+	}
+	return b.postList(func(p *model.Post) bool {
+		return p.Id == rootId || p.RootId == rootId
+	}, 0, -1), nil
+}
+
+// GetPostsForChannel returns posts of a channel, newest first.
+func (b BackendMock) GetPostsForChannel(channelId string, page, perPage int) (*model.PostList, *model.AppError) {
+	return b.postList(func(p *model.Post) bool {
+		return p.ChannelId == channelId
+	}, page, perPage), nil
+}
+
+// postList returns a page of the posts that are not deleted and match the
+// filter, newest first. All posts are returned if perPage is negative.
+func (b BackendMock) postList(filter func(*model.Post) bool, page, perPage int) *model.PostList {
+	posts := []*model.Post{}
+	for _, post := range b.Posts {
+		if post.DeleteAt == 0 && filter(post) {
+			posts = append(posts, post)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if posts[i].CreateAt != posts[j].CreateAt {
+			return posts[i].CreateAt > posts[j].CreateAt
+		}
+		return posts[i].Id > posts[j].Id
+	})
+	if perPage >= 0 {
+		min := page * perPage
+		if min > len(posts) {
+			min = len(posts)
+		}
+		max := (page + 1) * perPage
+		if max > len(posts) {
+			max = len(posts)
+		}
+		posts = posts[min:max]
+	}
+	ret := model.NewPostList()
+	for _, post := range posts {
+		ret.AddPost(post)
+		ret.AddOrder(post.Id)
+	}
+	return ret
+}
 func (b BackendMock) GetSiteURL() string {
 	return b.SiteURL
 }
@@ -108,7 +261,39 @@ func (b BackendMock) GetUser(id string) (*model.User, *model.AppError) {
 	}
 	return user, nil
 }
+func (b BackendMock) GetUserByUsername(name string) (*model.User, *model.AppError) {
+	for _, user := range b.Users {
+		if user.Username == name {
+			return user, nil
+		}
+	}
+	return nil, model.NewAppError("BackendMock", "user_not_found", nil, "", 0)
+}
+func (b BackendMock) HasPermissionTo(userId string, permission *model.Permission) bool {
+	// Only system admins have permissions beyond those of a regular user.
+	user, ok := b.Users[userId]
+	return ok && strings.Contains(user.Roles, model.SYSTEM_ADMIN_ROLE_ID)
+}
+func (b BackendMock) HasPermissionToChannel(userId, channelId string, permission *model.Permission) bool {
+	// Channel members have all channel permissions except managing the channel,
+	// which is left to channel admins. System admins have all permissions.
+	if b.HasPermissionTo(userId, permission) {
+		return true
+	}
+	_, err := b.GetChannelMember(channelId, userId)
+	if err != nil {
+		return false
+	}
+	switch permission {
+	case model.PERMISSION_MANAGE_PUBLIC_CHANNEL_PROPERTIES, model.PERMISSION_MANAGE_PRIVATE_CHANNEL_PROPERTIES:
+		return b.ChannelAdmins[channelId+"_"+userId]
+	}
+	return true
+}
 func (b BackendMock) KVCompareAndSet(key string, oldValue, newValue []byte) (bool, *model.AppError) {
+	if err := validateMockKey(key); err != nil {
+		return false, err
+	}
 	actualOldValue, ok := b.KVStore[key]
 	if ok {
 		if oldValue == nil {
@@ -137,13 +322,51 @@ func (b BackendMock) KVCompareAndSet(key string, oldValue, newValue []byte) (boo
 }
 func (b BackendMock) KVDelete(key string) *model.AppError {
 	delete(b.KVStore, key)
+	if b.KVExpiry != nil {
+		delete(b.KVExpiry, key)
+	}
 	return nil
 }
 func (b BackendMock) KVGet(key string) ([]byte, *model.AppError) {
+	if b.KVExpiry != nil {
+		expiry, ok := b.KVExpiry[key]
+		if ok && expiry <= b.GetMillis() {
+			return nil, b.KVDelete(key)
+		}
+	}
 	return b.KVStore[key], nil
 }
+func (b BackendMock) KVList(page, perPage int) ([]string, *model.AppError) {
+	keys := make([]string, 0, len(b.KVStore))
+	for key := range b.KVStore {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	min := page * perPage
+	if min > len(keys) {
+		min = len(keys)
+	}
+	max := (page + 1) * perPage
+	if max > len(keys) {
+		max = len(keys)
+	}
+	return keys[min:max], nil
+}
 func (b BackendMock) KVSet(key string, value []byte) *model.AppError {
+	if err := validateMockKey(key); err != nil {
+		return err
+	}
+	b.KVStore[key] = value
+	return nil
+}
+func (b BackendMock) KVSetWithExpiry(key string, value []byte, expireInSeconds int64) *model.AppError {
+	if err := validateMockKey(key); err != nil {
+		return err
+	}
 	b.KVStore[key] = value
+	if b.KVExpiry != nil {
+		b.KVExpiry[key] = b.GetMillis() + expireInSeconds*1000
+	}
 	return nil
 }
 func (b BackendMock) NewId() string {
@@ -163,7 +386,24 @@ func (b BackendMock) NewId() string {
 	return ret
 }
 func (b BackendMock) ReadFile(path string) ([]byte, *model.AppError) {
-	return []byte{}, nil
+	content, ok := b.Files[path]
+	if !ok {
+		var buf bytes.Buffer
+		_ = png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2)))
+		return buf.Bytes(), nil
+	}
+	return content, nil
+}
+
+// SendEphemeralPost records the post in EphemeralPosts, unless it is nil.
+func (b BackendMock) SendEphemeralPost(userId string, post *model.Post) *model.Post {
+	post = post.Clone()
+	post.Id = b.NewId()
+	post.CreateAt = b.GetMillis()
+	if b.EphemeralPosts != nil {
+		b.EphemeralPosts[userId] = append(b.EphemeralPosts[userId], post)
+	}
+	return post
 }
 func (b BackendMock) UpdateEphemeralPost(userId string, post *model.Post) *model.Post {
 	return post
@@ -175,3 +415,30 @@ func (b BackendMock) UpdatePost(post *model.Post) (*model.Post, *model.AppError)
 	b.Posts[post.Id] = post
 	return post, nil
 }
+
+// UploadFile stores the file in Files and its info in FileInfos, which must not
+// be nil.
+func (b BackendMock) UploadFile(data []byte, channelId string, filename string) (*model.FileInfo, *model.AppError) {
+	id := b.NewId()
+	info := &model.FileInfo{
+		Id:        id,
+		ChannelId: channelId,
+		CreateAt:  b.GetMillis(),
+		UpdateAt:  b.GetMillis(),
+		Path:      "mock-uploads/" + id + "/" + filename,
+		Name:      filename,
+		Extension: strings.TrimPrefix(filepath.Ext(filename), "."),
+		Size:      int64(len(data)),
+	}
+	b.Files[info.Path] = data
+	b.FileInfos[id] = info
+	return info, nil
+}
+
+// validateMockKey rejects keys longer than the server allows.
+func validateMockKey(key string) *model.AppError {
+	if key == "" || utf8.RuneCountInString(key) > 150 {
+		return model.NewAppError("BackendMock", "invalid_key", nil, "key="+key, 0)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// The cast of a channel is made of the default character profiles that apply to
+// its members there, and of the character profiles used there recently
+// according to the statistics of the channel. Users can opt out of being listed
+// in any channel.
+
+// CAST_RECENT_MILLIS is how long after its last message a character profile is
+// still listed in the cast of a channel.
+const CAST_RECENT_MILLIS = 7 * 24 * 60 * 60 * 1000
+
+type CastMember struct {
+	UserId  string
+	Profile Profile
+	// IsDefault is whether the profile is the default of the user in the
+	// channel, rather than recently used there.
+	IsDefault bool
+	LastUse   int64
+}
+
+func getCastOptOutKey(userId string) string {
+	return "castoptout_" + userId
+}
+
+// isCastOptedOut returns whether a user has opted out of being listed in casts.
+func isCastOptedOut(be Backend, userId string) (bool, *model.AppError) {
+	b, err := be.KVGet(getCastOptOutKey(userId))
+	return b != nil, err
+}
+
+// setCastOptOut sets whether a user is left out of casts.
+func setCastOptOut(be Backend, userId string, optOut bool) *model.AppError {
+	if optOut {
+		return be.KVSet(getCastOptOutKey(userId), []byte("true"))
+	}
+	return be.KVDelete(getCastOptOutKey(userId))
+}
+
+// GetCast returns the cast of a channel: the default character profiles of its
+// members, sorted by display name, followed by other character profiles used
+// there recently, most recent first.
+func GetCast(be Backend, channelId string) ([]CastMember, *model.AppError) {
+	listed := map[string]bool{}
+	defaults := []CastMember{}
+	members, err := GetAllChannelMembers(be, channelId)
+	if err != nil {
+		return nil, err
+	}
+	teamId := ""
+	if channel, _ := be.GetChannel(channelId); channel != nil {
+		teamId = channel.TeamId
+	}
+	for _, member := range *members {
+		out, err := isCastOptedOut(be, member.UserId)
+		if err != nil {
+			return nil, err
+		}
+		if out {
+			continue
+		}
+		profileId, _, err := getEffectiveDefaultProfileInTeam(be, member.UserId, channelId, teamId)
+		if err != nil {
+			return nil, err
+		}
+		if IsMe(profileId) {
+			continue
+		}
+		profile, _ := GetProfile(be, member.UserId, profileId, PROFILE_CHARACTER)
+		if profile == nil {
+			continue
+		}
+		defaults = append(defaults, CastMember{UserId: member.UserId, Profile: *profile, IsDefault: true})
+		listed[member.UserId+"_"+profile.Identifier] = true
+	}
+	sort.SliceStable(defaults, func(i, j int) bool {
+		return defaults[i].Profile.Name < defaults[j].Profile.Name
+	})
+	// The statistics leave out users who have opted out.
+	stats, err := GetChannelStats(be, channelId)
+	if err != nil {
+		return nil, err
+	}
+	recent := []CastMember{}
+	since := be.GetMillis() - CAST_RECENT_MILLIS
+	for _, entry := range stats {
+		if entry.LastUse < since || listed[entry.UserId+"_"+entry.Identifier] {
+			continue
+		}
+		profile, _ := GetProfile(be, entry.UserId, entry.Identifier, PROFILE_CHARACTER)
+		if profile == nil {
+			continue
+		}
+		recent = append(recent, CastMember{UserId: entry.UserId, Profile: *profile, LastUse: entry.LastUse})
+	}
+	sort.SliceStable(recent, func(i, j int) bool {
+		return recent[i].LastUse > recent[j].LastUse
+	})
+	return append(defaults, recent...), nil
+}
+
+// attachmentsFromCast returns a card for each member of a cast, telling who
+// plays the character.
+func attachmentsFromCast(be Backend, cast []CastMember) []*model.SlackAttachment {
+	ret := make([]*model.SlackAttachment, len(cast))
+	for i, member := range cast {
+		player := member.UserId
+		if user, _ := be.GetUser(member.UserId); user != nil {
+			player = "@" + user.Username
+		}
+		attachment := attachmentFromProfile(be, member.Profile)
+		if member.IsDefault {
+			attachment.Text += fmt.Sprintf("\nDefault profile of %s", player)
+		} else {
+			attachment.Text += fmt.Sprintf("\nPlayed by %s, last used %s", player, formatTime(member.LastUse))
+		}
+		ret[i] = attachment
+	}
+	return ret
+}
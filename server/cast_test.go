@@ -0,0 +1,73 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestCast(t *testing.T) {
+	be := newMockBackend()
+	cmd(t, be, "/character cast", tUser1, tChannel1, tTeam1, "",
+		"No character profiles are active in this channel.", nil)
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	milouImg := avatarImg(be, "milou", "Milou")
+	cmd(t, be, "/character milou=Milou", tUser2, tChannel1, tTeam1, "",
+		"Character profile `milou` created with display name \"Milou\"",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	tintinImg := avatarImg(be, "tintin", "Tintin")
+	cmd(t, be, "/character tintin=Tintin", tUser2, tChannel1, tTeam1, "",
+		"Character profile `tintin` created with display name \"Tintin\"",
+		[]tAtt{{"**Tintin**\n`tintin`", "#5c66ff", tintinImg}})
+
+	// Defaults of members, then recently used profiles
+	cmd(t, be, "/character I am milou", tUser2, tChannel1, tTeam1, "",
+		"You are now known as \"Milou\".",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	cmd(t, be, "/character I am haddock", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Captain Haddock\".",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	millis := *be.Millis
+	post(t, be, &model.Post{UserId: tUser2, ChannelId: tChannel1, CreateAt: millis, Message: "tintin: Great snakes!"},
+		"tintin", "Tintin", tintinImg)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: millis, Message: "Blistering barnacles!"},
+		"haddock", "Captain Haddock", haddockImg)
+	cmd(t, be, "/character cast", tUser1, tChannel1, tTeam1, "",
+		"## Cast of this channel",
+		[]tAtt{
+			{"**Captain Haddock**\n`haddock`\nDefault profile of @user-number-one", "#5c66ff", haddockImg},
+			{"**Milou**\n`milou`\nDefault profile of @user-number-two", "#5c66ff", milouImg},
+			{"**Tintin**\n`tintin`\nPlayed by @user-number-two, last used 2020-09-13 12:26 UTC", "#5c66ff", tintinImg},
+		})
+
+	// Profiles that have not been used for a week are left out
+	*be.Millis = millis + 8*24*60*60*1000
+	cmd(t, be, "/character cast", tUser1, tChannel1, tTeam1, "",
+		"## Cast of this channel",
+		[]tAtt{
+			{"**Captain Haddock**\n`haddock`\nDefault profile of @user-number-one", "#5c66ff", haddockImg},
+			{"**Milou**\n`milou`\nDefault profile of @user-number-two", "#5c66ff", milouImg},
+		})
+
+	// Opting out
+	cmd(t, be, "/character cast hide", tUser2, tChannel1, tTeam1, "",
+		"Your character profiles will no longer be listed by `/character cast` or in the statistics of channels.", nil)
+	cmd(t, be, "/character cast", tUser1, tChannel1, tTeam1, "",
+		"## Cast of this channel",
+		[]tAtt{
+			{"**Captain Haddock**\n`haddock`\nDefault profile of @user-number-one", "#5c66ff", haddockImg},
+		})
+	cmd(t, be, "/character cast show", tUser2, tChannel1, tTeam1, "",
+		"Your character profiles will be listed by `/character cast` and in the statistics of channels again.", nil)
+	cmd(t, be, "/character I am myself", tUser1, tChannel1, tTeam1, "",
+		"You are now yourself again. Hope that feels ok.",
+		[]tAtt{{"**user-number-one** *(your real profile)*\n`me`, `myself`", "#009900", nil}})
+	cmd(t, be, "/character cast", tUser1, tChannel1, tTeam1, "",
+		"## Cast of this channel",
+		[]tAtt{
+			{"**Milou**\n`milou`\nDefault profile of @user-number-two", "#5c66ff", milouImg},
+		})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// The channel index records, for each character profile, the channels where it
+// has been used. It is a string set of channel ids, which only ever grows:
+// channels are not removed when messages are deleted or moved to another
+// profile. It is kept up to date by RegisterPost, and filled in for messages
+// sent before the index existed by a periodic job that only runs once.
+
+const CHANNEL_INDEX_JOB = "indexchannels"
+
+const CHANNEL_INDEX_DONE_KEY = "channelindexdone"
+
+func getProfileChannelsKey(userId, profileId string) string {
+	return fmt.Sprintf("profilechannels_%s_%s", userId, encodeIdentifierForKey(profileId))
+}
+
+// GetProfileChannels returns the ids of all channels where a profile has been
+// used, sorted.
+func GetProfileChannels(be Backend, userId, profileId string) ([]string, *model.AppError) {
+	return StrsetGet(be, getProfileChannelsKey(userId, profileId))
+}
+
+func addProfileChannel(be Backend, userId, profileId, channelId string) *model.AppError {
+	if channelId == "" {
+		return nil
+	}
+	return StrsetInsert(be, getProfileChannelsKey(userId, profileId), channelId)
+}
+
+// IndexProfileChannels adds the channels of all messages using a character
+// profile to the channel index. This is only done once, since RegisterPost
+// keeps the index up to date for new and edited messages.
+func IndexProfileChannels(be Backend) *model.AppError {
+	done, err := be.KVGet(CHANNEL_INDEX_DONE_KEY)
+	if err != nil {
+		return err
+	}
+	if done != nil {
+		return nil
+	}
+	err = forEachUserProfile(be, func(userId, profileId string) *model.AppError {
+		return IdsetIter(be, getIdsetKey(userId, profileId), "", 0, func(postId string) *model.AppError {
+			post, err := GetPostIfExists(be, postId)
+			if err != nil {
+				return err
+			}
+			if post == nil {
+				return nil
+			}
+			return addProfileChannel(be, userId, profileId, post.ChannelId)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return be.KVSet(CHANNEL_INDEX_DONE_KEY, []byte("1"))
+}
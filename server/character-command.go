@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/mattermost/mattermost-server/v5/model"
@@ -35,158 +36,184 @@ func DoExecuteCommand(be Backend, command, userId, channelId, teamId, rootId str
 	// `/character haddock=Captain Haddock`: Create a character profile with identifier `haddock` unless it already exists, and set its display name to `Captain Haddock`.
 	// `/character picture haddock=Captain Haddock`: Create a character profile with identifier `haddock` unless it already exists, set its display name to `Captain Haddock`, and set its profile picture to the picture uploaded in the parent message. (Note that you can **not** attach a picture to the slash command itself, for technical reasons.)
 	// `/character picture haddock`: Modify an existing character profile by updating the profile picture to the picture uploaded in the parent message, leaving the display name as it is. (Note that you can **not** attach a picture to the slash command itself, for technical reasons.)
-	matches = regexp.MustCompile(`^(picture )?([a-z]+)(=.*)?$`).FindStringSubmatch(query)
-	if matches != nil && (matches[1] != "" || matches[3] != "") {
-		profileId := matches[2]
-		if IsMe(profileId) {
-			return "", nil, appError("You cannot use `myself` or `me` as a character profile identifyer. Use the Mattermost built-in functionality to change the display name or profile picture for your real Mattermost profile.", nil)
+	// `/character picture haddock crop=top`: Set the profile picture as above, cropping it to a square anchored at the top instead of the center.
+	// `/character picture haddock https://example.com/team/pl/abc... file=2`: Set the profile picture to the second file of the linked message instead of the parent message. Both the link and `file=` are optional.
+	// `/character haddock color=#3366cc`: Set the background color of the generated avatar shown for a character profile without a profile picture. `color=auto` goes back to a color derived from the identifier.
+	// `/character haddock=Old Haddock --keep-history`: Modify a character profile without changing how existing messages look. `--rewrite-history` instead updates existing messages even if the profile keeps its history.
+	matches = regexp.MustCompile(`^(picture )?([\pL\pM]+)(=.*?)?( (\S+/pl/[a-z0-9]{26}))?( file=([1-9][0-9]{0,2}))?( crop=(\S+))?( color=(\S+))?( --keep-history| --rewrite-history)?$`).FindStringSubmatch(query)
+	if matches != nil && (matches[1] != "" || matches[3] != "" || matches[10] != "") {
+		setPicture := matches[1] != ""
+		changes := ProfileChanges{}
+		if matches[3] != "" {
+			name := strings.TrimPrefix(matches[3], "=")
+			changes.Name = &name
 		}
-		existed, err := profileExists(be, userId, profileId)
-		if err != nil {
-			return "", nil, err
+		if !setPicture && (matches[4] != "" || matches[6] != "") {
+			return "", nil, appError("A message link or `file=` can only be given when setting the profile picture, e.g. `/character picture haddock file=2`.", nil)
 		}
-		profileDisplayName := strings.TrimPrefix(matches[3], "=")
-		setName := matches[3] != ""
-		setPicture := matches[1] != ""
-		newProfile := Profile{
-			UserId:     userId,
-			Identifier: profileId,
-			Status:     PROFILE_CHARACTER,
+		if matches[8] != "" && !setPicture {
+			return "", nil, appError("A crop can only be given when setting the profile picture, e.g. `/character picture haddock crop=top`.", nil)
 		}
-		var newPictureFileId string
+		var err *model.AppError
 		if setPicture {
-			if rootId == "" {
-				return "", nil, appError("Setting character profile picture can only be done in a thread, with the parent post containing the picture.", nil)
-			}
-			rootPost, gpErr := be.GetPost(rootId)
-			if gpErr != nil {
-				return "", nil, gpErr
-			}
-			if rootPost == nil {
-				return "", nil, appError(fmt.Sprintf("Could not fetch root post with id `%s`", rootId), nil)
-			}
-			if len(rootPost.FileIds) > 1 {
-				return "", nil, appError("Parent post cannot have more than one file when creating or modifying a character profile.", nil)
-			}
-			if len(rootPost.FileIds) == 0 {
-				return "", nil, appError("No more than one file when creating or modifying a character profile.", nil)
-			}
-			newPictureFileId = rootPost.FileIds[0]
-			if newPictureFileId == "" {
-				return "", nil, appError("Could not find file Id in parent post.", nil)
-			}
-		}
-		var successMessage string
-		if existed {
-			// Modify character profile
-			oldProfile, gpErr := GetProfile(be, userId, profileId, PROFILE_CHARACTER|PROFILE_CORRUPT)
-			if gpErr != nil {
-				return "", nil, gpErr
-			}
-			newProfile.Name = oldProfile.Name
-			newProfile.PictureFileId = oldProfile.PictureFileId
-			newProfile.RequestKey = oldProfile.RequestKey
-			successMessage = fmt.Sprintf("Character profile `%s` modified by", profileId)
-			if setName {
-				newProfile.Name = profileDisplayName
-				sameName := oldProfile.Name == newProfile.Name
-				if sameName {
-					successMessage += fmt.Sprintf(" setting the display name to \"%s\" (same as before)", newProfile.Name)
-				} else {
-					successMessage += fmt.Sprintf(" changing the display name from \"%s\" to \"%s\"", oldProfile.Name, newProfile.Name)
-				}
-			}
-			if setPicture {
-				newProfile.PictureFileId = newPictureFileId
-				samePicture := oldProfile.PictureFileId == newProfile.PictureFileId
-				if setName {
-					successMessage += " and"
-				}
-				if samePicture {
-					successMessage += " updating the profile picture (to the same as before)"
-				} else {
-					newProfile.RequestKey = be.NewId()
-					successMessage += " updating the profile picture"
+			crop := ""
+			if matches[8] != "" {
+				crop, err = parsePictureCrop(matches[9])
+				if err != nil {
+					return "", nil, err
 				}
 			}
-		} else {
-			// Create character profile
-			if !setName {
-				return "", nil, appError(fmt.Sprintf("No character profile with identifyer `%s` exists. In order to create it, you must at least provide a display name. Try `/character help` for details.", profileId), nil)
+			changes.PictureCrop = &crop
+		}
+		if matches[10] != "" {
+			color, err := parseAvatarColor(matches[11])
+			if err != nil {
+				return "", nil, err
 			}
-			newProfile.Name = profileDisplayName
-			successMessage = fmt.Sprintf("Character profile `%s` created with display name \"%s\"", newProfile.Identifier, newProfile.Name)
-			if setPicture {
-				newProfile.PictureFileId = newPictureFileId
-				successMessage += " and a profile picture"
+			changes.Color = &color
+		}
+		if setPicture {
+			fileIndex, _ := strconv.Atoi(matches[7])
+			fileId, err := pictureFileFromCommand(be, userId, rootId, matches[5], fileIndex)
+			if err != nil {
+				return "", nil, err
 			}
+			changes.PictureFileId = &fileId
+		}
+		if matches[12] != "" {
+			keepHistory := matches[12] == " --keep-history"
+			changes.KeepHistory = &keepHistory
 		}
-		if setPicture && newProfile.RequestKey == "" {
-			newProfile.RequestKey = be.NewId()
+		result, err := SaveProfile(be, userId, matches[2], changes, SAVE_CREATE|SAVE_MODIFY, confirmed)
+		if IsConfirmationRequired(err) {
+			retMsg, retAtt := uiConfirmation(err.Message, command, rootId)
+			return retMsg, retAtt, nil
 		}
-		err = populateProfile(be, &newProfile)
 		if err != nil {
 			return "", nil, err
 		}
-		err = newProfile.validate(newProfile.Identifier)
+		return describeSavedProfile(result, changes), attachmentsFromProfile(be, result.Profile), nil
+	}
+
+	// `/character delete haddock`: Delete character profile with identifier `haddock`.
+	matches = regexp.MustCompile(`^delete ([\pL\pM]+)$`).FindStringSubmatch(query)
+	if matches != nil {
+		profileId := NormalizeIdentifier(matches[1])
+		err := DeleteProfile(be, userId, profileId, confirmed)
+		if IsConfirmationRequired(err) {
+			retMsg, retAtt := uiConfirmation(err.Message, command, rootId)
+			return retMsg, retAtt, nil
+		}
 		if err != nil {
 			return "", nil, err
 		}
-		if !existed && !confirmed {
-			postCount, cErr := countPostsForProfile(be, userId, profileId)
-			if cErr != nil {
-				return "", nil, cErr
-			}
-			if postCount > 0 {
-				retMsg, retAtt := uiConfirmation(fmt.Sprintf("You are about to create a character profile with identifier `%s`, but this identifier is already used by %d existing messages. These messages will be updated according to this newly created character profile. Are you sure you want to proceed?", profileId, postCount), command, rootId)
-				return retMsg, retAtt, nil
-			}
-		}
-		err = setProfile(be, userId, &newProfile)
+		return fmt.Sprintf("Deleted character profile `%s`. You can restore it with `/character restore %s` within %d days.", profileId, profileId, be.GetConfiguration().GetTrashRetentionDays()), nil, nil
+	}
+
+	// `/character trash`: List your deleted character profiles.
+	if query == "trash" {
+		profiles, err := listTrashedProfiles(be, userId)
 		if err != nil {
 			return "", nil, err
 		}
-		// Update all existing messages that uses this profile. This is done no
-		// matter if the profile existed or not, because it is possible to delete a
-		// profile without deleting all messages that use it.
-		err = updatePostsForProfile(be, userId, profileId, profileId)
+		if len(profiles) == 0 {
+			return "Your trash is empty.", nil, nil
+		}
+		attachments := attachmentsFromProfiles(be, profiles)
+		for i, profile := range profiles {
+			attachments[i].Text += fmt.Sprintf("\nDeleted %s, will be purged %s.", formatTime(profile.DeletedAt), formatTime(trashPurgeTime(be, profile)))
+		}
+		return "## Deleted character profiles", attachments, nil
+	}
+
+	// `/character restore haddock`: Restore the deleted character profile with identifier `haddock` from the trash.
+	matches = regexp.MustCompile(`^restore ([\pL\pM]+)$`).FindStringSubmatch(query)
+	if matches != nil {
+		profileId := NormalizeIdentifier(matches[1])
+		if IsMe(profileId) {
+			return "", nil, appError("Your real profile cannot be deleted, and therefore not restored either.", nil)
+		}
+		profile, droppedAliases, err := restoreProfile(be, userId, profileId)
 		if err != nil {
 			return "", nil, err
 		}
-		return successMessage, attachmentsFromProfile(be, newProfile), nil
+		successMessage := fmt.Sprintf("Restored character profile `%s`.", profileId)
+		if len(droppedAliases) > 0 {
+			successMessage += fmt.Sprintf(" These aliases are now used for something else and were removed: `%s`.", strings.Join(droppedAliases, "`, `"))
+		}
+		return successMessage, attachmentsFromProfile(be, *profile), nil
 	}
 
-	// `/character delete haddock`: Delete character profile with identifier `haddock`.
-	matches = regexp.MustCompile(`^delete ([a-z]+)$`).FindStringSubmatch(query)
+	// `/character history haddock keep`: Make all future changes to character profile `haddock` leave existing messages as they are.
+	// `/character history haddock rewrite`: Make all future changes to character profile `haddock` update existing messages.
+	matches = regexp.MustCompile(`^history ([\pL\pM]+) (keep|rewrite)$`).FindStringSubmatch(query)
 	if matches != nil {
-		profileId := matches[1]
-		var postCount int
-		if !IsMe(profileId) {
-			var cErr *model.AppError
-			postCount, cErr = countPostsForProfile(be, userId, profileId)
-			if cErr != nil {
-				return "", nil, cErr
-			}
+		profileId := NormalizeIdentifier(matches[1])
+		keepHistory := matches[2] == "keep"
+		if IsMe(profileId) {
+			return "", nil, appError("The history of your real profile is not recorded by this plugin.", nil)
 		}
-		if postCount > 0 && !confirmed {
-			retMsg, retAtt := uiConfirmation(fmt.Sprintf("You are about to delete character profile `%s` which is used by %d existing messages. Soon after deletion, the profile picture for these messages will cease to work, but they will retain their display name. In order to manage those messages again, you can recreate the profile using the same identifier. Are you sure you want to proceed?", profileId, postCount), command, rootId)
-			return retMsg, retAtt, nil
+		profile, err := GetProfile(be, userId, profileId, PROFILE_CHARACTER)
+		if err != nil {
+			return "", nil, err
+		}
+		profileId = profile.Identifier
+		profile.KeepHistory = keepHistory
+		err = setProfile(be, userId, profile)
+		if err != nil {
+			return "", nil, err
 		}
+		if keepHistory {
+			return fmt.Sprintf("Changes to character profile `%s` will leave existing messages as they are.", profileId), nil, nil
+		}
+		return fmt.Sprintf("Changes to character profile `%s` will update existing messages, except those sent before earlier changes that kept the history.", profileId), nil, nil
+	}
+
+	// `/character history haddock`: List the changes to the display name and profile picture of character profile `haddock`.
+	matches = regexp.MustCompile(`^history ([\pL\pM]+)$`).FindStringSubmatch(query)
+	if matches != nil {
+		profileId := NormalizeIdentifier(matches[1])
 		if IsMe(profileId) {
-			return "", nil, appError("Please do not try to delete yourself. If you have suicidal thoughts, call 90101 (Sweden) or +1-800-273-8255 (International).", nil)
+			return "", nil, appError("The history of your real profile is not recorded by this plugin.", nil)
 		}
-		exists, err := profileExists(be, userId, profileId)
+		profileId, err := resolveProfileIdentifier(be, userId, profileId)
 		if err != nil {
 			return "", nil, err
 		}
-		if !exists {
-			return "", nil, appError(fmt.Sprintf("Character profile `%s` does not exist.", profileId), nil)
+		history, err := GetProfileHistory(be, userId, profileId)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(history) == 0 {
+			return fmt.Sprintf("No history is recorded for character profile `%s`.", profileId), nil, nil
+		}
+		return fmt.Sprintf("## History of character profile `%s`\n%s", profileId, describeProfileHistory(history)), nil, nil
+	}
+
+	// `/character alias haddock h`: Add `h` as an alias for character profile `haddock`, so that it can be used wherever `haddock` can.
+	matches = regexp.MustCompile(`^alias ([\pL\pM]+) ([\pL\pM]+)$`).FindStringSubmatch(query)
+	if matches != nil {
+		profileId := NormalizeIdentifier(matches[1])
+		alias := NormalizeIdentifier(matches[2])
+		if IsMe(profileId) {
+			return "", nil, appError("Aliases for your real profile are built in: `me` and `myself`.", nil)
+		}
+		profile, err := addProfileAlias(be, userId, profileId, alias)
+		if err != nil {
+			return "", nil, err
 		}
-		err = deleteProfile(be, userId, profileId)
+		return fmt.Sprintf("Added alias `%s` for character profile `%s`.", alias, profile.Identifier), attachmentsFromProfile(be, *profile), nil
+	}
+
+	// `/character unalias h`: Remove the alias `h`, leaving the character profile it refers to as it is.
+	matches = regexp.MustCompile(`^unalias ([\pL\pM]+)$`).FindStringSubmatch(query)
+	if matches != nil {
+		alias := NormalizeIdentifier(matches[1])
+		profile, err := removeProfileAlias(be, userId, alias)
 		if err != nil {
 			return "", nil, err
 		}
-		return fmt.Sprintf("Deleted character profile `%s`.", profileId), nil, nil
+		return fmt.Sprintf("Removed alias `%s` for character profile `%s`.", alias, profile.Identifier), attachmentsFromProfile(be, *profile), nil
 	}
 
 	// `/character list`: List your character profiles.
@@ -199,179 +226,127 @@ func DoExecuteCommand(be Backend, command, userId, channelId, teamId, rootId str
 	}
 
 	// `/character make haddock into milou`: Unless character profile `milou` already exists, create it with the same display name and profile picture as character profile `haddock`. Then, modify all existing messages that use character profile `haddock` to instead use character profile `milou`, and delete character profile `haddock`.
-	matches = regexp.MustCompile(`^make ([a-z]+) into ([a-z]+)$`).FindStringSubmatch(query)
+	matches = regexp.MustCompile(`^make ([\pL\pM]+) into ([\pL\pM]+)$`).FindStringSubmatch(query)
 	if matches != nil {
-		oldProfileId := matches[1]
-		targetProfileId := matches[2]
-		oldProfile, err := GetProfile(be, userId, oldProfileId, PROFILE_CHARACTER|PROFILE_ME|PROFILE_CORRUPT|PROFILE_NONEXISTENT)
-		if oldProfile == nil && err != nil {
-			return "", nil, err
+		result, err := RenameProfile(be, userId, matches[1], matches[2], confirmed)
+		if IsConfirmationRequired(err) {
+			retMsg, retAtt := uiConfirmation(err.Message, command, rootId)
+			return retMsg, retAtt, nil
 		}
-		targetProfile, err := GetProfile(be, userId, targetProfileId, PROFILE_CHARACTER|PROFILE_ME|PROFILE_CORRUPT|PROFILE_NONEXISTENT)
-		if targetProfile == nil && err != nil {
+		if err != nil {
 			return "", nil, err
 		}
-		var oldCount, targetCount int
-		if !IsMe(oldProfileId) {
-			oldCount, err = countPostsForProfile(be, userId, oldProfileId)
-			if err != nil {
-				return "", nil, err
-			}
-		}
-		if !IsMe(targetProfileId) {
-			targetCount, err = countPostsForProfile(be, userId, targetProfileId)
-			if err != nil {
-				return "", nil, err
-			}
-		}
-		switch oldProfile.Status {
+		successMsg := ""
+		switch result.TargetStatus {
 		case PROFILE_CHARACTER:
-			if oldCount == 0 {
-				return "", nil, appError(fmt.Sprintf("Character profile `%s` isn't used by any messages. You can delete it with `/character delete %s`.", oldProfileId, oldProfileId), nil)
-			}
+			successMsg = fmt.Sprintf("All messages that used character profile `%s` now use character profile `%s` instead. Character profile `%s` has been deleted.", result.OldProfileId, result.Profile.Identifier, result.OldProfileId)
 		case PROFILE_ME:
-			return "", nil, appError("Cannot make your real profile into something else. Use the Mattermost built-in functionality to change the display name or profile picture for your real Mattermost profile.", nil)
-		case PROFILE_CORRUPT:
-			if oldCount == 0 {
-				return "", nil, appError(fmt.Sprintf("Character profile `%s` is corrupt, and isn't used by any messages. You can delete it with `/character delete %s`.", oldProfileId, oldProfileId), nil)
-			}
-			return "", nil, appError(fmt.Sprintf("Character profile `%s` is corrupt, but is still used by %d messages. Before you try to make this character profile into something else, you need to delete and recreate it. The messages will not be affected by deleting the profile.", oldProfileId, oldCount), nil)
+			successMsg = fmt.Sprintf("All messages that used character profile `%s` now use your real profile instead. Character profile `%s` has been deleted.", result.OldProfileId, result.OldProfileId)
 		case PROFILE_NONEXISTENT:
-			if oldCount == 0 {
-				return "", nil, appError(fmt.Sprintf("Character profile `%s` doesn't exist, and isn't used by any messages.", oldProfileId), nil)
-			}
-			return "", nil, appError(fmt.Sprintf("Character profile `%s` doesn't exist, but is still used by %d messages. Create a character profile with this identifier in order to manage those messages.", oldProfileId, oldCount), nil)
-		default:
-			return "", nil, appError("Unexpected profile type", nil)
+			successMsg = fmt.Sprintf("Changed identifier for character profile `%s` to `%s`.", result.OldProfileId, result.Profile.Identifier)
 		}
-		// We now know that oldCount > 0 && oldProfile.Status == PROFILE_CHARACTER
-		switch targetProfile.Status {
-		case PROFILE_CHARACTER:
-			break
-		case PROFILE_ME:
-			break
-		case PROFILE_CORRUPT:
-			return "", nil, appError(fmt.Sprintf("Target character profile `%s` is corrupt.", targetProfileId), nil)
-		case PROFILE_NONEXISTENT:
-			if targetCount > 0 {
-				return "", nil, appError(fmt.Sprintf("Target character profile `%s` doesn't exist, but since it is still used by %d messages you must recreate it before you can make another character profile into it.", targetProfileId, targetCount), nil)
-			}
-		default:
-			return "", nil, appError("Unexpected profile type", nil)
-		}
-		// We now know that oldCount > 0 && oldProfile.Status == PROFILE_CHARACTER && (targetProfile.Status != PROFILE_CORRUPT) && (targetProfile.Status != PROFILE_NONEXISTENT || targetCount == 0)
-		confirmMsg := ""
-		newProfile := targetProfile
-		switch targetProfile.Status {
-		case PROFILE_CHARACTER:
-			confirmMsg = fmt.Sprintf("Target character profile `%s` already exists, and is used by %d messages. Modifying %d messages that currently use character profile `%s` to instead use character profile `%s` isn't easily reversible since the two sets of messages would be mixed together.", targetProfileId, targetCount, oldCount, oldProfileId, targetProfileId)
-		case PROFILE_ME:
-			confirmMsg = fmt.Sprintf("Modifying %d messages that currently use character profile `%s` to instead use your real profile isn't easily reversible since they'd be mixed in with any other messages you have sent using your real profile. Also, messages that use your real profile can only be changed to use a character profile by editing them individually.", oldCount, oldProfileId)
-		case PROFILE_NONEXISTENT:
-			// Create new profile
-			newProfile = &Profile{
-				UserId:        userId,
-				Identifier:    targetProfileId,
-				Name:          oldProfile.Name,
-				PictureFileId: oldProfile.PictureFileId,
-				Status:        PROFILE_CHARACTER,
-				RequestKey:    oldProfile.RequestKey,
-			}
-			neErr := populateProfile(be, newProfile)
-			if neErr != nil {
-				return "", nil, neErr
-			}
-			neErr = newProfile.validate(newProfile.Identifier)
-			if neErr != nil {
-				return "", nil, neErr
-			}
-			neErr = setProfile(be, userId, newProfile)
-			if neErr != nil {
-				return "", nil, neErr
+		return successMsg, attachmentsFromProfile(be, result.Profile), nil
+	}
+
+	// `/character I am haddock`: Set default character profile identifier for the current channel to `haddock`.
+	// `/character I am myself`: Use your real profile in the current channel, even if you have or later set a team or account default.
+	// `/character I am haddock in this team`: Set the default character profile for channels of this team that have no default of their own.
+	// `/character I am haddock everywhere`: Set the default character profile for your account, used in channels with no default of their own or of their team.
+	// `/character I am haddock for 2h`: Set the default character profile for the current channel to `haddock` for two hours.
+	// `/character I am haddock until I leave the channel`: Set the default character profile for the current channel to `haddock` until you leave the channel.
+	matches = regexp.MustCompile(`^I am ([\pL\pM]+)( in this team| everywhere)?( for (.+)| until I leave the channel)?$`).FindStringSubmatch(query)
+	if matches != nil && matches[2] != "" && matches[3] != "" {
+		return "", nil, appError("Only the default character profile of a channel can expire.", nil)
+	}
+	if matches != nil && matches[3] != "" {
+		var expireAt int64
+		if matches[4] != "" {
+			duration, ok := parseShortDuration(matches[4])
+			if !ok {
+				return "", nil, appError(fmt.Sprintf("Could not understand `%s`. Give a duration such as `90m`, `2h`, `2d` or `1w`.", matches[4]), nil)
 			}
+			expireAt = be.GetMillis() + duration.Milliseconds()
 		}
-		if !confirmed && confirmMsg != "" {
-			retMsg, retAtt := uiConfirmation(fmt.Sprintf("%s Are you sure you want to continue?", confirmMsg), command, rootId)
-			return retMsg, retAtt, nil
-		}
-		// Update all existing messages that uses the old profile.
-		newProfileId := newProfile.Identifier
-		err = updatePostsForProfile(be, userId, oldProfileId, newProfileId)
+		newProfile, expiry, err := SetExpiringDefaultProfile(be, userId, channelId, matches[1], expireAt)
 		if err != nil {
 			return "", nil, err
 		}
-		// Delete old profile
-		err = deleteProfile(be, userId, oldProfileId)
+		return fmt.Sprintf("You are now known as \"%s\"%s.", newProfile.Name, describeDefaultProfileExpiry(expiry)), attachmentsFromProfile(be, *newProfile), nil
+	}
+	if matches != nil && matches[2] != "" {
+		var oldProfileId string
+		var newProfile *Profile
+		var err *model.AppError
+		where := "in this team"
+		if matches[2] == " everywhere" {
+			where = "everywhere"
+			oldProfileId, newProfile, err = SetGlobalDefaultProfile(be, userId, matches[1])
+		} else {
+			if teamId == "" {
+				return "", nil, appError("This channel is not part of a team.", nil)
+			}
+			oldProfileId, newProfile, err = SetTeamDefaultProfile(be, userId, teamId, matches[1])
+		}
 		if err != nil {
 			return "", nil, err
 		}
-		successMsg := ""
-		switch targetProfile.Status {
-		case PROFILE_CHARACTER:
-			successMsg = fmt.Sprintf("All messages that used character profile `%s` now use character profile `%s` instead. Character profile `%s` has been deleted.", oldProfileId, targetProfileId, oldProfileId)
-		case PROFILE_ME:
-			successMsg = fmt.Sprintf("All messages that used character profile `%s` now use your real profile instead. Character profile `%s` has been deleted.", oldProfileId, oldProfileId)
-		case PROFILE_NONEXISTENT:
-			successMsg = fmt.Sprintf("Changed identifier for character profile `%s` to `%s`.", oldProfileId, newProfileId)
+		if newProfile.Status == PROFILE_ME {
+			if oldProfileId == "" {
+				return fmt.Sprintf("You have no default character profile %s.", where), nil, nil
+			}
+			return fmt.Sprintf("Removed your default character profile %s.", where), nil, nil
+		}
+		if oldProfileId == newProfile.Identifier {
+			return fmt.Sprintf("\"%s\" is already your default character profile %s.", newProfile.Name, where), nil, nil
 		}
-		return successMsg, attachmentsFromProfile(be, *newProfile), nil
+		if where == "everywhere" {
+			return fmt.Sprintf("You are now known as \"%s\" everywhere, except in teams and channels with a default of their own.", newProfile.Name), attachmentsFromProfile(be, *newProfile), nil
+		}
+		return fmt.Sprintf("You are now known as \"%s\" in this team, except in channels with a default of their own.", newProfile.Name), attachmentsFromProfile(be, *newProfile), nil
 	}
-
-	// `/character I am haddock`: Set default character profile identifier for the current channel to `haddock`.
-	// `/character I am myself`: Remove the default character profile for the current channel.
-	matches = regexp.MustCompile(`^I am ([a-z]+)$`).FindStringSubmatch(query)
 	if matches != nil {
-		newProfileId := matches[1]
-		oldProfileId, err := getDefaultProfileIdentifier(be, userId, channelId)
+		oldProfileId, newProfile, err := SetDefaultProfile(be, userId, channelId, matches[1])
 		if err != nil {
 			return "", nil, err
 		}
-		if IsMe(newProfileId) {
+		if newProfile.Status == PROFILE_ME {
 			if IsMe(oldProfileId) {
 				return "You are already yourself. Multiplicity was a fun movie, but let's leave it at that.", nil, nil
 			}
-			err := removeDefaultProfile(be, userId, channelId)
-			if err != nil {
-				return "", nil, err
-			}
-			realProfile, err := GetProfile(be, userId, "", PROFILE_ME)
-			if err != nil {
-				return "", nil, err
-			}
-			return "You are now yourself again. Hope that feels ok.", attachmentsFromProfile(be, *realProfile), nil
-		} else {
-			newProfile, err := setDefaultProfileIdentifier(be, userId, channelId, newProfileId)
-			if err != nil {
-				return "", nil, err
-			}
-			if newProfile == nil {
-				return "", nil, appError(fmt.Sprintf("Could not fetch profile `%s`.", newProfileId), nil)
-			}
-			if oldProfileId == newProfileId {
-				return fmt.Sprintf("You are already \"%s\", and if that's not enough you should've rolled better stats.", newProfile.Name), nil, nil
-			}
-			return fmt.Sprintf("You are now known as \"%s\".", newProfile.Name), attachmentsFromProfile(be, *newProfile), nil
+			return "You are now yourself again. Hope that feels ok.", attachmentsFromProfile(be, *newProfile), nil
+		}
+		if oldProfileId == newProfile.Identifier {
+			return fmt.Sprintf("You are already \"%s\", and if that's not enough you should've rolled better stats.", newProfile.Name), nil, nil
 		}
+		return fmt.Sprintf("You are now known as \"%s\".", newProfile.Name), attachmentsFromProfile(be, *newProfile), nil
 	}
 
-	// `/character who am I`: List default character profiles for the channels in this team.
+	// `/character who am I`: List default character profiles for the channels in this team, and whether each is set for the channel, the team or the account.
 	if query == "who am I" {
 		channels, err := be.GetChannelsForTeamForUser(teamId, userId, false)
 		if err != nil {
 			return "", nil, err
 		}
-		profileIdToChannelMentions := map[string][]string{}
+		// Channel mentions by default profile identifier and level.
+		profileIdToChannelMentions := map[string]map[string][]string{}
 		// Get default profile identifiers for all channels in this team.
 		for _, channel := range channels {
-			defaultProfileIdentifier, err := getDefaultProfileIdentifier(be, userId, channel.Id)
+			defaultProfileIdentifier, level, err := getEffectiveDefaultProfileInTeam(be, userId, channel.Id, channel.TeamId)
 			if err != nil {
 				return "", nil, err
 			}
+			if level == "" {
+				// The real profile is used since no default is set.
+				level = DEFAULT_LEVEL_CHANNEL
+			}
 			channelMention, err := channelMention(be, channel, userId, teamId)
 			if err != nil {
 				return "", nil, err
 			}
-			profileIdToChannelMentions[defaultProfileIdentifier] = append(profileIdToChannelMentions[defaultProfileIdentifier], channelMention)
+			if profileIdToChannelMentions[defaultProfileIdentifier] == nil {
+				profileIdToChannelMentions[defaultProfileIdentifier] = map[string][]string{}
+			}
+			profileIdToChannelMentions[defaultProfileIdentifier][level] = append(profileIdToChannelMentions[defaultProfileIdentifier][level], channelMention)
 		}
 		// Get profiles for all default profile identifiers and sort them.
 		profiles := []Profile{}
@@ -389,22 +364,321 @@ func DoExecuteCommand(be Backend, command, userId, channelId, teamId, rootId str
 		attachments := make([]*model.SlackAttachment, len(profiles))
 		for i, profile := range profiles {
 			profileId := profile.Identifier
-			channelMentions := profileIdToChannelMentions[profileId]
-			sortChannelMentions(channelMentions)
-			// Join channel mentions with commas.
-			channelNamesString := "\nDefault profile in: " + strings.Join(channelMentions, ", ")
 			attachment := attachmentFromProfile(be, profile)
-			attachment.Text += channelNamesString
+			for _, level := range []struct{ level, label string }{
+				{DEFAULT_LEVEL_CHANNEL, "Default profile in"},
+				{DEFAULT_LEVEL_TEAM, "Team default in"},
+				{DEFAULT_LEVEL_GLOBAL, "Account default in"},
+			} {
+				channelMentions := profileIdToChannelMentions[profileId][level.level]
+				if len(channelMentions) == 0 {
+					continue
+				}
+				sortChannelMentions(channelMentions)
+				// Join channel mentions with commas.
+				attachment.Text += fmt.Sprintf("\n%s: %s", level.label, strings.Join(channelMentions, ", "))
+			}
 			attachments[i] = attachment
 		}
-		return "## Default character profiles", attachments, nil
+		response := "## Default character profiles"
+		teamProfileId, err := getDefaultProfileIdentifierForKey(be, getTeamDefaultProfileKey(userId, teamId))
+		if err != nil {
+			return "", nil, err
+		}
+		if teamProfileId != "" {
+			response += fmt.Sprintf("\nTeam default: `%s`", teamProfileId)
+		}
+		globalProfileId, err := getDefaultProfileIdentifierForKey(be, getGlobalDefaultProfileKey(userId))
+		if err != nil {
+			return "", nil, err
+		}
+		if globalProfileId != "" {
+			response += fmt.Sprintf("\nAccount default: `%s`", globalProfileId)
+		}
+		return response, attachments, nil
+	}
+
+	// `/character cast`: List the default character profiles of the members of the current channel, and other character profiles used there during the last week.
+	if query == "cast" {
+		if !be.HasPermissionToChannel(userId, channelId, model.PERMISSION_READ_CHANNEL) {
+			return "", nil, appError("You cannot read this channel.", nil)
+		}
+		cast, err := GetCast(be, channelId)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(cast) == 0 {
+			return "No character profiles are active in this channel.", nil, nil
+		}
+		return "## Cast of this channel", attachmentsFromCast(be, cast), nil
+	}
+
+	// `/character cast hide`: Leave your character profiles out of `/character cast` and the statistics of channels in all channels.
+	// `/character cast show`: List your character profiles in `/character cast` and the statistics of channels again.
+	if query == "cast hide" || query == "cast show" {
+		hide := query == "cast hide"
+		err := setCastOptOut(be, userId, hide)
+		if err != nil {
+			return "", nil, err
+		}
+		if hide {
+			return "Your character profiles will no longer be listed by `/character cast` or in the statistics of channels.", nil, nil
+		}
+		return "Your character profiles will be listed by `/character cast` and in the statistics of channels again.", nil, nil
+	}
+
+	// `/character assign @alice as haddock`: Make the character profile `haddock` of user `alice` their default in the current channel, copying your own `haddock` to them if they have none. Only for channel admins. The user is told in a direct message from the plugin's bot account, and can decline.
+	matches = regexp.MustCompile(`^assign @([a-z0-9._-]+) as ([\pL\pM]+)$`).FindStringSubmatch(query)
+	if matches != nil {
+		user, profile, err := AssignProfile(be, userId, channelId, matches[1], matches[2])
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("@%s is now known as \"%s\" in this channel, unless they decline.", user.Username, profile.Name), attachmentsFromProfile(be, *profile), nil
+	}
+
+	// `/character decline`: Decline the character profile assigned to you in the current channel, going back to your earlier default.
+	matches = regexp.MustCompile(`^decline( ([a-z0-9]{26}))?$`).FindStringSubmatch(query)
+	if matches != nil {
+		declineChannelId := channelId
+		if matches[2] != "" {
+			declineChannelId = matches[2]
+		}
+		assignment, err := DeclineAssignment(be, userId, declineChannelId)
+		if err != nil {
+			return "", nil, err
+		}
+		profile, err := GetProfile(be, userId, assignment.Previous, PROFILE_CHARACTER|PROFILE_ME)
+		if err != nil || profile.Status == PROFILE_ME {
+			profile, err = GetProfile(be, userId, "", PROFILE_ME)
+			if err != nil {
+				return "", nil, err
+			}
+			return fmt.Sprintf("Declined character profile `%s`. You are yourself again.", assignment.Identifier), attachmentsFromProfile(be, *profile), nil
+		}
+		return fmt.Sprintf("Declined character profile `%s`. You are known as \"%s\" again.", assignment.Identifier, profile.Name), attachmentsFromProfile(be, *profile), nil
+	}
+
+	// `/character message edit https://example.com/team/pl/abc... Hello`: Replace the text of a message posted by the bot account on your behalf, which Mattermost does not let you edit.
+	matches = regexp.MustCompile(`^message edit (\S+) (.+)$`).FindStringSubmatch(query)
+	if matches != nil {
+		err := EditBotPost(be, userId, matches[1], matches[2])
+		if err != nil {
+			return "", nil, err
+		}
+		return "Edited the message.", nil, nil
+	}
+
+	// `/character message delete https://example.com/team/pl/abc...`: Delete a message posted by the bot account on your behalf, which Mattermost does not let you delete.
+	matches = regexp.MustCompile(`^message delete (\S+)$`).FindStringSubmatch(query)
+	if matches != nil {
+		err := DeleteBotPost(be, userId, matches[1])
+		if err != nil {
+			return "", nil, err
+		}
+		return "Deleted the message.", nil, nil
+	}
+
+	// `/character stats`: Show for each of your character profiles how many messages and words have been posted with it, in how many channels, and when it was first and last used.
+	// `/character stats ~town-square`: Show which character profiles have been most active in channel `town-square`.
+	matches = regexp.MustCompile(`^stats( ~([a-z0-9_-]+))?$`).FindStringSubmatch(query)
+	if matches != nil {
+		if matches[2] == "" {
+			response, err := describeProfileStats(be, userId)
+			return response, nil, err
+		}
+		channel, err := be.GetChannelByName(teamId, matches[2], false)
+		if err != nil || channel == nil || !be.HasPermissionToChannel(userId, channel.Id, model.PERMISSION_READ_CHANNEL) {
+			return "", nil, appError(fmt.Sprintf("Could not find channel ~%s.", matches[2]), nil)
+		}
+		response, err := describeChannelStats(be, channel)
+		return response, nil, err
+	}
+
+	// `/character search haddock "barnacles"`: List links to your messages using character profile `haddock` that contain `barnacles`. The quotes are optional, and without a text all messages using the profile are listed.
+	// `/character search haddock in ~town-square "barnacles"`: Only search messages in channel `town-square`.
+	matches = regexp.MustCompile(`^search ([\pL\pM]+)( in ~([a-z0-9_-]+))?( "([^"]*)"| ([^"].*?))?( after ([a-z0-9]{26}))?$`).FindStringSubmatch(query)
+	if matches != nil {
+		profile, err := GetProfile(be, userId, NormalizeIdentifier(matches[1]), PROFILE_CHARACTER|PROFILE_CORRUPT|PROFILE_NONEXISTENT)
+		if err != nil {
+			return "", nil, err
+		}
+		channelName := matches[3]
+		searchChannelId := ""
+		if channelName != "" {
+			channel, err := be.GetChannelByName(teamId, channelName, false)
+			if err != nil || channel == nil || !be.HasPermissionToChannel(userId, channel.Id, model.PERMISSION_READ_CHANNEL) {
+				return "", nil, appError(fmt.Sprintf("Could not find channel ~%s.", channelName), nil)
+			}
+			searchChannelId = channel.Id
+		}
+		text := matches[5] + matches[6]
+		result, err := SearchProfilePosts(be, userId, profile.Identifier, searchChannelId, text, matches[8])
+		if err != nil {
+			return "", nil, err
+		}
+		description := fmt.Sprintf("messages using character profile `%s`", profile.Identifier)
+		if channelName != "" {
+			description += " in ~" + channelName
+		}
+		if text != "" {
+			description += fmt.Sprintf(" containing \"%s\"", text)
+		}
+		if len(result.Posts) == 0 {
+			if matches[8] != "" {
+				return fmt.Sprintf("There are no more %s.", description), nil, nil
+			}
+			return fmt.Sprintf("There are no %s.", description), nil, nil
+		}
+		response := fmt.Sprintf("## Your %s\n%s", description, describeSearchResult(be, result, teamId))
+		if result.NextAfter == "" {
+			return response, nil, nil
+		}
+		return response, uiNextPage(searchCommand(profile.Identifier, channelName, text, result.NextAfter), rootId), nil
+	}
+
+	// `/character token create vtt bridge`: Create a token for the webhook endpoint, letting external tools post messages as your character profiles. The name is optional and only shown in `/character token list`.
+	matches = regexp.MustCompile(`^token create( (.+))?$`).FindStringSubmatch(query)
+	if matches != nil {
+		token, t, err := createWebhookToken(be, userId, strings.TrimSpace(matches[2]))
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("Created token `%s`. Copy it now, since it cannot be shown again:\n```\n%s\n```\nExternal tools can use it to post messages as your character profiles by sending a POST request to `%s` with the header `X-Character-Token: <token>` and a JSON body such as `{\"channel\": \"<channel id>\", \"profile\": \"haddock\", \"message\": \"Hello\", \"root_id\": \"\"}`. Anyone who has the token can post as you, so revoke it with `/character token revoke %s` if it leaks.", t.Id(), token, WebhookURL(be), t.Id()), nil, nil
+	}
+
+	// `/character token list`: List your tokens for the webhook endpoint.
+	if query == "token list" {
+		tokens, err := listWebhookTokens(be, userId)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(tokens) == 0 {
+			return "You have no tokens. Create one with `/character token create`.", nil, nil
+		}
+		return "## Tokens\n" + describeWebhookTokens(tokens), nil, nil
+	}
+
+	// `/character token revoke 1a2b3c4d`: Revoke a token for the webhook endpoint, so that it can no longer be used.
+	matches = regexp.MustCompile(`^token revoke (\S+)$`).FindStringSubmatch(query)
+	if matches != nil {
+		t, err := revokeWebhookToken(be, userId, matches[1])
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("Revoked token `%s`.", t.Id()), nil, nil
+	}
+
+	// `/character transcript`: Export the channel as Markdown, HTML and JSON files showing which character posted each message. Run it in a thread to export only the thread. The files are sent to you in a direct message from the plugin's bot account.
+	// `/character transcript since 3h`: Export only messages from the last three hours. The time can also be given as e.g. `2020-09-13 12:26` (UTC) or `2020-09-13`.
+	matches = regexp.MustCompile(`^transcript( since (.+))?$`).FindStringSubmatch(query)
+	if matches != nil {
+		since := int64(0)
+		if matches[2] != "" {
+			var err *model.AppError
+			since, err = parseTranscriptSince(be, matches[2])
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		if rootId != "" {
+			root, err := GetPostIfExists(be, rootId)
+			if err != nil {
+				return "", nil, err
+			}
+			if root != nil && root.RootId != "" {
+				rootId = root.RootId
+			}
+		}
+		transcript, err := SendTranscript(be, userId, channelId, rootId, since)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("Sent you a transcript of %d messages in a direct message from @%s.", len(transcript.Messages), BOT_USERNAME), nil, nil
+	}
+
+	// `/character scene start "The Black Island"`: Start a scene in the channel, as a channel admin. Until it is ended, messages in the channel are tagged with the scene, so that its transcript can be exported. The quotes are optional.
+	matches = regexp.MustCompile(`^scene start( "(.+)"| ([^"].*))$`).FindStringSubmatch(query)
+	if matches != nil {
+		scene, err := StartScene(be, userId, channelId, matches[2]+matches[3])
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("Started scene \"%s\". Messages in this channel are now part of it until `/character scene end`.", scene.Title), nil, nil
+	}
+
+	// `/character scene end`: End the running scene in the channel, as a channel admin or whoever started it.
+	if query == "scene end" {
+		scene, err := EndScene(be, userId, channelId)
+		if err != nil {
+			return "", nil, err
+		}
+		count, err := countScenePosts(be, scene)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("Ended scene \"%s\" with %d messages. Export it with `/character scene export`.", scene.Title, count), nil, nil
+	}
+
+	// `/character scene list`: List the scenes of the channel.
+	if query == "scene list" {
+		scenes, err := listScenes(be, channelId)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(scenes) == 0 {
+			return "There are no scenes in this channel. Start one with `/character scene start`.", nil, nil
+		}
+		response, err := describeScenes(be, scenes)
+		if err != nil {
+			return "", nil, err
+		}
+		return "## Scenes\n" + response, nil, nil
+	}
+
+	// `/character scene export`: Export the latest scene of the channel as Markdown, HTML and JSON files with its cast list. The files are sent to you in a direct message from the plugin's bot account.
+	// `/character scene export 2`: Export the second scene in `/character scene list`.
+	matches = regexp.MustCompile(`^scene export( ([1-9][0-9]*))?$`).FindStringSubmatch(query)
+	if matches != nil {
+		scenes, err := listScenes(be, channelId)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(scenes) == 0 {
+			return "", nil, appError("There are no scenes in this channel.", nil)
+		}
+		number := len(scenes)
+		if matches[2] != "" {
+			number, _ = strconv.Atoi(matches[2])
+			if number > len(scenes) {
+				return "", nil, appError(fmt.Sprintf("There is no scene %d in this channel. See `/character scene list`.", number), nil)
+			}
+		}
+		scene := scenes[number-1]
+		transcript, err := SendSceneTranscript(be, userId, &scene, number)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("Sent you a transcript of scene \"%s\" with %d messages and %d characters in a direct message from @%s.", scene.Title, len(transcript.Messages), len(transcript.Cast), BOT_USERNAME), nil, nil
+	}
+
+	// `/character admin rotate-secret`: Replace the secret used to sign links to character profile pictures. Links in existing messages are renewed within a few minutes. Only for system administrators.
+	if query == "admin rotate-secret" {
+		if !be.HasPermissionTo(userId, model.PERMISSION_MANAGE_SYSTEM) {
+			return "", nil, appError("Only system administrators can rotate the secret.", nil)
+		}
+		err := RotateURLSigningSecret(be)
+		if err != nil {
+			return "", nil, err
+		}
+		return "Rotated the secret used to sign links to character profile pictures. Links in existing messages will be renewed within a few minutes, after which links signed with the old secret stop working.", nil, nil
 	}
 
 	// Undocumented command to corrupt a profile, for testing purposes.
-	matches = regexp.MustCompile(`^corrupt([123]) ([a-z]+)$`).FindStringSubmatch(query)
+	matches = regexp.MustCompile(`^corrupt([123]) ([\pL\pM]+)$`).FindStringSubmatch(query)
 	if matches != nil {
 		corruptionMethod := matches[1]
-		profileId := matches[2]
+		profileId := NormalizeIdentifier(matches[2])
 		err := corruptProfile(be, userId, profileId, corruptionMethod)
 		if err != nil {
 			return "", nil, err
@@ -415,12 +689,58 @@ func DoExecuteCommand(be Backend, command, userId, channelId, teamId, rootId str
 	return "", nil, appError("Unrecognized command. Try `/character help`.", nil)
 }
 
+// describeSavedProfile returns a message describing how a profile was saved
+// with the given changes.
+func describeSavedProfile(result *SaveProfileResult, changes ProfileChanges) string {
+	profile := result.Profile
+	oldProfile := result.OldProfile
+	if oldProfile == nil {
+		message := fmt.Sprintf("Character profile `%s` created with display name \"%s\"", profile.Identifier, profile.Name)
+		if changes.PictureFileId != nil {
+			message += " and a profile picture"
+		}
+		if changes.Color != nil {
+			message += " and avatar color " + describeAvatarColor(profile.Color)
+		}
+		return message
+	}
+	message := fmt.Sprintf("Character profile `%s` modified by", profile.Identifier)
+	if changes.Name != nil {
+		if oldProfile.Name == profile.Name {
+			message += fmt.Sprintf(" setting the display name to \"%s\" (same as before)", profile.Name)
+		} else {
+			message += fmt.Sprintf(" changing the display name from \"%s\" to \"%s\"", oldProfile.Name, profile.Name)
+		}
+	}
+	if changes.PictureFileId != nil {
+		if changes.Name != nil {
+			message += " and"
+		}
+		if oldProfile.PictureFileId == profile.PictureFileId && oldProfile.PictureCrop == profile.PictureCrop {
+			message += " updating the profile picture (to the same as before)"
+		} else {
+			message += " updating the profile picture"
+		}
+	}
+	if changes.Color != nil {
+		if changes.Name != nil || changes.PictureFileId != nil {
+			message += " and"
+		}
+		message += " setting the avatar color to " + describeAvatarColor(profile.Color)
+	}
+	if result.KeptHistory {
+		message += ". Existing messages keep the display name and profile picture they were sent with"
+	}
+	return message
+}
+
 func attachmentFromProfile(be Backend, profile Profile) *model.SlackAttachment {
-	thumbUrl := profileIconUrl(be, profile, true)
+	// A missing thumbnail is not worth failing the command for.
+	thumbUrl, _ := profileIconUrl(be, profile, true)
 	switch profile.Status {
 	case PROFILE_CHARACTER:
 		return &model.SlackAttachment{
-			Text:     fmt.Sprintf("**%s**\n`%s`", profile.Name, profile.Identifier),
+			Text:     fmt.Sprintf("**%s**\n`%s`", profile.Name, strings.Join(append([]string{profile.Identifier}, profile.Aliases...), "`, `")),
 			ThumbURL: thumbUrl,
 			Color:    "#5c66ff",
 		}
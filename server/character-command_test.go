@@ -64,13 +64,6 @@ func TestScenario1(t *testing.T) {
 	}
 	pluginURL := main.GetPluginURL(be)
 	var (
-		characterImg = func(thumb bool) string {
-			if thumb {
-				return pluginURL + "/static/defaultprofilepicture/thumbnail"
-			} else {
-				return pluginURL + "/static/defaultprofilepicture"
-			}
-		}
 		nosign = func(thumb bool) string {
 			if thumb {
 				return pluginURL + "/static/corruptedprofilepicture/thumbnail"
@@ -88,12 +81,7 @@ func TestScenario1(t *testing.T) {
 				if profile == nil {
 					return "ERROR: profile not found"
 				}
-				rk := profile.RequestKey
-				t := ""
-				if thumb {
-					t = "/thumbnail"
-				}
-				return fmt.Sprintf("%s/plugins/%s/profile/%s/%s%s?rk=%s", be.GetSiteURL(), main.PLUGIN_ID, userId, profileIdentifier, t, rk)
+				return signedImageURL(t, be, userId, profileIdentifier, profile.Version, profile.RequestKey, thumb)
 			}
 		}
 		user1haddockImg = characterImage(be, user1, "haddock")
@@ -112,16 +100,16 @@ func TestScenario1(t *testing.T) {
 	cmd(t, be, "/character someone=Someone", user1, channel1, team1, "",
 		"Character profile `someone` created with display name \"Someone\"",
 		[]tAtt{{"**Someone**\n`someone`",
-			blue, characterImg},
+			blue, avatarImg(be, "someone", "Someone")},
 		})
 	cmd(t, be, "/character delete someone", user1, channel1, team1, "",
-		"Deleted character profile `someone`.",
+		"Deleted character profile `someone`. You can restore it with `/character restore someone` within 30 days.",
 		[]tAtt{})
 	// Create a new profile, then set its profile picture in a separate command
 	cmd(t, be, "/character haddock=Captain Haddock", user1, channel1, team1, "",
 		"Character profile `haddock` created with display name \"Captain Haddock\"",
 		[]tAtt{{"**Captain Haddock**\n`haddock`",
-			blue, characterImg},
+			blue, avatarImg(be, "haddock", "Captain Haddock")},
 		})
 	cmd(t, be, "/character picture haddock", user1, channel1, team1, post1,
 		"Character profile `haddock` modified by updating the profile picture",
@@ -204,7 +192,7 @@ func TestScenario1(t *testing.T) {
 		})
 	// Delete the second profile
 	cmd(t, be, "/character delete milou", user1, channel1, team1, "",
-		"Deleted character profile `milou`.",
+		"Deleted character profile `milou`. You can restore it with `/character restore milou` within 30 days.",
 		[]tAtt{})
 	// List default profiles for user1
 	cmd(t, be, "/character who am I", user1, channel1, team1, "",
@@ -357,12 +345,12 @@ func TestScenario1(t *testing.T) {
 				cmd(t, be, fmt.Sprintf("/character %s=%s", pId, pName), user1, channel, team1, "",
 					fmt.Sprintf("Character profile `%s` created with display name \"%s\"", pId, pName),
 					[]tAtt{{"**" + pName + "**\n`" + pId + "`",
-						blue, characterImg},
+						blue, avatarImg(be, pId, pName)},
 					})
 				message = fmt.Sprintf("%s: Test message from %s", pId, pName)
 			}
 			for i := 0; i < postCount; i++ {
-				postId := post(t, be, &model.Post{UserId: user1, ChannelId: channel, Message: message}, pId, pName, characterImg)
+				postId := post(t, be, &model.Post{UserId: user1, ChannelId: channel, Message: message}, pId, pName, avatarImg(be, pId, pName))
 				pPostIds = append(pPostIds, postId)
 			}
 			switch status {
@@ -377,7 +365,7 @@ func TestScenario1(t *testing.T) {
 			case main.PROFILE_NONEXISTENT:
 				// Delete the profile
 				cmd(t, be, fmt.Sprintf("/character delete %s", pId), user1, channel, team1, "",
-					fmt.Sprintf("Deleted character profile `%s`.", pId),
+					fmt.Sprintf("Deleted character profile `%s`. You can restore it with `/character restore %s` within 30 days.", pId, pId),
 					[]tAtt{},
 				)
 			}
@@ -415,12 +403,12 @@ func TestScenario1(t *testing.T) {
 			switch resProfile {
 			case OLD:
 				att = []tAtt{{"**" + p1Name + "**\n`" + p2Id + "`",
-					blue, characterImg},
+					blue, avatarImg(be, p2Id, p1Name)},
 				}
 				resName = p1Name
 			case NEW:
 				att = []tAtt{{"**" + p2Name + "**\n`" + p2Id + "`",
-					blue, characterImg},
+					blue, avatarImg(be, p2Id, p2Name)},
 				}
 				resName = p2Name
 				if main.IsMe(p2Id) {
@@ -449,7 +437,7 @@ func TestScenario1(t *testing.T) {
 type tAtt struct {
 	Text      string
 	Color     string
-	GetImgURL func(thumb bool) string
+	GetImgURL func(thumb bool) string // nil to skip checking the image URL
 }
 
 func cmd(t *testing.T, be main.Backend, command, userId, channelId, teamId, rootId string,
@@ -463,7 +451,9 @@ func cmd(t *testing.T, be main.Backend, command, userId, channelId, teamId, root
 	for i, expectedAttachment := range expectedAttachments {
 		assert.Equal(t, expectedAttachment.Text, attachments[i].Text, msg)
 		assert.Equal(t, expectedAttachment.Color, attachments[i].Color, msg)
-		assert.Equal(t, expectedAttachment.GetImgURL(true), attachments[i].ThumbURL, msg)
+		if expectedAttachment.GetImgURL != nil {
+			assert.Equal(t, expectedAttachment.GetImgURL(true), attachments[i].ThumbURL, msg)
+		}
 	}
 }
 
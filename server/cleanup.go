@@ -0,0 +1,292 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// When a user leaves a channel or a team, their default profiles there are
+// removed, along with the expiry and assignment that belong to them. When a
+// user is deactivated, a periodic job removes all their default profiles and
+// keeps, archives or purges their character profiles, as set by the system
+// administrator. Archived profiles are restored if the user is reactivated.
+//
+// The channels and teams where a user has a default are recorded in string
+// sets, so that they can be found without listing the whole KV store. The sets
+// are filled in for defaults set before they existed by a periodic job that
+// only runs once.
+
+const DEACTIVATED_USERS_JOB = "deactivatedusers"
+
+const DEFAULT_INDEX_JOB = "indexdefaults"
+
+const DEFAULT_INDEX_DONE_KEY = "defaultindexdone"
+
+func getDefaultChannelsKey(userId string) string {
+	return "defaultchannels_" + userId
+}
+
+func getDefaultTeamsKey(userId string) string {
+	return "defaultteams_" + userId
+}
+
+// getArchivedProfilesKey returns the key of the string set of profiles that
+// were moved to the trash when the user was deactivated.
+func getArchivedProfilesKey(userId string) string {
+	return "archivedprofiles_" + userId
+}
+
+// IndexDefaults adds the channels and teams of all default profiles to the
+// string sets of their users. This is only done once, since the sets are kept
+// up to date when defaults are set.
+func IndexDefaults(be Backend) *model.AppError {
+	done, err := be.KVGet(DEFAULT_INDEX_DONE_KEY)
+	if err != nil {
+		return err
+	}
+	if done != nil {
+		return nil
+	}
+	for prefix, getKey := range map[string]func(string) string{
+		"defaultprofile_":     getDefaultChannelsKey,
+		"teamdefaultprofile_": getDefaultTeamsKey,
+	} {
+		keys, err := KVListWithPrefix(be, prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			parts := strings.Split(strings.TrimPrefix(key, prefix), "_")
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				continue
+			}
+			err = StrsetInsert(be, getKey(parts[0]), parts[1])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return be.KVSet(DEFAULT_INDEX_DONE_KEY, []byte("1"))
+}
+
+// clearChannelDefault removes the default profile of a user in a channel,
+// along with its expiry and assignment.
+func clearChannelDefault(be Backend, userId, channelId string) *model.AppError {
+	err := removeDefaultProfileExpiry(be, userId, channelId)
+	if err != nil {
+		return err
+	}
+	err = be.KVDelete(getAssignmentKey(userId, channelId))
+	if err != nil {
+		return err
+	}
+	return removeDefaultProfile(be, userId, channelId)
+}
+
+// clearTeamDefault removes the default profile of a user in a team.
+func clearTeamDefault(be Backend, userId, teamId string) *model.AppError {
+	err := be.KVDelete(getTeamDefaultProfileKey(userId, teamId))
+	if err != nil {
+		return err
+	}
+	return StrsetRemove(be, getDefaultTeamsKey(userId), teamId)
+}
+
+// UserLeftChannel removes the default profile of a user in a channel they have
+// left.
+func UserLeftChannel(be Backend, userId, channelId string) *model.AppError {
+	return clearChannelDefault(be, userId, channelId)
+}
+
+// UserLeftTeam removes the default profiles of a user in a team they have left,
+// and in its channels.
+func UserLeftTeam(be Backend, userId, teamId string) *model.AppError {
+	channelIds, err := StrsetGet(be, getDefaultChannelsKey(userId))
+	if err != nil {
+		return err
+	}
+	for _, channelId := range channelIds {
+		channel, _ := be.GetChannel(channelId)
+		if channel == nil || channel.TeamId != teamId {
+			continue
+		}
+		err = clearChannelDefault(be, userId, channelId)
+		if err != nil {
+			return err
+		}
+	}
+	return clearTeamDefault(be, userId, teamId)
+}
+
+// clearAllDefaults removes all default profiles of a user.
+func clearAllDefaults(be Backend, userId string) *model.AppError {
+	channelIds, err := StrsetGet(be, getDefaultChannelsKey(userId))
+	if err != nil {
+		return err
+	}
+	for _, channelId := range channelIds {
+		err = clearChannelDefault(be, userId, channelId)
+		if err != nil {
+			return err
+		}
+	}
+	teamIds, err := StrsetGet(be, getDefaultTeamsKey(userId))
+	if err != nil {
+		return err
+	}
+	for _, teamId := range teamIds {
+		err = clearTeamDefault(be, userId, teamId)
+		if err != nil {
+			return err
+		}
+	}
+	return be.KVDelete(getGlobalDefaultProfileKey(userId))
+}
+
+// restoreArchivedProfiles moves the archived profiles of a reactivated user
+// back from the trash. A profile that cannot be restored, since its identifier
+// has been taken, stays in the trash for the whole retention period.
+func restoreArchivedProfiles(be Backend, userId string) *model.AppError {
+	profileIds, err := StrsetGet(be, getArchivedProfilesKey(userId))
+	if err != nil {
+		return err
+	}
+	for _, profileId := range profileIds {
+		_, _, rErr := restoreProfile(be, userId, profileId)
+		if rErr == nil {
+			continue
+		}
+		b, err := be.KVGet(getTrashedProfileKey(userId, profileId))
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			continue
+		}
+		profile, dErr := DecodeProfileFromByte(b)
+		if dErr != nil {
+			continue
+		}
+		profile.DeletedAt = be.GetMillis()
+		err = be.KVSet(getTrashedProfileKey(userId, profileId), profile.EncodeToByte())
+		if err != nil {
+			return err
+		}
+	}
+	return be.KVDelete(getArchivedProfilesKey(userId))
+}
+
+// forgetProfilePosts removes the record of which messages and channels a
+// purged character profile was used in.
+func forgetProfilePosts(be Backend, userId, profileId string) *model.AppError {
+	postIds := []string{}
+	err := IdsetIter(be, getIdsetKey(userId, profileId), "", 0, func(postId string) *model.AppError {
+		postIds = append(postIds, postId)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, postId := range postIds {
+		err = IdsetRemove(be, getIdsetKey(userId, profileId), postId)
+		if err != nil {
+			return err
+		}
+	}
+	return be.KVDelete(getProfileChannelsKey(userId, profileId))
+}
+
+// cleanUpDeactivatedUser removes the default profiles of a deactivated user,
+// and archives or purges their character profiles according to the setting.
+func cleanUpDeactivatedUser(be Backend, userId, setting string) *model.AppError {
+	err := clearAllDefaults(be, userId)
+	if err != nil || setting == DEACTIVATED_PROFILES_KEEP {
+		return err
+	}
+	profileIds, err := StrsetGet(be, ProfileIdsKey(userId))
+	if err != nil {
+		return err
+	}
+	for _, profileId := range profileIds {
+		err = trashProfile(be, userId, profileId)
+		if err != nil {
+			return err
+		}
+		if setting == DEACTIVATED_PROFILES_ARCHIVE {
+			err = StrsetInsert(be, getArchivedProfilesKey(userId), profileId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if setting == DEACTIVATED_PROFILES_ARCHIVE {
+		return nil
+	}
+	trashedProfileIds, err := StrsetGet(be, TrashListKey(userId))
+	if err != nil {
+		return err
+	}
+	for _, profileId := range trashedProfileIds {
+		err = purgeTrashedProfile(be, userId, profileId)
+		if err != nil {
+			return err
+		}
+		err = forgetProfilePosts(be, userId, profileId)
+		if err != nil {
+			return err
+		}
+	}
+	return be.KVDelete(getArchivedProfilesKey(userId))
+}
+
+// CleanUpDeactivatedUsers removes the default profiles of all deactivated
+// users, and archives or purges their character profiles according to the
+// configuration. The archived profiles of reactivated users are restored.
+func CleanUpDeactivatedUsers(be Backend) *model.AppError {
+	setting := be.GetConfiguration().GetDeactivatedUserProfiles()
+	userIds := map[string]bool{}
+	archivedUserIds := map[string]bool{}
+	for _, prefix := range []string{
+		ProfileIdsKey(""),
+		TrashListKey(""),
+		getDefaultChannelsKey(""),
+		getDefaultTeamsKey(""),
+		getGlobalDefaultProfileKey(""),
+		getArchivedProfilesKey(""),
+	} {
+		keys, err := KVListWithPrefix(be, prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			userId := strings.TrimPrefix(key, prefix)
+			userIds[userId] = true
+			if prefix == getArchivedProfilesKey("") {
+				archivedUserIds[userId] = true
+			}
+		}
+	}
+	for userId := range userIds {
+		// Users that cannot be found are left alone, since the lookup may fail
+		// for other reasons.
+		user, _ := be.GetUser(userId)
+		if user == nil {
+			continue
+		}
+		if user.DeleteAt == 0 {
+			if archivedUserIds[userId] {
+				err := restoreArchivedProfiles(be, userId)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		err := cleanUpDeactivatedUser(be, userId, setting)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+func TestLeaveClearsDefaults(t *testing.T) {
+	be := newMockBackend()
+	tChannel2 := "channel2aaaaaaaaaaaaaaaaaa"
+	be.Channels[tChannel2] = &model.Channel{Id: tChannel2, Name: "channel-two", TeamId: tTeam1, Type: model.CHANNEL_OPEN}
+	tTeam2 := "team2aaaaaaaaaaaaaaaaaaaaa"
+	tChannel3 := "channel3aaaaaaaaaaaaaaaaaa"
+	be.Channels[tChannel3] = &model.Channel{Id: tChannel3, Name: "channel-three", TeamId: tTeam2, Type: model.CHANNEL_OPEN}
+	be.ChannelMembers = append(be.ChannelMembers,
+		struct {
+			UserId    string
+			ChannelId string
+		}{tUser1, tChannel2},
+		struct {
+			UserId    string
+			ChannelId string
+		}{tUser1, tChannel3})
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	tintinImg := avatarImg(be, "tintin", "Tintin")
+	cmd(t, be, "/character tintin=Tintin", tUser1, tChannel1, tTeam1, "",
+		"Character profile `tintin` created with display name \"Tintin\"",
+		[]tAtt{{"**Tintin**\n`tintin`", "#5c66ff", tintinImg}})
+	cmd(t, be, "/character I am tintin in this team", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Tintin\" in this team, except in channels with a default of their own.",
+		[]tAtt{{"**Tintin**\n`tintin`", "#5c66ff", tintinImg}})
+	for _, channelId := range []string{tChannel1, tChannel2} {
+		cmd(t, be, "/character I am haddock", tUser1, channelId, tTeam1, "",
+			"You are now known as \"Captain Haddock\".",
+			[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	}
+	cmd(t, be, "/character I am haddock", tUser1, tChannel3, tTeam2, "",
+		"You are now known as \"Captain Haddock\".",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+
+	// Leaving a channel removes the default there
+	assert.Nil(t, main.UserLeftChannel(be, tUser1, tChannel1))
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Great snakes!"}, "tintin", "Tintin", tintinImg)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel2, Message: "Blistering barnacles!"}, "haddock", "Captain Haddock", haddockImg)
+
+	// Leaving a team removes the defaults of the team and its channels
+	assert.Nil(t, main.UserLeftTeam(be, tUser1, tTeam1))
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Hello"}, "myself", "", nil)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel2, Message: "Hello"}, "myself", "", nil)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel3, Message: "Blistering barnacles!"}, "haddock", "Captain Haddock", haddockImg)
+}
+
+func TestCleanUpDeactivatedUsers(t *testing.T) {
+	for _, setting := range []string{main.DEACTIVATED_PROFILES_KEEP, main.DEACTIVATED_PROFILES_ARCHIVE, main.DEACTIVATED_PROFILES_PURGE} {
+		be := newMockBackend()
+		be.Configuration = &main.Configuration{DeactivatedUserProfiles: setting}
+		for _, userId := range []string{tUser1, tUser2} {
+			cmd(t, be, "/character haddock=Captain Haddock", userId, tChannel1, tTeam1, "",
+				"Character profile `haddock` created with display name \"Captain Haddock\"",
+				[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", avatarImg(be, "haddock", "Captain Haddock")}})
+			cmd(t, be, "/character I am haddock", userId, tChannel1, tTeam1, "",
+				"You are now known as \"Captain Haddock\".",
+				[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", avatarImg(be, "haddock", "Captain Haddock")}})
+			cmd(t, be, "/character I am haddock everywhere", userId, tChannel1, tTeam1, "",
+				"You are now known as \"Captain Haddock\" everywhere, except in teams and channels with a default of their own.",
+				[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", avatarImg(be, "haddock", "Captain Haddock")}})
+		}
+		be.Users[tUser2].DeleteAt = *be.Millis
+		assert.Nil(t, main.RunDueJobs(be), setting)
+
+		// Active users are left alone
+		post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Blistering barnacles!"}, "haddock", "Captain Haddock", avatarImg(be, "haddock", "Captain Haddock"))
+		cmd(t, be, "/character who am I", tUser1, tChannel1, tTeam1, "",
+			"## Default character profiles\nAccount default: `haddock`",
+			[]tAtt{{"**Captain Haddock**\n`haddock`\nDefault profile in: ~channel-one", "#5c66ff", avatarImg(be, "haddock", "Captain Haddock")}})
+
+		// Deactivated users lose their defaults, and their profiles are kept,
+		// archived or purged
+		post(t, be, &model.Post{UserId: tUser2, ChannelId: tChannel1, Message: "Hello"}, "myself", "", nil)
+		cmd(t, be, "/character who am I", tUser2, tChannel1, tTeam1, "",
+			"## Default character profiles",
+			[]tAtt{{"**user-number-two** *(your real profile)*\n`me`, `myself`\nDefault profile in: ~channel-one", "#009900", nil}})
+		profile, _ := main.GetProfile(be, tUser2, "haddock", main.PROFILE_CHARACTER)
+		assert.Equal(t, setting == main.DEACTIVATED_PROFILES_KEEP, profile != nil, setting)
+		trashed, err := main.GetTrashedProfile(be, tUser2, "haddock")
+		assert.Nil(t, err, setting)
+		assert.Equal(t, setting == main.DEACTIVATED_PROFILES_ARCHIVE, trashed != nil, setting)
+
+		// Archived profiles are kept in the trash beyond the retention period
+		*be.Millis += 40 * main.MILLISECONDS_PER_DAY
+		assert.Nil(t, main.RunDueJobs(be), setting)
+		trashed, err = main.GetTrashedProfile(be, tUser2, "haddock")
+		assert.Nil(t, err, setting)
+		assert.Equal(t, setting == main.DEACTIVATED_PROFILES_ARCHIVE, trashed != nil, setting)
+	}
+}
+
+func TestReactivatedUserGetsArchivedProfilesBack(t *testing.T) {
+	be := newMockBackend()
+	be.Configuration = &main.Configuration{DeactivatedUserProfiles: main.DEACTIVATED_PROFILES_ARCHIVE}
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	cmd(t, be, "/character tintin=Tintin", tUser1, tChannel1, tTeam1, "",
+		"Character profile `tintin` created with display name \"Tintin\"",
+		[]tAtt{{"**Tintin**\n`tintin`", "#5c66ff", avatarImg(be, "tintin", "Tintin")}})
+	be.Users[tUser1].DeleteAt = *be.Millis
+	assert.Nil(t, main.RunDueJobs(be))
+	profile, _ := main.GetProfile(be, tUser1, "haddock", main.PROFILE_CHARACTER)
+	assert.Nil(t, profile)
+
+	// The archived profiles are restored once the user is active again, even
+	// if the retention period has passed or the setting has changed, unless
+	// the identifier has been taken
+	*be.Millis += 40 * main.MILLISECONDS_PER_DAY
+	be.Users[tUser1].DeleteAt = 0
+	be.Configuration = &main.Configuration{DeactivatedUserProfiles: main.DEACTIVATED_PROFILES_KEEP}
+	cmd(t, be, "/character tintin=Tintin the reporter", tUser1, tChannel1, tTeam1, "",
+		"Character profile `tintin` created with display name \"Tintin the reporter\"",
+		[]tAtt{{"**Tintin the reporter**\n`tintin`", "#5c66ff", avatarImg(be, "tintin", "Tintin the reporter")}})
+	assert.Nil(t, main.RunDueJobs(be))
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Blistering barnacles!"}, "haddock", "Captain Haddock", haddockImg)
+	trashed, err := main.GetTrashedProfile(be, tUser1, "tintin")
+	assert.Nil(t, err)
+	if assert.NotNil(t, trashed) {
+		assert.Equal(t, "Tintin", trashed.Name)
+	}
+
+	// Profiles left in the trash get the whole retention period
+	*be.Millis += 20 * main.MILLISECONDS_PER_DAY
+	assert.Nil(t, main.RunDueJobs(be))
+	trashed, err = main.GetTrashedProfile(be, tUser1, "tintin")
+	assert.Nil(t, err)
+	assert.NotNil(t, trashed)
+	*be.Millis += 20 * main.MILLISECONDS_PER_DAY
+	assert.Nil(t, main.RunDueJobs(be))
+	trashed, err = main.GetTrashedProfile(be, tUser1, "tintin")
+	assert.Nil(t, err)
+	assert.Nil(t, trashed)
+}
+
+func TestIndexDefaults(t *testing.T) {
+	be := newMockBackend()
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	// Defaults set before the channels and teams of defaults were recorded
+	assert.Nil(t, be.KVSet("teamdefaultprofile_"+tUser1+"_"+tTeam1, []byte("haddock")))
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Hello"}, "myself", "", nil)
+	assert.Nil(t, main.RunDueJobs(be))
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Blistering barnacles!"}, "haddock", "Captain Haddock", haddockImg)
+
+	// and are removed when the user leaves
+	assert.Nil(t, be.KVSet("defaultprofile_"+tUser1+"_"+tChannel1, []byte("haddock")))
+	assert.Nil(t, be.KVDelete("defaultindexdone"))
+	assert.Nil(t, main.IndexDefaults(be))
+	assert.Nil(t, main.UserLeftTeam(be, tUser1, tTeam1))
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Hello"}, "myself", "", nil)
+}
@@ -18,6 +18,77 @@ import (
 // If you add non-reference types to your configuration struct, be sure to rewrite Clone as a deep
 // copy appropriate for your types.
 type configuration struct {
+	// TrashRetentionDays is the number of days a deleted character profile is
+	// kept in the trash before it is purged. Values below 1 mean the default.
+	TrashRetentionDays int
+
+	// ImageURLLifetimeDays is the number of days a signed profile image URL is
+	// valid. Values below 1 mean the default.
+	ImageURLLifetimeDays int
+
+	// DisableLegacyImageURLs makes profile images inaccessible through URLs
+	// authorized only by the profile's request key.
+	DisableLegacyImageURLs bool
+
+	// RestrictImagesToChannelMembers makes profile images accessible only to
+	// users who are members of a channel where the profile has been used.
+	RestrictImagesToChannelMembers bool
+
+	// AllowAnimatedPictures makes animated GIF profile pictures animated. When
+	// false, only their first frame is shown. Thumbnails are never animated.
+	AllowAnimatedPictures bool
+
+	// UseBotAccount makes character messages be posted by the plugin's bot
+	// account, with the real author recorded in the message props, instead of
+	// by the author with webhook-style overrides.
+	UseBotAccount bool
+
+	// DeactivatedUserProfiles is what happens to the character profiles of
+	// deactivated users: DEACTIVATED_PROFILES_KEEP, DEACTIVATED_PROFILES_ARCHIVE
+	// or DEACTIVATED_PROFILES_PURGE. Other values mean the default.
+	DeactivatedUserProfiles string
+}
+
+const DEFAULT_TRASH_RETENTION_DAYS = 30
+
+const DEFAULT_IMAGE_URL_LIFETIME_DAYS = 30
+
+const (
+	DEACTIVATED_PROFILES_KEEP    = "keep"
+	DEACTIVATED_PROFILES_ARCHIVE = "archive"
+	DEACTIVATED_PROFILES_PURGE   = "purge"
+)
+
+// GetTrashRetentionDays returns the configured trash retention period, or the
+// default if none is configured.
+func (c *configuration) GetTrashRetentionDays() int {
+	if c == nil || c.TrashRetentionDays < 1 {
+		return DEFAULT_TRASH_RETENTION_DAYS
+	}
+	return c.TrashRetentionDays
+}
+
+// GetImageURLLifetimeDays returns the configured lifetime of signed image URLs,
+// or the default if none is configured.
+func (c *configuration) GetImageURLLifetimeDays() int {
+	if c == nil || c.ImageURLLifetimeDays < 1 {
+		return DEFAULT_IMAGE_URL_LIFETIME_DAYS
+	}
+	return c.ImageURLLifetimeDays
+}
+
+// GetDeactivatedUserProfiles returns what happens to the character profiles of
+// deactivated users, or the default if nothing valid is configured.
+func (c *configuration) GetDeactivatedUserProfiles() string {
+	if c == nil {
+		return DEACTIVATED_PROFILES_KEEP
+	}
+	switch c.DeactivatedUserProfiles {
+	case DEACTIVATED_PROFILES_ARCHIVE, DEACTIVATED_PROFILES_PURGE:
+		return c.DeactivatedUserProfiles
+	default:
+		return DEACTIVATED_PROFILES_KEEP
+	}
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
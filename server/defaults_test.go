@@ -0,0 +1,97 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestDefaultLevels(t *testing.T) {
+	be := newMockBackend()
+	tChannel2 := "channel2aaaaaaaaaaaaaaaaaa"
+	be.Channels[tChannel2] = &model.Channel{Id: tChannel2, Name: "channel-two", TeamId: tTeam1, Type: model.CHANNEL_OPEN}
+	tChannel3 := "channel3aaaaaaaaaaaaaaaaaa"
+	be.Channels[tChannel3] = &model.Channel{Id: tChannel3, Name: "channel-three", TeamId: "team2aaaaaaaaaaaaaaaaaaaaa", Type: model.CHANNEL_OPEN}
+	be.ChannelMembers = append(be.ChannelMembers,
+		struct {
+			UserId    string
+			ChannelId string
+		}{tUser1, tChannel2},
+		struct {
+			UserId    string
+			ChannelId string
+		}{tUser1, tChannel3})
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	milouImg := avatarImg(be, "milou", "Milou")
+	cmd(t, be, "/character milou=Milou", tUser1, tChannel1, tTeam1, "",
+		"Character profile `milou` created with display name \"Milou\"",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	tintinImg := avatarImg(be, "tintin", "Tintin")
+	cmd(t, be, "/character tintin=Tintin", tUser1, tChannel1, tTeam1, "",
+		"Character profile `tintin` created with display name \"Tintin\"",
+		[]tAtt{{"**Tintin**\n`tintin`", "#5c66ff", tintinImg}})
+
+	// Account default applies everywhere
+	cmd(t, be, "/character I am milou everywhere", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Milou\" everywhere, except in teams and channels with a default of their own.",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel3, Message: "Woof!"}, "milou", "Milou", milouImg)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Woof!"}, "milou", "Milou", milouImg)
+
+	// Team default overrides the account default
+	cmd(t, be, "/character I am tintin in this team", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Tintin\" in this team, except in channels with a default of their own.",
+		[]tAtt{{"**Tintin**\n`tintin`", "#5c66ff", tintinImg}})
+	cmd(t, be, "/character I am tintin in this team", tUser1, tChannel1, tTeam1, "",
+		"\"Tintin\" is already your default character profile in this team.", nil)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Great snakes!"}, "tintin", "Tintin", tintinImg)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel3, Message: "Woof!"}, "milou", "Milou", milouImg)
+
+	// Channel default overrides both, and one-off prefixes override all
+	cmd(t, be, "/character I am haddock", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Captain Haddock\".",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Blistering barnacles!"}, "haddock", "Captain Haddock", haddockImg)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "milou: Woof!"}, "milou", "Milou", milouImg)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel2, Message: "Great snakes!"}, "tintin", "Tintin", tintinImg)
+
+	// who am I explains the level of each default
+	cmd(t, be, "/character who am I", tUser1, tChannel1, tTeam1, "",
+		"## Default character profiles\nTeam default: `tintin`\nAccount default: `milou`",
+		[]tAtt{
+			{"**Captain Haddock**\n`haddock`\nDefault profile in: ~channel-one", "#5c66ff", haddockImg},
+			{"**Tintin**\n`tintin`\nTeam default in: ~channel-two", "#5c66ff", tintinImg},
+		})
+
+	// The real profile can be used in a channel despite a team default
+	cmd(t, be, "/character I am myself", tUser1, tChannel2, tTeam1, "",
+		"You are now yourself again. Hope that feels ok.",
+		[]tAtt{{"**user-number-one** *(your real profile)*\n`me`, `myself`", "#009900", nil}})
+	cmd(t, be, "/character I am myself", tUser1, tChannel2, tTeam1, "",
+		"You are already yourself. Multiplicity was a fun movie, but let's leave it at that.", nil)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel2, Message: "Hello"}, "", "", nil)
+	cmd(t, be, "/character who am I", tUser1, tChannel1, tTeam1, "",
+		"## Default character profiles\nTeam default: `tintin`\nAccount default: `milou`",
+		[]tAtt{
+			{"**Captain Haddock**\n`haddock`\nDefault profile in: ~channel-one", "#5c66ff", haddockImg},
+			{"**user-number-one** *(your real profile)*\n`me`, `myself`\nDefault profile in: ~channel-two", "#009900", nil},
+		})
+
+	// Removing the team default falls back to the account default
+	cmd(t, be, "/character I am myself in this team", tUser1, tChannel1, tTeam1, "",
+		"Removed your default character profile in this team.", nil)
+	cmd(t, be, "/character I am myself in this team", tUser1, tChannel1, tTeam1, "",
+		"You have no default character profile in this team.", nil)
+	cmd(t, be, "/character I am myself", tUser1, tChannel1, tTeam1, "",
+		"You are now yourself again. Hope that feels ok.",
+		[]tAtt{{"**user-number-one** *(your real profile)*\n`me`, `myself`", "#009900", nil}})
+	cmd(t, be, "/character I am milou", tUser1, tChannel2, tTeam1, "",
+		"You are now known as \"Milou\".",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	cmd(t, be, "/character I am myself everywhere", tUser1, tChannel1, tTeam1, "",
+		"Removed your default character profile everywhere.", nil)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel3, Message: "Hello"}, "", "", nil)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// The default profile of a channel can be set to expire after a while, or when
+// the user leaves the channel. The expiry is stored next to the default, and
+// defaults that expire at a certain time are listed in a string set, so that
+// the periodic job that removes them does not need to scan the KV store. An
+// expired default is ignored even before the job has removed it. Defaults that
+// expire when the user leaves are removed by UserLeftChannel.
+
+// EXPIRING_DEFAULTS_KEY holds the string set of "<user id>_<channel id>" for
+// defaults that expire at a certain time.
+const EXPIRING_DEFAULTS_KEY = "expiringdefaults"
+
+const EXPIRE_DEFAULTS_JOB = "expiredefaults"
+
+// DEFAULT_PROFILE_GAP is how long a default character profile must have been
+// unused in a channel for the user to be reminded of it when it is applied.
+const DEFAULT_PROFILE_GAP = 12 * time.Hour
+
+type defaultProfileExpiry struct {
+	// Identifier is the default profile that expires, so that a default set
+	// later is left alone.
+	Identifier string `json:"identifier"`
+	ExpireAt   int64  `json:"expire_at,omitempty"`
+	UntilLeave bool   `json:"until_leave,omitempty"`
+}
+
+func getDefaultProfileExpiryKey(userId, channelId string) string {
+	return fmt.Sprintf("defaultprofileexpiry_%s_%s", userId, channelId)
+}
+
+func getDefaultProfileExpiry(be Backend, userId, channelId string) (*defaultProfileExpiry, *model.AppError) {
+	b, err := be.KVGet(getDefaultProfileExpiryKey(userId, channelId))
+	if err != nil || b == nil {
+		return nil, err
+	}
+	expiry := defaultProfileExpiry{}
+	jErr := json.Unmarshal(b, &expiry)
+	if jErr != nil {
+		return nil, appError("Failed to unmarshal default profile expiry.", jErr)
+	}
+	return &expiry, nil
+}
+
+// setDefaultProfileExpiry makes the default profile of a user in a channel
+// expire.
+func setDefaultProfileExpiry(be Backend, userId, channelId string, expiry defaultProfileExpiry) *model.AppError {
+	b, jErr := json.Marshal(expiry)
+	if jErr != nil {
+		return appError("Failed to marshal default profile expiry.", jErr)
+	}
+	err := be.KVSet(getDefaultProfileExpiryKey(userId, channelId), b)
+	if err != nil {
+		return err
+	}
+	if expiry.ExpireAt != 0 {
+		return StrsetInsert(be, EXPIRING_DEFAULTS_KEY, userId+"_"+channelId)
+	}
+	return nil
+}
+
+// removeDefaultProfileExpiry makes the default profile of a user in a channel
+// no longer expire.
+func removeDefaultProfileExpiry(be Backend, userId, channelId string) *model.AppError {
+	expiry, err := getDefaultProfileExpiry(be, userId, channelId)
+	if err != nil || expiry == nil {
+		return err
+	}
+	err = be.KVDelete(getDefaultProfileExpiryKey(userId, channelId))
+	if err != nil {
+		return err
+	}
+	if expiry.ExpireAt != 0 {
+		return StrsetRemove(be, EXPIRING_DEFAULTS_KEY, userId+"_"+channelId)
+	}
+	return nil
+}
+
+// isDefaultProfileExpired returns whether the given default profile of a user
+// in a channel has expired.
+func isDefaultProfileExpired(be Backend, userId, channelId, profileId string) (bool, *model.AppError) {
+	expiry, err := getDefaultProfileExpiry(be, userId, channelId)
+	if err != nil || expiry == nil {
+		return false, err
+	}
+	return expiry.Identifier == profileId && expiry.ExpireAt != 0 && expiry.ExpireAt <= be.GetMillis(), nil
+}
+
+// SetExpiringDefaultProfile sets the default character profile of a user in a
+// channel until a given time, or until they leave the channel if expireAt is
+// zero. It returns the new default profile.
+func SetExpiringDefaultProfile(be Backend, userId, channelId, profileId string, expireAt int64) (*Profile, *defaultProfileExpiry, *model.AppError) {
+	if IsMe(NormalizeIdentifier(profileId)) {
+		return nil, nil, appError("Only a character profile can be your default for a while.", nil)
+	}
+	_, profile, err := SetDefaultProfile(be, userId, channelId, profileId)
+	if err != nil {
+		return nil, nil, err
+	}
+	expiry := defaultProfileExpiry{
+		Identifier: profile.Identifier,
+		ExpireAt:   expireAt,
+		UntilLeave: expireAt == 0,
+	}
+	err = setDefaultProfileExpiry(be, userId, channelId, expiry)
+	if err != nil {
+		return nil, nil, err
+	}
+	return profile, &expiry, nil
+}
+
+// describeDefaultProfileExpiry returns when a default profile expires, e.g.
+// " until 2020-09-13 14:26 UTC", or the empty string if it does not.
+func describeDefaultProfileExpiry(expiry *defaultProfileExpiry) string {
+	switch {
+	case expiry == nil:
+		return ""
+	case expiry.UntilLeave:
+		return " until you leave this channel"
+	case expiry.ExpireAt != 0:
+		return " until " + formatTime(expiry.ExpireAt)
+	default:
+		return ""
+	}
+}
+
+// expireDefaultProfile removes the default profile of a user in a channel if
+// it is the expiring one, and tells the user.
+func expireDefaultProfile(be Backend, userId, channelId string, expiry *defaultProfileExpiry) *model.AppError {
+	err := removeDefaultProfileExpiry(be, userId, channelId)
+	if err != nil {
+		return err
+	}
+	current, err := getDefaultProfileIdentifier(be, userId, channelId)
+	if err != nil {
+		return err
+	}
+	if current != expiry.Identifier {
+		return nil
+	}
+	err = removeDefaultProfile(be, userId, channelId)
+	if err != nil {
+		return err
+	}
+	profileId, _, err := getEffectiveDefaultProfile(be, userId, channelId)
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("Your default character profile `%s` in this channel has expired, so you are yourself again.", expiry.Identifier)
+	if profileId != "" {
+		message = fmt.Sprintf("Your default character profile `%s` in this channel has expired, so your default `%s` of the team or account applies again.", expiry.Identifier, profileId)
+	}
+	uiNotice(be, userId, channelId, message)
+	return nil
+}
+
+// ExpireDefaultProfiles removes the default profiles that have expired.
+func ExpireDefaultProfiles(be Backend) *model.AppError {
+	entries, err := StrsetGet(be, EXPIRING_DEFAULTS_KEY)
+	if err != nil {
+		return err
+	}
+	now := be.GetMillis()
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "_", 2)
+		if len(parts) != 2 {
+			err = StrsetRemove(be, EXPIRING_DEFAULTS_KEY, entry)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		userId, channelId := parts[0], parts[1]
+		expiry, err := getDefaultProfileExpiry(be, userId, channelId)
+		if err != nil {
+			return err
+		}
+		if expiry == nil || expiry.ExpireAt == 0 {
+			err = StrsetRemove(be, EXPIRING_DEFAULTS_KEY, entry)
+		} else if expiry.ExpireAt <= now {
+			err = expireDefaultProfile(be, userId, channelId, expiry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remindDefaultProfileAfterGap tells a user that a default character profile
+// is about to be applied to their message in a channel where they have not
+// used it for a while.
+func remindDefaultProfileAfterGap(be Backend, userId, channelId string, profile Profile) {
+	if profile.Status != PROFILE_CHARACTER {
+		return
+	}
+	stats, _ := getChannelCharacterStats(be, channelId, userId, profile.Identifier)
+	if stats == nil || stats.LastUse == 0 || be.GetMillis()-stats.LastUse < DEFAULT_PROFILE_GAP.Milliseconds() {
+		return
+	}
+	uiNotice(be, userId, channelId, fmt.Sprintf("Your message is being posted as \"%s\", your default character profile here, which you last used %s. Use `/character I am myself` to post as yourself.", profile.Name, formatTime(stats.LastUse)))
+}
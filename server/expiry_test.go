@@ -0,0 +1,83 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+func TestDefaultExpiry(t *testing.T) {
+	be := newMockBackend()
+	be.EphemeralPosts = map[string][]*model.Post{}
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	milouImg := avatarImg(be, "milou", "Milou")
+	cmd(t, be, "/character milou=Milou", tUser1, tChannel1, tTeam1, "",
+		"Character profile `milou` created with display name \"Milou\"",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	cmd(t, be, "/character I am milou everywhere", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Milou\" everywhere, except in teams and channels with a default of their own.",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+
+	// Only character profiles can be channel defaults for a while
+	cmdFail(t, be, "/character I am haddock in this team for 2h", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Only the default character profile of a channel can expire.")
+	cmdFail(t, be, "/character I am myself for 2h", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Only a character profile can be your default for a while.")
+	cmdFail(t, be, "/character I am haddock for a while", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Could not understand `a while`. Give a duration such as `90m`, `2h`, `2d` or `1w`.")
+
+	// The default expires after the given time, even before the job runs
+	cmd(t, be, "/character I am haddock for 2h", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Captain Haddock\" until 2020-09-13 14:26 UTC.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Blistering barnacles!"}, "haddock", "Captain Haddock", haddockImg)
+	*be.Millis += 2 * 60 * 60 * 1000
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Woof!"}, "milou", "Milou", milouImg)
+	assert.Empty(t, be.EphemeralPosts[tUser1])
+	assert.Nil(t, main.ExpireDefaultProfiles(be))
+	if assert.Len(t, be.EphemeralPosts[tUser1], 1) {
+		notice := be.EphemeralPosts[tUser1][0]
+		assert.Equal(t, tChannel1, notice.ChannelId)
+		assert.Equal(t, "Your default character profile `haddock` in this channel has expired, so your default `milou` of the team or account applies again.", notice.Message)
+	}
+	cmd(t, be, "/character I am milou", tUser1, tChannel1, tTeam1, "",
+		"You are already \"Milou\", and if that's not enough you should've rolled better stats.", nil)
+
+	// Setting the default again removes the expiry
+	cmd(t, be, "/character I am haddock for 1h", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Captain Haddock\" until 2020-09-13 15:26 UTC.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	cmd(t, be, "/character I am haddock", tUser1, tChannel1, tTeam1, "",
+		"You are already \"Captain Haddock\", and if that's not enough you should've rolled better stats.", nil)
+	*be.Millis += 2 * 60 * 60 * 1000
+	assert.Nil(t, main.ExpireDefaultProfiles(be))
+	assert.Len(t, be.EphemeralPosts[tUser1], 1)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: *be.Millis, Message: "Thundering typhoons!"}, "haddock", "Captain Haddock", haddockImg)
+
+	// A default that has not been used for a while is pointed out
+	*be.Millis += 13 * 60 * 60 * 1000
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: *be.Millis, Message: "Ten thousand thundering typhoons!"}, "haddock", "Captain Haddock", haddockImg)
+	if assert.Len(t, be.EphemeralPosts[tUser1], 2) {
+		assert.Equal(t, "Your message is being posted as \"Captain Haddock\", your default character profile here, which you last used 2020-09-13 16:26 UTC. Use `/character I am myself` to post as yourself.", be.EphemeralPosts[tUser1][1].Message)
+	}
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Billions of bilious blue blistering barnacles!"}, "haddock", "Captain Haddock", haddockImg)
+	assert.Len(t, be.EphemeralPosts[tUser1], 2)
+
+	// The default can last until the user leaves the channel
+	cmd(t, be, "/character I am haddock until I leave the channel", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Captain Haddock\" until you leave this channel.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	*be.Millis += 2 * 7 * 24 * 60 * 60 * 1000
+	assert.Nil(t, main.ExpireDefaultProfiles(be))
+	assert.Nil(t, main.UserLeftChannel(be, tUser2, tChannel1))
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: *be.Millis, Message: "Blistering barnacles!"}, "haddock", "Captain Haddock", haddockImg)
+	assert.Len(t, be.EphemeralPosts[tUser1], 3)
+	assert.Nil(t, main.UserLeftChannel(be, tUser1, tChannel1))
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Woof!"}, "milou", "Milou", milouImg)
+}
@@ -0,0 +1,8 @@
+package main
+
+// Configuration lets the tests in package main_test configure the mock
+// backend.
+type Configuration = configuration
+
+// RouterFromBackend lets the tests make HTTP requests to the plugin.
+var RouterFromBackend = routerFromBackend
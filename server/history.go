@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Every change to the display name or profile picture of a character profile
+// is recorded as a new version in the profile's history. The history is stored
+// as a JSON array in the KV store, and outlives the profile while it is in the
+// trash. Messages record the version of the profile they were sent with in the
+// profile_version prop.
+//
+// Normally, changing a profile updates all messages using it. When history is
+// kept, either for a single change or for all changes to a profile, messages
+// sent with earlier versions are instead frozen at the version they were sent
+// with. Profile.FrozenVersion is the latest version whose messages are frozen.
+// Since messages refer to the profile picture of a version using a versioned
+// URL, those pictures remain available for as long as the history is kept.
+
+type ProfileVersion struct {
+	Version       int    `json:"version"`
+	Name          string `json:"displayName"`
+	PictureFileId string `json:"pictureFile"`
+	PictureCrop   string `json:"pictureCrop,omitempty"`
+	RequestKey    string `json:"requestKey"`
+	Color         string `json:"color,omitempty"`
+	CreateAt      int64  `json:"createAt"`
+}
+
+func getProfileHistoryKey(userId, profileId string) string {
+	return fmt.Sprintf("profilehistory_%s_%s", userId, encodeIdentifierForKey(profileId))
+}
+
+// getProfileHistory returns the history of a profile along with the raw JSON
+// value, oldest version first.
+func getProfileHistory(be Backend, userId, profileId string) ([]ProfileVersion, []byte, *model.AppError) {
+	jsonVal, err := be.KVGet(getProfileHistoryKey(userId, profileId))
+	if err != nil {
+		return nil, nil, err
+	}
+	history := []ProfileVersion{}
+	if jsonVal == nil {
+		return history, nil, nil
+	}
+	jsonErr := json.Unmarshal(jsonVal, &history)
+	if jsonErr != nil {
+		return nil, jsonVal, appError("Failed to decode profile history.", jsonErr)
+	}
+	return history, jsonVal, nil
+}
+
+// GetProfileHistory returns the history of a profile, oldest version first.
+func GetProfileHistory(be Backend, userId, profileId string) ([]ProfileVersion, *model.AppError) {
+	history, _, err := getProfileHistory(be, userId, profileId)
+	return history, err
+}
+
+// recordProfileVersion sets profile.Version, appending a new version to the
+// history unless the display name, profile picture, request key and avatar
+// color are the same as in the latest version.
+func recordProfileVersion(be Backend, userId string, profile *Profile) *model.AppError {
+	history, oldJson, err := getProfileHistory(be, userId, profile.Identifier)
+	if err != nil {
+		return err
+	}
+	if len(history) > 0 {
+		latest := history[len(history)-1]
+		if latest.Name == profile.Name && latest.PictureFileId == profile.PictureFileId && latest.RequestKey == profile.RequestKey && latest.Color == profile.Color {
+			profile.Version = latest.Version
+			return nil
+		}
+		profile.Version = latest.Version + 1
+	} else {
+		profile.Version = 1
+	}
+	history = append(history, ProfileVersion{
+		Version:       profile.Version,
+		Name:          profile.Name,
+		PictureFileId: profile.PictureFileId,
+		PictureCrop:   profile.PictureCrop,
+		RequestKey:    profile.RequestKey,
+		Color:         profile.Color,
+		CreateAt:      be.GetMillis(),
+	})
+	newJson, jsonErr := json.Marshal(history)
+	if jsonErr != nil {
+		return appError("Failed to encode profile history.", jsonErr)
+	}
+	ok, err := be.KVCompareAndSet(getProfileHistoryKey(userId, profile.Identifier), oldJson, newJson)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return appError(fmt.Sprintf("Character profile `%s` was modified concurrently. Please try again.", profile.Identifier), nil)
+	}
+	return nil
+}
+
+// copyProfileHistory appends the history of a profile to that of another
+// identifier, for when a profile is renamed. The new identifier normally has no
+// history, but it does if a profile with that identifier is in the trash, in
+// which case the copied versions are numbered after its versions. It returns
+// how much the version numbers were increased.
+func copyProfileHistory(be Backend, userId, oldProfileId, newProfileId string) (int, *model.AppError) {
+	oldHistory, _, err := getProfileHistory(be, userId, oldProfileId)
+	if err != nil {
+		return 0, err
+	}
+	history, oldJson, err := getProfileHistory(be, userId, newProfileId)
+	if err != nil {
+		return 0, err
+	}
+	offset := 0
+	if len(history) > 0 {
+		offset = history[len(history)-1].Version
+	}
+	for _, entry := range oldHistory {
+		entry.Version += offset
+		history = append(history, entry)
+	}
+	newJson, jsonErr := json.Marshal(history)
+	if jsonErr != nil {
+		return 0, appError("Failed to encode profile history.", jsonErr)
+	}
+	ok, err := be.KVCompareAndSet(getProfileHistoryKey(userId, newProfileId), oldJson, newJson)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, appError(fmt.Sprintf("Character profile `%s` was modified concurrently. Please try again.", newProfileId), nil)
+	}
+	return offset, nil
+}
+
+// deleteProfileHistoryIfUnused deletes the history of a profile unless the
+// profile exists or is in the trash.
+func deleteProfileHistoryIfUnused(be Backend, userId, profileId string) *model.AppError {
+	exists, err := profileExists(be, userId, profileId)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	trashed, err := be.KVGet(getTrashedProfileKey(userId, profileId))
+	if err != nil {
+		return err
+	}
+	if trashed != nil {
+		return nil
+	}
+	return be.KVDelete(getProfileHistoryKey(userId, profileId))
+}
+
+// describeProfileHistory returns a Markdown list describing the changes made
+// in each version.
+func describeProfileHistory(history []ProfileVersion) string {
+	lines := make([]string, len(history))
+	for i, version := range history {
+		changes := []string{}
+		if i == 0 {
+			changes = append(changes, fmt.Sprintf("display name \"%s\"", version.Name))
+			if version.PictureFileId != "" {
+				changes = append(changes, "a profile picture")
+			} else {
+				changes = append(changes, "no profile picture")
+			}
+		} else {
+			previous := history[i-1]
+			if previous.Name != version.Name {
+				changes = append(changes, fmt.Sprintf("display name changed from \"%s\" to \"%s\"", previous.Name, version.Name))
+			}
+			if previous.PictureFileId != version.PictureFileId || previous.RequestKey != version.RequestKey {
+				if version.PictureFileId == "" {
+					changes = append(changes, "profile picture removed")
+				} else {
+					changes = append(changes, "profile picture changed")
+				}
+			}
+			if previous.Color != version.Color {
+				if version.Color == "" {
+					changes = append(changes, "avatar color changed to automatic")
+				} else {
+					changes = append(changes, fmt.Sprintf("avatar color changed to `%s`", version.Color))
+				}
+			}
+		}
+		lines[i] = fmt.Sprintf("- Version %d, %s: %s", version.Version, formatTime(version.CreateAt), strings.Join(changes, " and "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// GetProfileAtVersion returns a profile as it was at the given version. The
+// returned profile has status PROFILE_CHARACTER, PROFILE_CORRUPT, or
+// PROFILE_NONEXISTENT if the version is not in the history.
+func GetProfileAtVersion(be Backend, userId, profileId string, version int) (*Profile, *model.AppError) {
+	history, err := GetProfileHistory(be, userId, profileId)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range history {
+		if entry.Version == version {
+			profile := &Profile{
+				UserId:        userId,
+				Identifier:    profileId,
+				Name:          entry.Name,
+				PictureFileId: entry.PictureFileId,
+				PictureCrop:   entry.PictureCrop,
+				RequestKey:    entry.RequestKey,
+				Color:         entry.Color,
+				Version:       entry.Version,
+			}
+			checkProfile(be, profile, nil)
+			return profile, nil
+		}
+	}
+	return &Profile{
+		UserId:     userId,
+		Identifier: profileId,
+		Status:     PROFILE_NONEXISTENT,
+		Error:      appError(fmt.Sprintf("Version %d of profile `%s` does not exist.", version, profileId), nil),
+	}, nil
+}
+
+// getPostProfileVersion returns the profile version recorded in a post, or 0
+// if there is none.
+func getPostProfileVersion(post *model.Post) int {
+	versionStr, ok := post.Props["profile_version"].(string)
+	if !ok {
+		return 0
+	}
+	version, err := strconv.Atoi(versionStr)
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// isFrozenVersion returns whether messages sent with the given version of a
+// profile should keep their appearance.
+func isFrozenVersion(profile Profile, version int) bool {
+	return version > 0 && version <= profile.FrozenVersion && version != profile.Version
+}
@@ -0,0 +1,157 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+func TestProfileHistory(t *testing.T) {
+	be := newMockBackend()
+	file2 := "file2aaaaaaaaaaaaaaaaaaaaa"
+	post2 := "post2aaaaaaaaaaaaaaaaaaaaa"
+	be.FileInfos[file2] = &model.FileInfo{Id: file2, CreatorId: tUser1, CreateAt: 2, UpdateAt: 2, Path: "some-path-to/file2.png", Name: "file2.png", Extension: "png", MimeType: "image/png", PostId: post2}
+	be.Posts[post2] = &model.Post{Id: post2, UserId: tUser1, ChannelId: tChannel1, FileIds: []string{file2}}
+	cmd(t, be, "/character history haddock", tUser1, tChannel1, tTeam1, "",
+		"No history is recorded for character profile `haddock`.",
+		[]tAtt{})
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	postId := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Blistering barnacles!"},
+		"haddock", "Captain Haddock", avatarImg(be, "haddock", "Captain Haddock"))
+	assert.Equal(t, "1", be.Posts[postId].Props["profile_version"])
+	*be.Millis += 60 * 60 * 1000
+	cmd(t, be, "/character picture haddock", tUser1, tChannel1, tTeam1, tPost1,
+		"Character profile `haddock` modified by updating the profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	// Setting the same display name does not create a new version
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` modified by setting the display name to \"Captain Haddock\" (same as before)",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	*be.Millis += 24 * 60 * 60 * 1000
+	cmd(t, be, "/character picture haddock=Archibald Haddock", tUser1, tChannel1, tTeam1, post2,
+		"Character profile `haddock` modified by changing the display name from \"Captain Haddock\" to \"Archibald Haddock\" and updating the profile picture",
+		[]tAtt{{"**Archibald Haddock**\n`haddock`", "#5c66ff", nil}})
+	cmd(t, be, "/character history haddock", tUser1, tChannel1, tTeam1, "",
+		"## History of character profile `haddock`\n"+
+			"- Version 1, 2020-09-13 12:26 UTC: display name \"Captain Haddock\" and no profile picture\n"+
+			"- Version 2, 2020-09-13 13:26 UTC: profile picture changed\n"+
+			"- Version 3, 2020-09-14 13:26 UTC: display name changed from \"Captain Haddock\" to \"Archibald Haddock\" and profile picture changed",
+		[]tAtt{})
+	// The existing message was updated to the latest version
+	assert.Equal(t, "3", be.Posts[postId].Props["profile_version"])
+	assert.Equal(t, "Archibald Haddock", be.Posts[postId].Props["override_username"])
+	// The history is kept while the profile is in the trash, and deleted when
+	// it is purged.
+	cmd(t, be, "/character delete haddock", tUser1, tChannel1, tTeam1, "",
+		"Deleted character profile `haddock`. You can restore it with `/character restore haddock` within 30 days.",
+		[]tAtt{})
+	history, err := main.GetProfileHistory(be, tUser1, "haddock")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(history))
+	*be.Millis += 31 * 24 * 60 * 60 * 1000
+	assert.Nil(t, main.RunDueJobs(be))
+	history, err = main.GetProfileHistory(be, tUser1, "haddock")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(history))
+}
+
+func TestKeepHistory(t *testing.T) {
+	be := newMockBackend()
+	cmd(t, be, "/character picture haddock=Captain Haddock", tUser1, tChannel1, tTeam1, tPost1,
+		"Character profile `haddock` created with display name \"Captain Haddock\" and a profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	v1Img := versionImg(t, be, tUser1, "haddock", 1)
+	oldPostId := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Thundering typhoons!"},
+		"haddock", "Captain Haddock", v1Img)
+	// Keep the history for a single change
+	cmd(t, be, "/character haddock=Old Haddock --keep-history", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` modified by changing the display name from \"Captain Haddock\" to \"Old Haddock\". Existing messages keep the display name and profile picture they were sent with",
+		[]tAtt{{"**Old Haddock**\n`haddock`", "#5c66ff", nil}})
+	assert.Equal(t, "Captain Haddock", be.Posts[oldPostId].Props["override_username"])
+	assert.Equal(t, v1Img(false), be.Posts[oldPostId].Props["override_icon_url"])
+	// Editing a frozen message keeps its version
+	editPost(t, be, oldPostId, "Thundering typhoons, again!", "haddock", "Captain Haddock", v1Img)
+	// A later change that does not keep the history leaves frozen messages alone
+	newPostId := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Ten thousand thundering typhoons!"},
+		"haddock", "Old Haddock", versionImg(t, be, tUser1, "haddock", 2))
+	cmd(t, be, "/character haddock=Ancient Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` modified by changing the display name from \"Old Haddock\" to \"Ancient Haddock\"",
+		[]tAtt{{"**Ancient Haddock**\n`haddock`", "#5c66ff", nil}})
+	assert.Equal(t, "Captain Haddock", be.Posts[oldPostId].Props["override_username"])
+	assert.Equal(t, "Ancient Haddock", be.Posts[newPostId].Props["override_username"])
+	assert.Equal(t, "3", be.Posts[newPostId].Props["profile_version"])
+	// Keep the history for all changes to the profile
+	cmd(t, be, "/character history haddock keep", tUser1, tChannel1, tTeam1, "",
+		"Changes to character profile `haddock` will leave existing messages as they are.",
+		[]tAtt{})
+	cmd(t, be, "/character haddock=Eternal Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` modified by changing the display name from \"Ancient Haddock\" to \"Eternal Haddock\". Existing messages keep the display name and profile picture they were sent with",
+		[]tAtt{{"**Eternal Haddock**\n`haddock`", "#5c66ff", nil}})
+	assert.Equal(t, "Ancient Haddock", be.Posts[newPostId].Props["override_username"])
+	// ...unless overridden for a single change
+	cmd(t, be, "/character haddock=Haddock --rewrite-history", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` modified by changing the display name from \"Eternal Haddock\" to \"Haddock\"",
+		[]tAtt{{"**Haddock**\n`haddock`", "#5c66ff", nil}})
+	assert.Equal(t, "Captain Haddock", be.Posts[oldPostId].Props["override_username"])
+	assert.Equal(t, "Ancient Haddock", be.Posts[newPostId].Props["override_username"])
+	// Historic versions remain available
+	profile, err := main.GetProfileAtVersion(be, tUser1, "haddock", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, main.PROFILE_CHARACTER, profile.Status)
+	assert.Equal(t, "Captain Haddock", profile.Name)
+	profile, err = main.GetProfileAtVersion(be, tUser1, "haddock", 9)
+	assert.Nil(t, err)
+	assert.Equal(t, main.PROFILE_NONEXISTENT, profile.Status)
+
+	// Renaming the profile brings its history along
+	cmd(t, be, "/character make haddock into archibald", tUser1, tChannel1, tTeam1, "",
+		"Changed identifier for character profile `haddock` to `archibald`.",
+		[]tAtt{{"**Haddock**\n`archibald`", "#5c66ff", nil}})
+	assert.Equal(t, "archibald", be.Posts[oldPostId].Props["profile_identifier"])
+	assert.Equal(t, "Captain Haddock", be.Posts[oldPostId].Props["override_username"])
+	assert.Equal(t, versionImg(t, be, tUser1, "archibald", 1)(false), be.Posts[oldPostId].Props["override_icon_url"])
+	assert.Equal(t, "Ancient Haddock", be.Posts[newPostId].Props["override_username"])
+	history, err := main.GetProfileHistory(be, tUser1, "archibald")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(history))
+	cmd(t, be, "/character archibald=Archibald Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `archibald` modified by changing the display name from \"Haddock\" to \"Archibald Haddock\". Existing messages keep the display name and profile picture they were sent with",
+		[]tAtt{{"**Archibald Haddock**\n`archibald`", "#5c66ff", nil}})
+	assert.Equal(t, "Ancient Haddock", be.Posts[newPostId].Props["override_username"])
+	// The mock backend does not run the hook that registers updated posts
+	for _, postId := range []string{oldPostId, newPostId} {
+		assert.Nil(t, main.RegisterPost(be, be.Posts[postId]))
+	}
+	// A profile in the trash keeps its history, and the renamed versions follow
+	cmd(t, be, "/character tintin=Tintin", tUser1, tChannel1, tTeam1, "",
+		"Character profile `tintin` created with display name \"Tintin\"",
+		[]tAtt{{"**Tintin**\n`tintin`", "#5c66ff", nil}})
+	cmd(t, be, "/character delete tintin", tUser1, tChannel1, tTeam1, "",
+		"Deleted character profile `tintin`. You can restore it with `/character restore tintin` within 30 days.",
+		[]tAtt{})
+	cmd(t, be, "/character make archibald into tintin", tUser1, tChannel1, tTeam1, "",
+		"Changed identifier for character profile `archibald` to `tintin`.",
+		[]tAtt{{"**Archibald Haddock**\n`tintin`", "#5c66ff", nil}})
+	history, err = main.GetProfileHistory(be, tUser1, "tintin")
+	assert.Nil(t, err)
+	assert.Equal(t, 7, len(history))
+	assert.Equal(t, "Captain Haddock", be.Posts[oldPostId].Props["override_username"])
+	assert.Equal(t, "2", be.Posts[oldPostId].Props["profile_version"])
+	assert.Equal(t, "Ancient Haddock", be.Posts[newPostId].Props["override_username"])
+	assert.Equal(t, "4", be.Posts[newPostId].Props["profile_version"])
+}
+
+// versionImg returns a function giving the image URL of a profile version.
+func versionImg(t *testing.T, be main.Backend, userId, profileId string, version int) func(thumb bool) string {
+	return func(thumb bool) string {
+		profile, err := main.GetProfileAtVersion(be, userId, profileId, version)
+		assert.Nil(t, err)
+		return signedImageURL(t, be, userId, profileId, version, profile.RequestKey, thumb)
+	}
+}
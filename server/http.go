@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,25 +28,71 @@ func routerFromBackend(be Backend) *mux.Router {
 	// Serve static files from /static
 	router.HandleFunc("/static/{path:.*}", func(w http.ResponseWriter, r *http.Request) {
 		serveStaticFile(be, w, r, mux.Vars(r)["path"])
-	})
+	}).Methods(http.MethodGet, http.MethodHead)
 	// Serve profile images from /profile
-	router.HandleFunc("/profile/{userId:[a-z0-9]{26}}/{profileId:[a-z]+}", func(w http.ResponseWriter, r *http.Request) {
-		serveProfileImage(be, w, r, mux.Vars(r)["userId"], mux.Vars(r)["profileId"], r.URL.Query().Get("rk"), false)
-	})
-	router.HandleFunc("/profile/{userId:[a-z0-9]{26}}/{profileId:[a-z]+}/thumbnail", func(w http.ResponseWriter, r *http.Request) {
-		serveProfileImage(be, w, r, mux.Vars(r)["userId"], mux.Vars(r)["profileId"], r.URL.Query().Get("rk"), true)
-	})
+	router.HandleFunc("/profile/{userId:[a-z0-9]{26}}/{profileId}", func(w http.ResponseWriter, r *http.Request) {
+		serveProfileImage(be, w, r, mux.Vars(r)["userId"], mux.Vars(r)["profileId"], 0, false)
+	}).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/profile/{userId:[a-z0-9]{26}}/{profileId}/thumbnail", func(w http.ResponseWriter, r *http.Request) {
+		serveProfileImage(be, w, r, mux.Vars(r)["userId"], mux.Vars(r)["profileId"], 0, true)
+	}).Methods(http.MethodGet, http.MethodHead)
+	// Serve profile images of a specific profile version
+	router.HandleFunc("/profile/{userId:[a-z0-9]{26}}/{profileId}/version/{version:[1-9][0-9]{0,8}}", func(w http.ResponseWriter, r *http.Request) {
+		version, _ := strconv.Atoi(mux.Vars(r)["version"])
+		serveProfileImage(be, w, r, mux.Vars(r)["userId"], mux.Vars(r)["profileId"], version, false)
+	}).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/profile/{userId:[a-z0-9]{26}}/{profileId}/version/{version:[1-9][0-9]{0,8}}/thumbnail", func(w http.ResponseWriter, r *http.Request) {
+		version, _ := strconv.Atoi(mux.Vars(r)["version"])
+		serveProfileImage(be, w, r, mux.Vars(r)["userId"], mux.Vars(r)["profileId"], version, true)
+	}).Methods(http.MethodGet, http.MethodHead)
+	// Serve generated avatars from /avatar
+	router.HandleFunc("/avatar/{color:[0-9a-f]{6}}/{initials}", func(w http.ResponseWriter, r *http.Request) {
+		serveAvatar(be, w, r, mux.Vars(r)["color"], mux.Vars(r)["initials"], false)
+	}).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/avatar/{color:[0-9a-f]{6}}/{initials}/thumbnail", func(w http.ResponseWriter, r *http.Request) {
+		serveAvatar(be, w, r, mux.Vars(r)["color"], mux.Vars(r)["initials"], true)
+	}).Methods(http.MethodGet, http.MethodHead)
+	// Let external tools post messages with a token
+	router.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+		serveWebhook(be, w, r)
+	}).Methods(http.MethodPost).Name(ROUTE_WEBHOOK)
 	router.HandleFunc("/api/v1/confirm", func(w http.ResponseWriter, r *http.Request) {
 		serveConfirm(be, w, r)
 	})
 	router.HandleFunc("/api/v1/echo", func(w http.ResponseWriter, r *http.Request) {
 		serveEcho(be, w, r)
 	})
+	router.HandleFunc("/api/v1/decline", func(w http.ResponseWriter, r *http.Request) {
+		serveDecline(be, w, r)
+	})
+	// Serve the REST API from /api/v1
+	addAPIRoutes(router, be)
+	// Serve other plugins from /interplugin/v1
+	addInterPluginRoutes(router, be)
 	return router
 }
 
+// ROUTE_WEBHOOK names the route that authenticates requests with a token
+// instead of requiring a Mattermost session.
+const ROUTE_WEBHOOK = "webhook"
+
 func checkAuthenticity(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route != nil && route.GetName() == ROUTE_WEBHOOK {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Requests from other plugins are not made by a user. Mattermost sets
+		// Mattermost-Plugin-ID on them, and removes it from requests from outside.
+		if route != nil && strings.HasPrefix(route.GetName(), ROUTE_INTERPLUGIN_PREFIX) {
+			if r.Header.Get("Mattermost-Plugin-ID") == "" {
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
 		if r.Header.Get("Mattermost-User-ID") == "" {
 			http.Error(w, "Not authorized", http.StatusUnauthorized)
 			return
@@ -65,12 +117,97 @@ func serveStaticFile(be Backend, w http.ResponseWriter, r *http.Request, path st
 		http.NotFound(w, r)
 		return
 	}
-	http.ServeFile(w, r, filepath.Join(be.GetBundlePath(), "assets", filename))
+	file, err := os.Open(filepath.Join(be.GetBundlePath(), "assets", filename))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Static files only change when the plugin is upgraded, so the size and
+	// modification time identify the content.
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", stat.ModTime().UnixNano(), stat.Size()))
+	http.ServeContent(w, r, filename, stat.ModTime(), file)
+}
+
+// imageETag returns a strong ETag for a profile image. The request key is
+// included since it changes whenever the picture does, but hashed so that it
+// is not revealed.
+func imageETag(fileId, variant, crop, requestKey string) string {
+	sum := sha256.Sum256([]byte(fileId + "\n" + variant + "\n" + crop + "\n" + requestKey))
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
+
+// notModified returns whether a conditional GET or HEAD request can be answered
+// with 304 Not Modified. As per RFC 7232, If-Modified-Since is ignored when
+// If-None-Match is present.
+func notModified(r *http.Request, etag string, modtime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			// Weak comparison is used for If-None-Match.
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modtime.IsZero() {
+		return false
+	}
+	return !modtime.Truncate(time.Second).After(ims)
 }
 
-func serveProfileImage(be Backend, w http.ResponseWriter, r *http.Request, userId string, profileId string, requestKey string, thumbnail bool) {
+// getProfileForImage returns the profile whose picture should be served for
+// the given request. The authorized function tells whether the request is
+// authorized for a profile.
+func getProfileForImage(be Backend, userId string, profileId string, version int, authorized func(profile *Profile) bool) (*Profile, *model.AppError) {
+	if version > 0 {
+		return GetProfileAtVersion(be, userId, profileId, version)
+	}
 	profile, err := GetProfile(be, userId, profileId, PROFILE_CORRUPT|PROFILE_ME|PROFILE_CHARACTER|PROFILE_NONEXISTENT)
 	if profile == nil && err != nil {
+		return nil, err
+	}
+	// Messages using a deleted profile keep their picture while the profile is
+	// in the trash, even if a new profile with the same identifier is created.
+	if profile.Status == PROFILE_NONEXISTENT || (profile.Status == PROFILE_CHARACTER && !authorized(profile)) {
+		trashedProfile, tErr := GetTrashedProfile(be, userId, profileId)
+		if tErr != nil {
+			return nil, tErr
+		}
+		if trashedProfile != nil && trashedProfile.Status == PROFILE_CHARACTER && authorized(trashedProfile) {
+			profile = trashedProfile
+		}
+	}
+	return profile, nil
+}
+
+func serveProfileImage(be Backend, w http.ResponseWriter, r *http.Request, userId string, profileId string, version int, thumbnail bool) {
+	profileId = NormalizeIdentifier(profileId)
+	if validateIdentifier(profileId) != nil {
+		http.NotFound(w, r)
+		return
+	}
+	variant := IMAGE_VARIANT_FULL
+	if thumbnail {
+		variant = IMAGE_VARIANT_THUMBNAIL
+	}
+	query := r.URL.Query()
+	requesterId := r.Header.Get("Mattermost-User-ID")
+	authorized := func(profile *Profile) bool {
+		return checkImageSignature(be, *profile, version, variant, query, true)
+	}
+	profile, err := getProfileForImage(be, userId, profileId, version, authorized)
+	if err != nil {
 		http.Error(w, ErrStr(err), http.StatusInternalServerError)
 		return
 	}
@@ -94,8 +231,30 @@ func serveProfileImage(be Backend, w http.ResponseWriter, r *http.Request, userI
 		http.Error(w, "Profile image request key not set", http.StatusInternalServerError)
 		return
 	}
-	if profile.RequestKey != requestKey {
-		http.Error(w, "Invalid request key", http.StatusForbidden)
+	if !authorized(profile) {
+		http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+		return
+	}
+	if isImageQueryExpired(be, query) {
+		// Messages keep the URL they were posted with, so expired URLs are
+		// accepted from those who can see such messages.
+		canSee, err := canSeeProfileMessages(be, requesterId, userId, profile.Identifier)
+		if err != nil {
+			http.Error(w, ErrStr(err), http.StatusInternalServerError)
+			return
+		}
+		if !canSee {
+			http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+			return
+		}
+	}
+	canView, err := canViewProfileImage(be, requesterId, userId, profile.Identifier)
+	if err != nil {
+		http.Error(w, ErrStr(err), http.StatusInternalServerError)
+		return
+	}
+	if !canView {
+		http.Error(w, "Not a member of any channel where this profile is used", http.StatusForbidden)
 		return
 	}
 	info := profile.PictureFileInfo
@@ -103,27 +262,38 @@ func serveProfileImage(be Backend, w http.ResponseWriter, r *http.Request, userI
 		http.Error(w, "Could not get file info", http.StatusInternalServerError)
 		return
 	}
-	// Serve the file. Some of this code is copied and refactored from
-	// mattermost-server/api4/file.go.
-	path := ""
-	contentType := ""
-	if thumbnail {
-		path = info.ThumbnailPath
-		contentType = api4.ThumbnailImageType
-	} else {
-		path = info.Path
-		contentType = info.MimeType
-	}
-	if path == "" {
-		http.NotFound(w, r)
+	modtime := time.Unix(0, info.UpdateAt*int64(MICROSECONDS_PER_SECOND))
+	header := w.Header()
+	header.Set("Cache-Control", "private, immutable, max-age=604800")
+	header.Set("ETag", imageETag(info.Id, pictureRenderVariant(be, variant), profile.PictureCrop, profile.RequestKey))
+	// Answer conditional requests before rendering or reading the file.
+	if notModified(r, header.Get("ETag"), modtime) {
+		header.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
-	content, cErr := be.ReadFile(path)
-	if cErr != nil {
-		http.Error(w, ErrStr(cErr), http.StatusInternalServerError)
-		return
+	content, contentType, pErr := getProfilePicture(be, *profile, variant)
+	ext := ".jpg"
+	switch contentType {
+	case "image/png":
+		ext = ".png"
+	case "image/gif":
+		ext = ".gif"
+	}
+	if pErr != nil {
+		// Serve the generated avatar if the picture cannot be processed, rather
+		// than the uploaded file, which was never checked.
+		var aErr *model.AppError
+		content, aErr = getProfileAvatar(be, *profile, variant)
+		if aErr != nil {
+			http.Error(w, ErrStr(aErr), http.StatusInternalServerError)
+			return
+		}
+		contentType = "image/png"
+		ext = ".png"
+		header.Set("ETag", imageETag(info.Id, variant+"-avatar", profile.PictureCrop, profile.RequestKey))
 	}
-	filename := profile.Identifier + filepath.Ext(info.Name)
+	filename := url.PathEscape(profile.Identifier + ext)
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	} else {
@@ -134,19 +304,50 @@ func serveProfileImage(be Backend, w http.ResponseWriter, r *http.Request, userI
 			}
 		}
 	}
-	header := w.Header()
-	header.Set("Cache-Control", "private, immutable, max-age=604800")
 	header.Set("Content-Disposition", "inline;filename=\""+filename+"\"; filename*=UTF-8''"+filename)
 	header.Set("Content-Security-Policy", "Frame-ancestors 'none'")
 	header.Set("Content-Type", contentType)
-	header.Set("Last-Modified", time.Unix(0, info.UpdateAt*int64(MICROSECONDS_PER_SECOND)).UTC().Format(http.TimeFormat))
 	header.Set("X-Content-Type-Options", "nosniff")
 	header.Set("X-Frame-Options", "DENY")
-	_, wErr := w.Write(content)
-	if wErr != nil {
-		http.Error(w, wErr.Error(), http.StatusInternalServerError)
+	// ServeContent sets Last-Modified and handles HEAD and Range requests.
+	http.ServeContent(w, r, filename, modtime, bytes.NewReader(content))
+}
+
+func serveAvatar(be Backend, w http.ResponseWriter, r *http.Request, colorHex, initials string, thumbnail bool) {
+	if !validAvatarInitials(initials) {
+		http.NotFound(w, r)
+		return
+	}
+	variant := IMAGE_VARIANT_FULL
+	if thumbnail {
+		variant = IMAGE_VARIANT_THUMBNAIL
+	}
+	header := w.Header()
+	// Avatars never change, since their URL holds everything they show.
+	header.Set("Cache-Control", "private, immutable, max-age=604800")
+	header.Set("ETag", "\""+avatarHash(initials, colorHex, pictureSizes[variant])+"\"")
+	if notModified(r, header.Get("ETag"), time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	known, err := isKnownAvatar(be, initials, colorHex)
+	if err != nil {
+		http.Error(w, ErrStr(err), http.StatusInternalServerError)
 		return
 	}
+	var content []byte
+	if known {
+		content, err = getAvatar(be, initials, colorHex, variant)
+	} else {
+		content, err = RenderAvatar(initials, colorHex, pictureSizes[variant])
+	}
+	if err != nil {
+		http.Error(w, ErrStr(err), http.StatusInternalServerError)
+		return
+	}
+	header.Set("Content-Type", "image/png")
+	header.Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "avatar.png", time.Time{}, bytes.NewReader(content))
 }
 
 // Subset of model.PostActionIntegrationRequest
@@ -198,6 +399,68 @@ func serveConfirm(be Backend, w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// serveDecline handles the button that declines an assigned profile. The
+// button is in a real direct message from the bot account rather than an
+// ephemeral one, so that message is updated to tell the outcome instead of
+// showing the button. Only the direct message of the latest assignment to the
+// user is accepted, and the channel is taken from it rather than from the
+// request.
+func serveDecline(be Backend, w http.ResponseWriter, r *http.Request) {
+	var ir model.PostActionIntegrationRequest
+	dErr := json.NewDecoder(r.Body).Decode(&ir)
+	if dErr != nil {
+		http.Error(w, dErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if ir.UserId != r.Header.Get("Mattermost-User-ID") {
+		http.Error(w, "User ID mismatch", http.StatusBadRequest)
+		return
+	}
+	botUserId := be.GetBotUserId()
+	post, err := GetPostIfExists(be, ir.PostId)
+	if err != nil {
+		http.Error(w, ErrStr(err), http.StatusInternalServerError)
+		return
+	}
+	if post == nil || botUserId == "" || post.UserId != botUserId {
+		http.NotFound(w, r)
+		return
+	}
+	dm, err := be.GetDirectChannel(ir.UserId, botUserId)
+	if err != nil {
+		http.Error(w, ErrStr(err), http.StatusInternalServerError)
+		return
+	}
+	channelId, _ := post.GetProp(ASSIGNMENT_CHANNEL_PROP).(string)
+	if post.ChannelId != dm.Id || channelId == "" {
+		http.NotFound(w, r)
+		return
+	}
+	assignment, err := getAssignment(be, ir.UserId, channelId)
+	if err != nil {
+		http.Error(w, ErrStr(err), http.StatusInternalServerError)
+		return
+	}
+	if assignment == nil || assignment.NoticePostId != post.Id {
+		http.NotFound(w, r)
+		return
+	}
+	msg, _, eErr := DoExecuteCommand(be, declineCommand(channelId), ir.UserId, dm.Id, ir.TeamId, "", true)
+	if eErr != nil {
+		http.Error(w, eErr.Message, http.StatusConflict)
+		return
+	}
+	updated := DeepClonePost(post)
+	updated.Message = msg
+	updated.DelProp("attachments")
+	_, err = be.UpdatePost(updated)
+	if err != nil {
+		http.Error(w, ErrStr(err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func serveEcho(be Backend, w http.ResponseWriter, r *http.Request) {
 	servePAIR(be, w, r, func(be Backend, w http.ResponseWriter, ir PAIR) (string, model.StringInterface) {
 		iconURL := GetPluginURL(be) + "/static/botprofilepicture"
@@ -0,0 +1,107 @@
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+// request sends a request for a URL to the plugin's router.
+func request(be main.Backend, method, userId, rawURL string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, strings.TrimPrefix(rawURL, main.GetPluginURL(be)), nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	r.Header.Set("Mattermost-User-ID", userId)
+	w := httptest.NewRecorder()
+	main.RouterFromBackend(be).ServeHTTP(w, r)
+	return w
+}
+
+func TestConditionalImageRequests(t *testing.T) {
+	be := newMockBackend()
+	be.Files = map[string][]byte{"some-path-to/file1.png": testPNG(t, 20, 10)}
+	rendered, _, err := main.RenderProfilePicture(be.Files["some-path-to/file1.png"], "", 512, false)
+	assert.Nil(t, err)
+	cmd(t, be, "/character picture haddock=Captain Haddock", tUser1, tChannel1, tTeam1, tPost1,
+		"Character profile `haddock` created with display name \"Captain Haddock\" and a profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", versionImg(t, be, tUser1, "haddock", 1)}})
+	imageURL := versionImg(t, be, tUser1, "haddock", 1)(false)
+	w := request(be, http.MethodGet, tUser2, imageURL, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, rendered, w.Body.Bytes())
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	etag := w.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+	lastModified := w.Header().Get("Last-Modified")
+	assert.NotEmpty(t, lastModified)
+	// The ETag differs between variants
+	thumbURL := versionImg(t, be, tUser1, "haddock", 1)(true)
+	assert.NotEqual(t, etag, request(be, http.MethodGet, tUser2, thumbURL, nil).Header().Get("ETag"))
+	// Conditional requests
+	w = request(be, http.MethodGet, tUser2, imageURL, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	w = request(be, http.MethodGet, tUser2, imageURL, http.Header{"If-None-Match": {`"other", W/` + etag}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	w = request(be, http.MethodGet, tUser2, imageURL, http.Header{"If-None-Match": {`"other"`}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request(be, http.MethodGet, tUser2, imageURL, http.Header{"If-Modified-Since": {lastModified}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	w = request(be, http.MethodGet, tUser2, imageURL, http.Header{"If-Modified-Since": {"Mon, 01 Jan 1968 00:00:00 GMT"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	// Authorization is checked before conditional requests are answered
+	w = request(be, http.MethodGet, tUser2, strings.Replace(imageURL, "sig=", "sig=0", 1), http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	// HEAD and byte ranges
+	w = request(be, http.MethodHead, tUser2, imageURL, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, strconv.Itoa(len(rendered)), w.Header().Get("Content-Length"))
+	assert.Empty(t, w.Body.String())
+	w = request(be, http.MethodGet, tUser2, imageURL, http.Header{"Range": {"bytes=2-4"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, rendered[2:5], w.Body.Bytes())
+	assert.Equal(t, fmt.Sprintf("bytes 2-4/%d", len(rendered)), w.Header().Get("Content-Range"))
+	w = request(be, http.MethodGet, tUser2, imageURL, http.Header{"Range": {"bytes=2-4"}, "If-Range": {`"other"`}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, request(be, http.MethodPost, tUser2, imageURL, nil).Code)
+	// A new picture gives a new ETag
+	file2, post2 := "file2aaaaaaaaaaaaaaaaaaaaa", "post2aaaaaaaaaaaaaaaaaaaaa"
+	be.FileInfos[file2] = &model.FileInfo{Id: file2, CreatorId: tUser1, CreateAt: 2, UpdateAt: 2, Path: "some-path-to/file2.png", Name: "file2.png", Extension: "png", MimeType: "image/png", PostId: post2}
+	be.Posts[post2] = &model.Post{Id: post2, UserId: tUser1, ChannelId: tChannel1, FileIds: []string{file2}}
+	cmd(t, be, "/character picture haddock", tUser1, tChannel1, tTeam1, post2,
+		"Character profile `haddock` modified by updating the profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", versionImg(t, be, tUser1, "haddock", 2)}})
+	w = request(be, http.MethodGet, tUser2, versionImg(t, be, tUser1, "haddock", 2)(false), http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+func TestConditionalStaticRequests(t *testing.T) {
+	be := newMockBackend()
+	be.BundlePath = ".."
+	w := request(be, http.MethodGet, tUser1, "/static/defaultprofilepicture", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	w = request(be, http.MethodGet, tUser1, "/static/defaultprofilepicture", http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	w = request(be, http.MethodHead, tUser1, "/static/defaultprofilepicture", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String())
+	w = request(be, http.MethodGet, tUser1, "/static/defaultprofilepicture", http.Header{"Range": {"bytes=0-3"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "\x89PNG", w.Body.String())
+	assert.Equal(t, http.StatusNotFound, request(be, http.MethodGet, tUser1, "/static/nonexistent", nil).Code)
+}
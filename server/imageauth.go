@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// When RestrictImagesToChannelMembers is set, a profile image is only served to
+// the owner of the profile and to members of a channel where the profile has
+// been used, according to the channel index. Since checking channel membership
+// may take several API calls, a positive result is cached in the KV store for
+// a few minutes. The same check lets members use expired image URLs, since messages
+// keep the URL they were posted with.
+
+const IMAGE_AUTHORIZATION_CACHE_SECONDS = 5 * 60
+
+func getImageAuthorizationKey(requesterId, userId, profileId string) string {
+	return fmt.Sprintf("imageauth_%s_%s_%s", requesterId, userId, encodeIdentifierForKey(profileId))
+}
+
+// canViewProfileImage returns whether a user may view the profile image of a
+// profile owned by another user.
+func canViewProfileImage(be Backend, requesterId, userId, profileId string) (bool, *model.AppError) {
+	if !be.GetConfiguration().RestrictImagesToChannelMembers {
+		return true, nil
+	}
+	return canSeeProfileMessages(be, requesterId, userId, profileId)
+}
+
+// canSeeProfileMessages returns whether a user is the owner of a profile or a
+// member of a channel where it has been used.
+func canSeeProfileMessages(be Backend, requesterId, userId, profileId string) (bool, *model.AppError) {
+	if requesterId == userId {
+		return true, nil
+	}
+	key := getImageAuthorizationKey(requesterId, userId, profileId)
+	cached, err := be.KVGet(key)
+	if err != nil {
+		return false, err
+	}
+	if cached != nil {
+		return true, nil
+	}
+	authorized, err := sharesChannelWithProfile(be, requesterId, userId, profileId)
+	if err != nil || !authorized {
+		return false, err
+	}
+	// Denials are not cached, so that a profile is visible to the members of a
+	// channel as soon as it is used there.
+	err = be.KVSetWithExpiry(key, []byte("1"), IMAGE_AUTHORIZATION_CACHE_SECONDS)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sharesChannelWithProfile returns whether a user is a member of any channel
+// where a profile has been used.
+func sharesChannelWithProfile(be Backend, requesterId, userId, profileId string) (bool, *model.AppError) {
+	channelIds, err := GetProfileChannels(be, userId, profileId)
+	if err != nil {
+		return false, err
+	}
+	for _, channelId := range channelIds {
+		member, err := be.GetChannelMember(channelId, requesterId)
+		if err != nil && err.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if member != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
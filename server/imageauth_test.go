@@ -0,0 +1,47 @@
+package main_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+func TestRestrictImagesToChannelMembers(t *testing.T) {
+	be := newMockBackend()
+	tUser3 := "user3aaaaaaaaaaaaaaaaaaaaa"
+	be.Users[tUser3] = &model.User{Id: tUser3, Username: "user-number-three"}
+	cmd(t, be, "/character picture haddock=Captain Haddock", tUser1, tChannel1, tTeam1, tPost1,
+		"Character profile `haddock` created with display name \"Captain Haddock\" and a profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	// Only the owner can see the picture before the profile is used
+	be.Configuration = &main.Configuration{RestrictImagesToChannelMembers: true}
+	iconURL := versionImg(t, be, tUser1, "haddock", 1)(false)
+	assert.Equal(t, http.StatusOK, getImage(be, tUser1, iconURL))
+	assert.Equal(t, http.StatusForbidden, getImage(be, tUser2, iconURL))
+	// Using the profile in a channel makes the picture visible to its members
+	// right away
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Blistering barnacles!"},
+		"haddock", "Captain Haddock", versionImg(t, be, tUser1, "haddock", 1))
+	channels, err := main.GetProfileChannels(be, tUser1, "haddock")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{tChannel1}, channels)
+	assert.Equal(t, http.StatusOK, getImage(be, tUser2, iconURL))
+	assert.Equal(t, http.StatusForbidden, getImage(be, tUser3, iconURL))
+	// Without the restriction, anyone can see it
+	be.Configuration = nil
+	assert.Equal(t, http.StatusOK, getImage(be, tUser3, iconURL))
+	// Messages sent before the channel index existed are indexed once
+	assert.Nil(t, be.KVDelete("profilechannels_"+tUser1+"_haddock"))
+	channels, err = main.GetProfileChannels(be, tUser1, "haddock")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(channels))
+	assert.Nil(t, main.RunDueJobs(be))
+	channels, err = main.GetProfileChannels(be, tUser1, "haddock")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{tChannel1}, channels)
+}
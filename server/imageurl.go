@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Profile images are served with signed, expiring URLs. The signature is an
+// HMAC of the user, profile, version, request key, image variant and expiry
+// time, using a per-installation secret stored in the KV store. Expired URLs
+// are still accepted from the owner of the profile and from members of
+// channels where it has been used, so that messages keep the URL they were
+// posted with while links passed on to others stop working.
+//
+// When the secret is rotated, the previous secret is still accepted until a
+// periodic job has re-signed the URLs in all messages. URLs using only the
+// request key (`?rk=`) are accepted unless disabled in the configuration, and
+// are replaced by signed URLs by the same job. The job only goes through the
+// messages when there is something to re-sign.
+
+const URL_SIGNING_SECRETS_KEY = "urlsigningsecrets"
+
+const (
+	IMAGE_VARIANT_FULL      = "full"
+	IMAGE_VARIANT_THUMBNAIL = "thumbnail"
+)
+
+type urlSigningSecrets struct {
+	Current  string `json:"current"`
+	Previous string `json:"previous,omitempty"`
+}
+
+func newURLSigningSecret() (string, *model.AppError) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", appError("Failed to generate URL signing secret.", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// getURLSigningSecrets returns the URL signing secrets along with the raw JSON
+// value, creating them if they do not exist.
+func getURLSigningSecrets(be Backend) (*urlSigningSecrets, []byte, *model.AppError) {
+	for {
+		b, err := be.KVGet(URL_SIGNING_SECRETS_KEY)
+		if err != nil {
+			return nil, nil, err
+		}
+		if b != nil {
+			secrets := urlSigningSecrets{}
+			jsonErr := json.Unmarshal(b, &secrets)
+			if jsonErr != nil || secrets.Current == "" {
+				return nil, nil, appError("Failed to decode URL signing secrets.", jsonErr)
+			}
+			return &secrets, b, nil
+		}
+		secret, err := newURLSigningSecret()
+		if err != nil {
+			return nil, nil, err
+		}
+		newJson, _ := json.Marshal(urlSigningSecrets{Current: secret})
+		_, err = be.KVCompareAndSet(URL_SIGNING_SECRETS_KEY, nil, newJson)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Whether or not we won the race, read back the stored secrets.
+	}
+}
+
+// RotateURLSigningSecret replaces the URL signing secret. URLs signed with the
+// old secret keep working until they have been re-signed, which is done on the
+// next check for periodic jobs.
+func RotateURLSigningSecret(be Backend) *model.AppError {
+	secrets, oldJson, err := getURLSigningSecrets(be)
+	if err != nil {
+		return err
+	}
+	secret, err := newURLSigningSecret()
+	if err != nil {
+		return err
+	}
+	newJson, _ := json.Marshal(urlSigningSecrets{Current: secret, Previous: secrets.Current})
+	ok, err := be.KVCompareAndSet(URL_SIGNING_SECRETS_KEY, oldJson, newJson)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return appError("The URL signing secret was rotated concurrently. Please try again.", nil)
+	}
+	return be.KVDelete(getJobLastRunKey(REFRESH_IMAGE_URLS_JOB))
+}
+
+// forgetPreviousURLSigningSecret stops accepting URLs signed with the previous
+// secret. It must only be called after all URLs have been re-signed since the
+// secret was rotated.
+func forgetPreviousURLSigningSecret(be Backend, secrets *urlSigningSecrets, oldJson []byte) *model.AppError {
+	if secrets.Previous == "" {
+		return nil
+	}
+	newJson, _ := json.Marshal(urlSigningSecrets{Current: secrets.Current})
+	// If this fails, the secret has been rotated again and the previous secret
+	// must still be accepted.
+	_, err := be.KVCompareAndSet(URL_SIGNING_SECRETS_KEY, oldJson, newJson)
+	return err
+}
+
+func imageURLSignature(secret, userId, profileId string, version int, requestKey, variant string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n%s\n%d", userId, profileId, version, requestKey, variant, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// imageURLExpiry returns the expiry time, in seconds, for an image URL signed
+// now. It is rounded up to a whole day, so that URLs signed on the same day are
+// the same.
+func imageURLExpiry(be Backend) int64 {
+	lifetime := int64(be.GetConfiguration().GetImageURLLifetimeDays()) * MILLISECONDS_PER_DAY
+	expires := (be.GetMillis() + lifetime + MILLISECONDS_PER_DAY - 1) / MILLISECONDS_PER_DAY * MILLISECONDS_PER_DAY
+	return expires / 1000
+}
+
+// signedImageQuery returns the query string authorizing a request for an image
+// of the given profile.
+func signedImageQuery(be Backend, profile Profile, variant string) (string, *model.AppError) {
+	secrets, _, err := getURLSigningSecrets(be)
+	if err != nil {
+		return "", err
+	}
+	expires := imageURLExpiry(be)
+	sig := imageURLSignature(secrets.Current, profile.UserId, profile.Identifier, profile.Version, profile.RequestKey, variant, expires)
+	return fmt.Sprintf("exp=%d&sig=%s", expires, sig), nil
+}
+
+// checkImageSignature returns whether a query string authorizes a request for
+// an image of the given profile. The version is the one given in the URL, which
+// is 0 for URLs without a version. Expired signatures are accepted only if
+// allowExpired is set.
+func checkImageSignature(be Backend, profile Profile, version int, variant string, query url.Values, allowExpired bool) bool {
+	sig := query.Get("sig")
+	if sig == "" {
+		if be.GetConfiguration().DisableLegacyImageURLs {
+			return false
+		}
+		requestKey := query.Get("rk")
+		return requestKey != "" && requestKey == profile.RequestKey
+	}
+	expires, pErr := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if pErr != nil {
+		return false
+	}
+	if !allowExpired && expires*1000 < be.GetMillis() {
+		return false
+	}
+	secrets, _, err := getURLSigningSecrets(be)
+	if err != nil {
+		return false
+	}
+	for _, secret := range []string{secrets.Current, secrets.Previous} {
+		if secret == "" {
+			continue
+		}
+		expected := imageURLSignature(secret, profile.UserId, profile.Identifier, version, profile.RequestKey, variant, expires)
+		if hmac.Equal([]byte(expected), []byte(sig)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isImageQueryExpired returns whether a query string holds an expired
+// signature.
+func isImageQueryExpired(be Backend, query url.Values) bool {
+	if query.Get("sig") == "" {
+		return false
+	}
+	expires, pErr := strconv.ParseInt(query.Get("exp"), 10, 64)
+	return pErr != nil || expires*1000 < be.GetMillis()
+}
+
+// Re-signing image URLs in messages
+
+const REFRESH_IMAGE_URLS_JOB = "refreshimageurls"
+
+// LEGACY_IMAGE_URLS_DONE_KEY is set once no messages are known to use legacy
+// image URLs.
+const LEGACY_IMAGE_URLS_DONE_KEY = "legacyimageurlsdone"
+
+var profileImageURLPathRegexp = regexp.MustCompile(`^/profile/([a-z0-9]{26})/([^/]+)(?:/version/([1-9][0-9]{0,8}))?(/thumbnail)?$`)
+
+// refreshImageURL returns a version of a profile image URL signed with the
+// current secret, or the same URL if it already is.
+func refreshImageURL(be Backend, rawURL string, secrets *urlSigningSecrets) (string, *model.AppError) {
+	pluginURL := GetPluginURL(be)
+	if !strings.HasPrefix(rawURL, pluginURL+"/profile/") {
+		return rawURL, nil
+	}
+	parsed, pErr := url.Parse(strings.TrimPrefix(rawURL, pluginURL))
+	if pErr != nil {
+		return rawURL, nil
+	}
+	matches := profileImageURLPathRegexp.FindStringSubmatch(parsed.Path)
+	if matches == nil {
+		return rawURL, nil
+	}
+	query := parsed.Query()
+	userId := matches[1]
+	profileId := NormalizeIdentifier(matches[2])
+	version, _ := strconv.Atoi(matches[3])
+	variant := IMAGE_VARIANT_FULL
+	if matches[4] != "" {
+		variant = IMAGE_VARIANT_THUMBNAIL
+	}
+	authorized := func(profile *Profile) bool {
+		return checkImageSignature(be, *profile, version, variant, query, true)
+	}
+	profile, err := getProfileForImage(be, userId, profileId, version, authorized)
+	if err != nil {
+		return "", err
+	}
+	if profile.Status != PROFILE_CHARACTER || !authorized(profile) {
+		// Re-signing an invalid URL would grant access it never had.
+		return rawURL, nil
+	}
+	if query.Get("sig") != "" {
+		expires, _ := strconv.ParseInt(query.Get("exp"), 10, 64)
+		current := imageURLSignature(secrets.Current, userId, profileId, version, profile.RequestKey, variant, expires)
+		if current == query.Get("sig") {
+			return rawURL, nil
+		}
+	}
+	profile.Version = version
+	return profileIconUrl(be, *profile, variant == IMAGE_VARIANT_THUMBNAIL)
+}
+
+// RefreshImageURLs re-signs the profile image URLs of all messages using a
+// character profile that were signed with a previous secret or use the legacy
+// request key. Messages are only gone through after the secret has been
+// rotated, or while legacy URLs may remain.
+func RefreshImageURLs(be Backend) *model.AppError {
+	secrets, secretsJson, err := getURLSigningSecrets(be)
+	if err != nil {
+		return err
+	}
+	legacyDone, err := be.KVGet(LEGACY_IMAGE_URLS_DONE_KEY)
+	if err != nil {
+		return err
+	}
+	if secrets.Previous == "" && legacyDone != nil {
+		return nil
+	}
+	err = forEachUserProfile(be, func(userId, profileId string) *model.AppError {
+		return refreshImageURLsForProfile(be, userId, profileId, secrets)
+	})
+	if err != nil {
+		return err
+	}
+	err = be.KVSet(LEGACY_IMAGE_URLS_DONE_KEY, []byte("1"))
+	if err != nil {
+		return err
+	}
+	return forgetPreviousURLSigningSecret(be, secrets, secretsJson)
+}
+
+func refreshImageURLsForProfile(be Backend, userId, profileId string, secrets *urlSigningSecrets) *model.AppError {
+	return IdsetIter(be, getIdsetKey(userId, profileId), "", 0, func(postId string) *model.AppError {
+		post, err := GetPostIfExists(be, postId)
+		if err != nil {
+			return err
+		}
+		if post == nil {
+			return nil
+		}
+		oldURL, ok := post.Props["override_icon_url"].(string)
+		if !ok {
+			return nil
+		}
+		newURL, err := refreshImageURL(be, oldURL, secrets)
+		if err != nil {
+			return err
+		}
+		if newURL == oldURL {
+			return nil
+		}
+		newPost := DeepClonePost(post)
+		newPost.AddProp("override_icon_url", newURL)
+		_, err = be.UpdatePost(newPost)
+		return err
+	})
+}
@@ -0,0 +1,116 @@
+package main_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+// signedImageURL returns the expected signed URL of a profile picture.
+func signedImageURL(t *testing.T, be main.Backend, userId, profileId string, version int, requestKey string, thumb bool) string {
+	b, err := be.KVGet(main.URL_SIGNING_SECRETS_KEY)
+	assert.Nil(t, err)
+	secrets := struct {
+		Current string `json:"current"`
+	}{}
+	assert.Nil(t, json.Unmarshal(b, &secrets))
+	day := int64(24 * 60 * 60 * 1000)
+	expires := (be.GetMillis() + 30*day + day - 1) / day * day / 1000
+	variant := "full"
+	variantPath := ""
+	if thumb {
+		variant = "thumbnail"
+		variantPath = "/thumbnail"
+	}
+	versionPath := ""
+	if version > 0 {
+		versionPath = fmt.Sprintf("/version/%d", version)
+	}
+	mac := hmac.New(sha256.New, []byte(secrets.Current))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n%s\n%d", userId, profileId, version, requestKey, variant, expires)
+	return fmt.Sprintf("%s/profile/%s/%s%s%s?exp=%d&sig=%s", main.GetPluginURL(be), userId, url.PathEscape(profileId), versionPath, variantPath, expires, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// getImage requests a URL from the plugin's router and returns the status code.
+func getImage(be main.Backend, userId, rawURL string) int {
+	return request(be, http.MethodGet, userId, rawURL, nil).Code
+}
+
+func TestSignedImageURLs(t *testing.T) {
+	be := newMockBackend()
+	cmd(t, be, "/character picture haddock=Captain Haddock", tUser1, tChannel1, tTeam1, tPost1,
+		"Character profile `haddock` created with display name \"Captain Haddock\" and a profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", versionImg(t, be, tUser1, "haddock", 1)}})
+	postId := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Blistering barnacles!"},
+		"haddock", "Captain Haddock", versionImg(t, be, tUser1, "haddock", 1))
+	iconURL := be.Posts[postId].Props["override_icon_url"].(string)
+	assert.Equal(t, http.StatusOK, getImage(be, tUser2, iconURL))
+	// The signature covers the variant and cannot be tampered with
+	thumbURL := versionImg(t, be, tUser1, "haddock", 1)(true)
+	assert.Equal(t, http.StatusOK, getImage(be, tUser2, thumbURL))
+	assert.Equal(t, http.StatusForbidden, getImage(be, tUser2, strings.Replace(thumbURL, "/thumbnail", "", 1)))
+	tampered := strings.Replace(iconURL, "sig=", "sig=0", 1)
+	assert.Equal(t, http.StatusForbidden, getImage(be, tUser2, tampered[:len(tampered)-1]))
+	// Legacy links using the request key work unless disabled
+	profile, err := main.GetProfile(be, tUser1, "haddock", main.PROFILE_CHARACTER)
+	assert.Nil(t, err)
+	legacyURL := fmt.Sprintf("%s/profile/%s/haddock?rk=%s", main.GetPluginURL(be), tUser1, profile.RequestKey)
+	assert.Equal(t, http.StatusOK, getImage(be, tUser2, legacyURL), legacyURL)
+	be.Configuration = &main.Configuration{DisableLegacyImageURLs: true}
+	assert.Equal(t, http.StatusForbidden, getImage(be, tUser2, legacyURL))
+	be.Configuration = nil
+	// Legacy links in messages are replaced by signed links
+	legacyPostId := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Thundering typhoons!"},
+		"haddock", "Captain Haddock", versionImg(t, be, tUser1, "haddock", 1))
+	be.Posts[legacyPostId].AddProp("override_icon_url", legacyURL)
+	*be.Millis += 10 * 24 * 60 * 60 * 1000
+	assert.Nil(t, main.RunDueJobs(be))
+	assert.Equal(t, iconURL, be.Posts[postId].Props["override_icon_url"])
+	assert.Equal(t, signedImageURL(t, be, tUser1, "haddock", 0, profile.RequestKey, false), be.Posts[legacyPostId].Props["override_icon_url"])
+	// Links expire except for members of channels where the profile is used,
+	// so messages need not be updated
+	tUser3 := "user3aaaaaaaaaaaaaaaaaaaaa"
+	be.Users[tUser3] = &model.User{Id: tUser3, Username: "user-number-three"}
+	assert.Equal(t, http.StatusOK, getImage(be, tUser3, iconURL))
+	*be.Millis += 22 * 24 * 60 * 60 * 1000
+	assert.Nil(t, main.RunDueJobs(be))
+	assert.Equal(t, iconURL, be.Posts[postId].Props["override_icon_url"])
+	assert.Equal(t, http.StatusOK, getImage(be, tUser2, iconURL))
+	assert.Equal(t, http.StatusOK, getImage(be, tUser1, iconURL))
+	assert.Equal(t, http.StatusForbidden, getImage(be, tUser3, iconURL))
+	assert.Equal(t, http.StatusOK, getImage(be, tUser3, versionImg(t, be, tUser1, "haddock", 1)(false)))
+	// Rotating the secret is reserved for system admins
+	cmdFail(t, be, "/character admin rotate-secret", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Only system administrators can rotate the secret.")
+	be.Users[tUser2].Roles = model.SYSTEM_USER_ROLE_ID + " " + model.SYSTEM_ADMIN_ROLE_ID
+	cmd(t, be, "/character admin rotate-secret", tUser2, tChannel1, tTeam1, "",
+		"Rotated the secret used to sign links to character profile pictures. Links in existing messages will be renewed within a few minutes, after which links signed with the old secret stop working.",
+		[]tAtt{})
+	// Old links keep working until messages have been updated
+	assert.Equal(t, http.StatusOK, getImage(be, tUser2, iconURL))
+	*be.Millis += 5 * 60 * 1000
+	assert.Nil(t, main.RunDueJobs(be))
+	assert.Equal(t, http.StatusForbidden, getImage(be, tUser2, iconURL))
+	iconURL = be.Posts[postId].Props["override_icon_url"].(string)
+	assert.Equal(t, versionImg(t, be, tUser1, "haddock", 1)(false), iconURL)
+	assert.Equal(t, http.StatusOK, getImage(be, tUser2, iconURL))
+	// Messages are not rejected when links cannot be signed
+	assert.Nil(t, be.KVSet(main.URL_SIGNING_SECRETS_KEY, []byte("corrupt")))
+	profiled, errStr := main.ProfiledPost(be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Ten thousand thundering typhoons!"}, false)
+	assert.Equal(t, "", errStr)
+	if assert.NotNil(t, profiled) {
+		assert.Equal(t, fmt.Sprintf("%s/profile/%s/haddock/version/1?rk=%s", main.GetPluginURL(be), tUser1, profile.RequestKey), profiled.Props["override_icon_url"])
+	}
+}
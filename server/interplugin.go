@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Other plugins on the server, such as dice rollers, can use the profiles of
+// users through the inter-plugin interface, by sending requests with
+// `PluginHTTP`. Mattermost marks such requests with the id of the sending
+// plugin, and they act on behalf of any user, so they are only accepted from
+// other plugins.
+
+// Route names of the inter-plugin interface begin with this.
+const ROUTE_INTERPLUGIN_PREFIX = "interplugin-"
+
+func addInterPluginRoutes(router *mux.Router, be Backend) {
+	ip := router.PathPrefix("/interplugin/v1").Subrouter()
+	ip.HandleFunc("/users/{userId:[a-z0-9]{26}}/channels/{channelId:[a-z0-9]{26}}/profile", func(w http.ResponseWriter, r *http.Request) {
+		serveInterPluginProfile(be, w, r, mux.Vars(r)["userId"], mux.Vars(r)["channelId"])
+	}).Methods(http.MethodGet).Name(ROUTE_INTERPLUGIN_PREFIX + "profile")
+	ip.HandleFunc("/posts/profile", func(w http.ResponseWriter, r *http.Request) {
+		serveInterPluginProfilePost(be, w, r)
+	}).Methods(http.MethodPost).Name(ROUTE_INTERPLUGIN_PREFIX + "post")
+}
+
+// activeProfile returns the profile to use for a user in a channel: the given
+// profile, or the default profile of the channel if profileId is empty. The
+// real profile is used instead of a default profile that no longer exists, as
+// it is for new messages.
+func activeProfile(be Backend, userId, channelId, profileId string) (*Profile, *model.AppError) {
+	if profileId != "" {
+		profile, err := GetProfile(be, userId, NormalizeIdentifier(profileId), PROFILE_CHARACTER|PROFILE_ME|PROFILE_NONEXISTENT)
+		if err != nil {
+			return nil, err
+		}
+		if profile.Status == PROFILE_NONEXISTENT {
+			return nil, serviceError(http.StatusNotFound, fmt.Sprintf("Character profile `%s` does not exist.", profile.Identifier))
+		}
+		return profile, nil
+	}
+	defaultProfileId, _, err := getEffectiveDefaultProfile(be, userId, channelId)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := GetProfile(be, userId, defaultProfileId, PROFILE_CHARACTER|PROFILE_ME)
+	if err != nil || profile == nil {
+		return GetProfile(be, userId, "", PROFILE_ME)
+	}
+	return profile, nil
+}
+
+// serveInterPluginProfile returns the profile a user has in a channel, which is
+// the default profile unless `?profile=` is given.
+func serveInterPluginProfile(be Backend, w http.ResponseWriter, r *http.Request, userId, channelId string) {
+	profile, err := activeProfile(be, userId, channelId, r.URL.Query().Get("profile"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiProfileFromProfile(be, *profile))
+}
+
+// serveInterPluginProfilePost applies a profile to a post given in the body,
+// which is the default profile of its author in the channel unless
+// `?profile=` is given. A new post, without id, is returned for the sending
+// plugin to create, with a nonce so that the posting hook keeps its profile.
+// For a post with an id, the stored post is updated instead and the other
+// fields of the body are ignored.
+func serveInterPluginProfilePost(be Backend, w http.ResponseWriter, r *http.Request) {
+	var post model.Post
+	if !decodeAPIRequest(w, r, &post) {
+		return
+	}
+	if post.Id != "" {
+		existing, err := GetPostIfExists(be, post.Id)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		if existing == nil {
+			writeAPIError(w, serviceError(http.StatusNotFound, fmt.Sprintf("Could not find message `%s`.", post.Id)))
+			return
+		}
+		post = *DeepClonePost(existing)
+	}
+	if post.UserId == "" || post.ChannelId == "" {
+		writeAPIError(w, appError("The message needs user_id and channel_id.", nil))
+		return
+	}
+	if post.IsSystemMessage() {
+		writeAPIError(w, appError("Cannot apply a profile to a system message.", nil))
+		return
+	}
+	profile, err := activeProfile(be, postAuthorId(be, &post), post.ChannelId, r.URL.Query().Get("profile"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if post.Id == "" {
+		postAsBot(be, &post, *profile)
+	}
+	profiled, errStr := profilePost(be, &post, *profile)
+	if errStr != "" {
+		writeAPIError(w, appError(errStr, nil))
+		return
+	}
+	if profiled.Id == "" {
+		err = addProfileNonce(be, profiled)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, profiled)
+		return
+	}
+	// The post is registered by the MessageHasBeenUpdated hook.
+	profiled, err = be.UpdatePost(profiled)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, profiled)
+}
@@ -0,0 +1,108 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+// interPluginRequest sends a request to the inter-plugin interface like
+// `PluginHTTP` does, and decodes the response into ret.
+func interPluginRequest(t *testing.T, be main.Backend, method, path, body string, ret interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(method, "/interplugin/v1"+path, strings.NewReader(body))
+	r.Header.Set("Mattermost-Plugin-ID", "com.example.dice-roller")
+	w := httptest.NewRecorder()
+	main.RouterFromBackend(be).ServeHTTP(w, r)
+	if ret != nil {
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), ret), w.Body.String())
+	}
+	return w.Code
+}
+
+func TestInterPlugin(t *testing.T) {
+	be := newMockBackend()
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	profilePath := "/users/" + tUser1 + "/channels/" + tChannel1 + "/profile"
+
+	// Only other plugins may use the interface
+	w := request(be, http.MethodGet, tUser1, "/interplugin/v1"+profilePath, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	r := httptest.NewRequest(http.MethodGet, "/interplugin/v1"+profilePath, nil)
+	w = httptest.NewRecorder()
+	main.RouterFromBackend(be).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Active profile
+	var profile main.APIProfile
+	assert.Equal(t, http.StatusOK, interPluginRequest(t, be, http.MethodGet, profilePath, "", &profile))
+	assert.Equal(t, "me", profile.Identifier)
+	assert.True(t, profile.RealProfile)
+	_, _, err := main.SetDefaultProfile(be, tUser1, tChannel1, "haddock")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, interPluginRequest(t, be, http.MethodGet, profilePath, "", &profile))
+	assert.Equal(t, "haddock", profile.Identifier)
+	assert.Equal(t, "Captain Haddock", profile.DisplayName)
+	assert.Equal(t, http.StatusOK, interPluginRequest(t, be, http.MethodGet, profilePath+"?profile=me", "", &profile))
+	assert.True(t, profile.RealProfile)
+	var apiErr main.APIError
+	assert.Equal(t, http.StatusNotFound, interPluginRequest(t, be, http.MethodGet, profilePath+"?profile=milou", "", &apiErr))
+	assert.Equal(t, "not_found", apiErr.Code)
+	// Other users have their own defaults
+	assert.Equal(t, http.StatusOK, interPluginRequest(t, be, http.MethodGet, "/users/"+tUser2+"/channels/"+tChannel1+"/profile", "", &profile))
+	assert.Equal(t, "me", profile.Identifier)
+
+	// Profile a new post, which is left for the sending plugin to create
+	var post model.Post
+	assert.Equal(t, http.StatusOK, interPluginRequest(t, be, http.MethodPost, "/posts/profile",
+		`{"user_id": "`+tUser1+`", "channel_id": "`+tChannel1+`", "message": "Haddock rolled 14"}`, &post))
+	assert.Equal(t, "", post.Id)
+	assert.Equal(t, tUser1, post.UserId)
+	assert.Equal(t, "Haddock rolled 14", post.Message)
+	assert.Equal(t, "haddock", post.GetProp("profile_identifier"))
+	assert.Equal(t, "Captain Haddock", post.GetProp("override_username"))
+	assert.Equal(t, "true", post.GetProp("from_webhook"))
+	// The posting hook keeps the profile of the returned post
+	profiled, errStr := main.ProfiledPost(be, &post, false)
+	assert.Equal(t, "", errStr)
+	assert.Equal(t, "haddock", profiled.GetProp("profile_identifier"))
+	assert.Nil(t, profiled.GetProp("profile_nonce"))
+	assert.Equal(t, http.StatusOK, interPluginRequest(t, be, http.MethodPost, "/posts/profile?profile=me",
+		`{"user_id": "`+tUser1+`", "channel_id": "`+tChannel1+`", "message": "I rolled 3"}`, &post))
+	assert.Nil(t, post.GetProp("profile_identifier"))
+	assert.Nil(t, post.GetProp("override_username"))
+	assert.Equal(t, http.StatusBadRequest, interPluginRequest(t, be, http.MethodPost, "/posts/profile",
+		`{"message": "Nobody rolled 1"}`, &apiErr))
+	assert.Equal(t, "invalid_request", apiErr.Code)
+
+	// Profile an existing post
+	existing, err := be.CreatePost(&model.Post{UserId: tUser2, ChannelId: tChannel1, Message: "Rolled 7"})
+	assert.Nil(t, err)
+	cmd(t, be, "/character milou=Milou", tUser2, tChannel1, tTeam1, "",
+		"Character profile `milou` created with display name \"Milou\"",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", nil}})
+	assert.Equal(t, http.StatusOK, interPluginRequest(t, be, http.MethodPost, "/posts/profile?profile=milou",
+		`{"id": "`+existing.Id+`", "message": "Ignored"}`, &post))
+	assert.Equal(t, existing.Id, post.Id)
+	assert.Equal(t, "Rolled 7", be.Posts[existing.Id].Message)
+	assert.Equal(t, "Milou", be.Posts[existing.Id].GetProp("override_username"))
+	// The update hook registers the post
+	assert.Nil(t, main.RegisterPost(be, be.Posts[existing.Id]))
+	// The post is updated when the profile changes
+	cmd(t, be, "/character milou=Snowy", tUser2, tChannel1, tTeam1, "",
+		"Character profile `milou` modified by changing the display name from \"Milou\" to \"Snowy\"",
+		[]tAtt{{"**Snowy**\n`milou`", "#5c66ff", nil}})
+	assert.Equal(t, "Snowy", be.Posts[existing.Id].GetProp("override_username"))
+	assert.Equal(t, http.StatusNotFound, interPluginRequest(t, be, http.MethodPost, "/posts/profile",
+		`{"id": "`+model.NewId()+`"}`, &apiErr))
+}
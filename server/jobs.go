@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Periodic jobs are run by RunDueJobs, which the plugin calls every
+// JOB_CHECK_INTERVAL. The time of the last run of each job is stored in the KV
+// store and claimed using compare-and-set, so that each job is run by at most
+// one server in a cluster, at most once per interval.
+
+const JOB_CHECK_INTERVAL = 5 * time.Minute
+
+type periodicJob struct {
+	name     string
+	interval time.Duration
+	run      func(be Backend) *model.AppError
+}
+
+var periodicJobs = []periodicJob{
+	{"purgetrash", 24 * time.Hour, PurgeExpiredTrash},
+	{REFRESH_IMAGE_URLS_JOB, 24 * time.Hour, RefreshImageURLs},
+	{CHANNEL_INDEX_JOB, 24 * time.Hour, IndexProfileChannels},
+	{EXPIRE_DEFAULTS_JOB, JOB_CHECK_INTERVAL, ExpireDefaultProfiles},
+	{DEFAULT_INDEX_JOB, 24 * time.Hour, IndexDefaults},
+	{DEACTIVATED_USERS_JOB, 24 * time.Hour, CleanUpDeactivatedUsers},
+}
+
+func getJobLastRunKey(name string) string {
+	return "joblastrun_" + name
+}
+
+// RunDueJobs runs all periodic jobs that are due. All due jobs are run even if
+// some of them fail, in which case the first error is returned.
+func RunDueJobs(be Backend) *model.AppError {
+	var firstErr *model.AppError
+	for _, job := range periodicJobs {
+		err := runJobIfDue(be, job)
+		if err != nil && firstErr == nil {
+			firstErr = appErrorPre("Job "+job.name+": ", err)
+		}
+	}
+	return firstErr
+}
+
+func runJobIfDue(be Backend, job periodicJob) *model.AppError {
+	key := getJobLastRunKey(job.name)
+	now := be.GetMillis()
+	oldValue, err := be.KVGet(key)
+	if err != nil {
+		return err
+	}
+	if oldValue != nil {
+		lastRun, pErr := strconv.ParseInt(string(oldValue), 10, 64)
+		if pErr == nil && now-lastRun < job.interval.Milliseconds() {
+			return nil
+		}
+	}
+	claimed, err := be.KVCompareAndSet(key, oldValue, []byte(strconv.FormatInt(now, 10)))
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		// Another server got here first.
+		return nil
+	}
+	return job.run(be)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const KV_LIST_PER_PAGE = 1000
+
+// KVListWithPrefix returns all keys in the KV store that begin with the given
+// prefix. This scans the entire KV store of the plugin, so it should only be
+// used by periodic jobs and other infrequent operations.
+func KVListWithPrefix(be Backend, prefix string) ([]string, *model.AppError) {
+	ret := []string{}
+	page := 0
+	for {
+		keys, err := be.KVList(page, KV_LIST_PER_PAGE)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				ret = append(ret, key)
+			}
+		}
+		if len(keys) < KV_LIST_PER_PAGE {
+			break
+		}
+		page++
+	}
+	return ret, nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp" // Register the WebP decoder
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Profile pictures are cropped to a square around the anchor chosen with
+// `crop=` and scaled down to the size of each image variant. JPEG, PNG, GIF and
+// WebP pictures are accepted, and GIF pictures may be animated. The rendered
+// pictures are cached in the KV store, where they are put when the picture is
+// set and re-rendered on demand after expiring.
+
+// Size in pixels of the square picture for each image variant. Smaller
+// pictures are not scaled up.
+var pictureSizes = map[string]int{
+	IMAGE_VARIANT_FULL:      512,
+	IMAGE_VARIANT_THUMBNAIL: 128,
+}
+
+const PICTURE_CACHE_SECONDS = 7 * 24 * 60 * 60
+
+const PICTURE_JPEG_QUALITY = 85
+
+// Crop anchors, by the name used in `crop=`. The default, center, is stored as
+// the empty string.
+var pictureCropAnchors = map[string]imaging.Anchor{
+	"":             imaging.Center,
+	"top":          imaging.Top,
+	"bottom":       imaging.Bottom,
+	"left":         imaging.Left,
+	"right":        imaging.Right,
+	"top-left":     imaging.TopLeft,
+	"top-right":    imaging.TopRight,
+	"bottom-left":  imaging.BottomLeft,
+	"bottom-right": imaging.BottomRight,
+}
+
+const PICTURE_CROP_NAMES = "`center`, `top`, `bottom`, `left`, `right`, `top-left`, `top-right`, `bottom-left` and `bottom-right`"
+
+// parsePictureCrop returns the stored form of a crop anchor given in a command.
+func parsePictureCrop(crop string) (string, *model.AppError) {
+	crop = strings.ToLower(crop)
+	if crop == "center" || crop == "centre" {
+		return "", nil
+	}
+	if _, ok := pictureCropAnchors[crop]; !ok || crop == "" {
+		return "", appError(fmt.Sprintf("Unknown crop `%s`. Valid crops are %s.", crop, PICTURE_CROP_NAMES), nil)
+	}
+	return crop, nil
+}
+
+var permalinkRegexp = regexp.MustCompile(`^(.*)/[^/]+/pl/([a-z0-9]{26})$`)
+
+// pictureFileFromCommand returns the id of the file to use as a profile
+// picture. It is taken from the linked message if permalink is given, or
+// otherwise from the root of the thread where the command was given. If the
+// message has several files, fileIndex tells which one to use, counting from 1.
+// It fails unless the user can read the message.
+func pictureFileFromCommand(be Backend, userId, rootId, permalink string, fileIndex int) (string, *model.AppError) {
+	postId := rootId
+	if permalink != "" {
+		matches := permalinkRegexp.FindStringSubmatch(permalink)
+		if matches == nil || matches[1] != be.GetSiteURL() {
+			return "", appError(fmt.Sprintf("`%s` is not a link to a message on this server.", permalink), nil)
+		}
+		postId = matches[2]
+	} else if rootId == "" {
+		return "", appError("Setting character profile picture can only be done in a thread, with the parent post containing the picture, or by giving a link to the message containing the picture.", nil)
+	}
+	post, err := GetPostIfExists(be, postId)
+	if err != nil {
+		return "", err
+	}
+	if post == nil || !be.HasPermissionToChannel(userId, post.ChannelId, model.PERMISSION_READ_CHANNEL) {
+		return "", appError(fmt.Sprintf("Could not find message `%s`, or you do not have permission to read it.", postId), nil)
+	}
+	if len(post.FileIds) == 0 {
+		return "", appError("The message does not have any file to use as profile picture.", nil)
+	}
+	if fileIndex == 0 {
+		if len(post.FileIds) > 1 {
+			return "", appError(fmt.Sprintf("The message has %d files. Choose one of them with `file=N`, e.g. `file=1` for the first one.", len(post.FileIds)), nil)
+		}
+		fileIndex = 1
+	}
+	if fileIndex > len(post.FileIds) {
+		return "", appError(fmt.Sprintf("Cannot use file %d since the message has only %d files.", fileIndex, len(post.FileIds)), nil)
+	}
+	return post.FileIds[fileIndex-1], nil
+}
+
+// checkPictureFile checks that a file can be used as a profile picture by a
+// user, who must be able to read the message it is attached to.
+func checkPictureFile(be Backend, userId, fileId string) *model.AppError {
+	info, err := be.GetFileInfo(fileId)
+	if err != nil || info == nil || info.PostId == "" {
+		return serviceError(http.StatusNotFound, fmt.Sprintf("Could not find file `%s` in any message.", fileId))
+	}
+	post, err := GetPostIfExists(be, info.PostId)
+	if err != nil {
+		return err
+	}
+	if post == nil || !be.HasPermissionToChannel(userId, post.ChannelId, model.PERMISSION_READ_CHANNEL) {
+		return serviceError(http.StatusForbidden, fmt.Sprintf("Could not find message `%s`, or you do not have permission to read it.", info.PostId))
+	}
+	return nil
+}
+
+// Profile pictures with more pixels than this, counting all frames of
+// animations, are rejected to limit the resources used for processing them.
+const PICTURE_MAX_PIXELS = 7680 * 4320
+
+// Formats of uploaded pictures that can be processed, as named by image.Decode.
+var pictureFormats = map[string]bool{"jpeg": true, "png": true, "gif": true, "webp": true}
+
+// RenderProfilePicture crops an image to a square around the given anchor and
+// scales it down to at most size pixels. Animated GIF images are rendered as
+// animated GIF if animate is set. Other JPEG images are rendered as JPEG, and
+// the rest as PNG to keep transparency. It returns the rendered image and its
+// content type.
+func RenderProfilePicture(content []byte, crop string, size int, animate bool) ([]byte, string, *model.AppError) {
+	anchor, ok := pictureCropAnchors[crop]
+	if !ok {
+		return nil, "", appError(fmt.Sprintf("Unknown crop `%s`.", crop), nil)
+	}
+	config, format, dErr := image.DecodeConfig(bytes.NewReader(content))
+	if dErr != nil {
+		return nil, "", appError("Failed to decode the profile picture.", dErr)
+	}
+	if !pictureFormats[format] {
+		return nil, "", appError(fmt.Sprintf("The profile picture format `%s` is not supported.", format), nil)
+	}
+	if int64(config.Width)*int64(config.Height) > PICTURE_MAX_PIXELS {
+		return nil, "", appError(fmt.Sprintf("The profile picture is too large. It may have at most %d pixels.", PICTURE_MAX_PIXELS), nil)
+	}
+	if config.Width < size {
+		size = config.Width
+	}
+	if config.Height < size {
+		size = config.Height
+	}
+	if size < 1 {
+		return nil, "", appError("The profile picture is empty.", nil)
+	}
+	if format == "gif" && animate {
+		// Every frame is decoded at once, so the frames are counted first.
+		if int64(countGIFFrames(content))*int64(config.Width)*int64(config.Height) > PICTURE_MAX_PIXELS {
+			return nil, "", appError(fmt.Sprintf("The animated profile picture is too large. It may have at most %d pixels in all frames.", PICTURE_MAX_PIXELS), nil)
+		}
+		anim, dErr := gif.DecodeAll(bytes.NewReader(content))
+		if dErr != nil {
+			return nil, "", appError("Failed to decode the profile picture.", dErr)
+		}
+		if len(anim.Image) > 1 {
+			return renderAnimation(anim, anchor, size)
+		}
+	}
+	img, dErr := imaging.Decode(bytes.NewReader(content), imaging.AutoOrientation(true))
+	if dErr != nil {
+		return nil, "", appError("Failed to decode the profile picture.", dErr)
+	}
+	img = imaging.Fill(img, size, size, anchor, imaging.Lanczos)
+	var buf bytes.Buffer
+	if format != "jpeg" {
+		eErr := png.Encode(&buf, img)
+		if eErr != nil {
+			return nil, "", appError("Failed to encode the profile picture.", eErr)
+		}
+		return buf.Bytes(), "image/png", nil
+	}
+	eErr := jpeg.Encode(&buf, img, &jpeg.Options{Quality: PICTURE_JPEG_QUALITY})
+	if eErr != nil {
+		return nil, "", appError("Failed to encode the profile picture.", eErr)
+	}
+	return buf.Bytes(), "image/jpeg", nil
+}
+
+// countGIFFrames returns the number of frames in a GIF image by walking its
+// blocks without decoding them. A truncated image is counted up to where it
+// ends, and left for the decoder to reject.
+func countGIFFrames(content []byte) int {
+	// Skip the header and logical screen descriptor, and the global color table.
+	pos := 13
+	if len(content) < pos {
+		return 0
+	}
+	if flags := content[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+	// skipSubBlocks returns the position after the data sub-blocks at pos.
+	skipSubBlocks := func(pos int) int {
+		for pos < len(content) && content[pos] != 0 {
+			pos += int(content[pos]) + 1
+		}
+		return pos + 1
+	}
+	frames := 0
+	for pos < len(content) {
+		switch content[pos] {
+		case 0x21:
+			// An extension, with a label followed by data sub-blocks.
+			pos = skipSubBlocks(pos + 2)
+		case 0x2C:
+			// An image descriptor, with an optional local color table followed by
+			// the minimum code size and the image data sub-blocks.
+			frames++
+			if pos+10 > len(content) {
+				return frames
+			}
+			flags := content[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			pos = skipSubBlocks(pos + 1)
+		default:
+			// The trailer, or something the decoder will reject.
+			return frames
+		}
+	}
+	return frames
+}
+
+// renderAnimation crops and scales each frame of an animated GIF image. Since
+// frames may only cover part of the image, they are first drawn onto a canvas
+// as a viewer would, so the rendered frames are complete images. Each rendered
+// frame is cleared before the next, so transparent parts of a frame do not
+// show the previous one.
+func renderAnimation(anim *gif.GIF, anchor imaging.Anchor, size int) ([]byte, string, *model.AppError) {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	// The last color of the palette is replaced by transparency.
+	pal := append(color.Palette{}, palette.Plan9[:len(palette.Plan9)-1]...)
+	pal = append(pal, color.Transparent)
+	canvas := image.NewRGBA(bounds)
+	rendered := &gif.GIF{LoopCount: anim.LoopCount}
+	for i, frame := range anim.Image {
+		var disposal byte
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, image.Point{}, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		scaled := imaging.Fill(canvas, size, size, anchor, imaging.Lanczos)
+		paletted := image.NewPaletted(scaled.Bounds(), pal)
+		draw.FloydSteinberg.Draw(paletted, scaled.Bounds(), scaled, image.Point{})
+		rendered.Image = append(rendered.Image, paletted)
+		delay := 0
+		if i < len(anim.Delay) {
+			delay = anim.Delay[i]
+		}
+		rendered.Delay = append(rendered.Delay, delay)
+		rendered.Disposal = append(rendered.Disposal, gif.DisposalBackground)
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	var buf bytes.Buffer
+	eErr := gif.EncodeAll(&buf, rendered)
+	if eErr != nil {
+		return nil, "", appError("Failed to encode the profile picture.", eErr)
+	}
+	return buf.Bytes(), "image/gif", nil
+}
+
+func getPictureCacheKey(fileId, crop, renderVariant string) string {
+	return fmt.Sprintf("picturecache_%s_%s_%s", fileId, crop, renderVariant)
+}
+
+// pictureRenderVariant returns how pictures are rendered for an image variant
+// with the current configuration.
+func pictureRenderVariant(be Backend, variant string) string {
+	if variant == IMAGE_VARIANT_FULL && be.GetConfiguration().AllowAnimatedPictures {
+		return variant + "-animated"
+	}
+	return variant
+}
+
+// getProfilePicture returns the rendered picture of a profile for an image
+// variant along with its content type, rendering and caching it unless cached.
+func getProfilePicture(be Backend, profile Profile, variant string) ([]byte, string, *model.AppError) {
+	info := profile.PictureFileInfo
+	if info == nil {
+		return nil, "", appError("Could not get file info", nil)
+	}
+	renderVariant := pictureRenderVariant(be, variant)
+	key := getPictureCacheKey(info.Id, profile.PictureCrop, renderVariant)
+	cached, err := be.KVGet(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(cached) > 0 {
+		return cached, pictureContentType(cached), nil
+	}
+	content, err := be.ReadFile(info.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	rendered, contentType, err := RenderProfilePicture(content, profile.PictureCrop, pictureSizes[variant], renderVariant != variant)
+	if err != nil {
+		return nil, "", err
+	}
+	err = be.KVSetWithExpiry(key, rendered, PICTURE_CACHE_SECONDS)
+	if err != nil {
+		return nil, "", err
+	}
+	return rendered, contentType, nil
+}
+
+// pictureContentType returns the content type of a rendered picture.
+func pictureContentType(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte("\x89PNG")):
+		return "image/png"
+	case bytes.HasPrefix(content, []byte("GIF8")):
+		return "image/gif"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// renderProfilePictures renders and caches the picture of a profile for all
+// image variants, failing if it cannot be processed.
+func renderProfilePictures(be Backend, profile Profile) *model.AppError {
+	if profile.PictureFileId == "" {
+		return nil
+	}
+	for variant := range pictureSizes {
+		_, _, err := getProfilePicture(be, profile, variant)
+		if err != nil {
+			return appErrorPre(fmt.Sprintf("The profile picture of `%s` could not be processed: ", profile.Identifier), err)
+		}
+	}
+	return nil
+}
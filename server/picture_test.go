@@ -0,0 +1,287 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/bmp"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+// testImage returns an image divided into a red, a green and a blue band along
+// its longer side.
+func testImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	bands := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}}
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			if width >= height {
+				img.Set(x, y, bands[x*3/width])
+			} else {
+				img.Set(x, y, bands[y*3/height])
+			}
+		}
+	}
+	return img
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	assert.Nil(t, png.Encode(&buf, testImage(width, height)))
+	return buf.Bytes()
+}
+
+// renderedBand returns the size of a rendered picture and the band of the test
+// image at its center.
+func renderedBand(t *testing.T, content []byte, crop string, size int) (int, int, string) {
+	rendered, _, err := main.RenderProfilePicture(content, crop, size, false)
+	assert.Nil(t, err)
+	img, _, dErr := image.Decode(bytes.NewReader(rendered))
+	assert.Nil(t, dErr)
+	bounds := img.Bounds()
+	r, g, b, _ := img.At(bounds.Dx()/2, bounds.Dy()/2).RGBA()
+	band := "blue"
+	if r > g && r > b {
+		band = "red"
+	} else if g > r && g > b {
+		band = "green"
+	}
+	return bounds.Dx(), bounds.Dy(), band
+}
+
+func TestRenderProfilePicture(t *testing.T) {
+	wide := testPNG(t, 300, 100)
+	w, h, band := renderedBand(t, wide, "", 512)
+	assert.Equal(t, []interface{}{100, 100, "green"}, []interface{}{w, h, band})
+	_, _, band = renderedBand(t, wide, "left", 512)
+	assert.Equal(t, "red", band)
+	_, _, band = renderedBand(t, wide, "bottom-right", 512)
+	assert.Equal(t, "blue", band)
+	tall := testPNG(t, 400, 1200)
+	w, h, band = renderedBand(t, tall, "top", 128)
+	assert.Equal(t, []interface{}{128, 128, "red"}, []interface{}{w, h, band})
+	_, _, band = renderedBand(t, tall, "", 128)
+	assert.Equal(t, "green", band)
+	// PNG pictures stay PNG, others become JPEG
+	_, contentType, err := main.RenderProfilePicture(wide, "", 128, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/png", contentType)
+	var buf bytes.Buffer
+	assert.Nil(t, jpeg.Encode(&buf, testImage(300, 100), nil))
+	_, contentType, err = main.RenderProfilePicture(buf.Bytes(), "", 128, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/jpeg", contentType)
+	_, _, err = main.RenderProfilePicture([]byte("not an image"), "", 128, false)
+	assert.NotNil(t, err)
+}
+
+// testGIF returns an animated GIF image with one frame per band of the test
+// image.
+func testGIF(t *testing.T, width, height int) []byte {
+	bands := []color.Color{color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	anim := &gif.GIF{}
+	for _, band := range bands {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{band})
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, gif.EncodeAll(&buf, anim))
+	return buf.Bytes()
+}
+
+// A 1-bit lossless WebP image of 75x100 pixels, from golang.org/x/image.
+const testWebP = "UklGRrIBAABXRUJQVlA4TKUBAAAvSsAYAA8w//M///MfeJAkbXvaSG7m8Q3GfYSBJekwQztm/IcZlgwnmWImn2BK7aFmBtnVir6q//8VOkFE/xm4baTIu8c48ArEo6+B3zFKYln3pqClSCKX0begFTAXFOLXHSyF8cCNcZEG4OywuA4KVVfJCiArU7GAgJI8+lJP/OKMT/fBAjevg1cYB7YVkFuWga2lyPi5I0HFy5YTpWIHg0RZpkniRVW9odHAKOwosWuOGdxIyn2OvaCDvhg/we6TwadPBPbqBV58MsLmMJ8yZnOWk8SRz4N+QoyPL+MnamzMvcE1rHNEr91F9GKZPVUcS9w7PhhH36suB9qPeYb/oLk6cuTiJ0wOK3m5h1cKjW6EVZCYMK7dxcKCBdgP9HkKr9gkAO2P8GKZGWVdIAatQa+1IDpt6qyorVwdy01xdW8Jkfk6xjEXmVQQ+HQdFr6OKhIN34dXWq0+0qr6EJSCeeVLH9+gvGTLyqM65PQ44ihzlTXxQKjKbAvshXgir7Lil9w4L2bvMycmjQcqXaMCO6BlY28i+FOLzbfI1vEqxAhotocAAA=="
+
+func TestRenderProfilePictureFormats(t *testing.T) {
+	// WebP pictures are rendered as PNG
+	webp, dErr := base64.StdEncoding.DecodeString(testWebP)
+	assert.Nil(t, dErr)
+	rendered, contentType, err := main.RenderProfilePicture(webp, "", 128, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/png", contentType)
+	config, _, dErr := image.DecodeConfig(bytes.NewReader(rendered))
+	assert.Nil(t, dErr)
+	assert.Equal(t, image.Config{ColorModel: config.ColorModel, Width: 75, Height: 75}, config)
+	// Animated GIF pictures stay animated only if requested
+	animated := testGIF(t, 60, 30)
+	rendered, contentType, err = main.RenderProfilePicture(animated, "", 512, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/gif", contentType)
+	anim, dErr := gif.DecodeAll(bytes.NewReader(rendered))
+	assert.Nil(t, dErr)
+	assert.Len(t, anim.Image, 3)
+	assert.Equal(t, []int{10, 10, 10}, anim.Delay)
+	assert.Equal(t, []byte{gif.DisposalBackground, gif.DisposalBackground, gif.DisposalBackground}, anim.Disposal)
+	assert.Equal(t, image.Rect(0, 0, 30, 30), anim.Image[0].Bounds())
+	r, g, b, _ := anim.Image[1].At(15, 15).RGBA()
+	assert.True(t, g > r && g > b)
+	_, contentType, err = main.RenderProfilePicture(animated, "", 512, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/png", contentType)
+	// Other formats are not accepted even if Go can decode them
+	var buf bytes.Buffer
+	assert.Nil(t, bmp.Encode(&buf, testImage(30, 10)))
+	_, _, err = main.RenderProfilePicture(buf.Bytes(), "", 128, false)
+	assert.Equal(t, "The profile picture format `bmp` is not supported.", err.Message)
+	// Huge pictures are rejected before being decoded
+	huge := image.NewPaletted(image.Rect(0, 0, 10000, 5000), color.Palette{color.Black})
+	buf.Reset()
+	assert.Nil(t, gif.Encode(&buf, huge, nil))
+	_, _, err = main.RenderProfilePicture(buf.Bytes(), "", 128, false)
+	assert.Equal(t, "The profile picture is too large. It may have at most 33177600 pixels.", err.Message)
+	// so are animations with too many frames, even if each frame is tiny
+	many := &gif.GIF{Config: image.Config{Width: 100, Height: 100, ColorModel: color.Palette{color.Black, color.White}}}
+	for i := 0; i < 4000; i++ {
+		many.Image = append(many.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black, color.White}))
+		many.Delay = append(many.Delay, 0)
+	}
+	buf.Reset()
+	assert.Nil(t, gif.EncodeAll(&buf, many))
+	_, _, err = main.RenderProfilePicture(buf.Bytes(), "", 128, true)
+	assert.Equal(t, "The animated profile picture is too large. It may have at most 33177600 pixels in all frames.", err.Message)
+	// while fewer frames are fine
+	many.Image, many.Delay = many.Image[:3], many.Delay[:3]
+	buf.Reset()
+	assert.Nil(t, gif.EncodeAll(&buf, many))
+	_, contentType, err = main.RenderProfilePicture(buf.Bytes(), "", 128, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/gif", contentType)
+}
+
+func TestAnimatedPictures(t *testing.T) {
+	be := newMockBackend()
+	be.Configuration = &main.Configuration{AllowAnimatedPictures: true}
+	file2, post2 := "file2aaaaaaaaaaaaaaaaaaaaa", "post2aaaaaaaaaaaaaaaaaaaaa"
+	be.FileInfos[file2] = &model.FileInfo{Id: file2, CreatorId: tUser1, CreateAt: 2, UpdateAt: 2, Path: "some-path-to/file2.gif", Name: "file2.gif", Extension: "gif", MimeType: "image/gif", PostId: post2}
+	be.Posts[post2] = &model.Post{Id: post2, UserId: tUser1, ChannelId: tChannel1, FileIds: []string{file2}}
+	be.Files = map[string][]byte{"some-path-to/file2.gif": testGIF(t, 60, 30)}
+	cmd(t, be, "/character picture haddock=Captain Haddock", tUser1, tChannel1, tTeam1, post2,
+		"Character profile `haddock` created with display name \"Captain Haddock\" and a profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", versionImg(t, be, tUser1, "haddock", 1)}})
+	w := request(be, http.MethodGet, tUser2, versionImg(t, be, tUser1, "haddock", 1)(false), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/gif", w.Header().Get("Content-Type"))
+	assert.Equal(t, `inline;filename="haddock.gif"; filename*=UTF-8''haddock.gif`, w.Header().Get("Content-Disposition"))
+	animatedETag := w.Header().Get("ETag")
+	// Thumbnails are never animated
+	w = request(be, http.MethodGet, tUser2, versionImg(t, be, tUser1, "haddock", 1)(true), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	// Disallowing animation changes the picture and its ETag
+	be.Configuration.AllowAnimatedPictures = false
+	w = request(be, http.MethodGet, tUser2, versionImg(t, be, tUser1, "haddock", 1)(false), http.Header{"If-None-Match": {animatedETag}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.NotEqual(t, animatedETag, w.Header().Get("ETag"))
+	// The generated avatar is served instead of a picture that cannot be
+	// rendered
+	be.Files["some-path-to/file2.gif"] = []byte("not an image")
+	for key := range be.KVStore {
+		if strings.HasPrefix(key, "picturecache_") {
+			delete(be.KVStore, key)
+		}
+	}
+	w = request(be, http.MethodGet, tUser2, versionImg(t, be, tUser1, "haddock", 1)(false), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	avatar, err := main.RenderAvatar("CH", strings.TrimPrefix(main.DefaultAvatarColor("haddock"), "#"), 512)
+	assert.Nil(t, err)
+	assert.Equal(t, avatar, w.Body.Bytes())
+}
+
+func TestPictureCrop(t *testing.T) {
+	be := newMockBackend()
+	be.Files = map[string][]byte{"some-path-to/file1.png": testPNG(t, 300, 100)}
+	cmd(t, be, "/character picture haddock=Captain Haddock crop=right", tUser1, tChannel1, tTeam1, tPost1,
+		"Character profile `haddock` created with display name \"Captain Haddock\" and a profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", versionImg(t, be, tUser1, "haddock", 1)}})
+	w := request(be, http.MethodGet, tUser2, versionImg(t, be, tUser1, "haddock", 1)(false), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `inline;filename="haddock.png"; filename*=UTF-8''haddock.png`, w.Header().Get("Content-Disposition"))
+	rendered, _, err := main.RenderProfilePicture(be.Files["some-path-to/file1.png"], "right", 512, false)
+	assert.Nil(t, err)
+	assert.Equal(t, rendered, w.Body.Bytes())
+	// Changing the crop is a change of the picture
+	cmd(t, be, "/character picture haddock crop=CENTER", tUser1, tChannel1, tTeam1, tPost1,
+		"Character profile `haddock` modified by updating the profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", versionImg(t, be, tUser1, "haddock", 2)}})
+	cmd(t, be, "/character picture haddock", tUser1, tChannel1, tTeam1, tPost1,
+		"Character profile `haddock` modified by updating the profile picture (to the same as before)",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", versionImg(t, be, tUser1, "haddock", 2)}})
+	w = request(be, http.MethodGet, tUser2, versionImg(t, be, tUser1, "haddock", 2)(true), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	rendered, _, err = main.RenderProfilePicture(be.Files["some-path-to/file1.png"], "", 128, false)
+	assert.Nil(t, err)
+	assert.Equal(t, rendered, w.Body.Bytes())
+	// Earlier versions keep their crop
+	w = request(be, http.MethodGet, tUser2, versionImg(t, be, tUser1, "haddock", 1)(true), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	rendered, _, err = main.RenderProfilePicture(be.Files["some-path-to/file1.png"], "right", 128, false)
+	assert.Nil(t, err)
+	assert.Equal(t, rendered, w.Body.Bytes())
+	cmdFail(t, be, "/character picture haddock crop=middle", tUser1, tChannel1, tTeam1, tPost1,
+		"Character Profile Plugin: Unknown crop `middle`. Valid crops are `center`, `top`, `bottom`, `left`, `right`, `top-left`, `top-right`, `bottom-left` and `bottom-right`.")
+	cmdFail(t, be, "/character haddock=Haddock crop=top", tUser1, tChannel1, tTeam1, tPost1,
+		"Character Profile Plugin: A crop can only be given when setting the profile picture, e.g. `/character picture haddock crop=top`.")
+	// Pictures that cannot be processed are rejected
+	file2, post2 := "file2aaaaaaaaaaaaaaaaaaaaa", "post2aaaaaaaaaaaaaaaaaaaaa"
+	be.FileInfos[file2] = &model.FileInfo{Id: file2, CreatorId: tUser1, CreateAt: 2, UpdateAt: 2, Path: "some-path-to/file2.png", Name: "file2.png", Extension: "png", MimeType: "image/png", PostId: post2}
+	be.Posts[post2] = &model.Post{Id: post2, UserId: tUser1, ChannelId: tChannel1, FileIds: []string{file2}}
+	be.Files["some-path-to/file2.png"] = []byte("not an image")
+	cmdFail(t, be, "/character picture milou=Milou", tUser1, tChannel1, tTeam1, post2,
+		"Character Profile Plugin: The profile picture of `milou` could not be processed: Failed to decode the profile picture.")
+}
+
+func TestPictureFromLink(t *testing.T) {
+	be := newMockBackend()
+	channel2, file2, post2 := "channel2aaaaaaaaaaaaaaaaaa", "file2aaaaaaaaaaaaaaaaaaaaa", "post2aaaaaaaaaaaaaaaaaaaaa"
+	be.Channels[channel2] = &model.Channel{Id: channel2, Name: "channel-two", TeamId: tTeam1, Type: model.CHANNEL_PRIVATE}
+	be.ChannelMembers = append(be.ChannelMembers, struct {
+		UserId    string
+		ChannelId string
+	}{tUser1, channel2})
+	be.FileInfos[file2] = &model.FileInfo{Id: file2, CreatorId: tUser1, CreateAt: 2, UpdateAt: 2, Path: "some-path-to/file2.png", Name: "file2.png", Extension: "png", MimeType: "image/png", PostId: post2}
+	be.FileInfos[tFile1].PostId = post2
+	be.Posts[post2] = &model.Post{Id: post2, UserId: tUser1, ChannelId: channel2, FileIds: []string{tFile1, file2}}
+	link := be.GetSiteURL() + "/team-one/pl/" + post2
+	cmdFail(t, be, "/character picture haddock=Captain Haddock "+link, tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: The message has 2 files. Choose one of them with `file=N`, e.g. `file=1` for the first one.")
+	cmdFail(t, be, "/character picture haddock=Captain Haddock "+link+" file=3", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Cannot use file 3 since the message has only 2 files.")
+	cmd(t, be, "/character picture haddock=Captain Haddock "+link+" file=2", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\" and a profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", versionImg(t, be, tUser1, "haddock", 1)}})
+	profile, err := main.GetProfile(be, tUser1, "haddock", main.PROFILE_CHARACTER)
+	assert.Nil(t, err)
+	assert.Equal(t, file2, profile.PictureFileId)
+	// file= also works for the parent message
+	cmd(t, be, "/character picture haddock file=1", tUser1, tChannel1, tTeam1, post2,
+		"Character profile `haddock` modified by updating the profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", versionImg(t, be, tUser1, "haddock", 2)}})
+	// The user must be able to read the message
+	cmdFail(t, be, "/character picture milou=Milou "+link+" file=1", tUser2, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Could not find message `"+post2+"`, or you do not have permission to read it.")
+	cmdFail(t, be, "/character picture milou=Milou https://elsewhere.tld/team-one/pl/"+post2, tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: `https://elsewhere.tld/team-one/pl/"+post2+"` is not a link to a message on this server.")
+	cmdFail(t, be, "/character picture milou=Milou", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Setting character profile picture can only be done in a thread, with the parent post containing the picture, or by giving a link to the message containing the picture.")
+	cmdFail(t, be, "/character milou=Milou file=1", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: A message link or `file=` can only be given when setting the profile picture, e.g. `/character picture haddock file=2`.")
+	// The picture is still validated
+	be.FileInfos[file2].Extension = "txt"
+	cmdFail(t, be, "/character picture milou=Milou "+link+" file=2", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Failed validating profile `milou`: The file extension \"txt\" is not valid for a profile picture. Only .JPG, .JPEG, .PNG, .GIF and .WEBP are acceptable.")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mattermost/mattermost-server/v5/model"
@@ -12,6 +13,7 @@ import (
 const (
 	PLUGIN_ID       = "com.axelsvensson.mattermost-plugin-character-profiles"
 	BOT_DISPLAYNAME = "Character Profiles"
+	BOT_USERNAME    = "character-profiles"
 )
 
 // Plugin implements the interface expected by the Mattermost server to communicate between the server and plugin processes.
@@ -29,6 +31,9 @@ type Plugin struct {
 
 	// Mockable backend, the only thing passed to non-glue code.
 	backend Backend
+
+	// Closed on deactivation to stop the periodic jobs.
+	stopJobs chan struct{}
 }
 
 func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
@@ -72,10 +77,23 @@ func getRealBackendFromPlugin(p *Plugin) (Backend, *model.AppError) {
 		return backend, model.NewAppError("backendFromPlugin", "Cannot get bundle path", nil, "", http.StatusInternalServerError)
 	}
 	backend.BundlePath = bundlePath
+	backend.ConfigurationGetter = p.getConfiguration
 	if p.API == nil {
 		return backend, model.NewAppError("backendFromPlugin", "Cannot get API", nil, "", http.StatusInternalServerError)
 	}
 	backend.API = p.API
+	// The bot account always exists, since it also sends transcripts. Whether
+	// messages are posted through it is decided by UseBotAccount. If it cannot
+	// be ensured, the plugin works without it.
+	botUserId, err := p.Helpers.EnsureBot(&model.Bot{
+		Username:    BOT_USERNAME,
+		DisplayName: BOT_DISPLAYNAME,
+		Description: "Posts messages using character profiles and sends transcripts.",
+	}, plugin.ProfileImagePath("assets/pluginicon.png"))
+	if err != nil {
+		p.API.LogError("Failed to ensure bot account", "error", err.Error())
+	}
+	backend.BotUserId = botUserId
 	return backend, nil
 }
 
@@ -97,9 +115,35 @@ func (p *Plugin) OnActivate() error {
 		return err
 	}
 	p.router = routerFromBackend(p.backend)
+	p.stopJobs = make(chan struct{})
+	go p.runJobs(p.stopJobs)
+	return nil
+}
+
+func (p *Plugin) OnDeactivate() error {
+	if p.stopJobs != nil {
+		close(p.stopJobs)
+		p.stopJobs = nil
+	}
 	return nil
 }
 
+func (p *Plugin) runJobs(stop chan struct{}) {
+	ticker := time.NewTicker(JOB_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := RunDueJobs(p.backend)
+			if err != nil {
+				p.API.LogError("Failed to run periodic jobs", "error", err.Error())
+			}
+		}
+	}
+}
+
 func (p *Plugin) MessageWillBePosted(_ *plugin.Context, post *model.Post) (*model.Post, string) {
 	if p.backend == nil {
 		return nil, "Backend not initialized"
@@ -121,13 +165,33 @@ func (p *Plugin) MessageHasBeenPosted(_ *plugin.Context, post *model.Post) {
 	}
 }
 
-func (p *Plugin) MessageHasBeenUpdated(_ *plugin.Context, newPost *model.Post, _ *model.Post) {
-	err := RegisterPost(p.backend, newPost)
+func (p *Plugin) MessageHasBeenUpdated(_ *plugin.Context, newPost *model.Post, oldPost *model.Post) {
+	err := RegisterEditedPost(p.backend, newPost, oldPost)
 	if err != nil {
 		p.API.LogError("Failed to register message", "error", err.Error())
 	}
 }
 
+func (p *Plugin) UserHasLeftChannel(_ *plugin.Context, channelMember *model.ChannelMember, _ *model.User) {
+	if p.backend == nil {
+		return
+	}
+	err := UserLeftChannel(p.backend, channelMember.UserId, channelMember.ChannelId)
+	if err != nil {
+		p.API.LogError("Failed to clean up after user left channel", "error", err.Error())
+	}
+}
+
+func (p *Plugin) UserHasLeftTeam(_ *plugin.Context, teamMember *model.TeamMember, _ *model.User) {
+	if p.backend == nil {
+		return
+	}
+	err := UserLeftTeam(p.backend, teamMember.UserId, teamMember.TeamId)
+	if err != nil {
+		p.API.LogError("Failed to clean up after user left team", "error", err.Error())
+	}
+}
+
 func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
 	be := p.backend
 	if be == nil {
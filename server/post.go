@@ -4,33 +4,197 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strconv"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 )
 
-// RegisterPost adds a post to the corresponding id set.
+// RegisterPost adds a post to the corresponding id sets and channel index.
 func RegisterPost(be Backend, post *model.Post) *model.AppError {
 	if post == nil {
 		return appError("Message is nil", nil)
 	}
-	profileId := ""
-	profileIdRaw, ok := post.Props["profile_identifier"]
-	if ok {
-		profileId, ok = profileIdRaw.(string)
-		if !ok {
-			profileId = ""
+	if sceneId, ok := post.GetProp(SCENE_PROP).(string); ok && sceneId != "" {
+		err := registerScenePost(be, post, sceneId)
+		if err != nil {
+			return err
 		}
 	}
+	profileId, _ := post.GetProp("profile_identifier").(string)
 	if profileId != "" {
-		key := getIdsetKey(post.UserId, profileId)
+		authorId := postAuthorId(be, post)
+		key := getIdsetKey(authorId, profileId)
+		registered, hasErr := IdsetHas(be, key, post.Id)
+		if hasErr != nil {
+			return hasErr
+		}
 		addErr := IdsetInsert(be, key, post.Id)
 		if addErr != nil {
 			return addErr
 		}
+		addErr = addProfileChannel(be, authorId, profileId, post.ChannelId)
+		if addErr != nil {
+			return addErr
+		}
+		if !registered {
+			addErr = countPostInStats(be, authorId, profileId, post, 1)
+			if addErr != nil {
+				return addErr
+			}
+		}
 	}
 	return nil
 }
 
+// RegisterEditedPost registers a post after an edit. If the edit moved it to
+// another profile, it is removed from the id set and statistics of the profile
+// it used before.
+func RegisterEditedPost(be Backend, newPost, oldPost *model.Post) *model.AppError {
+	if newPost == nil || oldPost == nil {
+		return appError("Message is nil", nil)
+	}
+	oldProfileId, _ := oldPost.GetProp("profile_identifier").(string)
+	newProfileId, _ := newPost.GetProp("profile_identifier").(string)
+	if oldProfileId != "" && oldProfileId != newProfileId {
+		authorId := postAuthorId(be, oldPost)
+		key := getIdsetKey(authorId, oldProfileId)
+		registered, err := IdsetHas(be, key, oldPost.Id)
+		if err != nil {
+			return err
+		}
+		if registered {
+			err = IdsetRemove(be, key, oldPost.Id)
+			if err != nil {
+				return err
+			}
+			err = countPostInStats(be, authorId, oldProfileId, oldPost, -1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return RegisterPost(be, newPost)
+}
+
+// Messages posted by the bot account on behalf of a user record the user in
+// this prop.
+const AUTHOR_PROP = "profile_author_id"
+
+// isBotPost returns whether a post is posted by the bot account on behalf of a
+// user. Such posts stay so even if the bot account is no longer used.
+func isBotPost(be Backend, post *model.Post) bool {
+	botUserId := be.GetBotUserId()
+	_, ok := post.Props[AUTHOR_PROP].(string)
+	return botUserId != "" && post.UserId == botUserId && ok
+}
+
+// postAuthorId returns the id of the user who wrote a post, which is not the
+// poster for posts by the bot account.
+func postAuthorId(be Backend, post *model.Post) string {
+	if isBotPost(be, post) {
+		return post.Props[AUTHOR_PROP].(string)
+	}
+	return post.UserId
+}
+
+// postAsBot makes a new post be posted by the bot account on behalf of its
+// author, if the bot account is used and the profile is a character profile.
+// Existing posts cannot change poster.
+func postAsBot(be Backend, post *model.Post, profile Profile) {
+	botUserId := be.GetBotUserId()
+	if !be.GetConfiguration().UseBotAccount || botUserId == "" || profile.Status != PROFILE_CHARACTER || post.UserId == botUserId {
+		return
+	}
+	post.AddProp(AUTHOR_PROP, post.UserId)
+	post.UserId = botUserId
+}
+
+// getOwnBotPost returns the message that a permalink points to, if it was posted
+// by the bot account on behalf of the given user. Users cannot edit or delete
+// such messages in Mattermost, so the plugin does it for them.
+func getOwnBotPost(be Backend, userId, permalink string) (*model.Post, *model.AppError) {
+	matches := permalinkRegexp.FindStringSubmatch(permalink)
+	if matches == nil || matches[1] != be.GetSiteURL() {
+		return nil, appError(fmt.Sprintf("`%s` is not a link to a message on this server.", permalink), nil)
+	}
+	post, err := GetPostIfExists(be, matches[2])
+	if err != nil {
+		return nil, err
+	}
+	if post == nil || !isBotPost(be, post) || postAuthorId(be, post) != userId {
+		return nil, appError(fmt.Sprintf("Could not find message `%s` posted by the bot account on your behalf.", matches[2]), nil)
+	}
+	return post, nil
+}
+
+// EditBotPost replaces the text of a message posted by the bot account on
+// behalf of the user, keeping its profile unless the text has a one-off prefix.
+func EditBotPost(be Backend, userId, permalink, message string) *model.AppError {
+	post, err := getOwnBotPost(be, userId, permalink)
+	if err != nil {
+		return err
+	}
+	edited := DeepClonePost(post)
+	edited.Message = message
+	profiled, errStr := ProfiledPost(be, edited, true)
+	if errStr != "" {
+		return appError(errStr, nil)
+	}
+	if profiled != nil {
+		edited = profiled
+	}
+	_, err = be.UpdatePost(edited)
+	return err
+}
+
+// DeleteBotPost deletes a message posted by the bot account on behalf of the
+// user.
+func DeleteBotPost(be Backend, userId, permalink string) *model.AppError {
+	post, err := getOwnBotPost(be, userId, permalink)
+	if err != nil {
+		return err
+	}
+	return be.DeletePost(post.Id)
+}
+
+// New posts that already have a profile applied by the plugin, such as those
+// created through the webhook endpoint, carry a nonce in this prop, so that the
+// posting hook keeps their profile. Without it, a client could post with any
+// profile_identifier.
+const PROFILE_NONCE_PROP = "profile_nonce"
+
+// PROFILE_NONCE_SECONDS is how long a nonce can be used.
+const PROFILE_NONCE_SECONDS = 300
+
+func getProfileNonceKey(nonce string) string {
+	return "profilenonce_" + nonce
+}
+
+// addProfileNonce marks a new post as having its profile applied by the plugin.
+func addProfileNonce(be Backend, post *model.Post) *model.AppError {
+	nonce := be.NewId()
+	err := be.KVSetWithExpiry(getProfileNonceKey(nonce), []byte("1"), PROFILE_NONCE_SECONDS)
+	if err != nil {
+		return err
+	}
+	post.AddProp(PROFILE_NONCE_PROP, nonce)
+	return nil
+}
+
+// useProfileNonce returns whether a new post has had its profile applied by the
+// plugin. Each nonce can only be used once.
+func useProfileNonce(be Backend, post *model.Post) bool {
+	nonce, ok := post.GetProp(PROFILE_NONCE_PROP).(string)
+	if !ok || nonce == "" {
+		return false
+	}
+	b, err := be.KVGet(getProfileNonceKey(nonce))
+	if err != nil || b == nil {
+		return false
+	}
+	return be.KVDelete(getProfileNonceKey(nonce)) == nil
+}
+
 // ProfiledPost decides which profile to apply to the given post based on its
 // Message, Props and whether it's edited. It returns the post with the profile
 // applied, potentially with a prefix removed from the message.
@@ -39,24 +203,40 @@ func ProfiledPost(be Backend, post *model.Post, isedited bool) (*model.Post, str
 	if post == nil {
 		return nil, ""
 	}
-	userId := post.UserId
 	// Only touch posts created by users
 	if post.IsSystemMessage() || post.UserId == "" {
 		return nil, ""
 	}
+	userId := postAuthorId(be, post)
 	// Clone before altering
 	ret := DeepClonePost(post)
 
+	// New posts that already have a profile applied by the plugin, such as those
+	// created through the webhook endpoint, keep it. Other new posts cannot
+	// choose their profile through props.
+	keepProfile := false
+	if !isedited {
+		keepProfile = useProfileNonce(be, post)
+		ret.DelProp(PROFILE_NONCE_PROP)
+		if !keepProfile {
+			ret.DelProp("profile_identifier")
+			ret.DelProp("profile_version")
+		}
+	}
+
 	// Handle one-off profiled posts
-	matches := regexp.MustCompile(`(?s)^([a-z]+):[ \n](.*)$`).FindStringSubmatch(post.Message)
-	if matches != nil {
+	matches := regexp.MustCompile(`(?s)^([\pL\pM]+):[ \n](.*)$`).FindStringSubmatch(post.Message)
+	if matches != nil && !keepProfile {
 		// This might be a one-off post.
-		profileId := matches[1]
+		profileId := NormalizeIdentifier(matches[1])
 		actualMessage := matches[2]
 		profile, err := GetProfile(be, userId, profileId, PROFILE_CHARACTER|PROFILE_ME)
 		if err == nil && profile != nil {
 			// We found a matching profile, so this is an actual one-off post.
 			ret.Message = actualMessage
+			if !isedited {
+				postAsBot(be, ret, *profile)
+			}
 			return profilePost(be, ret, *profile)
 		}
 	}
@@ -68,11 +248,24 @@ func ProfiledPost(be Backend, post *model.Post, isedited bool) (*model.Post, str
 		if ok {
 			profile, err := GetProfile(be, userId, oldProfileIdentifierStr, PROFILE_CHARACTER)
 			if err == nil && profile != nil {
-				// We found a matching profile, so let's update the post with the current settings.
+				// We found a matching profile. If the post is frozen at an earlier
+				// version, keep that version.
+				version := getPostProfileVersion(ret)
+				if isFrozenVersion(*profile, version) {
+					frozenProfile, fErr := GetProfileAtVersion(be, userId, profile.Identifier, version)
+					if fErr == nil && frozenProfile.Status == PROFILE_CHARACTER {
+						return profilePost(be, ret, *frozenProfile)
+					}
+				}
+				// Otherwise, update the post with the current settings.
 				return profilePost(be, ret, *profile)
 			}
 		}
 	}
+	if keepProfile {
+		// The post uses the real profile, which is kept.
+		return ret, ""
+	}
 	if isedited {
 		// We didn't find a matching profile but we can't change it, so let it be as it is.
 		return nil, ""
@@ -80,11 +273,13 @@ func ProfiledPost(be Backend, post *model.Post, isedited bool) (*model.Post, str
 
 	// Handle new posts
 	channelId := post.ChannelId
-	profileId, err := getDefaultProfileIdentifier(be, userId, channelId)
+	profileId, _, err := getEffectiveDefaultProfile(be, userId, channelId)
 	if err == nil {
 		profile, err := GetProfile(be, userId, profileId, PROFILE_CHARACTER|PROFILE_ME)
 		if err == nil && profile != nil {
 			// We found a matching profile, so let's apply it to the post.
+			remindDefaultProfileAfterGap(be, userId, channelId, *profile)
+			postAsBot(be, ret, *profile)
 			return profilePost(be, ret, *profile)
 		}
 	}
@@ -93,20 +288,61 @@ func ProfiledPost(be Backend, post *model.Post, isedited bool) (*model.Post, str
 	return nil, ""
 }
 
+// postIconUrl returns the image URL of a profile for a message. If the URL
+// cannot be signed, a legacy URL is used rather than failing the message, and
+// the periodic job is made to sign it later.
+func postIconUrl(be Backend, profile Profile) (string, *model.AppError) {
+	iconUrl, err := profileIconUrl(be, profile, false)
+	if err == nil {
+		return iconUrl, nil
+	}
+	err = be.KVDelete(LEGACY_IMAGE_URLS_DONE_KEY)
+	if err != nil {
+		return "", err
+	}
+	return legacyProfileIconUrl(be, profile, false), nil
+}
+
 // profilePost returns a post with the given profile applied.
 func profilePost(be Backend, post *model.Post, profile Profile) (*model.Post, string) {
+	tagPostWithScene(be, post)
 	// Send a normal message with the selected profile
 	switch profile.Status {
 	case PROFILE_ME:
 		post.AddProp("profile_identifier", nil)
+		post.AddProp("profile_version", nil)
+		if isBotPost(be, post) {
+			// A message posted by the bot account cannot be given back to its author,
+			// so it is made to look like it was.
+			user, err := be.GetUser(profile.UserId)
+			if err != nil {
+				return nil, ErrStr(err)
+			}
+			iconUrl, err := postIconUrl(be, profile)
+			if err != nil {
+				return nil, ErrStr(err)
+			}
+			post.AddProp("override_username", user.Username)
+			post.AddProp("override_icon_url", iconUrl)
+			return post, ""
+		}
 		post.AddProp("override_username", nil)
 		post.AddProp("override_icon_url", nil)
 		post.AddProp("from_webhook", nil)
 		return post, ""
 	case PROFILE_CHARACTER:
 		post.AddProp("profile_identifier", profile.Identifier)
+		post.AddProp("profile_version", strconv.Itoa(profile.Version))
 		post.AddProp("override_username", profile.Name)
-		post.AddProp("override_icon_url", profileIconUrl(be, profile, false))
+		iconUrl, err := postIconUrl(be, profile)
+		if err != nil {
+			return nil, ErrStr(err)
+		}
+		post.AddProp("override_icon_url", iconUrl)
+		if isBotPost(be, post) {
+			post.AddProp("from_bot", "true")
+			return post, ""
+		}
 		post.AddProp("from_webhook", "true") // Unfortunately we need to pretend this is from a bot, or the username won't get overridden.
 		return post, ""
 	default:
@@ -117,15 +353,18 @@ func profilePost(be Backend, post *model.Post, profile Profile) (*model.Post, st
 // Handle id sets
 
 func getIdsetKey(userId, profileId string) string {
-	return fmt.Sprintf("profiledpost_%s_%s", userId, profileId)
+	return fmt.Sprintf("profiledpost_%s_%s", userId, encodeIdentifierForKey(profileId))
 }
 
 // updatePostsForProfile updates all posts of the given user that use the given
 // profile identifier to use the new profile identifier. Provide an empty string
 // for newProfileId to remove the profile identifier from the posts and instead
 // use the default profile. Provide the same value for oldProfileId and
-// newProfileId to update the display name and icon of the posts.
-func updatePostsForProfile(be Backend, userId, oldProfileId, newProfileId string) *model.AppError {
+// newProfileId to update the display name and icon of the posts. If the new
+// profile has the history of the old one, with version numbers increased by
+// versionOffset, posts frozen at an earlier version keep it. A negative
+// versionOffset means that the histories are unrelated.
+func updatePostsForProfile(be Backend, userId, oldProfileId, newProfileId string, versionOffset int) *model.AppError {
 	pre := fmt.Sprintf("updatePostsUsingProfile(%s, %s, %s)", userId, oldProfileId, newProfileId)
 	if IsMe(oldProfileId) {
 		return appError(pre+"Cannot update message that are using the user's real profile.", nil)
@@ -145,8 +384,8 @@ func updatePostsForProfile(be Backend, userId, oldProfileId, newProfileId string
 			// we'll just ignore it.
 			return nil
 		}
-		if post.UserId != userId {
-			return appError(fmt.Sprintf("Found message with userId \"%s\" but expected \"%s\"", post.UserId, userId), nil)
+		if postAuthorId(be, post) != userId {
+			return appError(fmt.Sprintf("Found message with userId \"%s\" but expected \"%s\"", postAuthorId(be, post), userId), nil)
 		}
 		profileIdOfPost, ok := post.Props["profile_identifier"]
 		if !ok {
@@ -164,16 +403,33 @@ func updatePostsForProfile(be Backend, userId, oldProfileId, newProfileId string
 			// happen if the post was edited to use a different profile.
 			return nil
 		}
-		profiledPost, errStr := profilePost(be, DeepClonePost(post), *newProfile)
+		appearance := *newProfile
+		version := getPostProfileVersion(post)
+		if version > 0 {
+			version += versionOffset
+		}
+		if versionOffset >= 0 && isFrozenVersion(*newProfile, version) {
+			// This post keeps the appearance it was sent with.
+			if oldProfileId == newProfileId {
+				return nil
+			}
+			frozenProfile, fErr := GetProfileAtVersion(be, userId, newProfileId, version)
+			if fErr == nil && frozenProfile.Status == PROFILE_CHARACTER {
+				appearance = *frozenProfile
+			}
+		}
+		profiledPost, errStr := profilePost(be, DeepClonePost(post), appearance)
 		if errStr != "" {
 			return appError(errStr, nil)
 		}
 		// If post is unchanged, don't update it.
 		if profiledPost.Message == post.Message &&
 			profiledPost.Props["profile_identifier"] == post.Props["profile_identifier"] &&
+			profiledPost.Props["profile_version"] == post.Props["profile_version"] &&
 			profiledPost.Props["override_username"] == post.Props["override_username"] &&
 			profiledPost.Props["override_icon_url"] == post.Props["override_icon_url"] &&
-			profiledPost.Props["from_webhook"] == post.Props["from_webhook"] {
+			profiledPost.Props["from_webhook"] == post.Props["from_webhook"] &&
+			profiledPost.Props["from_bot"] == post.Props["from_bot"] {
 			return nil
 		}
 		// Update the post. This will also insert it into the new idset.
@@ -189,6 +445,10 @@ func updatePostsForProfile(be Backend, userId, oldProfileId, newProfileId string
 			if err != nil {
 				return err
 			}
+			err = countPostInStats(be, userId, oldProfileId, post, -1)
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	})
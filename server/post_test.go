@@ -43,3 +43,93 @@ func TestDeepClonePost(t *testing.T) {
 	assert.Equal(t, postJson1, clone2Json1)
 	assert.Equal(t, postJson1, clone2Json2)
 }
+
+func TestBotAccount(t *testing.T) {
+	be := newMockBackend()
+	bot := "botaaaaaaaaaaaaaaaaaaaaaaa"
+	be.BotUserId = bot
+	be.Configuration = &main.Configuration{UseBotAccount: true}
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	send := func(post *model.Post, isedited bool) *model.Post {
+		t.Helper()
+		profiled, errStr := main.ProfiledPost(be, post, isedited)
+		assert.Equal(t, "", errStr)
+		if profiled == nil {
+			profiled = post
+		}
+		if !isedited {
+			profiled.Id = be.NewId()
+		}
+		be.Posts[profiled.Id] = profiled
+		assert.Nil(t, main.RegisterPost(be, profiled))
+		return profiled
+	}
+	// Character messages are posted by the bot on behalf of the author
+	post := send(&model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Blistering barnacles!"}, false)
+	assert.Equal(t, bot, post.UserId)
+	assert.Equal(t, tUser1, post.Props["profile_author_id"])
+	assert.Equal(t, "true", post.Props["from_bot"])
+	assert.Nil(t, post.Props["from_webhook"])
+	assert.Equal(t, "Captain Haddock", post.Props["override_username"])
+	assert.Equal(t, "Blistering barnacles!", post.Message)
+	// Messages using the real profile are posted as usual
+	own := send(&model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "me: Hello"}, false)
+	assert.Equal(t, tUser1, own.UserId)
+	assert.Nil(t, own.Props["profile_author_id"])
+	// Messages posted by the bot are managed along with the author's messages
+	cmd(t, be, "/character make haddock into archibald", tUser1, tChannel1, tTeam1, "",
+		"Changed identifier for character profile `haddock` to `archibald`.",
+		[]tAtt{{"**Captain Haddock**\n`archibald`", "#5c66ff", nil}})
+	assert.Equal(t, "archibald", be.Posts[post.Id].Props["profile_identifier"])
+	assert.Nil(t, main.RegisterPost(be, be.Posts[post.Id]))
+	cmd(t, be, "/character archibald=Archibald Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `archibald` modified by changing the display name from \"Captain Haddock\" to \"Archibald Haddock\"",
+		[]tAtt{{"**Archibald Haddock**\n`archibald`", "#5c66ff", nil}})
+	assert.Equal(t, "Archibald Haddock", be.Posts[post.Id].Props["override_username"])
+	// Editing a message to use the real profile keeps the bot as poster
+	edited := main.DeepClonePost(be.Posts[post.Id])
+	edited.Message = "me: Sorry about that."
+	edited = send(edited, true)
+	assert.Equal(t, bot, edited.UserId)
+	assert.Nil(t, edited.Props["profile_identifier"])
+	assert.Equal(t, "user-number-one", edited.Props["override_username"])
+	assert.Equal(t, be.GetSiteURL()+"/api/v4/users/"+tUser1+"/image", edited.Props["override_icon_url"])
+	assert.Equal(t, "Sorry about that.", edited.Message)
+	// When the bot account is no longer used, new messages are posted as
+	// before, while messages by the bot are still recognized.
+	be.Configuration.UseBotAccount = false
+	post2 := send(&model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "archibald: Thundering typhoons!"}, false)
+	assert.Equal(t, tUser1, post2.UserId)
+	assert.Equal(t, "true", post2.Props["from_webhook"])
+	edited = main.DeepClonePost(be.Posts[post.Id])
+	edited.Message = "archibald: Ten thousand thundering typhoons!"
+	edited = send(edited, true)
+	assert.Equal(t, bot, edited.UserId)
+	assert.Equal(t, "archibald", edited.Props["profile_identifier"])
+	assert.Equal(t, "true", edited.Props["from_bot"])
+	// Only messages posted by the bot can claim another author
+	be.Configuration.UseBotAccount = true
+	spoofed := send(&model.Post{UserId: tUser2, ChannelId: tChannel1, Message: "Hi",
+		Props: model.StringInterface{"profile_author_id": tUser1, "profile_identifier": "archibald"}}, false)
+	assert.Equal(t, tUser2, spoofed.UserId)
+	cmd(t, be, "/character archibald=Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `archibald` modified by changing the display name from \"Archibald Haddock\" to \"Haddock\"",
+		[]tAtt{{"**Haddock**\n`archibald`", "#5c66ff", nil}})
+	assert.Nil(t, be.Posts[spoofed.Id].Props["override_username"])
+	// Authors can edit and delete messages posted by the bot on their behalf
+	link := be.GetSiteURL() + "/team-one/pl/" + post.Id
+	cmd(t, be, "/character message edit "+link+" archibald: Billions of blue blistering barnacles!", tUser1, tChannel1, tTeam1, "",
+		"Edited the message.", nil)
+	assert.Equal(t, "Billions of blue blistering barnacles!", be.Posts[post.Id].Message)
+	assert.Equal(t, "archibald", be.Posts[post.Id].Props["profile_identifier"])
+	assert.Equal(t, bot, be.Posts[post.Id].UserId)
+	cmdFail(t, be, "/character message edit "+link+" Mine now", tUser2, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Could not find message `"+post.Id+"` posted by the bot account on your behalf.")
+	cmdFail(t, be, "/character message delete "+be.GetSiteURL()+"/team-one/pl/"+own.Id, tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Could not find message `"+own.Id+"` posted by the bot account on your behalf.")
+	cmd(t, be, "/character message delete "+link, tUser1, tChannel1, tTeam1, "",
+		"Deleted the message.", nil)
+	assert.NotEqual(t, int64(0), be.Posts[post.Id].DeleteAt)
+}
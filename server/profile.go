@@ -1,10 +1,17 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"regexp"
 	"sort"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 )
@@ -25,11 +32,18 @@ type Profile struct {
 	Identifier      string          `json:"-"`           // not stored
 	Name            string          `json:"displayName"` // todo rename to DisplayName
 	PictureFileId   string          `json:"pictureFile"`
-	PictureFileInfo *model.FileInfo `json:"-"`          // not stored
-	PicturePost     *model.Post     `json:"-"`          // not stored
-	Status          int             `json:"-"`          // not stored. Can be any of PROFILE_*.
-	Error           *model.AppError `json:"-"`          // not stored. Must be set if Status == PROFILE_NONEXISTENT || Status == PROFILE_CORRUPTED.
-	RequestKey      string          `json:"requestKey"` // Used to authorize HTTP requests for the profile picture, as well as force a cache miss.
+	PictureCrop     string          `json:"pictureCrop,omitempty"`   // Anchor of the square crop of the profile picture. Empty means center.
+	PictureFileInfo *model.FileInfo `json:"-"`                       // not stored
+	PicturePost     *model.Post     `json:"-"`                       // not stored
+	Status          int             `json:"-"`                       // not stored. Can be any of PROFILE_*.
+	Error           *model.AppError `json:"-"`                       // not stored. Must be set if Status == PROFILE_NONEXISTENT || Status == PROFILE_CORRUPTED.
+	RequestKey      string          `json:"requestKey"`              // Used to authorize HTTP requests for the profile picture, as well as force a cache miss.
+	DeletedAt       int64           `json:"deletedAt,omitempty"`     // Set when the profile is moved to the trash.
+	Version         int             `json:"version,omitempty"`       // The latest version in the profile history.
+	KeepHistory     bool            `json:"keepHistory,omitempty"`   // Whether changes should leave existing messages as they are.
+	FrozenVersion   int             `json:"frozenVersion,omitempty"` // Messages sent with this version or earlier are never updated.
+	Aliases         []string        `json:"aliases,omitempty"`       // Sorted list of additional identifiers for the profile.
+	Color           string          `json:"color,omitempty"`         // Background color of the generated avatar as `#rrggbb`. Empty means derived from the identifier.
 }
 
 func populateProfile(be Backend, profile *Profile) *model.AppError {
@@ -59,6 +73,47 @@ func populateProfile(be Backend, profile *Profile) *model.AppError {
 	return nil
 }
 
+// NormalizeIdentifier returns the canonical form of a profile identifier, so
+// that identifiers differing only in case or Unicode normalization refer to the
+// same profile. All identifiers given by users must be normalized before use.
+func NormalizeIdentifier(id string) string {
+	return norm.NFC.String(cases.Fold().String(norm.NFC.String(id)))
+}
+
+// validateIdentifier checks that a string can be used as a profile identifier
+// or alias.
+func validateIdentifier(id string) *model.AppError {
+	// Letters may carry combining marks, as in many scripts such as Devanagari.
+	matches := regexp.MustCompile(`^\pL[\pL\pM]{0,59}$`).FindStringSubmatch(id)
+	if len(matches) != 1 {
+		return appError("Identifier must be 1-60 letters.", nil)
+	}
+	if id != NormalizeIdentifier(id) {
+		return appError("Identifier is not normalized.", nil)
+	}
+	return nil
+}
+
+// MAX_ENCODED_IDENTIFIER_LENGTH is the length of the longest encoded identifier
+// that is used as it is in KV store keys. It keeps keys well within the limit
+// of 150 characters of the server.
+const MAX_ENCODED_IDENTIFIER_LENGTH = 60
+
+// encodeIdentifierForKey returns a profile identifier encoded for use in a KV
+// store key. Identifiers consisting of letters a-z are left as they are, while
+// other letters are percent-encoded to keep keys ASCII. Percent-encoding makes
+// non-ASCII identifiers up to nine times longer, so encodings that would be
+// too long are replaced by a hash, marked with a tilde that cannot otherwise
+// occur.
+func encodeIdentifierForKey(profileId string) string {
+	encoded := url.PathEscape(profileId)
+	if len(encoded) <= MAX_ENCODED_IDENTIFIER_LENGTH {
+		return encoded
+	}
+	sum := sha256.Sum256([]byte(profileId))
+	return "~" + hex.EncodeToString(sum[:16])
+}
+
 func (profile *Profile) validate(profileId string) *model.AppError {
 	pre := fmt.Sprintf("Failed validating profile `%s`: ", profileId)
 	if profile == nil {
@@ -67,14 +122,17 @@ func (profile *Profile) validate(profileId string) *model.AppError {
 	if profile.Identifier != profileId {
 		return appError(pre+"Identifier mismatch.", nil)
 	}
-	matches := regexp.MustCompile(`^[a-z]{1,60}$`).FindStringSubmatch(profile.Identifier)
-	if len(matches) != 1 {
-		return appError(pre+"Identifier must be 1-60 lowercase letters a-z.", nil)
+	err := validateIdentifier(profile.Identifier)
+	if err != nil {
+		return appErrorPre(pre, err)
 	}
-	matches = regexp.MustCompile("^[^|`>#*_~[\\]]{1,200}$").FindStringSubmatch(profile.Name)
+	matches := regexp.MustCompile("^[^|`>#*_~[\\]]{1,200}$").FindStringSubmatch(profile.Name)
 	if len(matches) != 1 {
 		return appError(pre+"Display name must be 1-200 characters and must not contain format control characters.", nil)
 	}
+	if profile.Color != "" && !regexp.MustCompile(`^#[0-9a-f]{6}$`).MatchString(profile.Color) {
+		return appError(fmt.Sprintf("%sInvalid avatar color `%s`.", pre, profile.Color), nil)
+	}
 	if profile.PictureFileId == "" {
 		if profile.PictureFileInfo != nil {
 			return appError(pre+"PictureFileInfo has a value despite no PictureFileId.", nil)
@@ -85,17 +143,20 @@ func (profile *Profile) validate(profileId string) *model.AppError {
 		if profile.RequestKey != "" {
 			return appError(pre+"RequestKey has a value despite no PictureFileId.", nil)
 		}
+		if profile.PictureCrop != "" {
+			return appError(pre+"PictureCrop has a value despite no PictureFileId.", nil)
+		}
 	} else {
 		file := profile.PictureFileInfo
 		if !file.IsImage() {
 			return appError(fmt.Sprintf("%sThe file \"%s\" is not recognized as an image file.", pre, file.Name), nil)
 		}
 		ext := file.Extension
-		matches := regexp.MustCompile(`(?i)^(jpe?g|png)$`).FindStringSubmatch(ext)
+		matches := regexp.MustCompile(`(?i)^(jpe?g|png|gif|webp)$`).FindStringSubmatch(ext)
 		if len(matches) == 0 {
-			return appError(fmt.Sprintf("%sThe file extension \"%s\" is not valid for a profile picture. Only .JPG, .JPEG and .PNG are acceptable.", pre, ext), nil)
+			return appError(fmt.Sprintf("%sThe file extension \"%s\" is not valid for a profile picture. Only .JPG, .JPEG, .PNG, .GIF and .WEBP are acceptable.", pre, ext), nil)
 		}
-		err := file.IsValid()
+		err = file.IsValid()
 		if err != nil {
 			return appErrorPre(pre, err)
 		}
@@ -107,15 +168,19 @@ func (profile *Profile) validate(profileId string) *model.AppError {
 			// This probably can't happen because the API doesn't return deleted posts.
 			return appError(pre+"The message supposedly holding the profile picture is deleted.", nil)
 		}
-		if len(post.FileIds) != 1 {
-			return appError(pre+"The message supposedly holding the profile picture does not have exactly 1 file.", nil)
+		hasFile := false
+		for _, fileId := range post.FileIds {
+			hasFile = hasFile || fileId == profile.PictureFileId
 		}
-		if post.FileIds[0] != profile.PictureFileId {
+		if !hasFile {
 			return appError(pre+"The message supposedly holding the profile picture does not hold the expected file.", nil)
 		}
 		if profile.RequestKey == "" {
 			return appError(pre+"RequestKey is empty despite PictureFileId being set.", nil)
 		}
+		if _, ok := pictureCropAnchors[profile.PictureCrop]; !ok {
+			return appError(fmt.Sprintf("%sUnknown crop `%s`.", pre, profile.PictureCrop), nil)
+		}
 	}
 	switch profile.Status {
 	case PROFILE_CHARACTER:
@@ -155,7 +220,7 @@ func DecodeProfileFromByte(b []byte) (*Profile, *model.AppError) {
 }
 
 func getProfileKey(userId, profileId string) string {
-	return fmt.Sprintf("profile_%s_%s", userId, profileId)
+	return fmt.Sprintf("profile_%s_%s", userId, encodeIdentifierForKey(profileId))
 }
 
 func profileExists(be Backend, userId, profileId string) (bool, *model.AppError) {
@@ -194,6 +259,17 @@ func GetProfile(be Backend, userId, profileId string, accepted int) (*Profile, *
 	// id list, but that would require an extra database call and is not
 	// necessary.
 
+	// Handle aliases
+	if b == nil {
+		target, err := getAliasTarget(be, userId, profileId)
+		if err != nil {
+			return nil, err
+		}
+		if target != "" {
+			return GetProfile(be, userId, target, accepted)
+		}
+	}
+
 	// Handle nonexistent profile
 	if b == nil {
 		nonexistentErr := appError(fmt.Sprintf("Profile `%s` does not exist.", profileId), nil)
@@ -209,22 +285,51 @@ func GetProfile(be Backend, userId, profileId string, accepted int) (*Profile, *
 		}
 	}
 
-	// Decode
-	profile, corruptionErr := DecodeProfileFromByte(b)
-	// Handle character and corrupt profile
-	if corruptionErr == nil && profile == nil {
-		corruptionErr = appError(fmt.Sprintf("Profile `%s` failed to decode and needs to be recreated.", profileId), nil)
+	// Decode and check
+	profile := profileFromBytes(be, userId, profileId, b)
+	if profile.Status == PROFILE_CORRUPT {
+		if accepted&PROFILE_CORRUPT != 0 {
+			return profile, nil
+		} else {
+			return nil, profile.Error
+		}
+	}
+	if accepted&PROFILE_CHARACTER != 0 {
+		return profile, nil
+	} else {
+		return nil, appError(fmt.Sprintf("Profile identifier `%s` refers to a character profile.", profileId), nil)
+	}
+}
+
+// profileFromBytes decodes, populates and validates a stored profile. The
+// returned profile has status PROFILE_CHARACTER, or PROFILE_CORRUPT with Error
+// set.
+func profileFromBytes(be Backend, userId, profileId string, b []byte) *Profile {
+	profile, decodeErr := DecodeProfileFromByte(b)
+	if decodeErr == nil && profile == nil {
+		decodeErr = appError(fmt.Sprintf("Profile `%s` failed to decode and needs to be recreated.", profileId), nil)
 	}
 	if profile == nil {
 		profile = &Profile{}
 	}
 	profile.UserId = userId
 	profile.Identifier = profileId
+	checkProfile(be, profile, decodeErr)
+	return profile
+}
+
+// checkProfile populates and validates a profile, setting its status to
+// PROFILE_CHARACTER, or PROFILE_CORRUPT with Error set. A non-nil corruptionErr
+// marks the profile as corrupt without further checks.
+func checkProfile(be Backend, profile *Profile, corruptionErr *model.AppError) {
+	profileId := profile.Identifier
 	profile.Status = PROFILE_CHARACTER
-	populateErr := populateProfile(be, profile)
 	corruptionPre := fmt.Sprintf("Profile `%s` is corrupt and needs to be recreated: ", profileId)
-	if populateErr != nil {
-		corruptionErr = appErrorPre(corruptionPre, populateErr)
+	if corruptionErr == nil {
+		populateErr := populateProfile(be, profile)
+		if populateErr != nil {
+			corruptionErr = appErrorPre(corruptionPre, populateErr)
+		}
 	}
 	if corruptionErr == nil {
 		validateErr := profile.validate(profileId)
@@ -233,23 +338,17 @@ func GetProfile(be Backend, userId, profileId string, accepted int) (*Profile, *
 		}
 	}
 	if corruptionErr != nil {
-		if accepted&PROFILE_CORRUPT != 0 {
-			profile.Status = PROFILE_CORRUPT
-			profile.Error = corruptionErr
-			return profile, nil
-		} else {
-			return nil, corruptionErr
-		}
-	}
-	if accepted&PROFILE_CHARACTER != 0 {
-		return profile, nil
-	} else {
-		return nil, appError(fmt.Sprintf("Profile identifier `%s` refers to a character profile.", profileId), nil)
+		profile.Status = PROFILE_CORRUPT
+		profile.Error = corruptionErr
 	}
 }
 
 func setProfile(be Backend, userId string, profile *Profile) *model.AppError {
-	err := be.KVSet(getProfileKey(userId, profile.Identifier), profile.EncodeToByte())
+	err := recordProfileVersion(be, userId, profile)
+	if err != nil {
+		return err
+	}
+	err = be.KVSet(getProfileKey(userId, profile.Identifier), profile.EncodeToByte())
 	if err != nil {
 		return err
 	}
@@ -257,15 +356,35 @@ func setProfile(be Backend, userId string, profile *Profile) *model.AppError {
 	if err != nil {
 		return err
 	}
-	return nil
+	return rememberAvatar(be, *profile)
 }
 
 func deleteProfile(be Backend, userId, profileId string) *model.AppError {
-	err := StrsetRemove(be, ProfileIdsKey(userId), profileId)
+	b, err := be.KVGet(getProfileKey(userId, profileId))
+	if err != nil {
+		return err
+	}
+	if b != nil {
+		profile, dErr := DecodeProfileFromByte(b)
+		if dErr == nil {
+			profile.Identifier = profileId
+			err = releaseProfileAliases(be, userId, profile)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = StrsetRemove(be, ProfileIdsKey(userId), profileId)
+	if err != nil {
+		return err
+	}
+	err = be.KVDelete(getProfileKey(userId, profileId))
 	if err != nil {
 		return err
 	}
-	return be.KVDelete(getProfileKey(userId, profileId))
+	// When moving a profile to the trash, the history is kept since the trashed
+	// profile is written before this is called.
+	return deleteProfileHistoryIfUnused(be, userId, profileId)
 }
 
 // Get an array of all character profiles, and also the real one.
@@ -309,23 +428,131 @@ func getDefaultProfileKey(userId, channelId string) string {
 }
 
 func removeDefaultProfile(be Backend, userId, channelId string) *model.AppError {
-	return be.KVDelete(getDefaultProfileKey(userId, channelId))
+	err := be.KVDelete(getDefaultProfileKey(userId, channelId))
+	if err != nil {
+		return err
+	}
+	return StrsetRemove(be, getDefaultChannelsKey(userId), channelId)
 }
 
 func getDefaultProfileIdentifier(be Backend, userId, channelId string) (string, *model.AppError) {
-	b, err := be.KVGet(getDefaultProfileKey(userId, channelId))
+	return getDefaultProfileIdentifierForKey(be, getDefaultProfileKey(userId, channelId))
+}
+
+func getDefaultProfileIdentifierForKey(be Backend, key string) (string, *model.AppError) {
+	b, err := be.KVGet(key)
 	if err != nil {
 		return "", err
 	}
 	return string(b), nil
 }
 
+// Default profiles can be set for a channel, for a team or for the whole
+// account. The most specific one that is set applies. A channel can be set to
+// the real profile, to override the default of its team or account.
+const (
+	DEFAULT_LEVEL_CHANNEL = "channel"
+	DEFAULT_LEVEL_TEAM    = "team"
+	DEFAULT_LEVEL_GLOBAL  = "global"
+)
+
+func getTeamDefaultProfileKey(userId, teamId string) string {
+	return fmt.Sprintf("teamdefaultprofile_%s_%s", userId, teamId)
+}
+
+func getGlobalDefaultProfileKey(userId string) string {
+	return fmt.Sprintf("globaldefaultprofile_%s", userId)
+}
+
+// getEffectiveDefaultProfile returns the identifier of the default profile
+// that applies to a user in a channel, along with the level it is set at. The
+// identifier is empty for the real profile, and so is the level if no default
+// is set at any level.
+func getEffectiveDefaultProfile(be Backend, userId, channelId string) (string, string, *model.AppError) {
+	teamId, err := getDefaultsTeamId(be, userId, channelId)
+	if err != nil {
+		return "", "", err
+	}
+	return getEffectiveDefaultProfileInTeam(be, userId, channelId, teamId)
+}
+
+// getEffectiveDefaultProfileInTeam is like getEffectiveDefaultProfile, for
+// callers that know the team of the channel, which is empty for direct and
+// group messages.
+func getEffectiveDefaultProfileInTeam(be Backend, userId, channelId, teamId string) (string, string, *model.AppError) {
+	profileId, err := getDefaultProfileIdentifier(be, userId, channelId)
+	if err != nil {
+		return "", "", err
+	}
+	if profileId != "" {
+		if IsMe(profileId) {
+			return "", DEFAULT_LEVEL_CHANNEL, nil
+		}
+		// An expired default is ignored until the job removes it.
+		expired, err := isDefaultProfileExpired(be, userId, channelId, profileId)
+		if err != nil {
+			return "", "", err
+		}
+		if !expired {
+			return profileId, DEFAULT_LEVEL_CHANNEL, nil
+		}
+	}
+	return getInheritedDefaultProfile(be, userId, teamId)
+}
+
+// getDefaultsTeamId returns the team of a channel, or the empty string for
+// direct and group messages. The channel is only looked up if the user has a
+// team default at all, since this is done for every message.
+func getDefaultsTeamId(be Backend, userId, channelId string) (string, *model.AppError) {
+	teamIds, err := StrsetGet(be, getDefaultTeamsKey(userId))
+	if err != nil || len(teamIds) == 0 {
+		return "", err
+	}
+	// A channel that cannot be found is treated as having no team, since the
+	// global default still applies.
+	channel, _ := be.GetChannel(channelId)
+	if channel == nil {
+		return "", nil
+	}
+	return channel.TeamId, nil
+}
+
+// getInheritedDefaultProfile is like getEffectiveDefaultProfileInTeam, but
+// ignores the default of the channel itself.
+func getInheritedDefaultProfile(be Backend, userId, teamId string) (string, string, *model.AppError) {
+	if teamId != "" {
+		profileId, err := getDefaultProfileIdentifierForKey(be, getTeamDefaultProfileKey(userId, teamId))
+		if err != nil {
+			return "", "", err
+		}
+		if profileId != "" {
+			return profileId, DEFAULT_LEVEL_TEAM, nil
+		}
+	}
+	profileId, err := getDefaultProfileIdentifierForKey(be, getGlobalDefaultProfileKey(userId))
+	if err != nil {
+		return "", "", err
+	}
+	if profileId != "" {
+		return profileId, DEFAULT_LEVEL_GLOBAL, nil
+	}
+	return "", "", nil
+}
+
 func setDefaultProfileIdentifier(be Backend, userId, channelId, profileId string) (*Profile, *model.AppError) {
+	profile, err := setDefaultProfileIdentifierForKey(be, userId, getDefaultProfileKey(userId, channelId), profileId)
+	if err != nil {
+		return nil, err
+	}
+	return profile, StrsetInsert(be, getDefaultChannelsKey(userId), channelId)
+}
+
+func setDefaultProfileIdentifierForKey(be Backend, userId, key, profileId string) (*Profile, *model.AppError) {
 	profile, err := GetProfile(be, userId, profileId, PROFILE_CHARACTER)
 	if err != nil {
 		return nil, err
 	}
-	err = be.KVSet(getDefaultProfileKey(userId, channelId), []byte(profileId))
+	err = be.KVSet(key, []byte(profile.Identifier))
 	if err != nil {
 		return nil, appError("", err)
 	}
@@ -336,37 +563,98 @@ func GetPluginURL(be Backend) string {
 	return be.GetSiteURL() + "/plugins/" + PLUGIN_ID
 }
 
-func profileIconUrl(be Backend, profile Profile, thumbnail bool) string {
+// profileIconUrl returns the image URL of a profile, signed if it is a
+// character profile with a profile picture.
+func profileIconUrl(be Backend, profile Profile, thumbnail bool) (string, *model.AppError) {
+	return buildProfileIconUrl(be, profile, thumbnail, func(variant string) (string, *model.AppError) {
+		return signedImageQuery(be, profile, variant)
+	})
+}
+
+// legacyProfileIconUrl returns the image URL of a profile authorized by its
+// request key rather than a signature, for when URLs cannot be signed.
+func legacyProfileIconUrl(be Backend, profile Profile, thumbnail bool) string {
+	ret, _ := buildProfileIconUrl(be, profile, thumbnail, func(string) (string, *model.AppError) {
+		return "rk=" + url.QueryEscape(profile.RequestKey), nil
+	})
+	return ret
+}
+
+func buildProfileIconUrl(be Backend, profile Profile, thumbnail bool, imageQuery func(variant string) (string, *model.AppError)) (string, *model.AppError) {
 	siteURL := be.GetSiteURL()
 	pluginURL := GetPluginURL(be)
 	if profile.Status == PROFILE_CHARACTER {
 		fileId := profile.PictureFileId
 		userId := profile.UserId
-		profileId := profile.Identifier
+		profileId := url.PathEscape(profile.Identifier)
 		if fileId == "" {
-			if thumbnail {
-				return fmt.Sprintf("%s/static/defaultprofilepicture/thumbnail", pluginURL)
-			}
-			return fmt.Sprintf("%s/static/defaultprofilepicture", pluginURL)
+			return avatarURL(be, profile, thumbnail), nil
+		}
+		versionPath := ""
+		if profile.Version > 0 {
+			versionPath = fmt.Sprintf("/version/%d", profile.Version)
 		}
+		variant := IMAGE_VARIANT_FULL
+		variantPath := ""
 		if thumbnail {
-			return fmt.Sprintf("%s/profile/%s/%s/thumbnail?rk=%s", pluginURL, userId, profileId, profile.RequestKey)
+			variant = IMAGE_VARIANT_THUMBNAIL
+			variantPath = "/thumbnail"
+		}
+		query, err := imageQuery(variant)
+		if err != nil {
+			return "", err
 		}
-		return fmt.Sprintf("%s/profile/%s/%s?rk=%s", pluginURL, userId, profileId, profile.RequestKey)
+		return fmt.Sprintf("%s/profile/%s/%s%s%s?%s", pluginURL, userId, profileId, versionPath, variantPath, query), nil
 	}
 	if profile.Status == PROFILE_ME {
-		return fmt.Sprintf("%s/api/v4/users/%s/image", siteURL, profile.UserId) // todo how to get thumbnail?
+		return fmt.Sprintf("%s/api/v4/users/%s/image", siteURL, profile.UserId), nil // todo how to get thumbnail?
 	}
 	if thumbnail {
-		return fmt.Sprintf("%s/static/corruptedprofilepicture/thumbnail", pluginURL)
+		return fmt.Sprintf("%s/static/corruptedprofilepicture/thumbnail", pluginURL), nil
 	}
-	return fmt.Sprintf("%s/static/corruptedprofilepicture", pluginURL)
+	return fmt.Sprintf("%s/static/corruptedprofilepicture", pluginURL), nil
 }
 
 func ProfileIdsKey(userId string) string {
 	return fmt.Sprintf("profilelist_%s", userId)
 }
 
+// forEachUserProfile calls f for the identifier of every character profile of
+// every user, including profiles in the trash. This scans the entire KV store,
+// so it should only be used by periodic jobs.
+func forEachUserProfile(be Backend, f func(userId, profileId string) *model.AppError) *model.AppError {
+	userIds := map[string]bool{}
+	for _, prefix := range []string{ProfileIdsKey(""), TrashListKey("")} {
+		keys, err := KVListWithPrefix(be, prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			userIds[strings.TrimPrefix(key, prefix)] = true
+		}
+	}
+	for userId := range userIds {
+		profileIds, err := StrsetGet(be, ProfileIdsKey(userId))
+		if err != nil {
+			return err
+		}
+		trashedProfileIds, err := StrsetGet(be, TrashListKey(userId))
+		if err != nil {
+			return err
+		}
+		for _, profileId := range trashedProfileIds {
+			profileIds = insertSorted(profileIds, profileId)
+		}
+		for _, profileId := range profileIds {
+			err = f(userId, profileId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func corruptProfile(be Backend, userId string, profileId string, method string) *model.AppError {
 	profile, err := GetProfile(be, userId, profileId, PROFILE_CHARACTER|PROFILE_CORRUPT)
 	if err != nil {
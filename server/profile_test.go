@@ -1,10 +1,13 @@
 package main_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/mattermost/mattermost-server/v5/model"
+
 	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
 )
 
@@ -21,3 +24,75 @@ func TestDecode(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Nil(t, profile)
 }
+
+func TestNormalizeIdentifier(t *testing.T) {
+	assert.Equal(t, "haddock", main.NormalizeIdentifier("haddock"))
+	assert.Equal(t, "haddock", main.NormalizeIdentifier("Haddock"))
+	assert.Equal(t, "åsa", main.NormalizeIdentifier("ÅSA"))
+	// Decomposed and precomposed forms are the same identifier
+	assert.Equal(t, "ñandú", main.NormalizeIdentifier("N\u0303andu\u0301"))
+	assert.Equal(t, "me", main.NormalizeIdentifier("Me"))
+}
+
+func TestUnicodeIdentifiers(t *testing.T) {
+	be := newMockBackend()
+	cmd(t, be, "/character picture Åsa=Åsa Larsson", tUser1, tChannel1, tTeam1, tPost1,
+		"Character profile `åsa` created with display name \"Åsa Larsson\" and a profile picture",
+		[]tAtt{{"**Åsa Larsson**\n`åsa`", "#5c66ff", versionImg(t, be, tUser1, "åsa", 1)}})
+	assert.Contains(t, versionImg(t, be, tUser1, "åsa", 1)(true), "/profile/"+tUser1+"/%C3%A5sa/version/1/thumbnail?exp=")
+	cmd(t, be, "/character åsa=Åsa", tUser1, tChannel1, tTeam1, "",
+		"Character profile `åsa` modified by changing the display name from \"Åsa Larsson\" to \"Åsa\"",
+		[]tAtt{{"**Åsa**\n`åsa`", "#5c66ff", nil}})
+	cmd(t, be, "/character alias ÅSA Ñandú", tUser1, tChannel1, tTeam1, "",
+		"Added alias `ñandú` for character profile `åsa`.",
+		[]tAtt{{"**Åsa**\n`åsa`, `ñandú`", "#5c66ff", nil}})
+	postId := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "ÑANDÚ: Hej!"},
+		"åsa", "Åsa", versionImg(t, be, tUser1, "åsa", 2))
+	assert.Equal(t, "Hej!", be.Posts[postId].Message)
+	_, ok := be.KVStore["profile_"+tUser1+"_%C3%A5sa"]
+	assert.True(t, ok)
+	cmdFail(t, be, "/character alias åsa a1", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Unrecognized command. Try `/character help`.")
+	cmd(t, be, "/character I am Me", tUser1, tChannel1, tTeam1, "",
+		"You are already yourself. Multiplicity was a fun movie, but let's leave it at that.",
+		[]tAtt{})
+}
+
+func TestCombiningMarkIdentifiers(t *testing.T) {
+	be := newMockBackend()
+	// A decomposed identifier is the same as the precomposed one
+	nanduImg := avatarImg(be, "ñandú", "Ñandú")
+	cmd(t, be, "/character Ñandú=Ñandú", tUser1, tChannel1, tTeam1, "",
+		"Character profile `ñandú` created with display name \"Ñandú\"",
+		[]tAtt{{"**Ñandú**\n`ñandú`", "#5c66ff", nanduImg}})
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Ñandú: Hola"}, "ñandú", "Ñandú", nanduImg)
+	// Devanagari vowel signs are combining marks
+	ramImg := avatarImg(be, "राम", "Rama")
+	cmd(t, be, "/character राम=Rama", tUser1, tChannel1, tTeam1, "",
+		"Character profile `राम` created with display name \"Rama\"",
+		[]tAtt{{"**Rama**\n`राम`", "#5c66ff", ramImg}})
+	cmd(t, be, "/character I am राम", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Rama\".",
+		[]tAtt{{"**Rama**\n`राम`", "#5c66ff", ramImg}})
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Namaste"}, "राम", "Rama", ramImg)
+	// A mark cannot start an identifier
+	cmdFail(t, be, "/character ाराम=Rama", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Failed validating profile `ाराम`: Identifier must be 1-60 letters.")
+	// Long identifiers in scripts that percent-encode to long strings still fit
+	// in KV store keys
+	long := strings.Repeat("रा", 30)
+	longImg := avatarImg(be, long, "Long")
+	cmd(t, be, "/character "+long+"=Long", tUser1, tChannel1, tTeam1, "",
+		"Character profile `"+long+"` created with display name \"Long\"",
+		[]tAtt{{"**Long**\n`" + long + "`", "#5c66ff", longImg}})
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: long + ": Namaste"}, long, "Long", longImg)
+	cmd(t, be, "/character alias "+long+" लंबा", tUser1, tChannel1, tTeam1, "",
+		"Added alias `लंबा` for character profile `"+long+"`.",
+		[]tAtt{{"**Long**\n`" + long + "`, `लंबा`", "#5c66ff", longImg}})
+	cmd(t, be, "/character delete "+long, tUser1, tChannel1, tTeam1, "",
+		"Deleted character profile `"+long+"`. You can restore it with `/character restore "+long+"` within 30 days.",
+		[]tAtt{})
+	cmd(t, be, "/character restore "+long, tUser1, tChannel1, tTeam1, "",
+		"Restored character profile `"+long+"`.",
+		[]tAtt{{"**Long**\n`" + long + "`, `लंबा`", "#5c66ff", longImg}})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// A scene marks a stretch of a channel, from `/character scene start` to
+// `/character scene end`. While a scene is running, profilePost tags every
+// message with the id of the scene, including those using the real profile of
+// their author, and RegisterPost records tagged messages of the channel in the
+// id set of the scene, which is what scene transcripts are made from. The
+// scenes of each channel are kept in a string set, and the running scene of a
+// channel, if any, under a key of its own. Scenes are run by channel admins,
+// except in direct and group messages, which have none.
+
+// Messages posted during a scene record its id in this prop.
+const SCENE_PROP = "scene_id"
+
+type Scene struct {
+	Id        string `json:"id"`
+	ChannelId string `json:"channel_id"`
+	Title     string `json:"title"`
+	StartedBy string `json:"started_by"`
+	StartAt   int64  `json:"start_at"`
+	EndedBy   string `json:"ended_by,omitempty"`
+	EndAt     int64  `json:"end_at,omitempty"`
+}
+
+func getSceneKey(sceneId string) string {
+	return "scene_" + sceneId
+}
+
+func getChannelScenesKey(channelId string) string {
+	return "scenes_" + channelId
+}
+
+func getActiveSceneKey(channelId string) string {
+	return "activescene_" + channelId
+}
+
+func getScenePostsKey(sceneId string) string {
+	return "scenepost_" + sceneId
+}
+
+func getScene(be Backend, sceneId string) (*Scene, *model.AppError) {
+	b, err := be.KVGet(getSceneKey(sceneId))
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+	scene := Scene{}
+	jErr := json.Unmarshal(b, &scene)
+	if jErr != nil {
+		return nil, appError("Failed to unmarshal scene.", jErr)
+	}
+	return &scene, nil
+}
+
+func setScene(be Backend, scene *Scene) *model.AppError {
+	b, jErr := json.Marshal(scene)
+	if jErr != nil {
+		return appError("Failed to marshal scene.", jErr)
+	}
+	return be.KVSet(getSceneKey(scene.Id), b)
+}
+
+// getActiveScene returns the running scene of a channel, or nil if there is
+// none.
+func getActiveScene(be Backend, channelId string) (*Scene, *model.AppError) {
+	sceneId, err := be.KVGet(getActiveSceneKey(channelId))
+	if err != nil || sceneId == nil {
+		return nil, err
+	}
+	return getScene(be, string(sceneId))
+}
+
+// canRunScenes returns whether a user can start and end scenes in a channel.
+func canRunScenes(be Backend, userId string, channel *model.Channel) bool {
+	switch channel.Type {
+	case model.CHANNEL_DIRECT, model.CHANNEL_GROUP:
+		return be.HasPermissionToChannel(userId, channel.Id, model.PERMISSION_CREATE_POST)
+	default:
+		return canManageChannel(be, userId, channel)
+	}
+}
+
+// StartScene starts a scene in a channel, unless one is already running.
+func StartScene(be Backend, userId, channelId, title string) (*Scene, *model.AppError) {
+	channel, err := be.GetChannel(channelId)
+	if err != nil {
+		return nil, err
+	}
+	if !canRunScenes(be, userId, channel) {
+		return nil, appError("Only channel admins can start scenes.", nil)
+	}
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return nil, appError("A scene needs a title.", nil)
+	}
+	scene := &Scene{
+		Id:        be.NewId(),
+		ChannelId: channelId,
+		Title:     title,
+		StartedBy: userId,
+		StartAt:   be.GetMillis(),
+	}
+	err = setScene(be, scene)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := be.KVCompareAndSet(getActiveSceneKey(channelId), nil, []byte(scene.Id))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		_ = be.KVDelete(getSceneKey(scene.Id))
+		active, _ := getActiveScene(be, channelId)
+		if active != nil {
+			return nil, appError(fmt.Sprintf("Scene \"%s\" is already running in this channel. End it first with `/character scene end`.", active.Title), nil)
+		}
+		return nil, appError("A scene is already running in this channel. End it first with `/character scene end`.", nil)
+	}
+	err = StrsetInsert(be, getChannelScenesKey(channelId), scene.Id)
+	if err != nil {
+		return nil, err
+	}
+	return scene, nil
+}
+
+// EndScene ends the running scene of a channel. It can be ended by channel
+// admins and by whoever started it.
+func EndScene(be Backend, userId, channelId string) (*Scene, *model.AppError) {
+	if !be.HasPermissionToChannel(userId, channelId, model.PERMISSION_CREATE_POST) {
+		return nil, appError("You cannot post in this channel.", nil)
+	}
+	scene, err := getActiveScene(be, channelId)
+	if err != nil {
+		return nil, err
+	}
+	if scene == nil {
+		return nil, appError("No scene is running in this channel. Start one with `/character scene start`.", nil)
+	}
+	if scene.StartedBy != userId {
+		channel, err := be.GetChannel(channelId)
+		if err != nil {
+			return nil, err
+		}
+		if !canRunScenes(be, userId, channel) {
+			return nil, appError(fmt.Sprintf("Only channel admins and whoever started scene \"%s\" can end it.", scene.Title), nil)
+		}
+	}
+	scene.EndedBy = userId
+	scene.EndAt = be.GetMillis()
+	err = setScene(be, scene)
+	if err != nil {
+		return nil, err
+	}
+	err = be.KVDelete(getActiveSceneKey(channelId))
+	if err != nil {
+		return nil, err
+	}
+	return scene, nil
+}
+
+// listScenes returns the scenes of a channel, oldest first.
+func listScenes(be Backend, channelId string) ([]Scene, *model.AppError) {
+	sceneIds, err := StrsetGet(be, getChannelScenesKey(channelId))
+	if err != nil {
+		return nil, err
+	}
+	scenes := []Scene{}
+	for _, sceneId := range sceneIds {
+		scene, err := getScene(be, sceneId)
+		if err != nil {
+			return nil, err
+		}
+		if scene != nil {
+			scenes = append(scenes, *scene)
+		}
+	}
+	sort.SliceStable(scenes, func(i, j int) bool {
+		return scenes[i].StartAt < scenes[j].StartAt
+	})
+	return scenes, nil
+}
+
+// tagPostWithScene tags a post with the running scene of its channel, unless it
+// was created before the scene started or is already tagged. Failing to look
+// up the scene leaves the post untagged, since it is no reason to reject it.
+func tagPostWithScene(be Backend, post *model.Post) {
+	if _, ok := post.GetProp(SCENE_PROP).(string); ok {
+		return
+	}
+	scene, err := getActiveScene(be, post.ChannelId)
+	if err != nil || scene == nil {
+		return
+	}
+	if post.CreateAt != 0 && post.CreateAt < scene.StartAt {
+		return
+	}
+	post.AddProp(SCENE_PROP, scene.Id)
+}
+
+// getScenePosts returns the messages of a scene that have not been deleted,
+// oldest first, and whether older ones were left out.
+func getScenePosts(be Backend, scene *Scene) ([]*model.Post, bool, *model.AppError) {
+	posts := []*model.Post{}
+	err := IdsetIter(be, getScenePostsKey(scene.Id), "", 0, func(postId string) *model.AppError {
+		post, err := GetPostIfExists(be, postId)
+		if err != nil {
+			return err
+		}
+		if post != nil && post.DeleteAt == 0 && post.ChannelId == scene.ChannelId && post.GetProp(SCENE_PROP) == scene.Id {
+			posts = append(posts, post)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].CreateAt < posts[j].CreateAt
+	})
+	truncated := len(posts) > TRANSCRIPT_MAX_MESSAGES
+	if truncated {
+		posts = posts[len(posts)-TRANSCRIPT_MAX_MESSAGES:]
+	}
+	return posts, truncated, nil
+}
+
+// countScenePosts returns the number of messages of a scene, including those
+// deleted since, without getting each message.
+func countScenePosts(be Backend, scene *Scene) (int, *model.AppError) {
+	count := 0
+	err := IdsetIter(be, getScenePostsKey(scene.Id), "", 0, func(string) *model.AppError {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// registerScenePost records a message tagged with a scene in the id set of the
+// scene, unless it belongs to another channel.
+func registerScenePost(be Backend, post *model.Post, sceneId string) *model.AppError {
+	scene, err := getScene(be, sceneId)
+	if err != nil || scene == nil || scene.ChannelId != post.ChannelId {
+		return err
+	}
+	return IdsetInsert(be, getScenePostsKey(sceneId), post.Id)
+}
+
+// BuildSceneTranscript returns the transcript of a scene, with its cast.
+func BuildSceneTranscript(be Backend, scene *Scene) (*Transcript, *model.AppError) {
+	channel, err := be.GetChannel(scene.ChannelId)
+	if err != nil {
+		return nil, err
+	}
+	posts, truncated, err := getScenePosts(be, scene)
+	if err != nil {
+		return nil, err
+	}
+	transcript := newTranscript(be, channel, posts)
+	transcript.Scene = scene.Title
+	transcript.Since = scene.StartAt
+	transcript.Truncated = truncated
+	transcript.fillCast()
+	return transcript, nil
+}
+
+// SendSceneTranscript exports a scene and sends it to the user in a direct
+// message from the bot account. It returns the transcript.
+func SendSceneTranscript(be Backend, userId string, scene *Scene, number int) (*Transcript, *model.AppError) {
+	if !be.HasPermissionToChannel(userId, scene.ChannelId, model.PERMISSION_READ_CHANNEL) {
+		return nil, appError("You cannot read this channel.", nil)
+	}
+	transcript, err := BuildSceneTranscript(be, scene)
+	if err != nil {
+		return nil, err
+	}
+	if len(transcript.Messages) == 0 {
+		return nil, appError(fmt.Sprintf("There are no messages in scene \"%s\" to export.", scene.Title), nil)
+	}
+	basename := fmt.Sprintf("scene-%s-%d-%s", transcript.ChannelName, number, time.Unix(0, scene.StartAt*int64(time.Millisecond)).UTC().Format("2006-01-02"))
+	return transcript, sendTranscript(be, userId, transcript, basename)
+}
+
+// describeScenes returns a numbered list of the scenes of a channel.
+func describeScenes(be Backend, scenes []Scene) (string, *model.AppError) {
+	lines := make([]string, len(scenes))
+	for i, scene := range scenes {
+		count, err := countScenePosts(be, &scene)
+		if err != nil {
+			return "", err
+		}
+		when := fmt.Sprintf("started %s, still running", formatTime(scene.StartAt))
+		if scene.EndAt != 0 {
+			when = fmt.Sprintf("%s to %s", formatTime(scene.StartAt), formatTime(scene.EndAt))
+		}
+		lines[i] = fmt.Sprintf("%d. **%s** (%s): %d messages", i+1, scene.Title, when, count)
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,109 @@
+package main_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+func TestScene(t *testing.T) {
+	be := newMockBackend()
+	be.BotUserId = tBot
+	be.Users[tBot] = &model.User{Id: tBot, Username: "character-profiles", IsBot: true}
+	be.ChannelAdmins = map[string]bool{tChannel1 + "_" + tUser1: true}
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	milouImg := avatarImg(be, "milou", "Milou")
+	cmd(t, be, "/character milou=Milou", tUser2, tChannel1, tTeam1, "",
+		"Character profile `milou` created with display name \"Milou\"",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	millis := *be.Millis
+	before := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: millis - 1000, Message: "haddock: Before the scene"},
+		"haddock", "Captain Haddock", haddockImg)
+
+	cmd(t, be, "/character scene list", tUser1, tChannel1, tTeam1, "",
+		"There are no scenes in this channel. Start one with `/character scene start`.", nil)
+	cmdFail(t, be, "/character scene end", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: No scene is running in this channel. Start one with `/character scene start`.")
+	// Scenes are run by channel admins
+	cmdFail(t, be, "/character scene start \"The Black Island\"", tUser2, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Only channel admins can start scenes.")
+	cmd(t, be, "/character scene start \"The Black Island\"", tUser1, tChannel1, tTeam1, "",
+		"Started scene \"The Black Island\". Messages in this channel are now part of it until `/character scene end`.", nil)
+	cmdFail(t, be, "/character scene start The Shooting Star", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Scene \"The Black Island\" is already running in this channel. End it first with `/character scene end`.")
+
+	// Messages during the scene are tagged, also those using the real profile
+	post1 := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: millis + 1000, Message: "haddock: Blistering barnacles!"},
+		"haddock", "Captain Haddock", haddockImg)
+	post(t, be, &model.Post{UserId: tUser2, ChannelId: tChannel1, CreateAt: millis + 2000, Message: "milou: Woof!"},
+		"milou", "Milou", milouImg)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: millis + 3000, Message: "haddock: Thundering typhoons!"},
+		"haddock", "Captain Haddock", haddockImg)
+	plain := post(t, be, &model.Post{UserId: tUser2, ChannelId: tChannel1, CreateAt: millis + 4000, Message: "Out of character"},
+		"", "", nil)
+	sceneId, _ := be.Posts[post1].GetProp(main.SCENE_PROP).(string)
+	assert.NotEqual(t, "", sceneId)
+	assert.Equal(t, sceneId, be.Posts[plain].GetProp(main.SCENE_PROP))
+	assert.Nil(t, be.Posts[before].GetProp(main.SCENE_PROP))
+	// Editing a message from before the scene does not add it to the scene
+	editPost(t, be, before, "Before the scene, edited", "haddock", "Captain Haddock", haddockImg)
+	assert.Nil(t, be.Posts[before].GetProp(main.SCENE_PROP))
+
+	// Messages from other channels are not part of the scene, even if tagged
+	spoofed := post(t, be, &model.Post{UserId: tUser2, ChannelId: "channel2aaaaaaaaaaaaaaaaaa", CreateAt: millis + 4500, Message: "Elsewhere",
+		Props: model.StringInterface{main.SCENE_PROP: sceneId}}, "", "", nil)
+	assert.Equal(t, sceneId, be.Posts[spoofed].GetProp(main.SCENE_PROP))
+
+	cmdFail(t, be, "/character scene end", tUser2, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Only channel admins and whoever started scene \"The Black Island\" can end it.")
+	cmd(t, be, "/character scene end", tUser1, tChannel1, tTeam1, "",
+		"Ended scene \"The Black Island\" with 4 messages. Export it with `/character scene export`.", nil)
+	after := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: millis + 5000, Message: "haddock: After the scene"},
+		"haddock", "Captain Haddock", haddockImg)
+	assert.Nil(t, be.Posts[after].GetProp(main.SCENE_PROP))
+
+	*be.Millis = millis + 120000
+	cmd(t, be, "/character scene start The Shooting Star", tUser1, tChannel1, tTeam1, "",
+		"Started scene \"The Shooting Star\". Messages in this channel are now part of it until `/character scene end`.", nil)
+	cmd(t, be, "/character scene list", tUser1, tChannel1, tTeam1, "",
+		"## Scenes\n"+
+			"1. **The Black Island** (2020-09-13 12:26 UTC to 2020-09-13 12:26 UTC): 4 messages\n"+
+			"2. **The Shooting Star** (started 2020-09-13 12:28 UTC, still running): 0 messages", nil)
+
+	// Export with cast list
+	cmdFail(t, be, "/character scene export", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: There are no messages in scene \"The Shooting Star\" to export.")
+	cmdFail(t, be, "/character scene export 3", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: There is no scene 3 in this channel. See `/character scene list`.")
+	assert.Nil(t, main.IdsetInsert(be, "scenepost_"+sceneId, spoofed))
+	cmd(t, be, "/character scene export 1", tUser1, tChannel1, tTeam1, "",
+		"Sent you a transcript of scene \"The Black Island\" with 4 messages and 3 characters in a direct message from @character-profiles.", nil)
+	files := transcriptFilesNamed(t, be, "scene-channel-one-1-2020-09-13.")
+	assert.Contains(t, files["md"], "# Transcript of scene \"The Black Island\" in Channel One\n")
+	assert.Contains(t, files["md"], "## Cast\n\n- Captain Haddock, played by @user-number-one, 2 messages\n- Milou, played by @user-number-two, 1 messages\n- user-number-two (@user-number-two), 1 messages\n")
+	assert.Contains(t, files["md"], "Thundering typhoons!")
+	assert.NotContains(t, files["md"], "Before the scene")
+	assert.NotContains(t, files["md"], "After the scene")
+	assert.NotContains(t, files["md"], "Elsewhere")
+	assert.Contains(t, files["md"], "Out of character")
+	assert.Contains(t, files["html"], "<li>Milou, played by @user-number-two, 1 messages</li>")
+	var transcript main.Transcript
+	assert.Nil(t, json.Unmarshal([]byte(files["json"]), &transcript))
+	assert.Equal(t, "The Black Island", transcript.Scene)
+	assert.Equal(t, 3, len(transcript.Cast))
+	assert.Equal(t, "haddock", transcript.Cast[0].Identifier)
+	assert.Equal(t, 2, transcript.Cast[0].Messages)
+
+	// Scenes are per channel
+	tChannel2 := "channel2aaaaaaaaaaaaaaaaaa"
+	cmd(t, be, "/character scene list", tUser1, tChannel2, tTeam1, "",
+		"There are no scenes in this channel. Start one with `/character scene start`.", nil)
+}
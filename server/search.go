@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Searching goes through the messages using a character profile, which are
+// recorded in the id set of the profile, since the search of Mattermost cannot
+// filter by profile. Results are paged by post id, so they come in no
+// particular order across pages.
+
+const SEARCH_PAGE_SIZE = 10
+
+// SEARCH_SCAN_BATCH is the number of messages to read from the id set at a
+// time while filling a page.
+const SEARCH_SCAN_BATCH = 100
+
+type SearchResult struct {
+	// Posts are the matching messages, newest first.
+	Posts []*model.Post
+	// NextAfter is the post id to continue searching after, or the empty string
+	// if there are no more messages to search.
+	NextAfter string
+}
+
+// searchMatches returns whether a message using a profile matches a search.
+func searchMatches(be Backend, post *model.Post, userId, profileId, channelId, text string) bool {
+	if post.DeleteAt != 0 || postAuthorId(be, post) != userId {
+		return false
+	}
+	// The id set may still hold messages that have since been moved to another
+	// profile.
+	if postProfileId, _ := post.GetProp("profile_identifier").(string); postProfileId != profileId {
+		return false
+	}
+	if channelId != "" && post.ChannelId != channelId {
+		return false
+	}
+	return strings.Contains(strings.ToLower(post.Message), strings.ToLower(text))
+}
+
+// SearchProfilePosts returns a page of the messages by a user using a
+// character profile that contain the given text, ignoring case. If channelId
+// is not empty, only messages in that channel are searched. The search begins
+// after the post id after, or at the beginning if it is empty. Messages in
+// channels the user can no longer read are left out.
+func SearchProfilePosts(be Backend, userId, profileId, channelId, text, after string) (*SearchResult, *model.AppError) {
+	result := &SearchResult{Posts: []*model.Post{}}
+	if channelId != "" {
+		// The channel index tells whether the profile was ever used in the
+		// channel, once it has been filled in for old messages.
+		indexed, err := be.KVGet(CHANNEL_INDEX_DONE_KEY)
+		if err != nil {
+			return nil, err
+		}
+		used, err := StrsetHas(be, getProfileChannelsKey(userId, profileId), channelId)
+		if err != nil {
+			return nil, err
+		}
+		if indexed != nil && !used {
+			return result, nil
+		}
+	}
+	readable := map[string]bool{}
+	key := getIdsetKey(userId, profileId)
+	last := after
+	for len(result.Posts) < SEARCH_PAGE_SIZE {
+		scanned := 0
+		err := IdsetIter(be, key, last, SEARCH_SCAN_BATCH, func(postId string) *model.AppError {
+			if len(result.Posts) >= SEARCH_PAGE_SIZE {
+				return nil
+			}
+			scanned++
+			last = postId
+			post, err := GetPostIfExists(be, postId)
+			if err != nil {
+				return err
+			}
+			if post == nil || !searchMatches(be, post, userId, profileId, channelId, text) {
+				return nil
+			}
+			canRead, ok := readable[post.ChannelId]
+			if !ok {
+				canRead = be.HasPermissionToChannel(userId, post.ChannelId, model.PERMISSION_READ_CHANNEL)
+				readable[post.ChannelId] = canRead
+			}
+			if canRead {
+				result.Posts = append(result.Posts, post)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if scanned < SEARCH_SCAN_BATCH && len(result.Posts) < SEARCH_PAGE_SIZE {
+			// All messages have been searched.
+			break
+		}
+	}
+	if len(result.Posts) >= SEARCH_PAGE_SIZE {
+		err := IdsetIter(be, key, last, 1, func(string) *model.AppError {
+			result.NextAfter = last
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(result.Posts, func(i, j int) bool {
+		return result.Posts[i].CreateAt > result.Posts[j].CreateAt
+	})
+	return result, nil
+}
+
+// searchCommand returns the command that shows the page of a search after the
+// given post id.
+func searchCommand(profileId, channelName, text, after string) string {
+	command := "/character search " + profileId
+	if channelName != "" {
+		command += " in ~" + channelName
+	}
+	if strings.Contains(text, "\"") {
+		command += " " + text
+	} else if text != "" {
+		command += " \"" + text + "\""
+	}
+	if after != "" {
+		command += " after " + after
+	}
+	return command
+}
+
+// describeSearchResult returns a list of permalinks to the messages found by
+// a search, with the time and channel of each message and the beginning of
+// its text.
+func describeSearchResult(be Backend, result *SearchResult, teamId string) string {
+	lines := make([]string, len(result.Posts))
+	channels := map[string]*model.Channel{}
+	teams := map[string]string{}
+	for i, post := range result.Posts {
+		channel, ok := channels[post.ChannelId]
+		if !ok {
+			channel, _ = be.GetChannel(post.ChannelId)
+			channels[post.ChannelId] = channel
+		}
+		where := ""
+		postTeamId := teamId
+		if channel != nil {
+			if channel.Type == model.CHANNEL_OPEN || channel.Type == model.CHANNEL_PRIVATE {
+				where = " in ~" + channel.Name
+			}
+			if channel.TeamId != "" {
+				postTeamId = channel.TeamId
+			}
+		}
+		teamName, ok := teams[postTeamId]
+		if !ok {
+			if team, _ := be.GetTeam(postTeamId); team != nil {
+				teamName = team.Name
+			}
+			teams[postTeamId] = teamName
+		}
+		excerpt := []rune(strings.Join(strings.Fields(post.Message), " "))
+		if len(excerpt) > 80 {
+			excerpt = append(excerpt[:79], '…')
+		}
+		lines[i] = fmt.Sprintf("- [%s%s](%s/%s/pl/%s): %s", formatTime(post.CreateAt), where, be.GetSiteURL(), teamName, post.Id, string(excerpt))
+	}
+	return strings.Join(lines, "\n")
+}
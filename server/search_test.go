@@ -0,0 +1,130 @@
+package main_test
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+// searchPage runs a search command and returns the linked post ids along with
+// the command for the next page, if any.
+func searchPage(t *testing.T, be main.BackendMock, command, userId string) ([]string, string) {
+	t.Helper()
+	response, attachments, err := main.DoExecuteCommand(be, command, userId, tChannel1, tTeam1, "", false)
+	assert.Nil(t, err, command)
+	postIds := []string{}
+	for _, m := range regexp.MustCompile(`\(http://mocksite.tld/team-one/pl/([a-z0-9]{26})\)`).FindAllStringSubmatch(response, -1) {
+		postIds = append(postIds, m[1])
+	}
+	if len(attachments) == 0 {
+		return postIds, ""
+	}
+	assert.Equal(t, 1, len(attachments))
+	assert.Equal(t, "Next page", attachments[0].Actions[0].Name)
+	return postIds, attachments[0].Actions[0].Integration.Context["command"].(string)
+}
+
+func TestSearch(t *testing.T) {
+	be := newMockBackend()
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	cmd(t, be, "/character alias haddock h", tUser1, tChannel1, tTeam1, "",
+		"Added alias `h` for character profile `haddock`.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`, `h`", "#5c66ff", haddockImg}})
+	cmd(t, be, "/character search haddock \"barnacles\"", tUser1, tChannel1, tTeam1, "",
+		"There are no messages using character profile `haddock` containing \"barnacles\".", nil)
+	matching := map[string]bool{}
+	for i := 0; i < 25; i++ {
+		message := fmt.Sprintf("haddock: Blistering Barnacles number %d!", i)
+		if i%5 == 0 {
+			message = fmt.Sprintf("haddock: Thundering typhoons number %d!", i)
+		}
+		postId := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: *be.Millis + int64(i), Message: message},
+			"haddock", "Captain Haddock", haddockImg)
+		if i%5 != 0 {
+			matching[postId] = true
+		}
+	}
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Barnacles from my real profile"}, "", "", nil)
+
+	// Results are paged, and every matching message is found once
+	found := map[string]bool{}
+	command := "/character search h \"barnacles\""
+	pages := 0
+	for command != "" {
+		var postIds []string
+		postIds, command = searchPage(t, be, command, tUser1)
+		assert.LessOrEqual(t, len(postIds), main.SEARCH_PAGE_SIZE)
+		for _, postId := range postIds {
+			assert.True(t, matching[postId], postId)
+			assert.False(t, found[postId], postId)
+			found[postId] = true
+		}
+		pages++
+		if pages == 1 {
+			assert.Regexp(t, `^/character search haddock "barnacles" after [a-z0-9]{26}$`, command)
+		}
+	}
+	assert.Equal(t, 2, pages)
+	assert.Equal(t, len(matching), len(found))
+	response, _, err := main.DoExecuteCommand(be, "/character search haddock barnacles", tUser1, tChannel1, tTeam1, "", false)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(response, "## Your messages using character profile `haddock` containing \"barnacles\"\n- [2020-09-13 12:26 UTC in ~channel-one](http://mocksite.tld/team-one/pl/"), response)
+	assert.Equal(t, main.SEARCH_PAGE_SIZE, strings.Count(response, "): Blistering Barnacles number "))
+
+	// Without a text, all messages using the profile are found
+	postIds, next := searchPage(t, be, "/character search haddock", tUser1)
+	assert.Equal(t, main.SEARCH_PAGE_SIZE, len(postIds))
+	assert.NotEqual(t, "", next)
+
+	// Messages moved to another profile are not found
+	response, _, err = main.DoExecuteCommand(be, "/character make haddock into me", tUser1, tChannel1, tTeam1, "", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "All messages that used character profile `haddock` now use your real profile instead. Character profile `haddock` has been deleted.", response)
+	cmd(t, be, "/character search haddock barnacles", tUser1, tChannel1, tTeam1, "",
+		"There are no messages using character profile `haddock` containing \"barnacles\".", nil)
+}
+
+func TestSearchInChannel(t *testing.T) {
+	be := newMockBackend()
+	tChannel2 := "channel2aaaaaaaaaaaaaaaaaa"
+	be.Channels[tChannel2] = &model.Channel{Id: tChannel2, Name: "channel-two", TeamId: tTeam1, Type: model.CHANNEL_OPEN}
+	be.ChannelMembers = append(be.ChannelMembers, struct {
+		UserId    string
+		ChannelId string
+	}{tUser1, tChannel2})
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	postId := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "haddock: Blistering barnacles!"},
+		"haddock", "Captain Haddock", haddockImg)
+	postIds, _ := searchPage(t, be, "/character search haddock in ~channel-one \"barnacles\"", tUser1)
+	assert.Equal(t, []string{postId}, postIds)
+	cmd(t, be, "/character search haddock in ~channel-two \"barnacles\"", tUser1, tChannel1, tTeam1, "",
+		"There are no messages using character profile `haddock` in ~channel-two containing \"barnacles\".", nil)
+	// Once the channel index is complete, it is used to skip channels
+	assert.Nil(t, main.IndexProfileChannels(be))
+	cmd(t, be, "/character search haddock in ~channel-two", tUser1, tChannel1, tTeam1, "",
+		"There are no messages using character profile `haddock` in ~channel-two.", nil)
+	postIds, _ = searchPage(t, be, "/character search haddock in ~channel-one", tUser1)
+	assert.Equal(t, []string{postId}, postIds)
+	cmdFail(t, be, "/character search haddock in ~channel-three", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Could not find channel ~channel-three.")
+	// Messages in channels the user can no longer read are left out
+	be.ChannelMembers = be.ChannelMembers[1:]
+	cmd(t, be, "/character search haddock", tUser1, tChannel1, tTeam1, "",
+		"There are no messages using character profile `haddock`.", nil)
+	// Other users have their own profiles
+	cmd(t, be, "/character search haddock", tUser2, tChannel1, tTeam1, "",
+		"There are no messages using character profile `haddock`.", nil)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// The service layer holds the logic for managing profiles that is shared by the
+// `/character` command and the REST API. Service functions return what they
+// did, which each caller describes in its own way. Errors that callers need to
+// tell apart have an HTTP status telling what kind of error it is, see
+// serviceError.
+
+// serviceError returns an error of the kind given by an HTTP status:
+//   - http.StatusNotFound: The profile or other item does not exist.
+//   - http.StatusConflict: The change conflicts with an existing item.
+//   - http.StatusForbidden: The user is not allowed to use the item.
+//   - http.StatusPreconditionRequired: The change needs to be confirmed, since
+//     it affects existing messages. The message asks for confirmation.
+//
+// Other errors have status http.StatusBadRequest.
+func serviceError(status int, message string) *model.AppError {
+	err := appError(message, nil)
+	err.StatusCode = status
+	return err
+}
+
+// IsConfirmationRequired returns whether an error asks for the change to be
+// confirmed.
+func IsConfirmationRequired(err *model.AppError) bool {
+	return err != nil && err.StatusCode == http.StatusPreconditionRequired
+}
+
+// Kinds of saving a profile allowed by SaveProfile.
+const (
+	SAVE_CREATE = 1 << iota
+	SAVE_MODIFY
+)
+
+// ProfileChanges describes changes to a character profile. Nil fields are left
+// as they are.
+type ProfileChanges struct {
+	Name *string
+	// PictureFileId is the id of the new profile picture, or the empty string to
+	// remove it. The user must be allowed to read it.
+	PictureFileId *string
+	// PictureCrop is the stored form of the crop anchor of the profile picture.
+	// It is reset when a new picture is set without a crop.
+	PictureCrop *string
+	// Color is the stored form of the avatar color.
+	Color *string
+	// KeepHistory tells whether existing messages keep how they look for this
+	// change. If nil, the setting of the profile is used.
+	KeepHistory *bool
+}
+
+// SaveProfileResult describes a profile saved by SaveProfile.
+type SaveProfileResult struct {
+	Profile Profile
+	// OldProfile is the profile before it was modified, or nil if it was
+	// created.
+	OldProfile *Profile
+	// KeptHistory tells whether existing messages keep the display name and
+	// profile picture they were sent with.
+	KeptHistory bool
+}
+
+// SaveProfile creates or modifies a character profile, depending on whether it
+// exists and which of SAVE_CREATE and SAVE_MODIFY are allowed. Messages using
+// the profile are updated unless they keep their history. Creating a profile
+// that is used by existing messages must be confirmed.
+func SaveProfile(be Backend, userId, profileId string, changes ProfileChanges, allowed int, confirmed bool) (*SaveProfileResult, *model.AppError) {
+	profileId = NormalizeIdentifier(profileId)
+	if IsMe(profileId) {
+		return nil, appError("You cannot use `myself` or `me` as a character profile identifyer. Use the Mattermost built-in functionality to change the display name or profile picture for your real Mattermost profile.", nil)
+	}
+	profileId, err := resolveProfileIdentifier(be, userId, profileId)
+	if err != nil {
+		return nil, err
+	}
+	existed, err := profileExists(be, userId, profileId)
+	if err != nil {
+		return nil, err
+	}
+	if existed && allowed&SAVE_MODIFY == 0 {
+		return nil, serviceError(http.StatusConflict, fmt.Sprintf("Character profile `%s` already exists.", profileId))
+	}
+	if !existed && allowed&SAVE_CREATE == 0 {
+		return nil, serviceError(http.StatusNotFound, fmt.Sprintf("Character profile `%s` does not exist.", profileId))
+	}
+	result := &SaveProfileResult{}
+	newProfile := Profile{
+		UserId:     userId,
+		Identifier: profileId,
+		Status:     PROFILE_CHARACTER,
+	}
+	if existed {
+		oldProfile, gpErr := GetProfile(be, userId, profileId, PROFILE_CHARACTER|PROFILE_CORRUPT)
+		if gpErr != nil {
+			return nil, gpErr
+		}
+		newProfile.Name = oldProfile.Name
+		newProfile.PictureFileId = oldProfile.PictureFileId
+		newProfile.PictureCrop = oldProfile.PictureCrop
+		newProfile.RequestKey = oldProfile.RequestKey
+		newProfile.KeepHistory = oldProfile.KeepHistory
+		newProfile.FrozenVersion = oldProfile.FrozenVersion
+		newProfile.Aliases = oldProfile.Aliases
+		newProfile.Color = oldProfile.Color
+		result.OldProfile = oldProfile
+	} else if changes.Name == nil {
+		return nil, appError(fmt.Sprintf("No character profile with identifyer `%s` exists. In order to create it, you must at least provide a display name. Try `/character help` for details.", profileId), nil)
+	}
+	if changes.Name != nil {
+		newProfile.Name = *changes.Name
+	}
+	setPicture := changes.PictureFileId != nil || changes.PictureCrop != nil
+	if changes.PictureFileId != nil {
+		newProfile.PictureFileId = *changes.PictureFileId
+		newProfile.PictureCrop = ""
+	}
+	if changes.PictureCrop != nil {
+		if newProfile.PictureFileId == "" {
+			return nil, appError(fmt.Sprintf("Character profile `%s` has no profile picture to crop.", profileId), nil)
+		}
+		newProfile.PictureCrop = *changes.PictureCrop
+	}
+	if newProfile.PictureFileId == "" {
+		newProfile.PictureCrop = ""
+		newProfile.RequestKey = ""
+	} else if setPicture && (result.OldProfile == nil || result.OldProfile.PictureFileId != newProfile.PictureFileId || result.OldProfile.PictureCrop != newProfile.PictureCrop || newProfile.RequestKey == "") {
+		newProfile.RequestKey = be.NewId()
+	}
+	if changes.Color != nil {
+		newProfile.Color = *changes.Color
+	}
+	keepHistory := newProfile.KeepHistory
+	if changes.KeepHistory != nil {
+		keepHistory = *changes.KeepHistory
+	}
+	err = populateProfile(be, &newProfile)
+	if err != nil {
+		return nil, err
+	}
+	err = newProfile.validate(newProfile.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	if setPicture {
+		err = renderProfilePictures(be, newProfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !existed && !confirmed {
+		postCount, cErr := countPostsForProfile(be, userId, profileId)
+		if cErr != nil {
+			return nil, cErr
+		}
+		if postCount > 0 {
+			return nil, serviceError(http.StatusPreconditionRequired, fmt.Sprintf("You are about to create a character profile with identifier `%s`, but this identifier is already used by %d existing messages. These messages will be updated according to this newly created character profile. Are you sure you want to proceed?", profileId, postCount))
+		}
+	}
+	err = setProfile(be, userId, &newProfile)
+	if err != nil {
+		return nil, err
+	}
+	if existed && keepHistory && newProfile.Version != result.OldProfile.Version {
+		// Freeze existing messages at the version they were sent with.
+		newProfile.FrozenVersion = result.OldProfile.Version
+		err = setProfile(be, userId, &newProfile)
+		if err != nil {
+			return nil, err
+		}
+		result.KeptHistory = true
+	} else {
+		// Update all existing messages that uses this profile. This is done no
+		// matter if the profile existed or not, because it is possible to delete
+		// a profile without deleting all messages that use it.
+		err = updatePostsForProfile(be, userId, profileId, profileId, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.Profile = newProfile
+	return result, nil
+}
+
+// DeleteProfile moves a character profile to the trash. Deleting a profile
+// that is used by existing messages must be confirmed.
+func DeleteProfile(be Backend, userId, profileId string, confirmed bool) *model.AppError {
+	profileId = NormalizeIdentifier(profileId)
+	var postCount int
+	if !IsMe(profileId) {
+		var cErr *model.AppError
+		postCount, cErr = countPostsForProfile(be, userId, profileId)
+		if cErr != nil {
+			return cErr
+		}
+	}
+	if postCount > 0 && !confirmed {
+		return serviceError(http.StatusPreconditionRequired, fmt.Sprintf("You are about to delete character profile `%s` which is used by %d existing messages. The profile will be kept in the trash for %d days, during which you can restore it with `/character restore %s`. After that, the profile picture for these messages will cease to work, but they will retain their display name. In order to manage those messages again, you can recreate the profile using the same identifier. Are you sure you want to proceed?", profileId, postCount, be.GetConfiguration().GetTrashRetentionDays(), profileId))
+	}
+	if IsMe(profileId) {
+		return appError("Please do not try to delete yourself. If you have suicidal thoughts, call 90101 (Sweden) or +1-800-273-8255 (International).", nil)
+	}
+	exists, err := profileExists(be, userId, profileId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		target, err := getAliasTarget(be, userId, profileId)
+		if err != nil {
+			return err
+		}
+		if target != "" {
+			return appError(fmt.Sprintf("`%s` is an alias for character profile `%s`. Use `/character unalias %s` to remove the alias, or `/character delete %s` to delete the profile.", profileId, target, profileId, target), nil)
+		}
+		return serviceError(http.StatusNotFound, fmt.Sprintf("Character profile `%s` does not exist.", profileId))
+	}
+	return trashProfile(be, userId, profileId)
+}
+
+// RenameProfileResult describes what RenameProfile did.
+type RenameProfileResult struct {
+	OldProfileId string
+	// Profile is the profile now used by the messages.
+	Profile Profile
+	// TargetStatus is the status the target profile had before, which is
+	// PROFILE_NONEXISTENT if the profile was renamed, and PROFILE_CHARACTER or
+	// PROFILE_ME if it was merged into an existing profile.
+	TargetStatus int
+}
+
+// RenameProfile makes the messages using a character profile use the target
+// profile instead, and deletes the character profile. If the target profile
+// does not exist, it is created as a copy of the character profile, which
+// renames it. Merging into an existing profile must be confirmed.
+func RenameProfile(be Backend, userId, oldProfileArg, targetProfileArg string, confirmed bool) (*RenameProfileResult, *model.AppError) {
+	oldProfileId, err := resolveProfileIdentifier(be, userId, NormalizeIdentifier(oldProfileArg))
+	if err != nil {
+		return nil, err
+	}
+	targetProfileId, err := resolveProfileIdentifier(be, userId, NormalizeIdentifier(targetProfileArg))
+	if err != nil {
+		return nil, err
+	}
+	if oldProfileId == targetProfileId && !IsMe(oldProfileId) {
+		return nil, appError(fmt.Sprintf("`%s` and `%s` refer to the same character profile `%s`.", oldProfileArg, targetProfileArg, oldProfileId), nil)
+	}
+	oldProfile, err := GetProfile(be, userId, oldProfileId, PROFILE_CHARACTER|PROFILE_ME|PROFILE_CORRUPT|PROFILE_NONEXISTENT)
+	if oldProfile == nil && err != nil {
+		return nil, err
+	}
+	targetProfile, err := GetProfile(be, userId, targetProfileId, PROFILE_CHARACTER|PROFILE_ME|PROFILE_CORRUPT|PROFILE_NONEXISTENT)
+	if targetProfile == nil && err != nil {
+		return nil, err
+	}
+	var oldCount, targetCount int
+	if !IsMe(oldProfileId) {
+		oldCount, err = countPostsForProfile(be, userId, oldProfileId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !IsMe(targetProfileId) {
+		targetCount, err = countPostsForProfile(be, userId, targetProfileId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch oldProfile.Status {
+	case PROFILE_CHARACTER:
+		if oldCount == 0 {
+			return nil, appError(fmt.Sprintf("Character profile `%s` isn't used by any messages. You can delete it with `/character delete %s`.", oldProfileId, oldProfileId), nil)
+		}
+	case PROFILE_ME:
+		return nil, appError("Cannot make your real profile into something else. Use the Mattermost built-in functionality to change the display name or profile picture for your real Mattermost profile.", nil)
+	case PROFILE_CORRUPT:
+		if oldCount == 0 {
+			return nil, appError(fmt.Sprintf("Character profile `%s` is corrupt, and isn't used by any messages. You can delete it with `/character delete %s`.", oldProfileId, oldProfileId), nil)
+		}
+		return nil, appError(fmt.Sprintf("Character profile `%s` is corrupt, but is still used by %d messages. Before you try to make this character profile into something else, you need to delete and recreate it. The messages will not be affected by deleting the profile.", oldProfileId, oldCount), nil)
+	case PROFILE_NONEXISTENT:
+		if oldCount == 0 {
+			return nil, serviceError(http.StatusNotFound, fmt.Sprintf("Character profile `%s` doesn't exist, and isn't used by any messages.", oldProfileId))
+		}
+		return nil, serviceError(http.StatusNotFound, fmt.Sprintf("Character profile `%s` doesn't exist, but is still used by %d messages. Create a character profile with this identifier in order to manage those messages.", oldProfileId, oldCount))
+	default:
+		return nil, appError("Unexpected profile type", nil)
+	}
+	// We now know that oldCount > 0 && oldProfile.Status == PROFILE_CHARACTER
+	switch targetProfile.Status {
+	case PROFILE_CHARACTER:
+		break
+	case PROFILE_ME:
+		break
+	case PROFILE_CORRUPT:
+		return nil, appError(fmt.Sprintf("Target character profile `%s` is corrupt.", targetProfileId), nil)
+	case PROFILE_NONEXISTENT:
+		if targetCount > 0 {
+			return nil, serviceError(http.StatusConflict, fmt.Sprintf("Target character profile `%s` doesn't exist, but since it is still used by %d messages you must recreate it before you can make another character profile into it.", targetProfileId, targetCount))
+		}
+	default:
+		return nil, appError("Unexpected profile type", nil)
+	}
+	// We now know that oldCount > 0 && oldProfile.Status == PROFILE_CHARACTER && (targetProfile.Status != PROFILE_CORRUPT) && (targetProfile.Status != PROFILE_NONEXISTENT || targetCount == 0)
+	confirmMsg := ""
+	newProfile := targetProfile
+	// Messages keep their version only if the new profile has the history of
+	// the old one.
+	versionOffset := -1
+	switch targetProfile.Status {
+	case PROFILE_CHARACTER:
+		confirmMsg = fmt.Sprintf("Target character profile `%s` already exists, and is used by %d messages. Modifying %d messages that currently use character profile `%s` to instead use character profile `%s` isn't easily reversible since the two sets of messages would be mixed together.", targetProfileId, targetCount, oldCount, oldProfileId, targetProfileId)
+	case PROFILE_ME:
+		confirmMsg = fmt.Sprintf("Modifying %d messages that currently use character profile `%s` to instead use your real profile isn't easily reversible since they'd be mixed in with any other messages you have sent using your real profile. Also, messages that use your real profile can only be changed to use a character profile by editing them individually.", oldCount, oldProfileId)
+	case PROFILE_NONEXISTENT:
+		// Create new profile
+		newProfile = &Profile{
+			UserId:        userId,
+			Identifier:    targetProfileId,
+			Name:          oldProfile.Name,
+			PictureFileId: oldProfile.PictureFileId,
+			PictureCrop:   oldProfile.PictureCrop,
+			Status:        PROFILE_CHARACTER,
+			RequestKey:    oldProfile.RequestKey,
+			Aliases:       oldProfile.Aliases,
+			Color:         oldProfile.Color,
+			KeepHistory:   oldProfile.KeepHistory,
+		}
+		neErr := populateProfile(be, newProfile)
+		if neErr != nil {
+			return nil, neErr
+		}
+		neErr = newProfile.validate(newProfile.Identifier)
+		if neErr != nil {
+			return nil, neErr
+		}
+		// The history comes along, so that messages frozen at an earlier version
+		// keep it.
+		versionOffset, neErr = copyProfileHistory(be, userId, oldProfileId, newProfile.Identifier)
+		if neErr != nil {
+			return nil, neErr
+		}
+		if oldProfile.FrozenVersion != 0 {
+			newProfile.FrozenVersion = oldProfile.FrozenVersion + versionOffset
+		}
+		neErr = setProfile(be, userId, newProfile)
+		if neErr != nil {
+			return nil, neErr
+		}
+		neErr = transferProfileAliases(be, userId, oldProfileId, newProfile)
+		if neErr != nil {
+			return nil, neErr
+		}
+	}
+	if !confirmed && confirmMsg != "" {
+		return nil, serviceError(http.StatusPreconditionRequired, fmt.Sprintf("%s Are you sure you want to continue?", confirmMsg))
+	}
+	// Update all existing messages that uses the old profile.
+	err = updatePostsForProfile(be, userId, oldProfileId, newProfile.Identifier, versionOffset)
+	if err != nil {
+		return nil, err
+	}
+	// Delete old profile
+	err = deleteProfile(be, userId, oldProfileId)
+	if err != nil {
+		return nil, err
+	}
+	return &RenameProfileResult{
+		OldProfileId: oldProfileId,
+		Profile:      *newProfile,
+		TargetStatus: targetProfile.Status,
+	}, nil
+}
+
+// SetDefaultProfile sets the default profile of a user in a channel. The real
+// profile is also stored, so that it overrides the defaults of the team and
+// account whenever they are set. It returns the identifier of the default
+// profile that applied before, which is empty for the real profile, along with
+// the new default profile. Any expiry of the earlier default is removed.
+func SetDefaultProfile(be Backend, userId, channelId, profileId string) (string, *Profile, *model.AppError) {
+	profileId = NormalizeIdentifier(profileId)
+	oldProfileId, _, err := getEffectiveDefaultProfile(be, userId, channelId)
+	if err != nil {
+		return "", nil, err
+	}
+	err = removeDefaultProfileExpiry(be, userId, channelId)
+	if err != nil {
+		return "", nil, err
+	}
+	if IsMe(profileId) {
+		// The real profile is stored as the default of the channel, so that team
+		// or account defaults set later do not apply here either.
+		err = be.KVSet(getDefaultProfileKey(userId, channelId), []byte("myself"))
+		if err != nil {
+			return "", nil, err
+		}
+		err = StrsetInsert(be, getDefaultChannelsKey(userId), channelId)
+		if err != nil {
+			return "", nil, err
+		}
+		realProfile, err := GetProfile(be, userId, "", PROFILE_ME)
+		if err != nil {
+			return "", nil, err
+		}
+		return oldProfileId, realProfile, nil
+	}
+	newProfile, err := setDefaultProfileIdentifier(be, userId, channelId, profileId)
+	if err != nil {
+		return "", nil, err
+	}
+	if newProfile == nil {
+		return "", nil, appError(fmt.Sprintf("Could not fetch profile `%s`.", profileId), nil)
+	}
+	return oldProfileId, newProfile, nil
+}
+
+// SetTeamDefaultProfile sets the default profile of a user in the channels of
+// a team that have no default of their own, which for the real profile means
+// removing it. It returns the identifier of the previous team default, which
+// is empty if there was none, along with the new default profile.
+func SetTeamDefaultProfile(be Backend, userId, teamId, profileId string) (string, *Profile, *model.AppError) {
+	oldProfileId, newProfile, err := setDefaultProfileForKey(be, userId, getTeamDefaultProfileKey(userId, teamId), profileId)
+	if err != nil {
+		return "", nil, err
+	}
+	if newProfile.Status == PROFILE_ME {
+		err = StrsetRemove(be, getDefaultTeamsKey(userId), teamId)
+	} else {
+		err = StrsetInsert(be, getDefaultTeamsKey(userId), teamId)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return oldProfileId, newProfile, nil
+}
+
+// SetGlobalDefaultProfile is like SetTeamDefaultProfile, but for all channels
+// without a default of their own or of their team.
+func SetGlobalDefaultProfile(be Backend, userId, profileId string) (string, *Profile, *model.AppError) {
+	return setDefaultProfileForKey(be, userId, getGlobalDefaultProfileKey(userId), profileId)
+}
+
+func setDefaultProfileForKey(be Backend, userId, key, profileId string) (string, *Profile, *model.AppError) {
+	profileId = NormalizeIdentifier(profileId)
+	oldProfileId, err := getDefaultProfileIdentifierForKey(be, key)
+	if err != nil {
+		return "", nil, err
+	}
+	if IsMe(profileId) {
+		if oldProfileId != "" {
+			err = be.KVDelete(key)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		realProfile, err := GetProfile(be, userId, "", PROFILE_ME)
+		if err != nil {
+			return "", nil, err
+		}
+		return oldProfileId, realProfile, nil
+	}
+	newProfile, err := setDefaultProfileIdentifierForKey(be, userId, key, profileId)
+	if err != nil {
+		return "", nil, err
+	}
+	return oldProfileId, newProfile, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Usage statistics are kept up to date by RegisterPost when a message starts
+// using a character profile, and by updatePostsForProfile and
+// RegisterEditedPost when messages are moved to another profile, so that they
+// never need to scan messages. Messages
+// sent before statistics were introduced are not counted. Edits do not change
+// the word count.
+
+// STATS_UPDATE_ATTEMPTS is how many times a statistics update is attempted
+// when it conflicts with concurrent updates.
+const STATS_UPDATE_ATTEMPTS = 10
+
+// ProfileStats are the usage statistics of a character profile. Channels maps
+// the ids of channels where the profile has been used to the number of
+// messages there.
+type ProfileStats struct {
+	Messages int            `json:"messages"`
+	Words    int            `json:"words"`
+	FirstUse int64          `json:"first_use,omitempty"`
+	LastUse  int64          `json:"last_use,omitempty"`
+	Channels map[string]int `json:"channels"`
+}
+
+// ChannelCharacterStats are the usage statistics of a character profile in a
+// channel.
+type ChannelCharacterStats struct {
+	UserId     string `json:"user_id"`
+	Identifier string `json:"identifier"`
+	Messages   int    `json:"messages"`
+	Words      int    `json:"words"`
+	LastUse    int64  `json:"last_use,omitempty"`
+}
+
+func getProfileStatsKey(userId, profileId string) string {
+	return fmt.Sprintf("profilestats_%s_%s", userId, encodeIdentifierForKey(profileId))
+}
+
+func getChannelStatsKey(channelId string) string {
+	return fmt.Sprintf("channelstats_%s", channelId)
+}
+
+// updateStats replaces the statistics stored as JSON under key with the result
+// of f, which is given the stored JSON, retrying if they are modified
+// concurrently.
+func updateStats(be Backend, key string, f func(oldJson []byte) (interface{}, *model.AppError)) *model.AppError {
+	for attempt := 0; attempt < STATS_UPDATE_ATTEMPTS; attempt++ {
+		oldJson, err := be.KVGet(key)
+		if err != nil {
+			return err
+		}
+		v, err := f(oldJson)
+		if err != nil {
+			return err
+		}
+		newJson, jsonErr := json.Marshal(v)
+		if jsonErr != nil {
+			return appError("Failed to encode statistics.", jsonErr)
+		}
+		ok, err := be.KVCompareAndSet(key, oldJson, newJson)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return appError(fmt.Sprintf("Statistics `%s` were modified concurrently too many times.", key), nil)
+}
+
+func decodeProfileStats(b []byte) (*ProfileStats, *model.AppError) {
+	stats := &ProfileStats{}
+	if b != nil {
+		jsonErr := json.Unmarshal(b, stats)
+		if jsonErr != nil {
+			return nil, appError("Failed to decode statistics.", jsonErr)
+		}
+	}
+	if stats.Channels == nil {
+		stats.Channels = map[string]int{}
+	}
+	return stats, nil
+}
+
+func decodeChannelStats(b []byte) (map[string]*ChannelCharacterStats, *model.AppError) {
+	channelStats := map[string]*ChannelCharacterStats{}
+	if b != nil {
+		jsonErr := json.Unmarshal(b, &channelStats)
+		if jsonErr != nil {
+			return nil, appError("Failed to decode statistics.", jsonErr)
+		}
+	}
+	return channelStats, nil
+}
+
+// countPostInStats adds a message to the statistics of a character profile and
+// of its channel, or removes it if sign is -1. The first and last use are kept
+// when removing a message, since they cannot be recomputed.
+func countPostInStats(be Backend, userId, profileId string, post *model.Post, sign int) *model.AppError {
+	words := len(strings.Fields(post.Message))
+	err := updateStats(be, getProfileStatsKey(userId, profileId), func(oldJson []byte) (interface{}, *model.AppError) {
+		stats, err := decodeProfileStats(oldJson)
+		if err != nil {
+			return nil, err
+		}
+		stats.Messages = max0(stats.Messages + sign)
+		stats.Words = max0(stats.Words + sign*words)
+		if sign > 0 {
+			if stats.FirstUse == 0 || post.CreateAt < stats.FirstUse {
+				stats.FirstUse = post.CreateAt
+			}
+			if post.CreateAt > stats.LastUse {
+				stats.LastUse = post.CreateAt
+			}
+		}
+		stats.Channels[post.ChannelId] = max0(stats.Channels[post.ChannelId] + sign)
+		if stats.Channels[post.ChannelId] == 0 {
+			delete(stats.Channels, post.ChannelId)
+		}
+		return stats, nil
+	})
+	if err != nil || post.ChannelId == "" {
+		return err
+	}
+	entryKey := userId + "_" + profileId
+	return updateStats(be, getChannelStatsKey(post.ChannelId), func(oldJson []byte) (interface{}, *model.AppError) {
+		channelStats, err := decodeChannelStats(oldJson)
+		if err != nil {
+			return nil, err
+		}
+		entry, ok := channelStats[entryKey]
+		if !ok {
+			entry = &ChannelCharacterStats{UserId: userId, Identifier: profileId}
+			channelStats[entryKey] = entry
+		}
+		entry.Messages = max0(entry.Messages + sign)
+		entry.Words = max0(entry.Words + sign*words)
+		if sign > 0 && post.CreateAt > entry.LastUse {
+			entry.LastUse = post.CreateAt
+		}
+		if entry.Messages == 0 {
+			delete(channelStats, entryKey)
+		}
+		return channelStats, nil
+	})
+}
+
+func max0(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// GetProfileStats returns the usage statistics of a character profile.
+func GetProfileStats(be Backend, userId, profileId string) (*ProfileStats, *model.AppError) {
+	b, err := be.KVGet(getProfileStatsKey(userId, profileId))
+	if err != nil {
+		return nil, err
+	}
+	return decodeProfileStats(b)
+}
+
+// GetChannelStats returns the usage statistics of the character profiles used
+// in a channel, most active first. Profiles of users who have opted out of
+// casts are left out.
+func GetChannelStats(be Backend, channelId string) ([]ChannelCharacterStats, *model.AppError) {
+	b, err := be.KVGet(getChannelStatsKey(channelId))
+	if err != nil {
+		return nil, err
+	}
+	channelStats, err := decodeChannelStats(b)
+	if err != nil {
+		return nil, err
+	}
+	optedOut := map[string]bool{}
+	ret := []ChannelCharacterStats{}
+	for _, entry := range channelStats {
+		out, ok := optedOut[entry.UserId]
+		if !ok {
+			out, err = isCastOptedOut(be, entry.UserId)
+			if err != nil {
+				return nil, err
+			}
+			optedOut[entry.UserId] = out
+		}
+		if !out {
+			ret = append(ret, *entry)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Messages != ret[j].Messages {
+			return ret[i].Messages > ret[j].Messages
+		}
+		if ret[i].Words != ret[j].Words {
+			return ret[i].Words > ret[j].Words
+		}
+		return ret[i].UserId+ret[i].Identifier < ret[j].UserId+ret[j].Identifier
+	})
+	return ret, nil
+}
+
+// getChannelCharacterStats returns the usage statistics of a character profile
+// in a channel, or nil if it has not been used there.
+func getChannelCharacterStats(be Backend, channelId, userId, profileId string) (*ChannelCharacterStats, *model.AppError) {
+	b, err := be.KVGet(getChannelStatsKey(channelId))
+	if err != nil {
+		return nil, err
+	}
+	channelStats, err := decodeChannelStats(b)
+	if err != nil {
+		return nil, err
+	}
+	return channelStats[userId+"_"+profileId], nil
+}
+
+// deleteProfileStats deletes the statistics of a character profile. Its
+// entries in the statistics of channels are left, since they cannot be found
+// without scanning.
+func deleteProfileStats(be Backend, userId, profileId string) *model.AppError {
+	return be.KVDelete(getProfileStatsKey(userId, profileId))
+}
+
+// describeProfileStats returns a table of the statistics of the character
+// profiles of a user.
+func describeProfileStats(be Backend, userId string) (string, *model.AppError) {
+	profiles, err := listProfiles(be, userId)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{
+		"| Character | Messages | Words | Channels | First used | Last used |",
+		"|:--|--:|--:|--:|:--|:--|",
+	}
+	for _, profile := range profiles {
+		if profile.Status == PROFILE_ME {
+			continue
+		}
+		stats, err := GetProfileStats(be, userId, profile.Identifier)
+		if err != nil {
+			return "", err
+		}
+		firstUse, lastUse := "", ""
+		if stats.Messages > 0 {
+			firstUse, lastUse = formatTime(stats.FirstUse), formatTime(stats.LastUse)
+		}
+		lines = append(lines, fmt.Sprintf("| %s `%s` | %d | %d | %d | %s | %s |", profile.Name, profile.Identifier, stats.Messages, stats.Words, len(stats.Channels), firstUse, lastUse))
+	}
+	if len(lines) == 2 {
+		return "You have no character profiles.", nil
+	}
+	return "## Your character profiles\n" + strings.Join(lines, "\n"), nil
+}
+
+// describeChannelStats returns a table of the most active character profiles
+// in a channel.
+func describeChannelStats(be Backend, channel *model.Channel) (string, *model.AppError) {
+	stats, err := GetChannelStats(be, channel.Id)
+	if err != nil {
+		return "", err
+	}
+	if len(stats) == 0 {
+		return fmt.Sprintf("No character profiles have been used in ~%s.", channel.Name), nil
+	}
+	lines := []string{
+		"| Character | Player | Messages | Words | Last used |",
+		"|:--|:--|--:|--:|:--|",
+	}
+	for _, entry := range stats {
+		name := fmt.Sprintf("`%s`", entry.Identifier)
+		profile, _ := GetProfile(be, entry.UserId, entry.Identifier, PROFILE_CHARACTER)
+		if profile != nil {
+			name = profile.Name + " " + name
+		}
+		player := ""
+		if user, _ := be.GetUser(entry.UserId); user != nil {
+			player = "@" + user.Username
+		}
+		lines = append(lines, fmt.Sprintf("| %s | %s | %d | %d | %s |", name, player, entry.Messages, entry.Words, formatTime(entry.LastUse)))
+	}
+	return fmt.Sprintf("## Most active characters in ~%s\n", channel.Name) + strings.Join(lines, "\n"), nil
+}
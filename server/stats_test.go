@@ -0,0 +1,138 @@
+package main_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+func TestStats(t *testing.T) {
+	be := newMockBackend()
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	milouImg := avatarImg(be, "milou", "Milou")
+	nestorImg := avatarImg(be, "nestor", "Nestor")
+	cmd(t, be, "/character stats", tUser1, tChannel1, tTeam1, "",
+		"You have no character profiles.", nil)
+	cmd(t, be, "/character stats ~channel-one", tUser1, tChannel1, tTeam1, "",
+		"No character profiles have been used in ~channel-one.", nil)
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	cmd(t, be, "/character milou=Milou", tUser1, tChannel1, tTeam1, "",
+		"Character profile `milou` created with display name \"Milou\"",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", milouImg}})
+	cmd(t, be, "/character nestor=Nestor", tUser2, tChannel1, tTeam1, "",
+		"Character profile `nestor` created with display name \"Nestor\"",
+		[]tAtt{{"**Nestor**\n`nestor`", "#5c66ff", nestorImg}})
+	millis := *be.Millis
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: millis, Message: "haddock: Blistering barnacles!"},
+		"haddock", "Captain Haddock", haddockImg)
+	post2 := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: millis + 3600000, Message: "haddock: Ten thousand thundering typhoons!"},
+		"haddock", "Captain Haddock", haddockImg)
+	milouPost := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: millis + 60000, Message: "milou: Woof!"},
+		"milou", "Milou", milouImg)
+	post(t, be, &model.Post{UserId: tUser2, ChannelId: tChannel1, CreateAt: millis + 120000, Message: "nestor: Yes sir."},
+		"nestor", "Nestor", nestorImg)
+	post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Messages from the real profile are not counted"},
+		"", "", nil)
+	// Registering a message again, as is done when it is edited, does not count
+	// it again
+	assert.Nil(t, main.RegisterPost(be, be.Posts[post2]))
+
+	cmd(t, be, "/character stats", tUser1, tChannel1, tTeam1, "",
+		"## Your character profiles\n"+
+			"| Character | Messages | Words | Channels | First used | Last used |\n"+
+			"|:--|--:|--:|--:|:--|:--|\n"+
+			"| Captain Haddock `haddock` | 2 | 6 | 1 | 2020-09-13 12:26 UTC | 2020-09-13 13:26 UTC |\n"+
+			"| Milou `milou` | 1 | 1 | 1 | 2020-09-13 12:27 UTC | 2020-09-13 12:27 UTC |", nil)
+	cmd(t, be, "/character stats ~channel-one", tUser2, tChannel1, tTeam1, "",
+		"## Most active characters in ~channel-one\n"+
+			"| Character | Player | Messages | Words | Last used |\n"+
+			"|:--|:--|--:|--:|:--|\n"+
+			"| Captain Haddock `haddock` | @user-number-one | 2 | 6 | 2020-09-13 13:26 UTC |\n"+
+			"| Nestor `nestor` | @user-number-two | 1 | 2 | 2020-09-13 12:28 UTC |\n"+
+			"| Milou `milou` | @user-number-one | 1 | 1 | 2020-09-13 12:27 UTC |", nil)
+	cmdFail(t, be, "/character stats ~channel-two", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Could not find channel ~channel-two.")
+
+	// JSON
+	var profileStats []main.APIProfileStats
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodGet, tUser1, "/stats", "", &profileStats))
+	assert.Equal(t, 2, len(profileStats))
+	assert.Equal(t, "haddock", profileStats[0].Identifier)
+	assert.Equal(t, 2, profileStats[0].Messages)
+	assert.Equal(t, 6, profileStats[0].Words)
+	assert.Equal(t, map[string]int{tChannel1: 2}, profileStats[0].Channels)
+	assert.Equal(t, millis, profileStats[0].FirstUse)
+	assert.Equal(t, millis+3600000, profileStats[0].LastUse)
+	var channelStats []main.APIChannelCharacterStats
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodGet, tUser2, "/channels/"+tChannel1+"/stats", "", &channelStats))
+	assert.Equal(t, 3, len(channelStats))
+	assert.Equal(t, "nestor", channelStats[1].Identifier)
+	assert.Equal(t, "Nestor", channelStats[1].DisplayName)
+	assert.Equal(t, "user-number-two", channelStats[1].Username)
+	assert.Equal(t, tUser2, channelStats[1].UserId)
+	code, _ := apiError(t, be, http.MethodGet, tUser1, "/channels/"+model.NewId()+"/stats", "", http.StatusNotFound)
+	assert.Equal(t, "not_found", code)
+	// Users who have opted out of casts are left out of channel statistics
+	cmd(t, be, "/character cast hide", tUser2, tChannel1, tTeam1, "",
+		"Your character profiles will no longer be listed by `/character cast` or in the statistics of channels.", nil)
+	cmd(t, be, "/character stats ~channel-one", tUser1, tChannel1, tTeam1, "",
+		"## Most active characters in ~channel-one\n"+
+			"| Character | Player | Messages | Words | Last used |\n"+
+			"|:--|:--|--:|--:|:--|\n"+
+			"| Captain Haddock `haddock` | @user-number-one | 2 | 6 | 2020-09-13 13:26 UTC |\n"+
+			"| Milou `milou` | @user-number-one | 1 | 1 | 2020-09-13 12:27 UTC |", nil)
+	assert.Equal(t, http.StatusOK, apiRequest(t, be, http.MethodGet, tUser1, "/channels/"+tChannel1+"/stats", "", &channelStats))
+	assert.Equal(t, 2, len(channelStats))
+	cmd(t, be, "/character cast show", tUser2, tChannel1, tTeam1, "",
+		"Your character profiles will be listed by `/character cast` and in the statistics of channels again.", nil)
+
+	// Messages moved to another profile are counted there instead
+	_, _, err := main.DoExecuteCommand(be, "/character make milou into haddock", tUser1, tChannel1, tTeam1, "", true)
+	assert.Nil(t, err)
+	// The mock backend does not call the hook that registers updated messages.
+	assert.Nil(t, main.RegisterPost(be, be.Posts[milouPost]))
+	stats, err := main.GetProfileStats(be, tUser1, "haddock")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, stats.Messages)
+	assert.Equal(t, 7, stats.Words)
+	stats, err = main.GetProfileStats(be, tUser1, "milou")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stats.Messages)
+	assert.Equal(t, map[string]int{}, stats.Channels)
+	entries, err := main.GetChannelStats(be, tChannel1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "haddock", entries[0].Identifier)
+	assert.Equal(t, 3, entries[0].Messages)
+
+	// Messages edited to use another profile are counted there instead
+	cmd(t, be, "/character tintin=Tintin", tUser1, tChannel1, tTeam1, "",
+		"Character profile `tintin` created with display name \"Tintin\"",
+		[]tAtt{{"**Tintin**\n`tintin`", "#5c66ff", avatarImg(be, "tintin", "Tintin")}})
+	old := be.Posts[post2]
+	edited, errStr := main.ProfiledPost(be, &model.Post{Id: post2, UserId: tUser1, ChannelId: tChannel1, CreateAt: old.CreateAt,
+		Message: "tintin: Great snakes!", Props: old.Props}, true)
+	assert.Equal(t, "", errStr)
+	be.Posts[post2] = edited
+	assert.Nil(t, main.RegisterEditedPost(be, edited, old))
+	stats, err = main.GetProfileStats(be, tUser1, "haddock")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Messages)
+	assert.Equal(t, 3, stats.Words)
+	stats, err = main.GetProfileStats(be, tUser1, "tintin")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Messages)
+	assert.Equal(t, 2, stats.Words)
+	// Registering the edit again changes nothing
+	assert.Nil(t, main.RegisterEditedPost(be, edited, old))
+	stats, err = main.GetProfileStats(be, tUser1, "haddock")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Messages)
+}
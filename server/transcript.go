@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Transcripts export the messages of a channel or thread, attributed to the
+// character profiles they were posted with, as Markdown, HTML and JSON files
+// sent to the user by the bot account.
+
+const TRANSCRIPT_PAGE_SIZE = 200
+
+// TRANSCRIPT_MAX_MESSAGES limits the size of a transcript. Older messages are
+// left out.
+const TRANSCRIPT_MAX_MESSAGES = 10000
+
+type Transcript struct {
+	ChannelId          string              `json:"channel_id"`
+	ChannelName        string              `json:"channel_name"`
+	ChannelDisplayName string              `json:"channel_display_name"`
+	RootId             string              `json:"root_id,omitempty"`
+	Scene              string              `json:"scene,omitempty"`
+	Since              int64               `json:"since,omitempty"`
+	ExportedAt         int64               `json:"exported_at"`
+	Truncated          bool                `json:"truncated,omitempty"`
+	Messages           []TranscriptMessage `json:"messages"`
+	// Cast lists the characters appearing in the transcript. It is only filled
+	// in for scenes.
+	Cast []TranscriptCastMember `json:"cast,omitempty"`
+}
+
+// TranscriptCastMember is a character appearing in a transcript, or a user
+// appearing with their real profile if Identifier is empty.
+type TranscriptCastMember struct {
+	UserId     string `json:"user_id"`
+	Username   string `json:"username"`
+	Identifier string `json:"identifier,omitempty"`
+	Name       string `json:"name"`
+	Messages   int    `json:"messages"`
+}
+
+// TranscriptMessage is a message in a transcript. Name is the display name the
+// message was shown with, which is that of the character profile if it was
+// posted as a character.
+type TranscriptMessage struct {
+	Id                string   `json:"id"`
+	CreateAt          int64    `json:"create_at"`
+	RootId            string   `json:"root_id,omitempty"`
+	UserId            string   `json:"user_id"`
+	Username          string   `json:"username"`
+	Name              string   `json:"name"`
+	ProfileIdentifier string   `json:"profile_identifier,omitempty"`
+	IconURL           string   `json:"icon_url"`
+	Message           string   `json:"message"`
+	Files             []string `json:"files,omitempty"`
+	// portrait is the picture of the character profile as a data URI, if it
+	// could be rendered. It is embedded in HTML transcripts.
+	portrait template.URL
+}
+
+// parseTranscriptSince parses the start time of a transcript, which is either
+// a UTC time such as `2020-09-13 12:26` or `2020-09-13`, or a duration before
+// now such as `90m`, `3h`, `2d` or `1w`. It returns milliseconds since the
+// epoch.
+func parseTranscriptSince(be Backend, s string) (int64, *model.AppError) {
+	s = strings.TrimSpace(s)
+	if d, ok := parseShortDuration(s); ok {
+		return be.GetMillis() - d.Milliseconds(), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t.UnixNano() / int64(time.Millisecond), nil
+		}
+	}
+	return 0, appError(fmt.Sprintf("Cannot understand the time `%s`. Use e.g. `2020-09-13 12:26` (UTC), `2020-09-13`, or a duration such as `3h` or `2d`.", s), nil)
+}
+
+// transcriptPosts returns the messages of a thread, or of a channel if rootId
+// is empty, created at or after since, oldest first. System messages are left
+// out. It also returns whether older messages were left out because of
+// TRANSCRIPT_MAX_MESSAGES.
+func transcriptPosts(be Backend, channelId, rootId string, since int64) ([]*model.Post, bool, *model.AppError) {
+	posts := []*model.Post{}
+	truncated := false
+	add := func(list *model.PostList) bool {
+		for _, postId := range list.Order {
+			post := list.Posts[postId]
+			if post == nil || post.CreateAt < since {
+				return false
+			}
+			if post.DeleteAt != 0 || post.IsSystemMessage() {
+				continue
+			}
+			if len(posts) >= TRANSCRIPT_MAX_MESSAGES {
+				truncated = true
+				return false
+			}
+			posts = append(posts, post)
+		}
+		return true
+	}
+	if rootId != "" {
+		list, err := be.GetPostThread(rootId)
+		if err != nil {
+			return nil, false, err
+		}
+		list.SortByCreateAt()
+		add(list)
+	} else {
+		for page := 0; ; page++ {
+			list, err := be.GetPostsForChannel(channelId, page, TRANSCRIPT_PAGE_SIZE)
+			if err != nil {
+				return nil, false, err
+			}
+			if !add(list) || len(list.Order) < TRANSCRIPT_PAGE_SIZE {
+				break
+			}
+		}
+	}
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].CreateAt < posts[j].CreateAt
+	})
+	return posts, truncated, nil
+}
+
+// transcriptPortrait returns the picture of a character profile as it was at
+// the given version as a data URI, or the empty string if it cannot be
+// rendered.
+func transcriptPortrait(be Backend, userId, profileId string, version int) template.URL {
+	var profile *Profile
+	if version > 0 {
+		profile, _ = GetProfileAtVersion(be, userId, profileId, version)
+	}
+	if profile == nil || profile.Status != PROFILE_CHARACTER {
+		profile, _ = GetProfile(be, userId, profileId, PROFILE_CHARACTER)
+	}
+	if profile == nil || profile.Status != PROFILE_CHARACTER {
+		return ""
+	}
+	var content []byte
+	contentType := "image/png"
+	var err *model.AppError
+	if profile.PictureFileId != "" {
+		content, contentType, err = getProfilePicture(be, *profile, IMAGE_VARIANT_THUMBNAIL)
+	} else {
+		content, err = getProfileAvatar(be, *profile, IMAGE_VARIANT_THUMBNAIL)
+	}
+	if err != nil {
+		return ""
+	}
+	// The content is an image rendered by the plugin, so it is safe to embed.
+	return template.URL("data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(content))
+}
+
+// BuildTranscript collects the messages of a thread, or of a channel if rootId
+// is empty, created at or after since.
+func BuildTranscript(be Backend, channelId, rootId string, since int64) (*Transcript, *model.AppError) {
+	channel, err := be.GetChannel(channelId)
+	if err != nil {
+		return nil, err
+	}
+	posts, truncated, err := transcriptPosts(be, channelId, rootId, since)
+	if err != nil {
+		return nil, err
+	}
+	transcript := newTranscript(be, channel, posts)
+	transcript.RootId = rootId
+	transcript.Since = since
+	transcript.Truncated = truncated
+	return transcript, nil
+}
+
+// newTranscript returns a transcript of the given messages of a channel, which
+// must be sorted oldest first.
+func newTranscript(be Backend, channel *model.Channel, posts []*model.Post) *Transcript {
+	transcript := &Transcript{
+		ChannelId:          channel.Id,
+		ChannelName:        channel.Name,
+		ChannelDisplayName: channel.DisplayName,
+		ExportedAt:         be.GetMillis(),
+		Messages:           make([]TranscriptMessage, 0, len(posts)),
+	}
+	if transcript.ChannelDisplayName == "" {
+		transcript.ChannelDisplayName = channel.Name
+	}
+	users := map[string]*model.User{}
+	portraits := map[string]template.URL{}
+	for _, post := range posts {
+		authorId := postAuthorId(be, post)
+		user, ok := users[authorId]
+		if !ok {
+			user, _ = be.GetUser(authorId)
+			if user == nil {
+				user = &model.User{Id: authorId}
+			}
+			users[authorId] = user
+		}
+		message := TranscriptMessage{
+			Id:       post.Id,
+			CreateAt: post.CreateAt,
+			RootId:   post.RootId,
+			UserId:   authorId,
+			Username: user.Username,
+			Name:     user.GetDisplayName(model.SHOW_FULLNAME),
+			IconURL:  fmt.Sprintf("%s/api/v4/users/%s/image", be.GetSiteURL(), authorId),
+			Message:  post.Message,
+		}
+		if name, ok := post.GetProp("override_username").(string); ok && name != "" {
+			message.Name = name
+		}
+		if iconURL, ok := post.GetProp("override_icon_url").(string); ok && iconURL != "" {
+			message.IconURL = iconURL
+		}
+		if profileId, ok := post.GetProp("profile_identifier").(string); ok && profileId != "" {
+			message.ProfileIdentifier = profileId
+			version := getPostProfileVersion(post)
+			key := fmt.Sprintf("%s_%s_%d", authorId, profileId, version)
+			portrait, ok := portraits[key]
+			if !ok {
+				portrait = transcriptPortrait(be, authorId, profileId, version)
+				portraits[key] = portrait
+			}
+			message.portrait = portrait
+		}
+		for _, fileId := range post.FileIds {
+			info, fErr := be.GetFileInfo(fileId)
+			if fErr == nil && info != nil {
+				message.Files = append(message.Files, info.Name)
+			}
+		}
+		transcript.Messages = append(transcript.Messages, message)
+	}
+	return transcript
+}
+
+// fillCast fills in the cast of a transcript, ordered by the number of
+// messages, most first.
+func (t *Transcript) fillCast() {
+	t.Cast = []TranscriptCastMember{}
+	index := map[string]int{}
+	for _, m := range t.Messages {
+		key := m.UserId + "_" + m.ProfileIdentifier
+		i, ok := index[key]
+		if !ok {
+			i = len(t.Cast)
+			index[key] = i
+			t.Cast = append(t.Cast, TranscriptCastMember{UserId: m.UserId, Username: m.Username, Identifier: m.ProfileIdentifier})
+		}
+		// The latest name is the one to show.
+		t.Cast[i].Name = m.Name
+		t.Cast[i].Messages++
+	}
+	sort.SliceStable(t.Cast, func(i, j int) bool {
+		return t.Cast[i].Messages > t.Cast[j].Messages
+	})
+}
+
+// describeCastMember returns the name of a cast member along with who plays
+// them.
+func describeCastMember(c TranscriptCastMember) string {
+	if c.Identifier == "" {
+		return fmt.Sprintf("%s (@%s), %d messages", c.Name, c.Username, c.Messages)
+	}
+	return fmt.Sprintf("%s, played by @%s, %d messages", c.Name, c.Username, c.Messages)
+}
+
+// describeScope returns a sentence describing what a transcript
+// covers, for the top of the Markdown and HTML files.
+func (t *Transcript) describeScope() string {
+	ret := fmt.Sprintf("Exported %s", formatTime(t.ExportedAt))
+	if t.Since > 0 {
+		ret += fmt.Sprintf(", with messages since %s", formatTime(t.Since))
+	}
+	ret += "."
+	if t.Truncated {
+		ret += fmt.Sprintf(" Only the latest %d messages are included.", TRANSCRIPT_MAX_MESSAGES)
+	}
+	return ret
+}
+
+func (t *Transcript) title() string {
+	if t.Scene != "" {
+		return fmt.Sprintf("Transcript of scene \"%s\" in %s", t.Scene, t.ChannelDisplayName)
+	}
+	if t.RootId != "" {
+		return "Transcript of a thread in " + t.ChannelDisplayName
+	}
+	return "Transcript of " + t.ChannelDisplayName
+}
+
+// Markdown renders the transcript as Markdown. Portraits are linked.
+func (t *Transcript) Markdown() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n%s\n", t.title(), t.describeScope())
+	if len(t.Cast) > 0 {
+		b.WriteString("\n## Cast\n\n")
+		for _, c := range t.Cast {
+			fmt.Fprintf(&b, "- %s\n", describeCastMember(c))
+		}
+		b.WriteString("\n## Messages\n")
+	}
+	for _, m := range t.Messages {
+		fmt.Fprintf(&b, "\n---\n\n![%s](%s) **%s** · %s\n\n%s\n", m.Name, m.IconURL, m.Name, formatTime(m.CreateAt), m.Message)
+		if len(m.Files) > 0 {
+			fmt.Fprintf(&b, "\n*Attached: %s*\n", strings.Join(m.Files, ", "))
+		}
+	}
+	return []byte(b.String())
+}
+
+var transcriptHTMLTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"formatTime": formatTime,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; color: #222; }
+.message { display: flex; margin: 1em 0; }
+.portrait { width: 40px; height: 40px; border-radius: 50%; margin-right: 0.75em; flex-shrink: 0; }
+.time, .files { color: #777; font-size: 0.85em; }
+.text { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Scope}}</p>
+{{if .Cast}}<h2>Cast</h2>
+<ul>
+{{range .Cast}}<li>{{.}}</li>
+{{end}}</ul>
+<h2>Messages</h2>
+{{end}}{{range .Messages}}<div class="message">
+<img class="portrait" src="{{if .Portrait}}{{.Portrait}}{{else}}{{.IconURL}}{{end}}" alt="">
+<div>
+<strong>{{.Name}}</strong> <span class="time">{{formatTime .CreateAt}}</span>
+<div class="text">{{.Message}}</div>
+{{if .Files}}<div class="files">Attached: {{range $i, $f := .Files}}{{if $i}}, {{end}}{{$f}}{{end}}</div>{{end}}
+</div>
+</div>
+{{end}}</body>
+</html>
+`))
+
+// HTML renders the transcript as a standalone HTML page. Character portraits
+// are embedded, since the links to them expire.
+func (t *Transcript) HTML() ([]byte, *model.AppError) {
+	type htmlMessage struct {
+		TranscriptMessage
+		Portrait template.URL
+	}
+	data := struct {
+		Title    string
+		Scope    string
+		Cast     []string
+		Messages []htmlMessage
+	}{t.title(), t.describeScope(), make([]string, len(t.Cast)), make([]htmlMessage, len(t.Messages))}
+	for i, c := range t.Cast {
+		data.Cast[i] = describeCastMember(c)
+	}
+	for i, m := range t.Messages {
+		data.Messages[i] = htmlMessage{m, m.portrait}
+	}
+	var buf bytes.Buffer
+	err := transcriptHTMLTemplate.Execute(&buf, data)
+	if err != nil {
+		return nil, appError("Failed to render transcript", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// JSON renders the transcript as JSON.
+func (t *Transcript) JSON() ([]byte, *model.AppError) {
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return nil, appError("Failed to encode transcript", err)
+	}
+	return b, nil
+}
+
+// SendTranscript exports a thread, or a channel if rootId is empty, and sends
+// it to the user in a direct message from the bot account. It returns the
+// transcript.
+func SendTranscript(be Backend, userId, channelId, rootId string, since int64) (*Transcript, *model.AppError) {
+	if !be.HasPermissionToChannel(userId, channelId, model.PERMISSION_READ_CHANNEL) {
+		return nil, appError("You cannot read this channel.", nil)
+	}
+	if be.GetBotUserId() == "" {
+		return nil, appError("The bot account of the plugin is not available, so transcripts cannot be sent.", nil)
+	}
+	transcript, err := BuildTranscript(be, channelId, rootId, since)
+	if err != nil {
+		return nil, err
+	}
+	if len(transcript.Messages) == 0 {
+		return nil, appError("There are no messages to export.", nil)
+	}
+	basename := fmt.Sprintf("transcript-%s-%s", transcript.ChannelName, time.Unix(0, transcript.ExportedAt*int64(time.Millisecond)).UTC().Format("2006-01-02"))
+	return transcript, sendTranscript(be, userId, transcript, basename)
+}
+
+// sendTranscript sends a transcript to the user in a direct message from the
+// bot account, as Markdown, HTML and JSON files with the given base name.
+func sendTranscript(be Backend, userId string, transcript *Transcript, basename string) *model.AppError {
+	botUserId := be.GetBotUserId()
+	if botUserId == "" {
+		return appError("The bot account of the plugin is not available, so transcripts cannot be sent.", nil)
+	}
+	html, err := transcript.HTML()
+	if err != nil {
+		return err
+	}
+	jsonContent, err := transcript.JSON()
+	if err != nil {
+		return err
+	}
+	dm, err := be.GetDirectChannel(userId, botUserId)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{basename + ".md", transcript.Markdown()},
+		{basename + ".html", html},
+		{basename + ".json", jsonContent},
+	}
+	fileIds := []string{}
+	for _, file := range files {
+		info, err := be.UploadFile(file.content, dm.Id, file.name)
+		if err != nil {
+			return err
+		}
+		fileIds = append(fileIds, info.Id)
+	}
+	_, err = be.CreatePost(&model.Post{
+		UserId:    botUserId,
+		ChannelId: dm.Id,
+		Message:   fmt.Sprintf("%s, with %d messages. %s", transcript.title(), len(transcript.Messages), transcript.describeScope()),
+		FileIds:   fileIds,
+	})
+	return err
+}
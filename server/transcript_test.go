@@ -0,0 +1,119 @@
+package main_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+const tBot = "botaaaaaaaaaaaaaaaaaaaaaaa"
+
+// transcriptFiles returns the files of the transcript sent by the bot, by file
+// extension, and removes the message holding them.
+func transcriptFiles(t *testing.T, be main.BackendMock) map[string]string {
+	t.Helper()
+	return transcriptFilesNamed(t, be, "transcript-channel-one-2020-09-13.")
+}
+
+// transcriptFilesNamed is like transcriptFiles, but for files whose names
+// begin with the given prefix.
+func transcriptFilesNamed(t *testing.T, be main.BackendMock, prefix string) map[string]string {
+	t.Helper()
+	var latest *model.Post
+	for _, p := range be.Posts {
+		if p.UserId == tBot {
+			assert.Nil(t, latest, "More than one transcript")
+			latest = p
+		}
+	}
+	if !assert.NotNil(t, latest) {
+		return nil
+	}
+	delete(be.Posts, latest.Id)
+	assert.Equal(t, model.CHANNEL_DIRECT, be.Channels[latest.ChannelId].Type)
+	assert.Equal(t, model.GetDMNameFromIds(tUser1, tBot), be.Channels[latest.ChannelId].Name)
+	files := map[string]string{}
+	for _, fileId := range latest.FileIds {
+		info := be.FileInfos[fileId]
+		assert.Equal(t, latest.ChannelId, info.ChannelId)
+		files[info.Extension] = string(be.Files[info.Path])
+		assert.True(t, strings.HasPrefix(info.Name, prefix), info.Name)
+	}
+	assert.Equal(t, 3, len(files))
+	return files
+}
+
+func TestTranscript(t *testing.T) {
+	be := newMockBackend()
+	cmdFail(t, be, "/character transcript", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: The bot account of the plugin is not available, so transcripts cannot be sent.")
+	be.BotUserId = tBot
+	be.Users[tBot] = &model.User{Id: tBot, Username: "character-profiles", IsBot: true}
+	haddockImg := avatarImg(be, "haddock", "Captain Haddock")
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", haddockImg}})
+	millis := *be.Millis
+	post1 := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: millis + 1000, Message: "haddock: Blistering barnacles!"},
+		"haddock", "Captain Haddock", haddockImg)
+	post(t, be, &model.Post{UserId: tUser2, ChannelId: tChannel1, CreateAt: millis + 2000, Message: "Hello <b>world</b>"},
+		"", "", nil)
+	post3 := post(t, be, &model.Post{UserId: tUser1, ChannelId: tChannel1, RootId: post1, CreateAt: millis + 60000, Message: "haddock: Thundering typhoons!"},
+		"haddock", "Captain Haddock", haddockImg)
+	be.Posts[model.NewId()] = &model.Post{UserId: tUser1, ChannelId: tChannel1, CreateAt: millis + 3000, Type: model.POST_JOIN_CHANNEL, Message: "joined"}
+
+	// Whole channel, including the post with a file from the mock backend
+	cmd(t, be, "/character transcript", tUser1, tChannel1, tTeam1, "",
+		"Sent you a transcript of 4 messages in a direct message from @character-profiles.", nil)
+	files := transcriptFiles(t, be)
+	assert.Contains(t, files["md"], "# Transcript of Channel One\n\nExported 2020-09-13 12:26 UTC.\n")
+	assert.Contains(t, files["md"], "![Captain Haddock]("+haddockImg(false)+") **Captain Haddock** · 2020-09-13 12:26 UTC\n\nBlistering barnacles!\n")
+	assert.Contains(t, files["md"], "**user-number-two** · 2020-09-13 12:26 UTC\n\nHello <b>world</b>\n")
+	assert.Contains(t, files["md"], "*Attached: file1.png*")
+	assert.NotContains(t, files["md"], "joined")
+	assert.Less(t, strings.Index(files["md"], "Blistering"), strings.Index(files["md"], "Thundering"))
+	// Character portraits are embedded in HTML, and messages are escaped
+	assert.Contains(t, files["html"], `<img class="portrait" src="data:image/png;base64,`)
+	assert.Contains(t, files["html"], `src="http://mocksite.tld/api/v4/users/`+tUser2+`/image"`)
+	assert.Contains(t, files["html"], "Hello &lt;b&gt;world&lt;/b&gt;")
+	var transcript main.Transcript
+	assert.Nil(t, json.Unmarshal([]byte(files["json"]), &transcript))
+	assert.Equal(t, tChannel1, transcript.ChannelId)
+	assert.Equal(t, 4, len(transcript.Messages))
+	assert.Equal(t, "haddock", transcript.Messages[1].ProfileIdentifier)
+	assert.Equal(t, "Captain Haddock", transcript.Messages[1].Name)
+	assert.Equal(t, tUser1, transcript.Messages[1].UserId)
+	assert.Equal(t, "user-number-one", transcript.Messages[1].Username)
+	assert.Equal(t, "", transcript.Messages[2].ProfileIdentifier)
+	assert.Equal(t, "user-number-two", transcript.Messages[2].Name)
+	assert.Equal(t, post1, transcript.Messages[3].RootId)
+
+	// Only a thread, also when run from a reply
+	cmd(t, be, "/character transcript", tUser1, tChannel1, tTeam1, post3,
+		"Sent you a transcript of 2 messages in a direct message from @character-profiles.", nil)
+	files = transcriptFiles(t, be)
+	assert.Contains(t, files["md"], "# Transcript of a thread in Channel One\n")
+	assert.NotContains(t, files["md"], "Hello")
+
+	// Only recent messages
+	cmd(t, be, "/character transcript since 2020-09-13 12:27", tUser1, tChannel1, tTeam1, "",
+		"Sent you a transcript of 1 messages in a direct message from @character-profiles.", nil)
+	files = transcriptFiles(t, be)
+	assert.Contains(t, files["md"], "Exported 2020-09-13 12:26 UTC, with messages since 2020-09-13 12:27 UTC.\n")
+	assert.Contains(t, files["md"], "Thundering typhoons!")
+	*be.Millis = millis + 90000
+	cmd(t, be, "/character transcript since 1m", tUser1, tChannel1, tTeam1, "",
+		"Sent you a transcript of 1 messages in a direct message from @character-profiles.", nil)
+	assert.Contains(t, transcriptFiles(t, be)["md"], "Thundering typhoons!")
+	*be.Millis = millis + 200000
+	cmdFail(t, be, "/character transcript since 1m", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: There are no messages to export.")
+	cmdFail(t, be, "/character transcript since yesterday", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Cannot understand the time `yesterday`. Use e.g. `2020-09-13 12:26` (UTC), `2020-09-13`, or a duration such as `3h` or `2d`.")
+}
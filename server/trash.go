@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Deleted character profiles are moved to a per-user trash rather than being
+// removed immediately. While in the trash, a profile is no longer usable for
+// new messages, but its profile picture is still served to existing messages.
+// Trashed profiles are purged by a periodic job once the retention period has
+// passed, except profiles archived when their user was deactivated.
+
+const MILLISECONDS_PER_DAY = 24 * 60 * 60 * 1000
+
+func getTrashedProfileKey(userId, profileId string) string {
+	return fmt.Sprintf("trashedprofile_%s_%s", userId, encodeIdentifierForKey(profileId))
+}
+
+func TrashListKey(userId string) string {
+	return fmt.Sprintf("trashlist_%s", userId)
+}
+
+// trashProfile moves a character profile to the trash. If the trash already
+// holds a profile with the same identifier, that profile is replaced.
+func trashProfile(be Backend, userId, profileId string) *model.AppError {
+	b, err := be.KVGet(getProfileKey(userId, profileId))
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return appError(fmt.Sprintf("Character profile `%s` does not exist.", profileId), nil)
+	}
+	profile, dErr := DecodeProfileFromByte(b)
+	if dErr != nil {
+		// A profile that cannot be decoded is of no use in the trash.
+		return deleteProfile(be, userId, profileId)
+	}
+	profile.DeletedAt = be.GetMillis()
+	err = be.KVSet(getTrashedProfileKey(userId, profileId), profile.EncodeToByte())
+	if err != nil {
+		return err
+	}
+	err = StrsetInsert(be, TrashListKey(userId), profileId)
+	if err != nil {
+		return err
+	}
+	return deleteProfile(be, userId, profileId)
+}
+
+// GetTrashedProfile returns the profile with the given identifier from the
+// trash, or nil if there is no such profile. The returned profile has status
+// PROFILE_CHARACTER or PROFILE_CORRUPT.
+func GetTrashedProfile(be Backend, userId, profileId string) (*Profile, *model.AppError) {
+	b, err := be.KVGet(getTrashedProfileKey(userId, profileId))
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+	return profileFromBytes(be, userId, profileId, b), nil
+}
+
+// listTrashedProfiles returns all profiles in the trash, sorted by identifier.
+func listTrashedProfiles(be Backend, userId string) ([]Profile, *model.AppError) {
+	profileIds, err := StrsetGet(be, TrashListKey(userId))
+	if err != nil {
+		return nil, err
+	}
+	ret := []Profile{}
+	for _, profileId := range profileIds {
+		profile, gtpErr := GetTrashedProfile(be, userId, profileId)
+		if gtpErr != nil {
+			return nil, gtpErr
+		}
+		if profile != nil {
+			ret = append(ret, *profile)
+		}
+	}
+	sortProfiles(ret)
+	return ret, nil
+}
+
+// restoreProfile moves a character profile from the trash back to the list of
+// profiles. It fails if a profile or alias with the same identifier already
+// exists. Aliases of the profile that have since been taken are dropped and
+// returned.
+func restoreProfile(be Backend, userId, profileId string) (*Profile, []string, *model.AppError) {
+	exists, err := profileExists(be, userId, profileId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if exists {
+		return nil, nil, appError(fmt.Sprintf("Character profile `%s` already exists. You need to delete it or make it into something else before you can restore the one in the trash.", profileId), nil)
+	}
+	target, err := getAliasTarget(be, userId, profileId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if target != "" {
+		return nil, nil, appError(fmt.Sprintf("`%s` is now an alias for character profile `%s`. You need to remove the alias before you can restore the profile in the trash.", profileId, target), nil)
+	}
+	b, err := be.KVGet(getTrashedProfileKey(userId, profileId))
+	if err != nil {
+		return nil, nil, err
+	}
+	if b == nil {
+		return nil, nil, appError(fmt.Sprintf("There is no character profile `%s` in the trash.", profileId), nil)
+	}
+	profile, err := DecodeProfileFromByte(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	profile.Identifier = profileId
+	profile.DeletedAt = 0
+	droppedAliases := claimProfileAliases(be, userId, profile)
+	err = setProfile(be, userId, profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = purgeTrashedProfile(be, userId, profileId)
+	if err != nil {
+		return nil, nil, err
+	}
+	profile, err = GetProfile(be, userId, profileId, PROFILE_CHARACTER|PROFILE_CORRUPT)
+	if err != nil {
+		return nil, nil, err
+	}
+	return profile, droppedAliases, nil
+}
+
+// purgeTrashedProfile permanently removes a profile from the trash.
+func purgeTrashedProfile(be Backend, userId, profileId string) *model.AppError {
+	err := be.KVDelete(getTrashedProfileKey(userId, profileId))
+	if err != nil {
+		return err
+	}
+	err = StrsetRemove(be, TrashListKey(userId), profileId)
+	if err != nil {
+		return err
+	}
+	err = StrsetRemove(be, getArchivedProfilesKey(userId), profileId)
+	if err != nil {
+		return err
+	}
+	err = deleteProfileStats(be, userId, profileId)
+	if err != nil {
+		return err
+	}
+	return deleteProfileHistoryIfUnused(be, userId, profileId)
+}
+
+// trashPurgeTime returns the time in milliseconds when a trashed profile will
+// be purged.
+func trashPurgeTime(be Backend, profile Profile) int64 {
+	return profile.DeletedAt + int64(be.GetConfiguration().GetTrashRetentionDays())*MILLISECONDS_PER_DAY
+}
+
+// PurgeExpiredTrash permanently removes all trashed profiles, for all users,
+// whose retention period has passed. Profiles archived when their user was
+// deactivated are kept.
+func PurgeExpiredTrash(be Backend) *model.AppError {
+	keys, err := KVListWithPrefix(be, TrashListKey(""))
+	if err != nil {
+		return err
+	}
+	now := be.GetMillis()
+	for _, key := range keys {
+		userId := strings.TrimPrefix(key, TrashListKey(""))
+		profileIds, err := StrsetGet(be, key)
+		if err != nil {
+			return err
+		}
+		for _, profileId := range profileIds {
+			archived, err := StrsetHas(be, getArchivedProfilesKey(userId), profileId)
+			if err != nil {
+				return err
+			}
+			if archived {
+				continue
+			}
+			b, err := be.KVGet(getTrashedProfileKey(userId, profileId))
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				profile, dErr := DecodeProfileFromByte(b)
+				if dErr == nil && trashPurgeTime(be, *profile) > now {
+					continue
+				}
+			}
+			err = purgeTrashedProfile(be, userId, profileId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
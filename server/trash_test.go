@@ -0,0 +1,136 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+const (
+	tChannel1 = "channel1aaaaaaaaaaaaaaaaaa"
+	tFile1    = "file1aaaaaaaaaaaaaaaaaaaaa"
+	tPost1    = "post1aaaaaaaaaaaaaaaaaaaaa"
+	tTeam1    = "team1aaaaaaaaaaaaaaaaaaaaa"
+	tUser1    = "user1aaaaaaaaaaaaaaaaaaaaa"
+	tUser2    = "user2aaaaaaaaaaaaaaaaaaaaa"
+)
+
+// newMockBackend returns a backend mock with one team, one channel, two users
+// that are both members of the channel, and one post by user1 holding an
+// image.
+func newMockBackend() main.BackendMock {
+	millis := int64(1600000000000)
+	return main.BackendMock{
+		ChannelMembers: []struct {
+			UserId    string
+			ChannelId string
+		}{
+			{tUser1, tChannel1},
+			{tUser2, tChannel1},
+		},
+		Channels: map[string]*model.Channel{
+			tChannel1: {Id: tChannel1, Name: "channel-one", DisplayName: "Channel One", TeamId: tTeam1, Type: model.CHANNEL_OPEN},
+		},
+		FileInfos: map[string]*model.FileInfo{
+			tFile1: {Id: tFile1, CreatorId: tUser1, CreateAt: 1, UpdateAt: 1, Path: "some-path-to/file1.png", ThumbnailPath: "some-path-to/file1_thumb.jpg", Name: "file1.png", Extension: "png", MimeType: "image/png", PostId: tPost1},
+		},
+		Files:     map[string][]byte{},
+		IdCounter: new(int),
+		KVExpiry:  map[string]int64{},
+		KVStore:   map[string][]byte{},
+		Millis:    &millis,
+		Posts: map[string]*model.Post{
+			tPost1: {Id: tPost1, UserId: tUser1, ChannelId: tChannel1, FileIds: []string{tFile1}},
+		},
+		SiteURL: "http://mocksite.tld",
+		Teams: map[string]*model.Team{
+			tTeam1: {Id: tTeam1, Name: "team-one"},
+		},
+		Users: map[string]*model.User{
+			tUser1: {Id: tUser1, Username: "user-number-one"},
+			tUser2: {Id: tUser2, Username: "user-number-two"},
+		},
+	}
+}
+
+func TestTrash(t *testing.T) {
+	be := newMockBackend()
+	cmd(t, be, "/character picture haddock=Captain Haddock", tUser1, tChannel1, tTeam1, tPost1,
+		"Character profile `haddock` created with display name \"Captain Haddock\" and a profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	cmd(t, be, "/character trash", tUser1, tChannel1, tTeam1, "",
+		"Your trash is empty.",
+		[]tAtt{})
+	cmd(t, be, "/character delete haddock", tUser1, tChannel1, tTeam1, "",
+		"Deleted character profile `haddock`. You can restore it with `/character restore haddock` within 30 days.",
+		[]tAtt{})
+	cmdFail(t, be, "/character I am haddock", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Profile `haddock` does not exist.")
+	cmd(t, be, "/character trash", tUser1, tChannel1, tTeam1, "",
+		"## Deleted character profiles",
+		[]tAtt{{"**Captain Haddock**\n`haddock`\nDeleted 2020-09-13 12:26 UTC, will be purged 2020-10-13 12:26 UTC.", "#5c66ff", nil}})
+	// The trash is per user
+	cmd(t, be, "/character trash", tUser2, tChannel1, tTeam1, "",
+		"Your trash is empty.",
+		[]tAtt{})
+	// A profile cannot be restored while another profile uses its identifier
+	cmd(t, be, "/character haddock=Haddock Jr", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Haddock Jr\"",
+		[]tAtt{{"**Haddock Jr**\n`haddock`", "#5c66ff", nil}})
+	cmdFail(t, be, "/character restore haddock", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: Character profile `haddock` already exists. You need to delete it or make it into something else before you can restore the one in the trash.")
+}
+
+func TestTrashRestoreAndPurge(t *testing.T) {
+	be := newMockBackend()
+	cmd(t, be, "/character picture haddock=Captain Haddock", tUser1, tChannel1, tTeam1, tPost1,
+		"Character profile `haddock` created with display name \"Captain Haddock\" and a profile picture",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	cmd(t, be, "/character milou=Milou", tUser1, tChannel1, tTeam1, "",
+		"Character profile `milou` created with display name \"Milou\"",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", nil}})
+	original, err := main.GetProfile(be, tUser1, "haddock", main.PROFILE_CHARACTER)
+	assert.Nil(t, err)
+	cmd(t, be, "/character delete haddock", tUser1, tChannel1, tTeam1, "",
+		"Deleted character profile `haddock`. You can restore it with `/character restore haddock` within 30 days.",
+		[]tAtt{})
+	cmd(t, be, "/character restore haddock", tUser1, tChannel1, tTeam1, "",
+		"Restored character profile `haddock`.",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	restored, err := main.GetProfile(be, tUser1, "haddock", main.PROFILE_CHARACTER)
+	assert.Nil(t, err)
+	assert.Equal(t, original.RequestKey, restored.RequestKey)
+	assert.Equal(t, int64(0), restored.DeletedAt)
+	cmdFail(t, be, "/character restore nobody", tUser1, tChannel1, tTeam1, "",
+		"Character Profile Plugin: There is no character profile `nobody` in the trash.")
+	// Delete both profiles, one of them ten days later than the other
+	cmd(t, be, "/character delete haddock", tUser1, tChannel1, tTeam1, "",
+		"Deleted character profile `haddock`. You can restore it with `/character restore haddock` within 30 days.",
+		[]tAtt{})
+	*be.Millis += 10 * main.MILLISECONDS_PER_DAY
+	cmd(t, be, "/character delete milou", tUser1, tChannel1, tTeam1, "",
+		"Deleted character profile `milou`. You can restore it with `/character restore milou` within 30 days.",
+		[]tAtt{})
+	// After 25 more days, the first one is purged but not the second
+	*be.Millis += 25 * main.MILLISECONDS_PER_DAY
+	assert.Nil(t, main.RunDueJobs(be))
+	trashed, err := main.GetTrashedProfile(be, tUser1, "haddock")
+	assert.Nil(t, err)
+	assert.Nil(t, trashed)
+	trashed, err = main.GetTrashedProfile(be, tUser1, "milou")
+	assert.Nil(t, err)
+	assert.NotNil(t, trashed)
+	// Ten days later, the second one is purged too
+	*be.Millis += 10 * main.MILLISECONDS_PER_DAY
+	assert.Nil(t, main.RunDueJobs(be))
+	trashed, err = main.GetTrashedProfile(be, tUser1, "milou")
+	assert.Nil(t, err)
+	assert.Nil(t, trashed)
+	ids, err := main.StrsetGet(be, main.TrashListKey(tUser1))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, ids)
+}
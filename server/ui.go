@@ -48,3 +48,45 @@ func uiConfirmation(text, command, rootId string) (string, []*model.SlackAttachm
 func uiError(text, command, rootId string) (string, []*model.SlackAttachment) {
 	return uiHelper("Error", text, command, "Try again", rootId)
 }
+
+// uiNextPage returns a button that replaces the response with the result of
+// the given command, which shows the next page.
+func uiNextPage(command, rootId string) []*model.SlackAttachment {
+	return []*model.SlackAttachment{
+		{
+			Actions: []*model.PostAction{
+				{
+					Type:  model.POST_ACTION_TYPE_BUTTON,
+					Name:  "Next page",
+					Style: "primary",
+					Integration: &model.PostActionIntegration{
+						URL: fmt.Sprintf("/plugins/%s/api/v1/confirm", PLUGIN_ID),
+						Context: map[string]interface{}{
+							"command": command,
+							"root_id": rootId,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// uiNotice shows a message from the plugin to a user in a channel, visible
+// only to them.
+func uiNotice(be Backend, userId, channelId, message string) {
+	senderId := be.GetBotUserId()
+	if senderId == "" {
+		senderId = userId
+	}
+	be.SendEphemeralPost(userId, &model.Post{
+		UserId:    senderId,
+		ChannelId: channelId,
+		Message:   message,
+		Props: model.StringInterface{
+			"override_username": BOT_DISPLAYNAME,
+			"override_icon_url": GetPluginURL(be) + "/static/botprofilepicture",
+			"from_webhook":      "true",
+		},
+	})
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 )
@@ -29,3 +33,39 @@ func appErrorPre(prefix string, err *model.AppError) *model.AppError {
 	errCopy.Message = prefix + err.Message
 	return &errCopy
 }
+
+// formatTime formats a time given in milliseconds since the epoch for display
+// in messages.
+func formatTime(millis int64) string {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04 UTC")
+}
+
+// parseShortDuration parses a duration such as `90m`, `3h`, `2d` or `1w`.
+func parseShortDuration(s string) (time.Duration, bool) {
+	matches := regexp.MustCompile(`^([1-9][0-9]{0,4})\s*([mhdw])$`).FindStringSubmatch(s)
+	if matches == nil {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(matches[1])
+	unit := map[string]time.Duration{
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}[matches[2]]
+	return time.Duration(n) * unit, true
+}
+
+// insertSorted inserts an element into a sorted slice of strings unless it is
+// already present.
+func insertSorted(slice []string, element string) []string {
+	i := sort.SearchStrings(slice, element)
+	if i < len(slice) && slice[i] == element {
+		return slice
+	}
+	ret := make([]string, len(slice)+1)
+	copy(ret, slice[:i])
+	ret[i] = element
+	copy(ret[i+1:], slice[i:])
+	return ret
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// External tools, such as bridges from virtual tabletops or other chat
+// services, can post messages as a user's characters through the webhook
+// endpoint, authenticated by a token that the user creates with
+// `/character token create`. Only a hash of each token is stored, under a key
+// derived from the hash so that a token can be looked up when used. The hashes
+// of the tokens of each user are kept in a string set. A token is referred to
+// by the beginning of its hash.
+
+const WEBHOOK_TOKEN_ID_LENGTH = 8
+
+// WEBHOOK_TOKEN_HEADER is the request header holding the token.
+const WEBHOOK_TOKEN_HEADER = "X-Character-Token"
+
+type webhookToken struct {
+	Hash     string `json:"hash"`
+	UserId   string `json:"user_id"`
+	Name     string `json:"name"`
+	CreateAt int64  `json:"create_at"`
+}
+
+// Id returns the identifier shown to the user for a token.
+func (t webhookToken) Id() string {
+	return t.Hash[:WEBHOOK_TOKEN_ID_LENGTH]
+}
+
+func getWebhookTokenKey(hash string) string {
+	return "webhooktoken_" + hash
+}
+
+func getWebhookTokensKey(userId string) string {
+	return "webhooktokens_" + userId
+}
+
+func hashWebhookToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// WebhookURL returns the URL of the webhook endpoint.
+func WebhookURL(be Backend) string {
+	return GetPluginURL(be) + "/webhook"
+}
+
+// createWebhookToken creates a token for the webhook endpoint on behalf of a
+// user. It returns the token, which is not stored and cannot be shown again.
+func createWebhookToken(be Backend, userId, name string) (string, *webhookToken, *model.AppError) {
+	b := make([]byte, 32)
+	_, rErr := rand.Read(b)
+	if rErr != nil {
+		return "", nil, appError("Failed to generate token.", rErr)
+	}
+	token := hex.EncodeToString(b)
+	t := &webhookToken{
+		Hash:     hashWebhookToken(token),
+		UserId:   userId,
+		Name:     name,
+		CreateAt: be.GetMillis(),
+	}
+	tJson, jErr := json.Marshal(t)
+	if jErr != nil {
+		return "", nil, appError("Failed to marshal token.", jErr)
+	}
+	err := be.KVSet(getWebhookTokenKey(t.Hash), tJson)
+	if err != nil {
+		return "", nil, err
+	}
+	err = StrsetInsert(be, getWebhookTokensKey(userId), t.Hash)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, t, nil
+}
+
+// getWebhookTokenByHash returns the token with the given hash, or nil if it
+// does not exist.
+func getWebhookTokenByHash(be Backend, hash string) (*webhookToken, *model.AppError) {
+	b, err := be.KVGet(getWebhookTokenKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+	t := webhookToken{}
+	jErr := json.Unmarshal(b, &t)
+	if jErr != nil {
+		return nil, appError("Failed to unmarshal token.", jErr)
+	}
+	return &t, nil
+}
+
+// listWebhookTokens returns the tokens of a user, oldest first.
+func listWebhookTokens(be Backend, userId string) ([]webhookToken, *model.AppError) {
+	hashes, err := StrsetGet(be, getWebhookTokensKey(userId))
+	if err != nil {
+		return nil, err
+	}
+	tokens := []webhookToken{}
+	for _, hash := range hashes {
+		t, err := getWebhookTokenByHash(be, hash)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			tokens = append(tokens, *t)
+		}
+	}
+	sort.SliceStable(tokens, func(i, j int) bool {
+		return tokens[i].CreateAt < tokens[j].CreateAt
+	})
+	return tokens, nil
+}
+
+// revokeWebhookToken deletes the token of a user with the given id.
+func revokeWebhookToken(be Backend, userId, tokenId string) (*webhookToken, *model.AppError) {
+	tokens, err := listWebhookTokens(be, userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		if t.Id() != strings.ToLower(tokenId) {
+			continue
+		}
+		err = be.KVDelete(getWebhookTokenKey(t.Hash))
+		if err != nil {
+			return nil, err
+		}
+		err = StrsetRemove(be, getWebhookTokensKey(userId), t.Hash)
+		if err != nil {
+			return nil, err
+		}
+		return &t, nil
+	}
+	return nil, appError(fmt.Sprintf("You have no token `%s`. Use `/character token list` to see your tokens.", tokenId), nil)
+}
+
+// describeWebhookTokens returns a Markdown list of tokens.
+func describeWebhookTokens(tokens []webhookToken) string {
+	lines := make([]string, len(tokens))
+	for i, t := range tokens {
+		name := ""
+		if t.Name != "" {
+			name = " " + t.Name
+		}
+		lines[i] = fmt.Sprintf("- `%s`%s, created %s", t.Id(), name, formatTime(t.CreateAt))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// WEBHOOK_MAX_BODY_BYTES is the largest request body accepted by the webhook
+// endpoint: the largest message the server can store, with room for the other
+// fields.
+const WEBHOOK_MAX_BODY_BYTES = model.POST_MESSAGE_MAX_BYTES_V2 + 1024
+
+// webhookRequest is the body of a request to the webhook endpoint. Profile is
+// the identifier or alias of the profile to post as, and defaults to the
+// default profile of the user in the channel.
+type webhookRequest struct {
+	Channel string `json:"channel"`
+	Profile string `json:"profile"`
+	Message string `json:"message"`
+	RootId  string `json:"root_id"`
+}
+
+func serveWebhook(be Backend, w http.ResponseWriter, r *http.Request) {
+	// Mattermost removes the Authorization header from requests to plugins, so
+	// the token is given in a header of its own.
+	token := r.Header.Get(WEBHOOK_TOKEN_HEADER)
+	if token == "" {
+		http.Error(w, "Missing token. Use the header `"+WEBHOOK_TOKEN_HEADER+": <token>`.", http.StatusUnauthorized)
+		return
+	}
+	t, err := getWebhookTokenByHash(be, hashWebhookToken(token))
+	if err != nil {
+		http.Error(w, ErrStr(err), http.StatusInternalServerError)
+		return
+	}
+	if t == nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	user, err := be.GetUser(t.UserId)
+	if err != nil || user == nil || user.DeleteAt != 0 {
+		http.Error(w, "The user of the token is not active", http.StatusForbidden)
+		return
+	}
+	body, rErr := io.ReadAll(http.MaxBytesReader(w, r.Body, WEBHOOK_MAX_BODY_BYTES))
+	if rErr != nil {
+		http.Error(w, fmt.Sprintf("The request body may have at most %d bytes.", WEBHOOK_MAX_BODY_BYTES), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var wr webhookRequest
+	dErr := json.Unmarshal(body, &wr)
+	if dErr != nil {
+		http.Error(w, dErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(wr.Message) == "" {
+		http.Error(w, "Missing message", http.StatusBadRequest)
+		return
+	}
+	if !model.IsValidId(wr.Channel) || !be.HasPermissionToChannel(t.UserId, wr.Channel, model.PERMISSION_CREATE_POST) {
+		http.Error(w, "Unknown channel, or no permission to post in it", http.StatusForbidden)
+		return
+	}
+	if wr.RootId != "" {
+		root, err := GetPostIfExists(be, wr.RootId)
+		if err != nil {
+			http.Error(w, ErrStr(err), http.StatusInternalServerError)
+			return
+		}
+		if root == nil || root.ChannelId != wr.Channel {
+			http.Error(w, "Unknown root_id", http.StatusBadRequest)
+			return
+		}
+		if root.RootId != "" {
+			wr.RootId = root.RootId
+		}
+	}
+	profileId := NormalizeIdentifier(wr.Profile)
+	if profileId == "" {
+		profileId, _, err = getEffectiveDefaultProfile(be, t.UserId, wr.Channel)
+		if err != nil {
+			http.Error(w, ErrStr(err), http.StatusInternalServerError)
+			return
+		}
+	}
+	profile, err := GetProfile(be, t.UserId, profileId, PROFILE_CHARACTER|PROFILE_ME)
+	if err != nil || profile == nil {
+		http.Error(w, fmt.Sprintf("Unknown profile `%s`", wr.Profile), http.StatusNotFound)
+		return
+	}
+	post := &model.Post{
+		UserId:    t.UserId,
+		ChannelId: wr.Channel,
+		RootId:    wr.RootId,
+		Message:   wr.Message,
+	}
+	postAsBot(be, post, *profile)
+	post, errStr := profilePost(be, post, *profile)
+	if errStr != "" {
+		http.Error(w, errStr, http.StatusInternalServerError)
+		return
+	}
+	err = addProfileNonce(be, post)
+	if err != nil {
+		http.Error(w, ErrStr(err), http.StatusInternalServerError)
+		return
+	}
+	// The post is registered by the MessageHasBeenPosted hook.
+	post, err = be.CreatePost(post)
+	if err != nil {
+		http.Error(w, ErrStr(err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(post)
+}
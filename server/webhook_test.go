@@ -0,0 +1,176 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	main "axelsvensson.com/mattermost-plugin-character-profiles/server"
+)
+
+// webhook sends a request to the webhook endpoint and returns the response
+// along with the created post, if any, after running it through the posting
+// hooks as the server would.
+func webhook(t *testing.T, be main.BackendMock, token, body string) (*httptest.ResponseRecorder, *model.Post) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("X-Character-Token", token)
+	}
+	// Mattermost removes this header before passing requests to plugins.
+	r.Header.Del("Authorization")
+	w := httptest.NewRecorder()
+	main.RouterFromBackend(be).ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		return w, nil
+	}
+	var created model.Post
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &created))
+	post := be.Posts[created.Id]
+	profiled, errStr := main.ProfiledPost(be, post, false)
+	assert.Equal(t, "", errStr)
+	if profiled != nil {
+		post = profiled
+		be.Posts[post.Id] = post
+	}
+	assert.Nil(t, main.RegisterPost(be, post))
+	return w, post
+}
+
+func TestWebhook(t *testing.T) {
+	be := newMockBackend()
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	cmd(t, be, "/character token list", tUser1, tChannel1, tTeam1, "",
+		"You have no tokens. Create one with `/character token create`.", nil)
+	response, _, err := main.DoExecuteCommand(be, "/character token create vtt bridge", tUser1, tChannel1, tTeam1, "", true)
+	assert.Nil(t, err)
+	matches := regexp.MustCompile("^Created token `([0-9a-f]{8})`.*\n```\n([0-9a-f]{64})\n```\n.*`http://mocksite.tld/plugins/[^`]*/webhook`").FindStringSubmatch(response)
+	if !assert.NotNil(t, matches, response) {
+		return
+	}
+	tokenId, token := matches[1], matches[2]
+	response, _, err = main.DoExecuteCommand(be, "/character token list", tUser1, tChannel1, tTeam1, "", true)
+	assert.Nil(t, err)
+	assert.Regexp(t, "^## Tokens\n- `"+tokenId+"` vtt bridge, created ", response)
+	// Tokens are personal
+	cmd(t, be, "/character token list", tUser2, tChannel1, tTeam1, "",
+		"You have no tokens. Create one with `/character token create`.", nil)
+	cmdFail(t, be, "/character token revoke "+tokenId, tUser2, tChannel1, tTeam1, "",
+		"Character Profile Plugin: You have no token `"+tokenId+"`. Use `/character token list` to see your tokens.")
+
+	// Requests need a valid token
+	w, _ := webhook(t, be, "", `{"channel": "`+tChannel1+`", "profile": "haddock", "message": "Hello"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w, _ = webhook(t, be, strings.Repeat("0", 64), `{"channel": "`+tChannel1+`", "profile": "haddock", "message": "Hello"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	// Requests are limited in size
+	w, _ = webhook(t, be, token, `{"channel": "`+tChannel1+`", "profile": "haddock", "message": "`+strings.Repeat("a", main.WEBHOOK_MAX_BODY_BYTES)+`"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	// Post as a character profile
+	w, post := webhook(t, be, token, `{"channel": "`+tChannel1+`", "profile": "haddock", "message": "milou: Blistering barnacles!"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	if !assert.NotNil(t, post) {
+		return
+	}
+	assert.Equal(t, tUser1, post.UserId)
+	assert.Equal(t, tChannel1, post.ChannelId)
+	assert.Equal(t, "milou: Blistering barnacles!", post.Message)
+	assert.Equal(t, "haddock", post.Props["profile_identifier"])
+	assert.Equal(t, "Captain Haddock", post.Props["override_username"])
+	assert.Equal(t, "true", post.Props["from_webhook"])
+	assert.Nil(t, post.Props["profile_nonce"])
+	// The posting hook keeps the profile, even if the message looks like a
+	// one-off message.
+	cmd(t, be, "/character milou=Milou", tUser1, tChannel1, tTeam1, "",
+		"Character profile `milou` created with display name \"Milou\"",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", nil}})
+	w, post = webhook(t, be, token, `{"channel": "`+tChannel1+`", "profile": "haddock", "message": "milou: Blistering barnacles!"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "haddock", post.Props["profile_identifier"])
+	assert.Equal(t, "milou: Blistering barnacles!", post.Message)
+	// Other new posts cannot choose their profile through props
+	spoofed, errStr := main.ProfiledPost(be, &model.Post{UserId: tUser1, ChannelId: tChannel1, Message: "Hi",
+		Props: model.StringInterface{"profile_identifier": "haddock", "profile_nonce": "made-up"}}, false)
+	assert.Equal(t, "", errStr)
+	assert.Nil(t, spoofed.Props["profile_identifier"])
+	assert.Nil(t, spoofed.Props["profile_nonce"])
+	// The post is registered, so it follows changes to the profile
+	cmd(t, be, "/character haddock=Archibald Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` modified by changing the display name from \"Captain Haddock\" to \"Archibald Haddock\"",
+		[]tAtt{{"**Archibald Haddock**\n`haddock`", "#5c66ff", nil}})
+	assert.Equal(t, "Archibald Haddock", be.Posts[post.Id].Props["override_username"])
+	// Replies go to the root of the thread
+	w, reply := webhook(t, be, token, `{"channel": "`+tChannel1+`", "profile": "haddock", "message": "Hi", "root_id": "`+post.Id+`"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, post.Id, reply.RootId)
+	w, reply2 := webhook(t, be, token, `{"channel": "`+tChannel1+`", "profile": "haddock", "message": "Hi", "root_id": "`+reply.Id+`"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, post.Id, reply2.RootId)
+	// Without a profile, the default profile of the channel is used
+	cmd(t, be, "/character I am milou", tUser1, tChannel1, tTeam1, "",
+		"You are now known as \"Milou\".",
+		[]tAtt{{"**Milou**\n`milou`", "#5c66ff", nil}})
+	w, post = webhook(t, be, token, `{"channel": "`+tChannel1+`", "message": "Woof"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "milou", post.Props["profile_identifier"])
+	// The real profile is kept by the posting hook, despite the default
+	w, post = webhook(t, be, token, `{"channel": "`+tChannel1+`", "profile": "me", "message": "Sorry"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Nil(t, post.Props["profile_identifier"])
+	assert.Nil(t, post.Props["override_username"])
+	// The token must be given in its own header, since Mattermost removes the
+	// Authorization header
+	r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{"channel": "`+tChannel1+`", "message": "Hello"}`))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	main.RouterFromBackend(be).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	// Invalid requests
+	w, _ = webhook(t, be, token, `{"channel": "`+tChannel1+`", "profile": "rastapopoulos", "message": "Hello"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, _ = webhook(t, be, token, `{"channel": "`+tChannel1+`", "profile": "haddock", "message": " "}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = webhook(t, be, token, `{"channel": "`+tChannel1+`", "profile": "haddock", "message": "Hello", "root_id": "`+tUser2+`"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = webhook(t, be, token, `not json`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	// Only channels where the user can post
+	be.Channels[tTeam1] = &model.Channel{Id: tTeam1, Name: "channel-two", TeamId: tTeam1, Type: model.CHANNEL_OPEN}
+	w, _ = webhook(t, be, token, `{"channel": "`+tTeam1+`", "profile": "haddock", "message": "Hello"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	// Revoked tokens no longer work
+	cmd(t, be, "/character token revoke "+tokenId, tUser1, tChannel1, tTeam1, "",
+		"Revoked token `"+tokenId+"`.", nil)
+	w, _ = webhook(t, be, token, `{"channel": "`+tChannel1+`", "profile": "haddock", "message": "Hello"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	cmd(t, be, "/character token list", tUser1, tChannel1, tTeam1, "",
+		"You have no tokens. Create one with `/character token create`.", nil)
+}
+
+func TestWebhookAsBot(t *testing.T) {
+	be := newMockBackend()
+	bot := "botaaaaaaaaaaaaaaaaaaaaaaa"
+	be.BotUserId = bot
+	be.Configuration = &main.Configuration{UseBotAccount: true}
+	cmd(t, be, "/character haddock=Captain Haddock", tUser1, tChannel1, tTeam1, "",
+		"Character profile `haddock` created with display name \"Captain Haddock\"",
+		[]tAtt{{"**Captain Haddock**\n`haddock`", "#5c66ff", nil}})
+	response, _, err := main.DoExecuteCommand(be, "/character token create", tUser1, tChannel1, tTeam1, "", true)
+	assert.Nil(t, err)
+	token := regexp.MustCompile("```\n([0-9a-f]{64})\n```").FindStringSubmatch(response)[1]
+	w, post := webhook(t, be, token, `{"channel": "`+tChannel1+`", "profile": "haddock", "message": "Hello"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, bot, post.UserId)
+	assert.Equal(t, tUser1, post.Props["profile_author_id"])
+	assert.Equal(t, "true", post.Props["from_bot"])
+	assert.Equal(t, "haddock", post.Props["profile_identifier"])
+}